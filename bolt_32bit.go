@@ -0,0 +1,10 @@
+//go:build 386 || arm
+// +build 386 arm
+
+package tinydb
+
+// maxMapSize represents the largest mmap size supported by Bolt.
+const maxMapSize = 0x7FFFFFFF // 2GB
+
+// maxAllocSize is the size used when creating array pointers.
+const maxAllocSize = 0xFFFFFFF
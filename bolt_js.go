@@ -0,0 +1,51 @@
+//go:build js
+// +build js
+
+package tinydb
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// flock does nothing since js/wasm has no file locks.
+func flock(db *Db, mode os.FileMode, exclusive bool, timeout time.Duration) error {
+	return nil
+}
+
+// funlock does nothing since js/wasm has no file locks.
+func funlock(db *Db) error {
+	return nil
+}
+
+// mmap fails since js/wasm can't map files. Open always reads pages through
+// the page cache instead.
+func mmap(db *Db, sz int) error {
+	return errors.New("mmap not supported on js")
+}
+
+// munmap does nothing since nothing is ever mapped.
+func munmap(db *Db) error {
+	return nil
+}
+
+// mmapFile fails since js/wasm can't map files.
+func mmapFile(f dbFile, sz int, readOnly bool, advice MmapAdvice) ([]byte, error) {
+	return nil, errors.New("mmap not supported on js")
+}
+
+// adviseMmap does nothing since nothing is ever mapped.
+func adviseMmap(b []byte, advice MmapAdvice) error {
+	return nil
+}
+
+// mlock does nothing since nothing is ever mapped.
+func mlock(b []byte) error {
+	return nil
+}
+
+// munmapFile does nothing since nothing is ever mapped.
+func munmapFile(b []byte) error {
+	return nil
+}
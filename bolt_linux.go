@@ -0,0 +1,66 @@
+package tinydb
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	fallocKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+)
+
+// punchHole deallocates size bytes of f at off, which then read as zeros,
+// without changing the file size.
+func punchHole(f *os.File, off, size int64) error {
+	if err := syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, off, size); err != nil {
+		return os.NewSyscallError("fallocate", err)
+	}
+	return nil
+}
+
+// pwritev writes bufs to f as one contiguous range starting at off, with as
+// few system calls as the kernel allows.
+func pwritev(f *os.File, bufs [][]byte, off int64) error {
+	const longBits = 32 << (^uintptr(0) >> 63)
+	for len(bufs) > 0 {
+		iovs := make([]syscall.Iovec, 0, len(bufs))
+		for _, b := range bufs {
+			if len(b) > 0 {
+				iov := syscall.Iovec{Base: &b[0]}
+				iov.SetLen(len(b))
+				iovs = append(iovs, iov)
+			}
+		}
+		if len(iovs) == 0 {
+			return nil
+		}
+
+		// The offset is passed as low and high words, as on 32-bit systems.
+		lo, hi := uintptr(off), uintptr(uint64(off)>>(longBits-1)>>1)
+		r, _, errno := syscall.Syscall6(syscall.SYS_PWRITEV, f.Fd(), uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)), lo, hi, 0)
+		runtime.KeepAlive(iovs)
+		if errno == syscall.EINTR {
+			continue
+		} else if errno != 0 {
+			return os.NewSyscallError("pwritev", errno)
+		} else if r == 0 {
+			return io.ErrShortWrite
+		}
+
+		// Skip past what was written and retry the rest.
+		n := int(r)
+		off += int64(n)
+		for len(bufs) > 0 && n >= len(bufs[0]) {
+			n -= len(bufs[0])
+			bufs = bufs[1:]
+		}
+		if n > 0 {
+			bufs = append([][]byte{bufs[0][n:]}, bufs[1:]...)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package tinydb
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// Ensure that large runs of free pages are punched out of the file once
+// released, and that the pages can be used again afterwards.
+func TestDb_PunchHoles(t *testing.T) {
+	path := tempfile()
+	defer os.RemoveAll(path)
+	db, err := Open(path, &Options{PageSize: 4096, PunchHoleMinPages: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	put := func() {
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 64; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 64*1024)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usage := func() (size, blocks int64) {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size(), info.Sys().(*syscall.Stat_t).Blocks * 512
+	}
+
+	put()
+	if err := db.Update(func(tx *Tx) error {
+		return tx.DeleteBucket([]byte("widgets"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	size, before := usage()
+
+	// The deleted pages are released, and punched, by the next writer.
+	if err := db.Update(func(tx *Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if db.punchHoles == 0 {
+		t.Skip("hole punching not supported")
+	}
+	newSize, after := usage()
+	if newSize != size {
+		t.Fatalf("unexpected file size: %d, expected %d", newSize, size)
+	} else if after > before/2 {
+		t.Fatalf("expected disk usage to shrink: %d -> %d bytes", before, after)
+	}
+
+	put()
+	if err := db.View(func(tx *Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("0063")); len(v) != 64*1024 {
+			t.Fatalf("unexpected value: %d bytes", len(v))
+		}
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build mips || mipsle
+// +build mips mipsle
+
+package tinydb
+
+// maxMapSize represents the largest mmap size supported by Bolt.
+// User space on 32-bit mips is limited to 2GB.
+const maxMapSize = 0x40000000 // 1GB
+
+// maxAllocSize is the size used when creating array pointers.
+const maxAllocSize = 0xFFFFFFF
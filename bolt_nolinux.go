@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package tinydb
+
+import (
+	"errors"
+	"os"
+)
+
+// punchHole fails since hole punching is only supported on Linux.
+func punchHole(f *os.File, off, size int64) error {
+	return errors.New("hole punching not supported")
+}
+
+// pwritev is only used on Linux; elsewhere batches are copied into a single
+// buffer and written with WriteAt.
+func pwritev(f *os.File, bufs [][]byte, off int64) error {
+	return errors.New("pwritev not supported")
+}
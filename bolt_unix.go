@@ -1,4 +1,5 @@
-// +build !windows,!plan9,!solaris
+//go:build !windows && !plan9 && !solaris && !js
+// +build !windows,!plan9,!solaris,!js
 
 package tinydb
 
@@ -46,17 +47,11 @@ func funlock(db *Db) error {
 
 // mmap memory maps a DB's data file.
 func mmap(db *Db, sz int) error {
-	// Map the data file to memory.
-	b, err := syscall.Mmap(int(db.file.Fd()), 0, sz, syscall.PROT_READ, syscall.MAP_SHARED)
+	b, err := mmapFile(db.file, sz, db.readOnly, db.mmapAdvice)
 	if err != nil {
 		return err
 	}
 
-	// Advise the kernel that the mmap is accessed randomly.
-	if err := madvise(b, syscall.MADV_RANDOM); err != nil {
-		return fmt.Errorf("madvise: %s", err)
-	}
-
 	// Save the original byte slice and convert to a byte array pointer.
 	db.dataref = b
 	db.data = (*[maxMapSize]byte)(unsafe.Pointer(&b[0]))
@@ -72,13 +67,64 @@ func munmap(db *Db) error {
 	}
 
 	// Unmap using the original byte slice.
-	err := syscall.Munmap(db.dataref)
+	err := munmapFile(db.dataref)
 	db.dataref = nil
 	db.data = nil
 	db.datasz = 0
 	return err
 }
 
+// mmapFile maps the first sz bytes of a file read-only with the given
+// advice. The file may be shorter than the mapping.
+func mmapFile(f dbFile, sz int, readOnly bool, advice MmapAdvice) ([]byte, error) {
+	// Map the data file to memory.
+	b, err := syscall.Mmap(int(f.Fd()), 0, sz, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	// Advise the kernel how the mmap is accessed, randomly by default.
+	if err := adviseMmap(b, advice); err != nil {
+		_ = syscall.Munmap(b)
+		return nil, err
+	}
+	return b, nil
+}
+
+// adviseMmap passes the advice for a mapping on to the kernel.
+func adviseMmap(b []byte, advice MmapAdvice) error {
+	var flag int
+	switch advice {
+	case MmapAdviceRandom:
+		flag = syscall.MADV_RANDOM
+	case MmapAdviceNormal:
+		flag = syscall.MADV_NORMAL
+	case MmapAdviceSequential:
+		flag = syscall.MADV_SEQUENTIAL
+	case MmapAdviceWillNeed:
+		flag = syscall.MADV_WILLNEED
+	default:
+		return fmt.Errorf("unknown mmap advice: %d", advice)
+	}
+	if err := madvise(b, flag); err != nil {
+		return fmt.Errorf("madvise: %s", err)
+	}
+	return nil
+}
+
+// mlock locks the pages of a mapping in memory.
+func mlock(b []byte) error {
+	if err := syscall.Mlock(b); err != nil {
+		return fmt.Errorf("mlock: %w", err)
+	}
+	return nil
+}
+
+// munmapFile unmaps a mapping returned by mmapFile.
+func munmapFile(b []byte) error {
+	return syscall.Munmap(b)
+}
+
 // NOTE: This function is copied from stdlib because it is not available on darwin.
 func madvise(b []byte, advice int) (err error) {
 	_, _, e1 := syscall.Syscall(syscall.SYS_MADVISE, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), uintptr(advice))
@@ -0,0 +1,180 @@
+package tinydb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	// see https://msdn.microsoft.com/en-us/library/windows/desktop/aa365203(v=vs.85).aspx
+	flagLockExclusive       = 2
+	flagLockFailImmediately = 1
+
+	// see https://msdn.microsoft.com/en-us/library/windows/desktop/ms681382(v=vs.85).aspx
+	errLockViolation syscall.Errno = 0x21
+)
+
+func lockFileEx(h syscall.Handle, flags, reserved, locklow, lockhigh uint32, ol *syscall.Overlapped) (err error) {
+	r, _, err := procLockFileEx.Call(uintptr(h), uintptr(flags), uintptr(reserved), uintptr(locklow), uintptr(lockhigh), uintptr(unsafe.Pointer(ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func unlockFileEx(h syscall.Handle, reserved, locklow, lockhigh uint32, ol *syscall.Overlapped) (err error) {
+	r, _, err := procUnlockFileEx.Call(uintptr(h), uintptr(reserved), uintptr(locklow), uintptr(lockhigh), uintptr(unsafe.Pointer(ol)), 0)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// lockRange returns the byte range locked on the database file. It is the
+// single byte at offset -1, far past the end of any file, because Windows
+// locks are mandatory and locking the pages themselves would block reads
+// and writes through other handles.
+func lockRange() *syscall.Overlapped {
+	var m1 uint32 = (1 << 32) - 1 // -1 in a uint32
+	return &syscall.Overlapped{Offset: m1, OffsetHigh: m1}
+}
+
+// flock acquires an advisory lock on a file descriptor.
+func flock(db *Db, mode os.FileMode, exclusive bool, timeout time.Duration) error {
+	var t time.Time
+	for {
+		// If we're beyond our timeout then return an error.
+		// This can only occur after we've attempted a flock once.
+		if t.IsZero() {
+			t = time.Now()
+		} else if timeout > 0 && time.Since(t) > timeout {
+			return ErrTimeout
+		}
+		var flag uint32 = flagLockFailImmediately
+		if exclusive {
+			flag |= flagLockExclusive
+		}
+
+		// Otherwise attempt to obtain the lock.
+		err := lockFileEx(syscall.Handle(db.file.Fd()), flag, 0, 1, 0, lockRange())
+		if err == nil {
+			return nil
+		} else if err != errLockViolation {
+			return err
+		}
+
+		// Wait for a bit and try again.
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// funlock releases an advisory lock on a file descriptor.
+func funlock(db *Db) error {
+	return unlockFileEx(syscall.Handle(db.file.Fd()), 0, 1, 0, lockRange())
+}
+
+// mmap memory maps a DB's data file.
+func mmap(db *Db, sz int) error {
+	b, err := mmapFile(db.file, sz, db.readOnly, db.mmapAdvice)
+	if err != nil {
+		return err
+	}
+	db.dataref = b
+	db.data = (*[maxMapSize]byte)(unsafe.Pointer(&b[0]))
+	db.datasz = sz
+	return nil
+}
+
+// munmap unmaps a DB's data file from memory.
+func munmap(db *Db) error {
+	// Ignore the unmap if we have no mapped data.
+	if db.dataref == nil {
+		return nil
+	}
+
+	err := munmapFile(db.dataref)
+	db.dataref = nil
+	db.data = nil
+	db.datasz = 0
+	return err
+}
+
+// mmapFile maps the first sz bytes of a file read-only. Windows has no
+// equivalent of madvise, so the advice is ignored.
+// Based on: https://github.com/edsrzf/mmap-go
+func mmapFile(f dbFile, sz int, readOnly bool, advice MmapAdvice) ([]byte, error) {
+	// A file can't be mapped past its end, so a writable database is grown
+	// to the size of the mapping first. Read-only databases map the whole
+	// file as it is, since only pages already in it are read.
+	var sizelo, sizehi uint32
+	if !readOnly {
+		if err := f.Truncate(int64(sz)); err != nil {
+			return nil, fmt.Errorf("truncate: %s", err)
+		}
+		sizehi = uint32(int64(sz) >> 32)
+		sizelo = uint32(sz) & 0xffffffff
+	}
+
+	// Open a file mapping handle.
+	h, errno := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil, syscall.PAGE_READONLY, sizehi, sizelo, nil)
+	if h == 0 {
+		return nil, os.NewSyscallError("CreateFileMapping", errno)
+	}
+
+	// Create the memory map.
+	addr, errno := syscall.MapViewOfFile(h, syscall.FILE_MAP_READ, 0, 0, 0)
+	if addr == 0 {
+		_ = syscall.CloseHandle(h)
+		return nil, os.NewSyscallError("MapViewOfFile", errno)
+	}
+
+	// Close mapping handle. The view keeps the mapping alive.
+	if err := syscall.CloseHandle(h); err != nil {
+		return nil, os.NewSyscallError("CloseHandle", err)
+	}
+
+	// Convert to a byte slice. The mapping is outside the Go heap and never
+	// moves, so the address is reinterpreted in place, which unlike a
+	// uintptr conversion isn't flagged by vet. A read-only view covers the
+	// whole file, which may be shorter than sz.
+	if readOnly {
+		info, err := f.Stat()
+		if err != nil {
+			_ = syscall.UnmapViewOfFile(addr)
+			return nil, err
+		} else if int(info.Size()) < sz {
+			sz = int(info.Size())
+		}
+	}
+	data := *(**[maxMapSize]byte)(unsafe.Pointer(&addr))
+	return data[:sz:sz], nil
+}
+
+// adviseMmap does nothing since Windows has no equivalent of madvise.
+func adviseMmap(b []byte, advice MmapAdvice) error {
+	return nil
+}
+
+// mlock fails since Windows databases can't be locked in memory.
+func mlock(b []byte) error {
+	return errors.New("mlock not supported on windows")
+}
+
+// munmapFile unmaps a view returned by mmapFile.
+func munmapFile(b []byte) error {
+	addr := uintptr(unsafe.Pointer(&b[0]))
+	if err := syscall.UnmapViewOfFile(addr); err != nil {
+		return os.NewSyscallError("UnmapViewOfFile", err)
+	}
+	return nil
+}
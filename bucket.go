@@ -1,13 +1,39 @@
 package tinydb
 
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+const (
+	// MaxKeySize is the maximum length of a key, in bytes.
+	// Keys are stored whole in both leaf and branch pages, so every level of
+	// the tree must be able to hold at least minKeysPerPage of them.
+	MaxKeySize = 32768
+
+	// MaxValueSize is the maximum length of a value, in bytes. Values larger
+	// than a page are stored on a run of contiguous overflow pages following
+	// their leaf page, so the limit comes from the largest slice the package
+	// can address in one piece, 2GB on 64-bit and 256MB on 32-bit platforms.
+	MaxValueSize = maxAllocSize - 1
+)
+
+// DefaultFillPercent is the percentage that split pages are filled.
+// This value can be changed by setting Bucket.FillPercent.
+const DefaultFillPercent = 0.5
+
 // Bucket represents a collection of key/value pairs inside the database.
 type Bucket struct {
 	*bucket
 	tx       *Tx                // the associated transaction
+	name     []byte             // top-level bucket name, nil for the root bucket
 	buckets  map[string]*Bucket // subbucket cache
 	page     *page              // inline page reference
 	rootNode *node              // materialized node for the root page.
 	nodes    map[pgid]*node     // node cache
+	packed   bool               // split at the max fill percent, set by Compact
 
 	// Sets the threshold for filling nodes when they split. By default,
 	// the bucket will fill to 50% but it can be useful to increase this
@@ -15,8 +41,24 @@ type Bucket struct {
 	//
 	// This is non-persisted across transactions so it must be set in every Tx.
 	FillPercent float64
+
+	// Sets the minimum number of keys kept on each side of a split. By default
+	// this is 2, which suits most buckets. Buckets holding a few very large
+	// values can lower it to 1 so oversized nodes still split, and buckets
+	// holding thousands of tiny values can raise it to avoid sparse pages.
+	//
+	// This is non-persisted across transactions so it must be set in every Tx.
+	MinKeysPerPage int
 }
 
+const bucketHeaderSize = int(unsafe.Sizeof(bucket{}))
+
+// unalignedMask is used to detect bucket values that can't be read in place.
+const unalignedMask = unsafe.Alignof(struct {
+	bucket
+	page
+}{}) - 1
+
 // bucket represents the on-file representation of a bucket.
 // This is stored as the "value" of a bucket key. If the bucket is small enough,
 // then its root page can be stored inline in the "value", after the bucket
@@ -26,6 +68,762 @@ type bucket struct {
 	sequence uint64 // monotonically incrementing, used by NextSequence()
 }
 
+// newBucket returns a new bucket associated with a transaction.
+func newBucket(tx *Tx) Bucket {
+	var b = Bucket{tx: tx, FillPercent: DefaultFillPercent}
+	if tx.writable {
+		b.buckets = make(map[string]*Bucket)
+		b.nodes = make(map[pgid]*node)
+	}
+	return b
+}
+
+// Tx returns the tx of the bucket.
+func (b *Bucket) Tx() *Tx {
+	return b.tx
+}
+
+// Root returns the root of the bucket.
+func (b *Bucket) Root() pgid {
+	return b.root
+}
+
+// Writable returns whether the bucket is writable.
+func (b *Bucket) Writable() bool {
+	return b.tx.writable
+}
+
+// engine returns the storage engine holding the bucket's elements.
+func (b *Bucket) engine() engine {
+	return btree{b}
+}
+
+// Cursor creates a cursor associated with the bucket.
+// The cursor is only valid as long as the transaction is open.
+// Do not use a cursor after the transaction is closed.
+func (b *Bucket) Cursor() *Cursor {
+	// Update transaction statistics.
+	b.tx.stats.CursorCount++
+
+	// Allocate and return a cursor.
+	return &Cursor{
+		bucket: b,
+		stack:  make([]elemRef, 0),
+	}
+}
+
+// Bucket retrieves a nested bucket by name.
+// Returns nil if the bucket does not exist.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (b *Bucket) Bucket(name []byte) *Bucket {
+	if b.buckets != nil {
+		if child := b.buckets[string(name)]; child != nil {
+			return child
+		}
+	}
+
+	// Move cursor to key.
+	c := b.Cursor()
+	k, v, flags := c.seek(name)
+
+	// Return nil if the key doesn't exist or it is not a bucket.
+	if !bytes.Equal(name, k) || (flags&bucketLeafFlag) == 0 {
+		return nil
+	}
+
+	// Otherwise create a bucket and cache it.
+	var child = b.openBucket(v)
+	if child.name = b.name; child.name == nil {
+		child.name = cloneBytes(name)
+	}
+	if b.buckets != nil {
+		b.buckets[string(name)] = child
+	}
+
+	return child
+}
+
+// openBucket helper method that re-interprets a sub-bucket value
+// from a parent into a Bucket
+func (b *Bucket) openBucket(value []byte) *Bucket {
+	var child = newBucket(b.tx)
+
+	// Values are packed after their keys so a bucket header, and the inline
+	// page that follows it, can start at any offset in the leaf page. Copy
+	// unaligned values so the uint64 fields can be read on architectures
+	// that fault on unaligned access, such as arm and mips.
+	if uintptr(unsafe.Pointer(&value[0]))&unalignedMask != 0 {
+		value = cloneBytes(value)
+	}
+
+	// If this is a writable transaction then we need to copy the bucket entry.
+	// Read-only transactions can point directly at the mmap entry.
+	if b.tx.writable {
+		child.bucket = &bucket{}
+		*child.bucket = *(*bucket)(unsafe.Pointer(&value[0]))
+	} else {
+		child.bucket = (*bucket)(unsafe.Pointer(&value[0]))
+	}
+
+	// Save a reference to the inline page if the bucket is inline.
+	if child.root == 0 {
+		child.page = (*page)(unsafe.Pointer(&value[bucketHeaderSize]))
+	}
+
+	return &child
+}
+
+// CreateBucket creates a new bucket at the given key and returns the new bucket.
+// Returns an error if the key already exists, if the bucket name is blank, or if the bucket name is too long.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (b *Bucket) CreateBucket(key []byte) (*Bucket, error) {
+	if b.tx.db == nil {
+		return nil, ErrTxClosed
+	} else if !b.tx.writable {
+		return nil, ErrTxNotWritable
+	} else if len(key) == 0 {
+		return nil, ErrBucketNameRequired
+	} else if len(key) > MaxKeySize {
+		return nil, ErrKeyTooLarge
+	}
+
+	// Move cursor to correct position.
+	c := b.Cursor()
+	k, _, flags := c.seek(key)
+
+	// Return an error if there is an existing key.
+	if bytes.Equal(key, k) {
+		if (flags & bucketLeafFlag) != 0 {
+			return nil, ErrBucketExists
+		}
+		return nil, ErrIncompatibleValue
+	}
+
+	// Create empty, inline bucket.
+	var bucket = Bucket{
+		bucket:      &bucket{},
+		rootNode:    &node{isLeaf: true},
+		FillPercent: DefaultFillPercent,
+	}
+	var value = bucket.write()
+
+	// Insert into node.
+	key = cloneBytes(key)
+	c.node().put(key, key, value, 0, bucketLeafFlag)
+	b.touch(key)
+
+	// Since subbuckets are not allowed on inline buckets, we need to
+	// dereference the inline page, if it exists. This will cause the bucket
+	// to be treated as a regular, non-inline bucket for the rest of the tx.
+	b.page = nil
+
+	return b.Bucket(key), nil
+}
+
+// CreateBucketIfNotExists creates a new bucket if it doesn't already exist and returns a reference to it.
+// Returns an error if the bucket name is blank, or if the bucket name is too long.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (b *Bucket) CreateBucketIfNotExists(key []byte) (*Bucket, error) {
+	child, err := b.CreateBucket(key)
+	if err == ErrBucketExists {
+		return b.Bucket(key), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return child, nil
+}
+
+// DeleteBucket deletes a bucket at the given key.
+// Returns an error if the bucket does not exist, or if the key represents a non-bucket value.
+func (b *Bucket) DeleteBucket(key []byte) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	}
+
+	// Move cursor to correct position.
+	c := b.Cursor()
+	k, _, flags := c.seek(key)
+
+	// Return an error if bucket doesn't exist or is not a bucket.
+	if !bytes.Equal(key, k) {
+		return ErrBucketNotFound
+	} else if (flags & bucketLeafFlag) == 0 {
+		return ErrIncompatibleValue
+	}
+
+	// Recursively delete all child buckets. Names are collected first so
+	// the cursor is not invalidated by the deletes.
+	child := b.Bucket(key)
+	var names [][]byte
+	cc := child.Cursor()
+	for k, v := cc.First(); k != nil; k, v = cc.Next() {
+		if v == nil && child.Bucket(k) != nil {
+			names = append(names, cloneBytes(k))
+		}
+	}
+	for _, name := range names {
+		if err := child.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+
+	// Remove cached copy.
+	delete(b.buckets, string(key))
+
+	// Release all bucket pages to freelist.
+	child.nodes = nil
+	child.rootNode = nil
+	child.free()
+
+	// Delete the node if we have a matching key.
+	c.node().del(key)
+	b.touch(key)
+
+	return nil
+}
+
+// Get retrieves the value for a key in the bucket.
+// Returns a nil value if the key does not exist or if the key is a nested bucket.
+// The returned value is only valid for the life of the transaction.
+func (b *Bucket) Get(key []byte) []byte {
+	v, flags, ok := b.engine().get(key)
+
+	// Return nil if the key doesn't exist or is a bucket.
+	if !ok || (flags&bucketLeafFlag) != 0 {
+		return nil
+	}
+	return v
+}
+
+// Put sets the value for a key in the bucket.
+// If the key exist then its previous value will be overwritten.
+// Supplied value must remain valid for the life of the transaction.
+// Returns an error if the bucket was created from a read-only transaction,
+// if the key is blank, if the key is too large, or if the key is a nested bucket.
+func (b *Bucket) Put(key []byte, value []byte) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	} else if len(key) == 0 {
+		return ErrKeyRequired
+	} else if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	} else if int64(len(value)) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+
+	if err := b.engine().put(key, value); err != nil {
+		return err
+	}
+	b.touch(key)
+
+	return nil
+}
+
+// Delete removes a key from the bucket.
+// If the key does not exist then nothing is done and a nil error is returned.
+// Returns an error if the bucket was created from a read-only transaction,
+// or if the key is a nested bucket.
+func (b *Bucket) Delete(key []byte) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	}
+
+	if ok, err := b.engine().del(key); err != nil || !ok {
+		return err
+	}
+	b.touch(key)
+
+	return nil
+}
+
+// Sequence returns the current integer for the bucket without incrementing it.
+func (b *Bucket) Sequence() uint64 { return b.bucket.sequence }
+
+// SetSequence updates the sequence number for the bucket.
+func (b *Bucket) SetSequence(v uint64) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	}
+
+	// Materialize the root node if it hasn't been already so that the
+	// bucket will be saved during commit.
+	if b.rootNode == nil {
+		_ = b.node(b.root, nil)
+	}
+
+	// Set the sequence.
+	b.bucket.sequence = v
+	return nil
+}
+
+// NextSequence returns an autoincrementing integer for the bucket.
+func (b *Bucket) NextSequence() (uint64, error) {
+	if b.tx.db == nil {
+		return 0, ErrTxClosed
+	} else if !b.Writable() {
+		return 0, ErrTxNotWritable
+	}
+
+	// Materialize the root node if it hasn't been already so that the
+	// bucket will be saved during commit.
+	if b.rootNode == nil {
+		_ = b.node(b.root, nil)
+	}
+
+	// Increment and return the sequence.
+	b.bucket.sequence++
+	return b.bucket.sequence, nil
+}
+
+// ForEach executes a function for each key/value pair in a bucket.
+// Nested buckets are passed with a nil value.
+// If the provided function returns an error then the iteration is stopped and
+// the error is returned to the caller. The provided function must not modify
+// the bucket; this will result in undefined behavior.
+func (b *Bucket) ForEach(fn func(k, v []byte) error) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	}
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan executes a function for each key/value pair whose key starts with
+// prefix, in key order. A nil or empty prefix visits every pair.
+// Iteration stops on the first error returned by fn and that error is
+// returned to the caller. The provided function must not modify the bucket.
+func (b *Bucket) Scan(prefix []byte, fn func(k, v []byte) error) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	}
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Range executes a function for each key/value pair with start <= key < end,
+// in key order. A nil start begins at the first key and a nil end continues to
+// the last key. Iteration stops on the first error returned by fn and that
+// error is returned to the caller. The provided function must not modify the
+// bucket.
+func (b *Bucket) Range(start, end []byte, fn func(k, v []byte) error) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	}
+	c := b.Cursor()
+	for k, v := c.Seek(start); k != nil && (end == nil || bytes.Compare(k, end) < 0); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact rewrites the bucket and all of its nested buckets into freshly
+// allocated pages packed to the database's maximum fill percent. The old
+// pages are freed when the transaction commits, which reclaims the space
+// held by a sparse or fragmented bucket without compacting the whole file.
+// The whole subtree is rewritten in the current transaction, so very large
+// buckets should be compacted in a transaction of their own.
+func (b *Bucket) Compact() error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	}
+
+	// Inline buckets are already stored in their parent's page.
+	if b.root == 0 {
+		return nil
+	}
+
+	// Gather every element of the bucket, including pending changes, into a
+	// single leaf node that replaces the root. Spilling splits it back into
+	// full pages and builds new branch pages above them.
+	n := &node{bucket: b, isLeaf: true, pgid: b.root}
+	var children [][]byte
+	c := b.Cursor()
+	c.First()
+	for k, v, flags := c.keyValue(); k != nil; k, v, flags = c.next() {
+		n.inodes = append(n.inodes, inode{flags: flags, key: k, value: v})
+		if (flags & bucketLeafFlag) != 0 {
+			children = append(children, k)
+		}
+	}
+
+	// Free every page except the root, which is freed when the new root
+	// node is spilled.
+	var tx = b.tx
+	b.forEachPageNode(func(p *page, old *node, _ int) {
+		if p != nil && p.id != b.root {
+			tx.db.freelist.free(tx.meta.txid, p)
+		} else if old != nil && old.pgid != b.root {
+			old.free()
+		}
+	})
+	b.rootNode = n
+	b.nodes = map[pgid]*node{b.root: n}
+	b.packed = true
+	tx.stats.NodeCount++
+
+	for _, name := range children {
+		if err := b.Bucket(name).Compact(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats retrieves stats on a bucket and its nested buckets. Writable
+// transactions see the pages as of the start of the transaction.
+func (b *Bucket) Stats() BucketStats {
+	var s, subStats BucketStats
+	pageSize := b.tx.db.pageSize
+	s.BucketN++
+	if b.root == 0 {
+		s.InlineBucketN++
+	}
+
+	var walk func(p *page, depth int)
+	walk = func(p *page, depth int) {
+		if depth+1 > s.Depth {
+			s.Depth = depth + 1
+		}
+
+		if (p.flags & branchPageFlag) != 0 {
+			s.BranchPageN++
+			s.BranchOverflowN += int(p.overflow)
+			s.BranchInuse += int(p.inuse())
+			s.BranchAlloc += (int(p.overflow) + 1) * pageSize
+			for i := 0; i < int(p.count); i++ {
+				walk(b.tx.page(p.branchPageElement(uint16(i)).pgid), depth+1)
+			}
+			return
+		}
+
+		s.KeyN += int(p.count)
+		if p == b.page {
+			// The page of an inline bucket is part of its parent's leaf page.
+			s.InlineBucketInuse += int(p.inuse())
+		} else {
+			s.LeafPageN++
+			s.LeafOverflowN += int(p.overflow)
+			s.LeafInuse += int(p.inuse())
+			s.LeafAlloc += (int(p.overflow) + 1) * pageSize
+		}
+
+		// Collect stats from sub-buckets.
+		for i := 0; i < int(p.count); i++ {
+			e := p.leafPageElement(uint16(i))
+			if (e.flags & bucketLeafFlag) != 0 {
+				subStats.Add(b.openBucket(e.value()).Stats())
+			}
+		}
+	}
+
+	if b.page != nil {
+		walk(b.page, 0)
+	} else {
+		p := b.tx.page(b.root)
+		p.mustBeBTree()
+		walk(p, 0)
+	}
+
+	// Add stats for child buckets.
+	s.Add(subStats)
+	return s
+}
+
+// BucketStats records statistics about resources used by a bucket.
+type BucketStats struct {
+	// Page count statistics.
+	BranchPageN     int // number of logical branch pages
+	BranchOverflowN int // number of physical branch overflow pages
+	LeafPageN       int // number of logical leaf pages
+	LeafOverflowN   int // number of physical leaf overflow pages
+
+	// Tree statistics.
+	KeyN  int // number of keys/value pairs
+	Depth int // number of levels in the deepest bucket tree
+
+	// Page size utilization.
+	BranchAlloc int // bytes allocated for physical branch pages
+	BranchInuse int // bytes actually used for branch data
+	LeafAlloc   int // bytes allocated for physical leaf pages
+	LeafInuse   int // bytes actually used for leaf data
+
+	// Bucket statistics
+	BucketN           int // total number of buckets including the top bucket
+	InlineBucketN     int // total number on inlined buckets
+	InlineBucketInuse int // bytes used for inlined buckets, not counted in LeafInuse
+}
+
+// Add accumulates other into s. Depth keeps the larger of the two.
+func (s *BucketStats) Add(other BucketStats) {
+	s.BranchPageN += other.BranchPageN
+	s.BranchOverflowN += other.BranchOverflowN
+	s.LeafPageN += other.LeafPageN
+	s.LeafOverflowN += other.LeafOverflowN
+	s.KeyN += other.KeyN
+	if s.Depth < other.Depth {
+		s.Depth = other.Depth
+	}
+	s.BranchAlloc += other.BranchAlloc
+	s.BranchInuse += other.BranchInuse
+	s.LeafAlloc += other.LeafAlloc
+	s.LeafInuse += other.LeafInuse
+
+	s.BucketN += other.BucketN
+	s.InlineBucketN += other.InlineBucketN
+	s.InlineBucketInuse += other.InlineBucketInuse
+}
+
+// FillRatio returns the fraction of allocated branch and leaf page bytes
+// that hold data, or 0 if the bucket has no pages of its own.
+func (s *BucketStats) FillRatio() float64 {
+	alloc := s.BranchAlloc + s.LeafAlloc
+	if alloc == 0 {
+		return 0
+	}
+	return float64(s.BranchInuse+s.LeafInuse) / float64(alloc)
+}
+
+// touch records that key changed in the bucket so subscribers of the
+// enclosing top-level bucket are notified once the transaction commits.
+func (b *Bucket) touch(key []byte) {
+	name := b.name
+	if name == nil {
+		name = key
+	}
+	if b.tx.changed == nil {
+		b.tx.changed = make(map[string]struct{})
+	}
+	b.tx.changed[string(name)] = struct{}{}
+}
+
+// forEachPageNode iterates over every page (or node) in a bucket.
+// This also includes inline pages.
+func (b *Bucket) forEachPageNode(fn func(*page, *node, int)) {
+	// If we have an inline page or root node then just use that.
+	if b.page != nil {
+		fn(b.page, nil, 0)
+		return
+	}
+	b.forEachPageNodeAt(b.root, 0, fn)
+}
+
+func (b *Bucket) forEachPageNodeAt(pgid pgid, depth int, fn func(*page, *node, int)) {
+	var p, n = b.pageNode(pgid)
+	if p != nil {
+		p.mustBeBTree()
+	}
+
+	// Execute function.
+	fn(p, n, depth)
+
+	// Recursively loop over children.
+	if p != nil {
+		if (p.flags & branchPageFlag) != 0 {
+			for i := 0; i < int(p.count); i++ {
+				elem := p.branchPageElement(uint16(i))
+				b.forEachPageNodeAt(elem.pgid, depth+1, fn)
+			}
+		}
+	} else {
+		if !n.isLeaf {
+			for _, inode := range n.inodes {
+				b.forEachPageNodeAt(inode.pgid, depth+1, fn)
+			}
+		}
+	}
+}
+
+// spill writes all the nodes for this bucket to dirty pages.
+func (b *Bucket) spill() error {
+	// Spill all child buckets first.
+	for name, child := range b.buckets {
+		// If the child bucket is small enough and it has no child buckets then
+		// write it inline into the parent bucket's page. Otherwise spill it
+		// like a normal bucket and make the parent value a pointer to the page.
+		var value []byte
+		if child.inlineable() {
+			child.free()
+			value = child.write()
+		} else {
+			if err := child.spill(); err != nil {
+				return err
+			}
+
+			// Update the child bucket header in this bucket.
+			value = make([]byte, unsafe.Sizeof(bucket{}))
+			var bucket = (*bucket)(unsafe.Pointer(&value[0]))
+			*bucket = *child.bucket
+		}
+
+		// Skip writing the bucket if there are no materialized nodes.
+		if child.rootNode == nil {
+			continue
+		}
+
+		// Update parent node.
+		var c = b.Cursor()
+		k, _, flags := c.seek([]byte(name))
+		if !bytes.Equal([]byte(name), k) {
+			panic(fmt.Sprintf("misplaced bucket header: %x -> %x", []byte(name), k))
+		}
+		if flags&bucketLeafFlag == 0 {
+			panic(fmt.Sprintf("unexpected bucket header flag: %x", flags))
+		}
+		c.node().put([]byte(name), []byte(name), value, 0, bucketLeafFlag)
+	}
+
+	// Ignore if there's not a materialized root node.
+	if b.rootNode == nil {
+		return nil
+	}
+
+	// Spill nodes.
+	if err := b.rootNode.spill(); err != nil {
+		return err
+	}
+	b.rootNode = b.rootNode.root()
+
+	// Update the root node for this bucket.
+	if b.rootNode.pgid >= b.tx.meta.pgid {
+		panic(fmt.Sprintf("pgid (%d) above high water mark (%d)", b.rootNode.pgid, b.tx.meta.pgid))
+	}
+	b.root = b.rootNode.pgid
+
+	return nil
+}
+
+// inlineable returns true if a bucket is small enough to be written inline
+// and if it contains no subbuckets. Otherwise returns false.
+func (b *Bucket) inlineable() bool {
+	var n = b.rootNode
+
+	// Bucket must only contain a single leaf node.
+	if n == nil || !n.isLeaf {
+		return false
+	}
+
+	// Bucket is not inlineable if it contains subbuckets or if it goes beyond
+	// our threshold for inline bucket size.
+	var size = pageHeaderSize
+	for _, inode := range n.inodes {
+		size += leafPageElementSize + uintptr(len(inode.key)) + uintptr(len(inode.value))
+
+		if inode.flags&bucketLeafFlag != 0 {
+			return false
+		} else if size > b.maxInlineBucketSize() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the maximum total size of a bucket to make it a candidate for inlining.
+func (b *Bucket) maxInlineBucketSize() uintptr {
+	return uintptr(b.tx.db.pageSize / 4)
+}
+
+// write allocates and writes a bucket to a byte slice.
+func (b *Bucket) write() []byte {
+	// Allocate the appropriate size.
+	var n = b.rootNode
+	var value = make([]byte, bucketHeaderSize+int(n.size()))
+
+	// Write a bucket header.
+	var bucket = (*bucket)(unsafe.Pointer(&value[0]))
+	*bucket = *b.bucket
+
+	// Convert byte slice to a fake page and write the root node.
+	var p = (*page)(unsafe.Pointer(&value[bucketHeaderSize]))
+	n.write(p)
+
+	return value
+}
+
+// rebalance attempts to balance all nodes.
+func (b *Bucket) rebalance() {
+	for _, n := range b.nodes {
+		n.rebalance()
+	}
+	for _, child := range b.buckets {
+		child.rebalance()
+	}
+}
+
+// free recursively frees all pages in the bucket.
+func (b *Bucket) free() {
+	if b.root == 0 {
+		return
+	}
+
+	var tx = b.tx
+	b.forEachPageNode(func(p *page, n *node, _ int) {
+		if p != nil {
+			tx.db.freelist.free(tx.meta.txid, p)
+		} else {
+			n.free()
+		}
+	})
+	b.root = 0
+}
+
+// pageNode returns the in-memory node, if it exists.
+// Otherwise returns the underlying page.
+func (b *Bucket) pageNode(id pgid) (*page, *node) {
+	// Inline buckets have a fake page embedded in their value so treat them
+	// differently. We'll return the rootNode (if available) or the fake page.
+	if b.root == 0 {
+		if id != 0 {
+			panic(fmt.Sprintf("inline bucket non-zero page access(2): %d != 0", id))
+		}
+		if b.rootNode != nil {
+			return nil, b.rootNode
+		}
+		return b.page, nil
+	}
+
+	// Check the node cache for non-inline buckets.
+	if b.nodes != nil {
+		if n := b.nodes[id]; n != nil {
+			return nil, n
+		}
+	}
+
+	// Finally lookup the page from the transaction if no node is materialized.
+	return b.tx.page(id), nil
+}
+
+// minKeysPerPage returns the minimum number of keys per page for splits,
+// falling back to the package default when no override is set.
+func (b *Bucket) minKeysPerPage() int {
+	if b.MinKeysPerPage < 1 {
+		return minKeysPerPage
+	}
+	return b.MinKeysPerPage
+}
+
 // dereference removes all references to the old mmap.
 func (b *Bucket) dereference() {
 	if b.rootNode != nil {
@@ -67,3 +865,21 @@ func (b *Bucket) node(pgid pgid, parent *node) *node {
 
 	return n
 }
+
+// cloneBytes returns a copy of a given slice.
+func cloneBytes(v []byte) []byte {
+	var clone = make([]byte, len(v))
+	copy(clone, v)
+	return clone
+}
+
+// openRoots records the root page of every bucket opened below b, keyed by
+// the slash-separated bucket path. Inline buckets are recorded as page 0.
+func (b *Bucket) openRoots(path []string, roots map[string]pgid) map[string]pgid {
+	for name, child := range b.buckets {
+		p := append(path[:len(path):len(path)], name)
+		roots[strings.Join(p, "/")] = child.root
+		child.openRoots(p, roots)
+	}
+	return roots
+}
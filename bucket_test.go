@@ -0,0 +1,1509 @@
+package tinydb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"unsafe"
+)
+
+// Ensure that a bucket that gets a non-existent key returns nil.
+func TestBucket_Get_NonExistent(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := b.Get([]byte("foo")); v != nil {
+			t.Fatal("expected nil value")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a bucket can write a key/value and read it back after reopening.
+func TestBucket_Put(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if v := b.Get([]byte("foo")); !bytes.Equal([]byte("bar"), v) {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if b == nil {
+			t.Fatal("expected bucket")
+		}
+		if v := b.Get([]byte("foo")); !bytes.Equal([]byte("bar"), v) {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that many keys written in random order can be read back across
+// several transactions, forcing the bucket out of its inline page.
+func TestBucket_Put_Large(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	const count, batch = 5000, 1000
+	perm := rand.New(rand.NewSource(0)).Perm(count)
+	for i := 0; i < count; i += batch {
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, j := range perm[i : i+batch] {
+				k := []byte(fmt.Sprintf("%08d", j))
+				if err := b.Put(k, bytes.Repeat([]byte{'x'}, j%100)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for j := 0; j < count; j++ {
+			v := b.Get([]byte(fmt.Sprintf("%08d", j)))
+			if !bytes.Equal(v, bytes.Repeat([]byte{'x'}, j%100)) {
+				t.Fatalf("unexpected value for %d: %q", j, v)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that setting a value on a key with a bucket value returns an error.
+func TestBucket_Put_IncompatibleValue(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.root.Put([]byte("widgets"), []byte("bar")); err != ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if v := tx.root.Get([]byte("widgets")); v != nil {
+			t.Fatalf("expected nil value for bucket key; got %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a setting a value while the transaction is closed returns an error.
+func TestBucket_Put_Closed(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := tx.CreateBucket([]byte("widgets"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Put([]byte("foo"), []byte("bar")); err != ErrTxClosed {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure that setting a value on a read-only bucket returns an error.
+func TestBucket_Put_ReadOnly(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if err := b.Put([]byte("foo"), []byte("bar")); err != ErrTxNotWritable {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := b.Put(nil, []byte("bar")); err != ErrTxNotWritable {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that putting an empty key returns an error.
+func TestBucket_Put_KeyRequired(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte{}, []byte("bar")); err != ErrKeyRequired {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := b.Put(nil, []byte("bar")); err != ErrKeyRequired {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a bucket can be created and retrieved.
+func TestTx_CreateBucket(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		} else if b == nil {
+			t.Fatal("expected bucket")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		if tx.Bucket([]byte("widgets")) == nil {
+			t.Fatal("expected bucket")
+		}
+		if tx.Bucket([]byte("missing")) != nil {
+			t.Fatal("expected nil bucket")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that creating an existing bucket or a blank bucket returns an error.
+func TestTx_CreateBucket_Errors(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.CreateBucket([]byte("widgets")); err != ErrBucketExists {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := tx.CreateBucket(nil); err != ErrBucketNameRequired {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := tx.root.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.CreateBucket([]byte("foo")); err != ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		if _, err := tx.CreateBucket([]byte("gadgets")); err != ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that CreateBucketIfNotExists returns the existing bucket.
+func TestTx_CreateBucketIfNotExists(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := b.Get([]byte("foo")); !bytes.Equal(v, []byte("bar")) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if _, err := tx.CreateBucketIfNotExists(nil); err != ErrBucketNameRequired {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a bucket can be deleted and its pages are released.
+func TestTx_DeleteBucket(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.DeleteBucket([]byte("widgets")); err != nil {
+			t.Fatal(err)
+		}
+		if tx.Bucket([]byte("widgets")) != nil {
+			t.Fatal("expected bucket to be deleted")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if db.freelist.count() == 0 {
+		t.Fatal("expected pages to be freed")
+	}
+
+	// Recreate the bucket and make sure it is empty.
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := b.Get([]byte("0000")); v != nil {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that deleting a missing bucket or a non-bucket key returns an error.
+func TestTx_DeleteBucket_Errors(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.DeleteBucket([]byte("widgets")); err != ErrBucketNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := tx.root.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.DeleteBucket([]byte("foo")); err != ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		if err := tx.DeleteBucket([]byte("foo")); err != ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that many buckets can be created, spilling the root bucket over
+// several pages.
+func TestTx_CreateBucket_Many(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		for i := 0; i < 500; i++ {
+			b, err := tx.CreateBucket([]byte(fmt.Sprintf("bucket-%03d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Put([]byte("id"), []byte(fmt.Sprint(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		for i := 0; i < 500; i++ {
+			b := tx.Bucket([]byte(fmt.Sprintf("bucket-%03d", i)))
+			if b == nil {
+				t.Fatalf("expected bucket %d", i)
+			} else if v := b.Get([]byte("id")); string(v) != fmt.Sprint(i) {
+				t.Fatalf("unexpected value: %q", v)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that keys larger than MaxKeySize are rejected.
+func TestBucket_Put_KeyTooLarge(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put(make([]byte, MaxKeySize+1), []byte("bar")); err != ErrKeyTooLarge {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := tx.CreateBucket(make([]byte, MaxKeySize+1)); err != ErrKeyTooLarge {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a value above MaxValueSize returns an error.
+func TestBucket_Put_ValueTooLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), make([]byte, MaxValueSize+1)); err != ErrValueTooLarge {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that values spanning many overflow pages round trip through a
+// reopen with page checksums verified.
+func TestBucket_Put_Overflow(t *testing.T) {
+	path := tempfile()
+	defer os.RemoveAll(path)
+
+	db, err := Open(path, &Options{ChecksumMode: ChecksumOnRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := func(i int) []byte {
+		v := make([]byte, (1<<20)+i*db.pageSize/2)
+		for j := range v {
+			v[j] = byte(i + j)
+		}
+		return v
+	}
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if err := b.Put([]byte(fmt.Sprint(i)), value(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, &Options{ChecksumMode: ChecksumOnRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 3; i++ {
+			if v := b.Get([]byte(fmt.Sprint(i))); !bytes.Equal(v, value(i)) {
+				t.Fatalf("value %d mismatch: len=%d", i, len(v))
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that keys much larger than a page can be written over several
+// transactions and read back in order.
+func TestBucket_Put_MaxKeySize(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	const count = 40
+	key := func(i int) []byte {
+		k := bytes.Repeat([]byte{'k'}, MaxKeySize)
+		copy(k, fmt.Sprintf("%03d", i))
+		return k
+	}
+	for r := 0; r < 2; r++ {
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := r; i < count; i += 2 {
+				if err := b.Put(key(i), []byte(fmt.Sprint(i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		var i int
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !bytes.Equal(k, key(i)) || string(v) != fmt.Sprint(i) {
+				t.Fatalf("unexpected pair at %d: %.3s=%s", i, k, v)
+			}
+			i++
+		}
+		if i != count {
+			t.Fatalf("exp=%d; got=%d", count, i)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that buckets can be nested several levels deep and survive a reopen.
+func TestBucket_Nested(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		users, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			user, err := users.CreateBucket([]byte(fmt.Sprintf("%03d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := user.Put([]byte("name"), []byte(fmt.Sprintf("user-%d", i))); err != nil {
+				t.Fatal(err)
+			}
+			sessions, err := user.CreateBucket([]byte("sessions"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j := 0; j < i; j++ {
+				if err := sessions.Put([]byte(fmt.Sprintf("%04d", j)), make([]byte, 64)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		users := tx.Bucket([]byte("users"))
+		for i := 0; i < 100; i++ {
+			user := users.Bucket([]byte(fmt.Sprintf("%03d", i)))
+			if user == nil {
+				t.Fatalf("expected user %d", i)
+			}
+			if v := user.Get([]byte("name")); string(v) != fmt.Sprintf("user-%d", i) {
+				t.Fatalf("unexpected name: %q", v)
+			}
+
+			var n int
+			c := user.Bucket([]byte("sessions")).Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				n++
+			}
+			if n != i {
+				t.Fatalf("user %d: exp %d sessions; got %d", i, i, n)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a nested bucket can grow from inline to regular pages and be
+// modified in a later transaction.
+func TestBucket_Nested_Grow(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.CreateBucket([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		return b.Put([]byte("bar"), []byte("0000"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Grow the nested bucket beyond the inline size.
+	if err := db.Update(func(tx *Tx) error {
+		foo := tx.Bucket([]byte("widgets")).Bucket([]byte("foo"))
+		for i := 0; i < 1000; i++ {
+			if err := foo.Put([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Update a value in the nested bucket and its parent.
+	if err := db.Update(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if err := b.Put([]byte("bar"), []byte("xxxx")); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bucket([]byte("foo")).Put([]byte("0500"), []byte("updated"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("bar")); string(v) != "xxxx" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		foo := b.Bucket([]byte("foo"))
+		if foo.Root() == 0 {
+			t.Fatal("expected nested bucket to be stored on its own pages")
+		}
+		if v := foo.Get([]byte("0500")); string(v) != "updated" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if v := foo.Get([]byte("0999")); string(v) != "999" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that deleting a bucket also deletes its nested buckets.
+func TestBucket_DeleteBucket_Nested(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		foo, err := b.CreateBucket([]byte("foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bar, err := foo.CreateBucket([]byte("bar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := bar.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *Tx) error {
+		return tx.Bucket([]byte("widgets")).DeleteBucket([]byte("foo"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A recreated bucket must not see the old nested buckets.
+	if err := db.Update(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if b.Bucket([]byte("foo")) != nil {
+			t.Fatal("expected nested bucket to be deleted")
+		}
+		foo, err := b.CreateBucket([]byte("foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if foo.Bucket([]byte("bar")) != nil {
+			t.Fatal("expected empty bucket")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The nested bucket's pages must have been released.
+	if db.freelist.count() < 25 {
+		t.Fatalf("expected freed pages; got %d", db.freelist.count())
+	}
+}
+
+// Ensure that nested bucket keys conflict with regular keys.
+func TestBucket_CreateBucket_IncompatibleValue(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.CreateBucket([]byte("foo")); err != ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := b.CreateBucket([]byte("baz")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("baz"), []byte("bar")); err != ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := b.DeleteBucket([]byte("foo")); err != ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure a user can loop over all key/value pairs in a bucket, including
+// uncommitted writes.
+func TestBucket_ForEach(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("0000")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("baz"), []byte("0001")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.CreateBucket([]byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+
+		var index int
+		if err := b.ForEach(func(k, v []byte) error {
+			switch index {
+			case 0:
+				if !bytes.Equal(k, []byte("bar")) || v != nil {
+					t.Fatalf("unexpected pair: %q=%q", k, v)
+				}
+			case 1:
+				if !bytes.Equal(k, []byte("baz")) || !bytes.Equal(v, []byte("0001")) {
+					t.Fatalf("unexpected pair: %q=%q", k, v)
+				}
+			case 2:
+				if !bytes.Equal(k, []byte("foo")) || !bytes.Equal(v, []byte("0000")) {
+					t.Fatalf("unexpected pair: %q=%q", k, v)
+				}
+			}
+			index++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if index != 3 {
+			t.Fatalf("unexpected index: %d", index)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure a database can stop iteration early.
+func TestBucket_ForEach_ShortCircuit(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"bar", "baz", "foo"} {
+			if err := b.Put([]byte(k), []byte("0000")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var index int
+		errStop := errors.New("marker")
+		if err := b.ForEach(func(k, v []byte) error {
+			index++
+			if bytes.Equal(k, []byte("baz")) {
+				return errStop
+			}
+			return nil
+		}); err != errStop {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if index != 2 {
+			t.Fatalf("unexpected index: %d", index)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that looping over a bucket on a closed transaction returns an error.
+func TestBucket_ForEach_Closed(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := tx.CreateBucket([]byte("widgets"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ForEach(func(k, v []byte) error { return nil }); err != ErrTxClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that Scan only visits keys with the given prefix.
+func TestBucket_Scan(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"a", "user", "user/1", "user/2", "user0", "users", "v"} {
+			if err := b.Put([]byte(k), []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var keys []string
+		if err := b.Scan([]byte("user/"), func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(keys) != "[user/1 user/2]" {
+			t.Fatalf("unexpected keys: %v", keys)
+		}
+
+		keys = nil
+		if err := b.Scan([]byte("zzz"), func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		} else if len(keys) != 0 {
+			t.Fatalf("unexpected keys: %v", keys)
+		}
+
+		var n int
+		if err := b.Scan(nil, func(k, v []byte) error { n++; return nil }); err != nil {
+			t.Fatal(err)
+		} else if n != 7 {
+			t.Fatalf("unexpected count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that Range visits the half-open interval [start, end) across pages.
+func TestBucket_Range(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for _, tt := range []struct {
+			start, end []byte
+			first      string
+			n          int
+		}{
+			{[]byte("0100"), []byte("0200"), "0100", 100},
+			{[]byte("0100"), []byte("01"), "", 0},
+			{[]byte("0995"), nil, "0995", 5},
+			{nil, []byte("0003"), "0000", 3},
+			{nil, nil, "0000", 1000},
+		} {
+			var first string
+			var n int
+			if err := b.Range(tt.start, tt.end, func(k, v []byte) error {
+				if n == 0 {
+					first = string(k)
+				}
+				n++
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if first != tt.first || n != tt.n {
+				t.Fatalf("Range(%q, %q): got %q/%d; exp %q/%d", tt.start, tt.end, first, n, tt.first, tt.n)
+			}
+		}
+
+		errStop := errors.New("marker")
+		if err := b.Range(nil, nil, func(k, v []byte) error { return errStop }); err != errStop {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a bucket can delete an existing key.
+func TestBucket_Delete(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.CreateBucket([]byte("baz")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Delete([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		if v := b.Get([]byte("foo")); v != nil {
+			t.Fatalf("unexpected value: %v", v)
+		}
+
+		// Deleting a missing key is not an error but a bucket key is.
+		if err := b.Delete([]byte("missing")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Delete([]byte("baz")); err != ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		if err := tx.Bucket([]byte("widgets")).Delete([]byte("foo")); err != ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that deleting a large set of keys merges nodes and reclaims pages.
+func TestBucket_Delete_Large(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	put := func() {
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2000; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%05d", i)), make([]byte, 256)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put()
+	hwm := db.meta().pgid
+
+	var rebalanced int
+	if err := db.Update(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 2000; i++ {
+			if i%500 == 0 {
+				continue
+			}
+			if err := b.Delete([]byte(fmt.Sprintf("%05d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tx.OnCommit(func() { rebalanced = tx.stats.Rebalance })
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if rebalanced == 0 {
+		t.Fatal("expected rebalance")
+	}
+
+	// Verify the remaining keys after a reopen.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		var keys []string
+		if err := tx.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(keys) != "[00000 00500 01000 01500]" {
+			t.Fatalf("unexpected keys: %v", keys)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewriting the same data must reuse the freed pages.
+	if n := db.freelist.count(); n < int(hwm)/2 {
+		t.Fatalf("expected freed pages; got %d", n)
+	}
+	put()
+	if db.meta().pgid > hwm+hwm/10 {
+		t.Fatalf("expected freed pages to be reused: high water mark %d -> %d", hwm, db.meta().pgid)
+	}
+}
+
+// Ensure that a bucket can set and retrieve its sequence.
+func TestBucket_Sequence(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		bkt, err := tx.CreateBucket([]byte("0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Retrieve sequence.
+		if v := bkt.Sequence(); v != 0 {
+			t.Fatalf("unexpected sequence: %d", v)
+		}
+
+		// Update sequence.
+		if err := bkt.SetSequence(1000); err != nil {
+			t.Fatal(err)
+		}
+
+		// Read sequence again.
+		if v := bkt.Sequence(); v != 1000 {
+			t.Fatalf("unexpected sequence: %d", v)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify sequence in separate transaction.
+	if err := db.View(func(tx *Tx) error {
+		if v := tx.Bucket([]byte("0")).Sequence(); v != 1000 {
+			t.Fatalf("unexpected sequence: %d", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a bucket can return an autoincrementing sequence.
+func TestBucket_NextSequence(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		widgets, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		woojits, err := tx.CreateBucket([]byte("woojits"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Make sure sequence increments.
+		if seq, err := widgets.NextSequence(); err != nil {
+			t.Fatal(err)
+		} else if seq != 1 {
+			t.Fatalf("unexpected sequence: %d", seq)
+		}
+
+		if seq, err := widgets.NextSequence(); err != nil {
+			t.Fatal(err)
+		} else if seq != 2 {
+			t.Fatalf("unexpected sequence: %d", seq)
+		}
+
+		// Buckets should be separate.
+		if seq, err := woojits.NextSequence(); err != nil {
+			t.Fatal(err)
+		} else if seq != 1 {
+			t.Fatalf("unexpected sequence: %d", seq)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a bucket will persist an autoincrementing sequence even if its
+// the only thing updated on the bucket, for both inline and paged buckets.
+func TestBucket_NextSequence_Persist(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		if _, err := tx.CreateBucket([]byte("inline")); err != nil {
+			t.Fatal(err)
+		}
+		b, err := tx.CreateBucket([]byte("paged"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := db.Update(func(tx *Tx) error {
+			for _, name := range []string{"inline", "paged"} {
+				if _, err := tx.Bucket([]byte(name)).NextSequence(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Update(func(tx *Tx) error {
+		for _, name := range []string{"inline", "paged"} {
+			if seq, err := tx.Bucket([]byte(name)).NextSequence(); err != nil {
+				t.Fatal(err)
+			} else if seq != 4 {
+				t.Fatalf("%s: unexpected sequence: %d", name, seq)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that retrieving the next sequence on a read-only bucket returns an error.
+func TestBucket_NextSequence_ReadOnly(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		_, err := tx.Bucket([]byte("widgets")).NextSequence()
+		if err != ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that bucket stats count the pages, keys and nested buckets of a
+// paged bucket holding an inline bucket.
+func TestBucket_Stats(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 500; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%03d", i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sub, err := b.CreateBucket([]byte("sub"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sub.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if err := sub.Put([]byte("baz"), []byte("bat")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		s := tx.Bucket([]byte("widgets")).Stats()
+		if s.KeyN != 503 {
+			t.Fatalf("unexpected KeyN: %d", s.KeyN)
+		} else if s.BucketN != 2 {
+			t.Fatalf("unexpected BucketN: %d", s.BucketN)
+		} else if s.InlineBucketN != 1 {
+			t.Fatalf("unexpected InlineBucketN: %d", s.InlineBucketN)
+		} else if s.InlineBucketInuse != int(pageHeaderSize+2*leafPageElementSize)+12 {
+			t.Fatalf("unexpected InlineBucketInuse: %d", s.InlineBucketInuse)
+		} else if s.Depth != 2 {
+			t.Fatalf("unexpected Depth: %d", s.Depth)
+		} else if s.BranchPageN != 1 || s.LeafPageN < 2 {
+			t.Fatalf("unexpected page counts: branch=%d leaf=%d", s.BranchPageN, s.LeafPageN)
+		} else if s.LeafAlloc != s.LeafPageN*db.pageSize || s.BranchAlloc != db.pageSize {
+			t.Fatalf("unexpected alloc: branch=%d leaf=%d", s.BranchAlloc, s.LeafAlloc)
+		} else if r := s.FillRatio(); r <= 0 || r > 1 {
+			t.Fatalf("unexpected FillRatio: %f", r)
+		}
+
+		// The inline bucket has no pages of its own.
+		sub := tx.Bucket([]byte("widgets")).Bucket([]byte("sub")).Stats()
+		if sub.KeyN != 2 || sub.Depth != 1 || sub.LeafPageN != 0 || sub.FillRatio() != 0 {
+			t.Fatalf("unexpected inline stats: %+v", sub)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that compacting a sparse bucket packs it and its nested buckets
+// into fewer pages without losing any keys.
+func TestBucket_Compact(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	// Fill a bucket and a nested bucket in random order, then delete
+	// most of the keys so the pages are left sparse.
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		child, err := b.CreateBucket([]byte("sub"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range rand.Perm(4000) {
+			k := []byte(fmt.Sprintf("%05d", i))
+			if err := b.Put(k, make([]byte, 64)); err != nil {
+				t.Fatal(err)
+			}
+			if err := child.Put(k, make([]byte, 64)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 4000; i++ {
+			if i%3 == 0 {
+				continue
+			}
+			k := []byte(fmt.Sprintf("%05d", i))
+			if err := b.Delete(k); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Bucket([]byte("sub")).Delete(k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := func(b *Bucket) (n int) {
+		b.forEachPageNode(func(*page, *node, int) { n++ })
+		return n
+	}
+	var before, beforeSub int
+	if err := db.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		before, beforeSub = pages(b), pages(b.Bucket([]byte("sub")))
+		return b.Compact()
+	}); err != ErrTxNotWritable {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := db.Update(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if err := b.Put([]byte("00001"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		b.FillPercent = 0.7
+		if err := b.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if b.FillPercent != 0.7 {
+			t.Fatalf("unexpected fill percent: %v", b.FillPercent)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if n := pages(b); n*3 > before*2 {
+			t.Fatalf("expected fewer pages: %d -> %d", before, n)
+		}
+		if n := pages(b.Bucket([]byte("sub"))); n*3 > beforeSub*2 {
+			t.Fatalf("expected fewer nested pages: %d -> %d", beforeSub, n)
+		}
+		if v := b.Get([]byte("00001")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		for _, b := range []*Bucket{b, b.Bucket([]byte("sub"))} {
+			var n int
+			if err := b.ForEach(func(k, v []byte) error {
+				n++
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if n < 1334 || n > 1336 {
+				t.Fatalf("unexpected key count: %d", n)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that inline buckets stored at unaligned offsets are opened from an
+// aligned copy in both read-only and writable transactions.
+func TestBucket_Inline_Unaligned(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	// Odd length keys push the following values off 8-byte boundaries.
+	names := []string{"a", "bbb", "ccccc", "ddddddd"}
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			child, err := b.CreateBucket([]byte(name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := child.Put([]byte("foo"), []byte(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for _, name := range names {
+			child := b.Bucket([]byte(name))
+			if child.root != 0 {
+				t.Fatalf("%s: expected inline bucket", name)
+			}
+			if p := uintptr(unsafe.Pointer(child.page)); p&unalignedMask != 0 {
+				t.Fatalf("%s: unaligned inline page: %#x", name, p)
+			}
+			if p := uintptr(unsafe.Pointer(child.bucket)); p&unalignedMask != 0 {
+				t.Fatalf("%s: unaligned bucket header: %#x", name, p)
+			}
+			if v := child.Get([]byte("foo")); string(v) != name {
+				t.Fatalf("%s: unexpected value: %q", name, v)
+			}
+		}
+		return nil
+	}
+	if err := db.View(check); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(check); err != nil {
+		t.Fatal(err)
+	}
+}
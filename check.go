@@ -0,0 +1,269 @@
+package tinydb
+
+import (
+	"bytes"
+	"fmt"
+	"unsafe"
+)
+
+// Check performs several consistency checks on the tree the transaction
+// reads and sends an error on the returned channel for each problem found.
+// The channel is closed once the check completes, so it can be drained with
+// a range loop.
+//
+// Every page reachable from the root bucket, including the pages of nested
+// buckets, must be below the high water mark, referenced once, not on the
+// freelist, match its checksum and be of the type expected at its position.
+// Checksums are verified whatever the database's ChecksumMode. Keys must be in order
+// within each page and fall inside the range their parent branch element
+// covers. Every page below the high water mark must be either reachable,
+// kept by a named snapshot, or on the freelist; that check is skipped when
+// the freelist isn't written to disk and on transactions opened with
+// ViewSnapshot, which have no freelist of their own.
+//
+// Check reads every page, so it is slow for large databases. It should be run
+// from a read-only transaction, or from a writable one before it changes
+// anything, since pages not yet spilled aren't visited.
+func (tx *Tx) Check() <-chan error {
+	ch := make(chan error)
+	go func() {
+		tx.check(ch)
+		close(ch)
+	}()
+	return ch
+}
+
+func (tx *Tx) check(ch chan error) {
+	// Report corruption that stops the check, such as a page checksum
+	// mismatch, rather than crashing the caller.
+	defer func() {
+		if r := recover(); r != nil {
+			ch <- pageError(r)
+		}
+	}()
+
+	c := &checker{tx: tx, ch: ch, reachable: make(map[pgid]pgid)}
+
+	// The meta pages and the freelist pages are always in use.
+	c.reachable[0], c.reachable[1] = 0, 1
+	freed, ok := c.freed()
+	if tx.meta.freelist != pgidNoFreelist && tx.meta.freelist < tx.meta.pgid {
+		p := tx.page(tx.meta.freelist)
+		for i := pgid(0); i <= pgid(p.overflow); i++ {
+			c.reachable[tx.meta.freelist+i] = 0
+		}
+	}
+	c.freedIDs = freed
+
+	c.checkPage(tx.meta.root.root, 0, nil, nil)
+
+	// Ensure all pages below high water mark are either reachable or freed.
+	// Pages below one that couldn't be read aren't known, so they would all
+	// be reported.
+	if !ok || c.partial {
+		return
+	}
+	pinned := tx.snapshotPages(nil)
+	for id := pgid(0); id < tx.meta.pgid; id++ {
+		if _, isReachable := c.reachable[id]; !isReachable && !freed[id] && !pinned[id] {
+			ch <- fmt.Errorf("page %d: unreachable unfreed", id)
+		}
+	}
+}
+
+// checker holds the state of a single Tx.Check run.
+type checker struct {
+	tx        *Tx
+	ch        chan error
+	freedIDs  map[pgid]bool
+	reachable map[pgid]pgid // page id to the id of the page referencing it
+	partial   bool          // a page's children were skipped because it couldn't be read
+}
+
+// freed returns the pages on the freelist of the transaction's meta page,
+// reporting ids above the high water mark and ids freed twice. It returns
+// false if the freelist isn't written to disk.
+func (c *checker) freed() (map[pgid]bool, bool) {
+	tx := c.tx
+	var ids []pgid
+	switch {
+	case tx.writable:
+		ids = make([]pgid, tx.db.freelist.count())
+		tx.db.freelist.copyall(ids)
+	case tx.meta.freelist == pgidNoFreelist:
+		return nil, false
+	case tx.meta.freelist >= tx.meta.pgid:
+		c.ch <- fmt.Errorf("page %d: freelist above high water mark %d", tx.meta.freelist, tx.meta.pgid)
+		return nil, false
+	default:
+		p := tx.page(tx.meta.freelist)
+		if err := tx.verify(p); err != nil {
+			c.ch <- err
+			return nil, false
+		}
+		if err := p.checkType(freelistPageFlag); err != nil {
+			c.ch <- fmt.Errorf("page %d: freelist: %w", tx.meta.freelist, err)
+			return nil, false
+		}
+		f := newFreelist(tx.db.freelistType)
+		f.read(p)
+		ids = f.getFreePageIDs()
+	}
+
+	freed := make(map[pgid]bool)
+	for _, id := range ids {
+		if id >= tx.meta.pgid {
+			c.ch <- fmt.Errorf("page %d: freed above high water mark %d", id, tx.meta.pgid)
+		} else if freed[id] {
+			c.ch <- fmt.Errorf("page %d: already freed", id)
+		}
+		freed[id] = true
+	}
+	return freed, true
+}
+
+// checkPage checks the page with the given id, referenced by parent, and
+// everything below it. Its keys must be in [min, max), where a nil max is
+// unbounded.
+func (c *checker) checkPage(id, parent pgid, min, max []byte) {
+	tx := c.tx
+	if id < 2 || id >= tx.meta.pgid {
+		c.ch <- fmt.Errorf("page %d: out of bounds: %d (referenced by %d)", id, tx.meta.pgid, parent)
+		return
+	}
+	if ref, ok := c.reachable[id]; ok {
+		c.ch <- fmt.Errorf("page %d: multiple references (%d and %d)", id, ref, parent)
+		return
+	}
+
+	p := tx.page(id)
+	if p.id != id {
+		c.ch <- fmt.Errorf("page %d: header has id %d (referenced by %d)", id, p.id, parent)
+		c.partial = true
+		return
+	} else if id+pgid(p.overflow) >= tx.meta.pgid {
+		c.ch <- fmt.Errorf("page %d: %d overflow pages run past high water mark %d", id, p.overflow, tx.meta.pgid)
+		c.partial = true
+		return
+	}
+	for i := pgid(0); i <= pgid(p.overflow); i++ {
+		if c.freedIDs[id+i] {
+			c.ch <- fmt.Errorf("page %d: reachable freed", id+i)
+		}
+		c.reachable[id+i] = parent
+	}
+	if err := tx.verify(p); err != nil {
+		c.ch <- err
+		c.partial = true
+		return
+	}
+	if err := p.checkType(branchPageFlag, leafPageFlag); err != nil {
+		c.ch <- fmt.Errorf("page %d: %w (referenced by %d)", id, err, parent)
+		c.partial = true
+		return
+	}
+
+	c.checkKeys(p, min, max)
+	if (p.flags & branchPageFlag) != 0 {
+		for i := 0; i < int(p.count); i++ {
+			e := p.branchPageElement(uint16(i))
+			var next []byte
+			if i+1 < int(p.count) {
+				next = p.branchPageElement(uint16(i + 1)).key()
+			} else {
+				next = max
+			}
+			c.checkPage(e.pgid, id, e.key(), next)
+		}
+		return
+	}
+	c.checkBuckets(p)
+}
+
+// checkBuckets checks the nested buckets stored on a leaf page.
+func (c *checker) checkBuckets(p *page) {
+	for i := 0; i < int(p.count); i++ {
+		e := p.leafPageElement(uint16(i))
+		if (e.flags & bucketLeafFlag) == 0 {
+			continue
+		}
+		if int(e.vsize) < bucketHeaderSize {
+			c.ch <- fmt.Errorf("page %d: bucket %q: truncated header", p.id, e.key())
+			continue
+		}
+
+		// Copy the bucket value so its header and inline page are aligned.
+		value := cloneBytes(e.value())
+		child := (*bucket)(unsafe.Pointer(&value[0]))
+		if child.root != 0 {
+			c.checkPage(child.root, p.id, nil, nil)
+			continue
+		}
+		inline := (*page)(unsafe.Pointer(&value[bucketHeaderSize]))
+		if err := inline.checkType(leafPageFlag); err != nil {
+			c.ch <- fmt.Errorf("page %d: bucket %q: inline page: %w", p.id, e.key(), err)
+			continue
+		}
+		c.checkKeys(inline, nil, nil)
+		c.checkBuckets(inline)
+	}
+}
+
+// checkKeys ensures the keys of a page are in strictly increasing order and
+// within [min, max).
+func (c *checker) checkKeys(p *page, min, max []byte) {
+	var prev []byte
+	for i := 0; i < int(p.count); i++ {
+		var key []byte
+		if (p.flags & branchPageFlag) != 0 {
+			key = p.branchPageElement(uint16(i)).key()
+		} else {
+			key = p.leafPageElement(uint16(i)).key()
+		}
+		if i > 0 && bytes.Compare(prev, key) >= 0 {
+			c.ch <- fmt.Errorf("page %d: key %d out of order: %x after %x", p.id, i, key, prev)
+		} else if i == 0 && min != nil && bytes.Compare(key, min) < 0 {
+			c.ch <- fmt.Errorf("page %d: key %x below parent key %x", p.id, key, min)
+		}
+		if max != nil && bytes.Compare(key, max) >= 0 {
+			c.ch <- fmt.Errorf("page %d: key %x not below next parent key %x", p.id, key, max)
+		}
+		prev = key
+	}
+}
+
+// ViewMeta executes fn in a managed read-only transaction on the tree
+// recorded by meta page 0 or 1 instead of the current one. The meta page
+// that isn't current holds the tree of the previous commit, which is what
+// Open falls back to if the current one is torn, so checking both with
+// Tx.Check shows whether that fallback is usable.
+//
+// An error is returned without calling fn if the meta page is invalid.
+func (db *Db) ViewMeta(i int, fn func(*Tx) error) error {
+	return db.View(func(tx *Tx) error {
+		var m *meta
+		switch i {
+		case 0:
+			m = db.meta0
+		case 1:
+			m = db.meta1
+		default:
+			return fmt.Errorf("invalid meta page: %d", i)
+		}
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("meta page %d: %w", i, err)
+		}
+
+		// Swap in the tree of the meta page. The transaction keeps its own
+		// id for reader tracking, which also keeps the previous tree's pages
+		// from being reused while it's open.
+		tx.meta.root = m.root
+		tx.meta.freelist = m.freelist
+		tx.meta.pgid = m.pgid
+		tx.root = newBucket(tx)
+		tx.root.bucket = &bucket{}
+		*tx.root.bucket = m.root
+		tx.snapshot = m.txid != db.meta().txid
+		return fn(tx)
+	})
+}
@@ -0,0 +1,191 @@
+package tinydb
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// mustCheck drains tx.Check and returns the errors as strings.
+func mustCheck(tx *Tx) []string {
+	var errs []string
+	for err := range tx.Check() {
+		errs = append(errs, err.Error())
+	}
+	return errs
+}
+
+// Ensure that a consistent database passes the check from both meta pages,
+// including pages kept alive by a named snapshot.
+func TestTx_Check(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	for n := 0; n < 3; n++ {
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 1000; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprint(n))); err != nil {
+					return err
+				}
+			}
+			sub, err := b.CreateBucketIfNotExists([]byte("sub"))
+			if err != nil {
+				return err
+			}
+			return sub.Put([]byte("foo"), []byte("bar"))
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			if err := db.CreateSnapshot([]byte("first")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		if errs := mustCheck(tx); errs != nil {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.ViewMeta(i, func(tx *Tx) error {
+			if errs := mustCheck(tx); errs != nil {
+				t.Fatalf("meta %d: unexpected errors: %v", i, errs)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.ViewSnapshot([]byte("first"), func(tx *Tx) error {
+		if errs := mustCheck(tx); errs != nil {
+			t.Fatalf("snapshot: unexpected errors: %v", errs)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ViewMeta(2, func(tx *Tx) error { return nil }); err == nil {
+		t.Fatal("expected error for invalid meta page")
+	}
+}
+
+// Ensure that the check reports keys out of order, pages referenced twice,
+// pages that are neither reachable nor free and checksum mismatches.
+func TestTx_Check_Corrupt(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Find the file offsets of the second key of the first leaf and of the
+	// second child pointer of the bucket's root branch page.
+	var keyOffset, childOffset int64
+	var root, first, second pgid
+	if err := db.View(func(tx *Tx) error {
+		p := tx.page(tx.Bucket([]byte("widgets")).Root())
+		if p.flags&branchPageFlag == 0 || p.count < 2 {
+			t.Fatalf("expected branch root, got %s page with %d elements", p.typ(), p.count)
+		}
+		root, first, second = p.id, p.branchPageElement(0).pgid, p.branchPageElement(1).pgid
+		childOffset = int64(p.id)*int64(db.pageSize) +
+			int64(uintptr(unsafe.Pointer(p.branchPageElement(1)))-uintptr(unsafe.Pointer(p))) +
+			int64(unsafe.Offsetof(branchPageElement{}.pgid))
+
+		leaf := tx.page(first)
+		keyOffset = int64(leaf.id)*int64(db.pageSize) +
+			int64(uintptr(unsafe.Pointer(&leaf.leafPageElement(1).key()[0]))-uintptr(unsafe.Pointer(leaf)))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("0000"), keyOffset); err != nil {
+		t.Fatal(err)
+	}
+
+	// Clear the checksums of both pages, which are then not verified.
+	buf := make([]byte, unsafe.Sizeof(uint64(0)))
+	for _, id := range []pgid{root, first} {
+		if _, err := f.WriteAt(buf, int64(id)*int64(db.pageSize)+int64(unsafe.Offsetof(page{}.checksum))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf = make([]byte, unsafe.Sizeof(pgid(0)))
+	*(*pgid)(unsafe.Pointer(&buf[0])) = first
+	if _, err := f.WriteAt(buf, childOffset); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		errs := strings.Join(mustCheck(tx), "\n")
+		for _, s := range []string{
+			fmt.Sprintf("page %d: key 1 out of order: 30303030 after 30303030", first),
+			fmt.Sprintf("page %d: multiple references", first),
+			fmt.Sprintf("page %d: unreachable unfreed", second),
+		} {
+			if !strings.Contains(errs, s) {
+				t.Fatalf("missing %q in:\n%s", s, errs)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restore the child pointer and corrupt the second leaf, whose checksum
+	// is still set.
+	f, err = os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*(*pgid)(unsafe.Pointer(&buf[0])) = second
+	if _, err := f.WriteAt(buf, childOffset); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, int64(second)*int64(db.pageSize)+int64(db.pageSize)-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		errs := mustCheck(tx)
+		if len(errs) != 2 || errs[1] != fmt.Sprintf("page checksum mismatch: page %d", second) {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
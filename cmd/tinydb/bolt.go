@@ -0,0 +1,660 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"strings"
+	"unsafe"
+
+	"tinydb"
+)
+
+// convertTxMaxSize bounds the key and value bytes written by one
+// transaction when converting a bbolt file into a tinydb database.
+const convertTxMaxSize = 64 << 20
+
+// convertCommand represents the "convert" command execution.
+type convertCommand struct{ *Main }
+
+func newConvertCommand(m *Main) *convertCommand { return &convertCommand{m} }
+
+// Run executes the command.
+func (cmd *convertCommand) Run(args ...string) (err error) {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	dstPath := fs.String("o", "", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	// Require database paths.
+	srcPath := fs.Arg(0)
+	if srcPath == "" || *dstPath == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(srcPath); os.IsNotExist(err) {
+		return ErrFileNotFound
+	} else if _, err := os.Stat(*dstPath); err == nil {
+		return fmt.Errorf("convert: %s already exists", *dstPath)
+	}
+
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var c *converter
+	if isBoltFile(f) {
+		c, err = convertFromBolt(f, *dstPath)
+	} else {
+		c, err = convertToBolt(f, srcPath, *dstPath)
+	}
+	if err != nil {
+		_ = os.Remove(*dstPath)
+		return err
+	}
+
+	fmt.Fprintf(cmd.Stdout, "Converted %s to %s: %d buckets, %d keys\n", c.from, c.to, c.buckets, c.keys)
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *convertCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb convert -o DST SRC
+
+Convert copies every bucket, key, value and bucket sequence between a bbolt
+data file and a tinydb database. The format of SRC is detected from its
+first meta page: a bbolt file is converted into a new tinydb database at
+DST, and a tinydb database into a new bbolt file at DST. DST must not exist
+and uses the same page size as SRC.
+
+Both formats lay out buckets as the same B+tree of branch and leaf pages,
+but tinydb pages have a checksum in their header and its meta pages have no
+magic number, so pages can't be copied as they are. Instead the tree of SRC
+is walked in key order and DST is written packed, with no free pages.
+
+Named snapshots of a tinydb database are not converted. bbolt files are
+read as written by bbolt 1.3 and later, on a machine of the same byte
+order.
+`, "\n")
+}
+
+// converter records what a conversion copied.
+type converter struct {
+	from, to string
+	buckets  int
+	keys     int
+}
+
+// The types below mirror the on-disk layout of bbolt. Leaf and branch page
+// elements and bucket headers are the same as tinydb's, but the page header
+// has no checksum and the meta page starts with a magic number.
+
+const (
+	boltMagic   uint32 = 0xED0CDAED
+	boltVersion uint32 = 2
+)
+
+type boltPage struct {
+	id       pgid
+	flags    uint16
+	count    uint16
+	overflow uint32
+}
+
+func (p *boltPage) meta() *boltMeta {
+	return (*boltMeta)(unsafe.Pointer(uintptr(unsafe.Pointer(p)) + unsafe.Sizeof(*p)))
+}
+
+func (p *boltPage) leafPageElement(index uint16) *leafPageElement {
+	off := unsafe.Sizeof(*p) + uintptr(index)*unsafe.Sizeof(leafPageElement{})
+	return (*leafPageElement)(unsafe.Pointer(uintptr(unsafe.Pointer(p)) + off))
+}
+
+func (p *boltPage) branchPageElement(index uint16) *branchPageElement {
+	off := unsafe.Sizeof(*p) + uintptr(index)*unsafe.Sizeof(branchPageElement{})
+	return (*branchPageElement)(unsafe.Pointer(uintptr(unsafe.Pointer(p)) + off))
+}
+
+type boltMeta struct {
+	magic    uint32
+	version  uint32
+	pageSize uint32
+	flags    uint32
+	root     bucket
+	freelist pgid
+	pgid     pgid
+	txid     uint64
+	checksum uint64
+}
+
+// validate checks the magic number, version and checksum of the meta page.
+func (m *boltMeta) validate() error {
+	if m.magic != boltMagic {
+		return tinydb.ErrInvalid
+	} else if m.version != boltVersion {
+		return tinydb.ErrVersionMismatch
+	} else if m.checksum != m.sum64() {
+		return tinydb.ErrChecksum
+	}
+	return nil
+}
+
+// sum64 returns the checksum of the meta fields before the checksum.
+func (m *boltMeta) sum64() uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write((*[unsafe.Offsetof(boltMeta{}.checksum)]byte)(unsafe.Pointer(m))[:])
+	return h.Sum64()
+}
+
+// isBoltFile returns true if the file starts with a bbolt meta page.
+func isBoltFile(f *os.File) bool {
+	buf := make([]byte, unsafe.Sizeof(boltPage{})+unsafe.Sizeof(boltMeta{}))
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return false
+	}
+	return (*boltPage)(unsafe.Pointer(&buf[0])).meta().magic == boltMagic
+}
+
+// boltReader walks the buckets of a bbolt file.
+type boltReader struct {
+	f        *os.File
+	pageSize int
+	meta     *boltMeta
+	visited  map[pgid]bool
+}
+
+// newBoltReader reads the meta pages of a bbolt file and uses the valid one
+// with the highest transaction id.
+func newBoltReader(f *os.File) (*boltReader, error) {
+	// Meta page 0 is at the start of the file whatever the page size.
+	buf := make([]byte, 0x1000)
+	if _, err := f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	var pageSize int
+	if m := (*boltPage)(unsafe.Pointer(&buf[0])).meta(); m.validate() == nil {
+		pageSize = int(m.pageSize)
+	}
+
+	// If meta 0 is torn, look for meta 1 at each possible page size.
+	if pageSize == 0 {
+		for sz := 1024; sz <= 64*1024; sz *= 2 {
+			buf := make([]byte, sz)
+			if _, err := f.ReadAt(buf, int64(sz)); err != nil {
+				break
+			}
+			p := (*boltPage)(unsafe.Pointer(&buf[0]))
+			if m := p.meta(); p.flags == metaPageFlag && m.validate() == nil && int(m.pageSize) == sz {
+				pageSize = sz
+				break
+			}
+		}
+	}
+	if pageSize == 0 {
+		return nil, ErrInvalidMeta
+	}
+
+	r := &boltReader{f: f, pageSize: pageSize, visited: make(map[pgid]bool)}
+	for id := 0; id < 2; id++ {
+		buf := make([]byte, pageSize)
+		if _, err := f.ReadAt(buf, int64(id*pageSize)); err != nil {
+			continue
+		}
+		if m := (*boltPage)(unsafe.Pointer(&buf[0])).meta(); m.validate() == nil && (r.meta == nil || m.txid > r.meta.txid) {
+			r.meta = m
+		}
+	}
+	if r.meta == nil {
+		return nil, ErrInvalidMeta
+	}
+	return r, nil
+}
+
+// readPage reads a page and its overflow pages. Pages are read into their
+// own buffers, so keys and values sliced from them stay valid.
+func (r *boltReader) readPage(id pgid) ([]byte, error) {
+	if id < 2 || id >= r.meta.pgid {
+		return nil, fmt.Errorf("bbolt page %d: %w", id, ErrPageNotFound)
+	} else if r.visited[id] {
+		return nil, fmt.Errorf("bbolt page %d: multiple references", id)
+	}
+	r.visited[id] = true
+
+	buf := make([]byte, r.pageSize)
+	if _, err := r.f.ReadAt(buf, int64(id)*int64(r.pageSize)); err != nil {
+		return nil, err
+	}
+	p := (*boltPage)(unsafe.Pointer(&buf[0]))
+	if p.id != id {
+		return nil, fmt.Errorf("bbolt page %d: %w: header has id %d", id, errStaleHeader, p.id)
+	} else if p.overflow == 0 {
+		return buf, nil
+	} else if id+pgid(p.overflow) >= r.meta.pgid {
+		return nil, fmt.Errorf("bbolt page %d: %w: %d overflow pages run past the high water mark", id, errStaleHeader, p.overflow)
+	}
+
+	buf = make([]byte, (int(p.overflow)+1)*r.pageSize)
+	if _, err := r.f.ReadAt(buf, int64(id)*int64(r.pageSize)); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// forEach calls fn for each element of the bucket with the given root page,
+// in key order. If root is 0, the elements are read from the inline page.
+func (r *boltReader) forEach(root pgid, inline []byte, fn func(k, v []byte, flags uint32) error) error {
+	if root == 0 {
+		// Inline pages follow the bucket header in a value and may be
+		// unaligned, so copy them first.
+		buf := make([]byte, len(inline))
+		copy(buf, inline)
+		return r.forEachLeaf(buf, fn)
+	}
+
+	buf, err := r.readPage(root)
+	if err != nil {
+		return err
+	}
+	p := (*boltPage)(unsafe.Pointer(&buf[0]))
+	switch p.flags {
+	case leafPageFlag:
+		return r.forEachLeaf(buf, fn)
+	case branchPageFlag:
+		if err := r.checkCount(buf, unsafe.Sizeof(branchPageElement{})); err != nil {
+			return err
+		}
+		for i := 0; i < int(p.count); i++ {
+			if err := r.forEach(p.branchPageElement(uint16(i)).pgid, nil, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("bbolt page %d: invalid page type: %02x", root, p.flags)
+}
+
+// forEachLeaf calls fn for each element of the leaf page read into buf.
+func (r *boltReader) forEachLeaf(buf []byte, fn func(k, v []byte, flags uint32) error) error {
+	if len(buf) < int(unsafe.Sizeof(boltPage{})) {
+		return fmt.Errorf("bbolt inline page: %d bytes", len(buf))
+	}
+	p := (*boltPage)(unsafe.Pointer(&buf[0]))
+	if p.flags != leafPageFlag {
+		return fmt.Errorf("bbolt page %d: invalid page type: %02x", p.id, p.flags)
+	} else if err := r.checkCount(buf, unsafe.Sizeof(leafPageElement{})); err != nil {
+		return err
+	}
+	for i := 0; i < int(p.count); i++ {
+		e := p.leafPageElement(uint16(i))
+		k, v := e.key(buf), e.value(buf)
+		if k == nil || v == nil {
+			return fmt.Errorf("bbolt page %d: element %d out of bounds", p.id, i)
+		}
+		if err := fn(k, v, e.flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCount returns an error if the element headers of the page read into
+// buf don't fit in it.
+func (r *boltReader) checkCount(buf []byte, elementSize uintptr) error {
+	p := (*boltPage)(unsafe.Pointer(&buf[0]))
+	if unsafe.Sizeof(*p)+uintptr(p.count)*elementSize > uintptr(len(buf)) {
+		return fmt.Errorf("bbolt page %d: %d elements out of bounds", p.id, p.count)
+	}
+	return nil
+}
+
+// convertFromBolt copies the buckets of the bbolt file f into a new tinydb
+// database at path.
+func convertFromBolt(f *os.File, path string) (_ *converter, err error) {
+	r, err := newBoltReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := tinydb.Open(path, &tinydb.Options{PageSize: r.pageSize, NoSync: true})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	c := &boltImporter{converter: converter{from: "bbolt", to: "tinydb"}, r: r, db: db, tx: tx}
+	defer func() { _ = c.tx.Rollback() }()
+
+	if err := c.copy(r.meta.root.root, nil, nil); err != nil {
+		return nil, err
+	}
+
+	// Only the last commit syncs, which also flushes the earlier ones.
+	db.NoSync = false
+	if err := c.tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &c.converter, nil
+}
+
+// boltImporter copies the buckets of a bbolt file into a tinydb database,
+// committing whenever a transaction has copied convertTxMaxSize bytes.
+type boltImporter struct {
+	converter
+	r    *boltReader
+	db   *tinydb.Db
+	tx   *tinydb.Tx
+	size int
+}
+
+// copy copies the bucket with the given root page or inline page into the
+// destination bucket at path, which must already exist. A nil path is the
+// root bucket.
+func (c *boltImporter) copy(root pgid, inline []byte, path [][]byte) error {
+	return c.r.forEach(root, inline, func(k, v []byte, flags uint32) error {
+		if err := c.reserve(len(k) + len(v)); err != nil {
+			return err
+		}
+
+		if (flags & bucketLeafFlag) == 0 {
+			if path == nil {
+				return fmt.Errorf("key %q: not a bucket", k)
+			} else if err := c.bucket(path).Put(k, v); err != nil {
+				return fmt.Errorf("key %q: %s", k, err)
+			}
+			c.keys++
+			return nil
+		}
+
+		// Copy the bucket header to read it aligned.
+		if len(v) < int(unsafe.Sizeof(bucket{})) {
+			return fmt.Errorf("bucket %q: invalid header", k)
+		}
+		var hdr bucket
+		copy((*[unsafe.Sizeof(bucket{})]byte)(unsafe.Pointer(&hdr))[:], v)
+
+		var b *tinydb.Bucket
+		var err error
+		if path == nil {
+			b, err = c.tx.CreateBucket(k)
+		} else {
+			b, err = c.bucket(path).CreateBucket(k)
+		}
+		if err != nil {
+			return fmt.Errorf("bucket %q: %s", k, err)
+		} else if err := b.SetSequence(hdr.sequence); err != nil {
+			return fmt.Errorf("bucket %q: %s", k, err)
+		}
+		c.buckets++
+		return c.copy(hdr.root, v[unsafe.Sizeof(bucket{}):], append(path[:len(path):len(path)], k))
+	})
+}
+
+// reserve accounts for n bytes about to be copied, first committing and
+// starting a new transaction if they would go over convertTxMaxSize.
+func (c *boltImporter) reserve(n int) error {
+	if c.size > 0 && c.size+n > convertTxMaxSize {
+		if err := c.tx.Commit(); err != nil {
+			return err
+		}
+		tx, err := c.db.Begin(true)
+		if err != nil {
+			return err
+		}
+		c.tx, c.size = tx, 0
+	}
+	c.size += n
+	return nil
+}
+
+// bucket returns the destination bucket at path in the current transaction.
+func (c *boltImporter) bucket(path [][]byte) *tinydb.Bucket {
+	b := c.tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		b = b.Bucket(name)
+	}
+	return b
+}
+
+// convertToBolt writes the buckets of the tinydb database at srcPath, opened
+// as src, into a new bbolt file at path.
+func convertToBolt(src *os.File, srcPath, path string) (_ *converter, err error) {
+	pageSize, _, err := readMeta(src)
+	if err != nil {
+		return nil, err
+	}
+	db, err := tinydb.Open(srcPath, &tinydb.Options{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	// Pages 0 and 1 are the meta pages and page 2 the empty freelist.
+	w := &boltWriter{converter: converter{from: "tinydb", to: "bbolt"}, f: f, pageSize: pageSize, next: 3}
+	var root pgid
+	if err := db.View(func(tx *tinydb.Tx) error {
+		root, err = w.writeTree(func(fn func(k, v []byte, b *tinydb.Bucket) error) error {
+			return tx.ForEach(func(name []byte, b *tinydb.Bucket) error {
+				return fn(name, nil, b)
+			})
+		})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if err := w.writeMeta(root); err != nil {
+		return nil, err
+	}
+	return &w.converter, f.Sync()
+}
+
+// boltWriter writes buckets as packed bbolt pages, allocating page ids in
+// the order pages are written.
+type boltWriter struct {
+	converter
+	f        *os.File
+	pageSize int
+	next     pgid
+}
+
+// boltElement is a key with either a value or the header of a nested bucket
+// for a leaf page, or with a child page for a branch page.
+type boltElement struct {
+	key   []byte
+	value []byte
+	flags uint32
+	pgid  pgid
+}
+
+// writeTree writes the elements listed by each into leaf pages, and branch
+// pages above them, and returns the root page. each calls fn for every key
+// in order, with a nil value and the bucket for nested buckets.
+func (w *boltWriter) writeTree(each func(fn func(k, v []byte, b *tinydb.Bucket) error) error) (pgid, error) {
+	// Fill leaf pages in order, recording the first key and id of each.
+	var leaves, pending []boltElement
+	size := int(unsafe.Sizeof(boltPage{}))
+	err := each(func(k, v []byte, b *tinydb.Bucket) error {
+		e := boltElement{key: append([]byte(nil), k...), value: append([]byte(nil), v...)}
+		if b != nil {
+			root, err := w.writeTree(func(fn func(k, v []byte, b *tinydb.Bucket) error) error {
+				return b.ForEach(func(k, v []byte) error {
+					var child *tinydb.Bucket
+					if v == nil {
+						child = b.Bucket(k)
+					}
+					return fn(k, v, child)
+				})
+			})
+			if err != nil {
+				return err
+			}
+			hdr := bucket{root: root, sequence: b.Sequence()}
+			e.value = append([]byte(nil), (*[unsafe.Sizeof(bucket{})]byte)(unsafe.Pointer(&hdr))[:]...)
+			e.flags = bucketLeafFlag
+			w.buckets++
+		} else {
+			w.keys++
+		}
+
+		n := int(unsafe.Sizeof(leafPageElement{})) + len(e.key) + len(e.value)
+		if len(pending) > 0 && size+n > w.pageSize {
+			if err := w.writeLeaf(pending, &leaves); err != nil {
+				return err
+			}
+			pending, size = nil, int(unsafe.Sizeof(boltPage{}))
+		}
+		pending = append(pending, e)
+		size += n
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// An empty bucket is an empty leaf page.
+	if len(pending) > 0 || len(leaves) == 0 {
+		if err := w.writeLeaf(pending, &leaves); err != nil {
+			return 0, err
+		}
+	}
+
+	// Add levels of branch pages until a single page is left.
+	for level := leaves; ; {
+		if len(level) == 1 {
+			return level[0].pgid, nil
+		}
+		var next, pending []boltElement
+		size := int(unsafe.Sizeof(boltPage{}))
+		for _, e := range level {
+			n := int(unsafe.Sizeof(branchPageElement{})) + len(e.key)
+			if len(pending) > 0 && size+n > w.pageSize {
+				id, err := w.writePage(pending, branchPageFlag, unsafe.Sizeof(branchPageElement{}))
+				if err != nil {
+					return 0, err
+				}
+				next = append(next, boltElement{key: pending[0].key, pgid: id})
+				pending, size = nil, int(unsafe.Sizeof(boltPage{}))
+			}
+			pending = append(pending, e)
+			size += n
+		}
+		id, err := w.writePage(pending, branchPageFlag, unsafe.Sizeof(branchPageElement{}))
+		if err != nil {
+			return 0, err
+		}
+		level = append(next, boltElement{key: pending[0].key, pgid: id})
+	}
+}
+
+// writeLeaf writes elems as a leaf page and records its first key and id in
+// leaves.
+func (w *boltWriter) writeLeaf(elems []boltElement, leaves *[]boltElement) error {
+	id, err := w.writePage(elems, leafPageFlag, unsafe.Sizeof(leafPageElement{}))
+	if err != nil {
+		return err
+	}
+	var key []byte
+	if len(elems) > 0 {
+		key = elems[0].key
+	}
+	*leaves = append(*leaves, boltElement{key: key, pgid: id})
+	return nil
+}
+
+// writePage writes elems as a leaf or branch page, with overflow pages if
+// they don't fit in one page, and returns its id.
+func (w *boltWriter) writePage(elems []boltElement, flags uint16, elementSize uintptr) (pgid, error) {
+	size := int(unsafe.Sizeof(boltPage{})) + len(elems)*int(elementSize)
+	for _, e := range elems {
+		size += len(e.key) + len(e.value)
+	}
+	count := (size + w.pageSize - 1) / w.pageSize
+	if len(elems) > 0xFFFF {
+		return 0, fmt.Errorf("bbolt page: %d elements", len(elems))
+	}
+
+	buf := make([]byte, count*w.pageSize)
+	p := (*boltPage)(unsafe.Pointer(&buf[0]))
+	p.id, p.flags, p.count, p.overflow = w.next, flags, uint16(len(elems)), uint32(count-1)
+
+	// Keys and values are packed after the element headers, each at an
+	// offset from its own element header.
+	off := int(unsafe.Sizeof(*p)) + len(elems)*int(elementSize)
+	for i, e := range elems {
+		elemOff := uintptr(unsafe.Sizeof(*p)) + uintptr(i)*elementSize
+		pos := uint32(uintptr(off) - elemOff)
+		if flags == leafPageFlag {
+			le := p.leafPageElement(uint16(i))
+			le.flags, le.pos, le.ksize, le.vsize = e.flags, pos, uint32(len(e.key)), uint32(len(e.value))
+		} else {
+			be := p.branchPageElement(uint16(i))
+			be.pos, be.ksize, be.pgid = pos, uint32(len(e.key)), e.pgid
+		}
+		off += copy(buf[off:], e.key)
+		off += copy(buf[off:], e.value)
+	}
+
+	id := w.next
+	if _, err := w.f.WriteAt(buf, int64(id)*int64(w.pageSize)); err != nil {
+		return 0, err
+	}
+	w.next += pgid(count)
+	return id, nil
+}
+
+// writeMeta writes the empty freelist page and both meta pages, which point
+// at the root page of the tree.
+func (w *boltWriter) writeMeta(root pgid) error {
+	buf := make([]byte, w.pageSize)
+	p := (*boltPage)(unsafe.Pointer(&buf[0]))
+	p.id, p.flags = 2, freelistPageFlag
+	if _, err := w.f.WriteAt(buf, 2*int64(w.pageSize)); err != nil {
+		return err
+	}
+
+	// A new bbolt file has transaction ids 0 and 1 in its meta pages.
+	for id := 0; id < 2; id++ {
+		buf := make([]byte, w.pageSize)
+		p := (*boltPage)(unsafe.Pointer(&buf[0]))
+		p.id, p.flags = pgid(id), metaPageFlag
+		m := p.meta()
+		m.magic = boltMagic
+		m.version = boltVersion
+		m.pageSize = uint32(w.pageSize)
+		m.root = bucket{root: root}
+		m.freelist = 2
+		m.pgid = w.next
+		m.txid = uint64(id)
+		m.checksum = m.sum64()
+		if _, err := w.f.WriteAt(buf, int64(id)*int64(w.pageSize)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"tinydb"
+	main "tinydb/cmd/tinydb"
+)
+
+// Ensure "convert" writes a tinydb database out as a bbolt file and reads
+// it back without losing buckets, keys, values or sequences.
+func TestConvertCommand_Run(t *testing.T) {
+	path := mustCreate(t)
+	defer os.RemoveAll(path)
+	boltPath := path + ".bolt"
+	defer os.RemoveAll(boltPath)
+	dstPath := path + ".tinydb"
+	defer os.RemoveAll(dstPath)
+
+	// Add an overflow value and a bucket with a sequence.
+	db, err := tinydb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *tinydb.Tx) error {
+		b, err := tx.CreateBucket([]byte("seq"))
+		if err != nil {
+			return err
+		} else if err := b.SetSequence(42); err != nil {
+			return err
+		}
+		return b.Put([]byte("large"), bytes.Repeat([]byte("x"), 10000))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMain()
+	if err := m.Run("convert", "-o", boltPath, path); err != nil {
+		t.Fatal(err)
+	} else if out := m.Stdout.String(); out != "Converted tinydb to bbolt: 3 buckets, 1001 keys\n" {
+		t.Fatalf("unexpected output: %s", out)
+	}
+	buf, err := ioutil.ReadFile(boltPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if magic := binary.LittleEndian.Uint32(buf[16:]); magic != 0xED0CDAED {
+		t.Fatalf("unexpected magic: %x", magic)
+	}
+
+	m = NewMain()
+	if err := m.Run("convert", "-o", dstPath, boltPath); err != nil {
+		t.Fatal(err)
+	} else if out := m.Stdout.String(); out != "Converted bbolt to tinydb: 3 buckets, 1001 keys\n" {
+		t.Fatalf("unexpected output: %s", out)
+	}
+	if err := NewMain().Run("check", dstPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Exports include sequences, which the hash leaves out.
+	want, got := NewMain(), NewMain()
+	if err := want.Run("export", path); err != nil {
+		t.Fatal(err)
+	} else if err := got.Run("export", dstPath); err != nil {
+		t.Fatal(err)
+	} else if want.Stdout.String() != got.Stdout.String() {
+		t.Fatalf("unexpected contents:\n%s", got.Stdout.String())
+	}
+
+	// An existing destination is left alone.
+	if err := NewMain().Run("convert", "-o", dstPath, boltPath); err == nil {
+		t.Fatal("expected error for existing destination")
+	} else if _, err := os.Stat(dstPath); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure "convert" reads a bbolt file laid out independently of the
+// converter, including an inline bucket.
+func TestConvertCommand_FromBolt(t *testing.T) {
+	path := mustCreate(t)
+	defer os.RemoveAll(path)
+	boltPath := path + ".bolt"
+	defer os.RemoveAll(boltPath)
+	dstPath := path + ".tinydb"
+	defer os.RemoveAll(dstPath)
+
+	const pageSize = 4096
+	le := binary.LittleEndian
+	buf := make([]byte, 4*pageSize)
+
+	// The inline bucket "widgets" holds foo=bar and has sequence 7.
+	inline := make([]byte, 16+16+16+6)
+	le.PutUint64(inline[8:], 7)
+	le.PutUint16(inline[16+8:], 0x02)
+	le.PutUint16(inline[16+10:], 1)
+	le.PutUint32(inline[32+4:], 16)
+	le.PutUint32(inline[32+8:], 3)
+	le.PutUint32(inline[32+12:], 3)
+	copy(inline[48:], "foobar")
+
+	// Page 3 is the root leaf with the bucket.
+	leaf := buf[3*pageSize:]
+	le.PutUint64(leaf[0:], 3)
+	le.PutUint16(leaf[8:], 0x02)
+	le.PutUint16(leaf[10:], 1)
+	le.PutUint32(leaf[16:], 0x01)
+	le.PutUint32(leaf[20:], 16)
+	le.PutUint32(leaf[24:], 7)
+	le.PutUint32(leaf[28:], uint32(len(inline)))
+	copy(leaf[32:], "widgets")
+	copy(leaf[39:], inline)
+
+	// Page 2 is the empty freelist and pages 0 and 1 the meta pages.
+	le.PutUint64(buf[2*pageSize:], 2)
+	le.PutUint16(buf[2*pageSize+8:], 0x10)
+	for id := 0; id < 2; id++ {
+		p := buf[id*pageSize:]
+		le.PutUint64(p[0:], uint64(id))
+		le.PutUint16(p[8:], 0x04)
+		m := p[16:]
+		le.PutUint32(m[0:], 0xED0CDAED)
+		le.PutUint32(m[4:], 2)
+		le.PutUint32(m[8:], pageSize)
+		le.PutUint64(m[16:], 3)
+		le.PutUint64(m[32:], 2)
+		le.PutUint64(m[40:], 4)
+		le.PutUint64(m[48:], uint64(id))
+		h := fnv.New64a()
+		_, _ = h.Write(m[:56])
+		le.PutUint64(m[56:], h.Sum64())
+	}
+	if err := ioutil.WriteFile(boltPath, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewMain().Run("convert", "-o", dstPath, boltPath); err != nil {
+		t.Fatal(err)
+	}
+	mustView(t, dstPath, func(tx *tinydb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if b == nil {
+			t.Fatal("expected bucket")
+		} else if seq := b.Sequence(); seq != 7 {
+			t.Fatalf("unexpected sequence: %d", seq)
+		} else if v := b.Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	})
+
+	// A file whose meta pages are both invalid is refused.
+	buf[16] ^= 0xff
+	buf[pageSize+16] ^= 0xff
+	if err := ioutil.WriteFile(boltPath, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewMain().Run("convert", "-o", dstPath+".2", boltPath); err == nil {
+		t.Fatal("expected error")
+	}
+	buf[16] ^= 0xff
+	le.PutUint64(buf[16+56:], 0)
+	if err := ioutil.WriteFile(boltPath, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewMain().Run("convert", "-o", dstPath+".2", boltPath); err != main.ErrInvalidMeta {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := os.Stat(dstPath + ".2"); !os.IsNotExist(err) {
+		t.Fatal("expected destination to be removed")
+	}
+}
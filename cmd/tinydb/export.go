@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"tinydb"
+)
+
+// exportCommand represents the "export" command execution.
+type exportCommand struct{ *Main }
+
+func newExportCommand(m *Main) *exportCommand { return &exportCommand{m} }
+
+// Run executes the command.
+func (cmd *exportCommand) Run(args ...string) (err error) {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	format := fs.String("format", "json", "")
+	outPath := fs.String("o", "", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	} else if *format != "json" {
+		return ErrUnsupportedFormat
+	}
+
+	// Require database path.
+	path := fs.Arg(0)
+	if path == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+
+	db, err := tinydb.Open(path, &tinydb.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	out := cmd.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		out = f
+	}
+
+	w := &jsonExporter{w: bufio.NewWriter(out)}
+	if err := db.View(func(tx *tinydb.Tx) error {
+		return w.root(tx)
+	}); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// Usage returns the help message.
+func (cmd *exportCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb export [options] PATH
+
+Export writes every bucket, key, value and bucket sequence of the database
+at PATH as a JSON document, which "tinydb import" reads back. Named
+snapshots are not exported.
+
+The document is a bucket object: an optional "sequence" and an "entries"
+array in key order. Each entry has a "key" and either a "value" or a nested
+"bucket" object. Keys and values that are UTF-8 text are written as JSON
+strings; others, including any with control characters other than tabs and
+line breaks, are written base64 encoded under "key64" or "value64".
+Every value is on a line of its own, so two exports can be diffed.
+
+Additional options include:
+
+	-format FORMAT
+		Output format. Only "json" is supported.
+	-o PATH
+		Write to PATH instead of standard output.
+`, "\n")
+}
+
+// jsonExporter writes buckets as the JSON document read by importCommand.
+type jsonExporter struct {
+	w   *bufio.Writer
+	err error
+}
+
+// root writes the top-level buckets of tx as the root bucket object.
+func (e *jsonExporter) root(tx *tinydb.Tx) error {
+	e.entries(0, func(fn func(k, v []byte, b *tinydb.Bucket)) error {
+		return tx.ForEach(func(name []byte, b *tinydb.Bucket) error {
+			fn(name, nil, b)
+			return e.err
+		})
+	})
+	e.write("\n")
+	return e.err
+}
+
+// bucket writes b as a bucket object indented to depth.
+func (e *jsonExporter) bucket(b *tinydb.Bucket, depth int) {
+	e.entries(depth, func(fn func(k, v []byte, b *tinydb.Bucket)) error {
+		if seq := b.Sequence(); seq != 0 {
+			e.write(fmt.Sprintf("%s  \"sequence\": %d,\n", indent(depth), seq))
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var child *tinydb.Bucket
+			if v == nil {
+				child = b.Bucket(k)
+			}
+			fn(k, v, child)
+			return e.err
+		})
+	})
+}
+
+// entries writes a bucket object whose fields are written by each. It calls
+// fn for every entry, with a nil value and the bucket for nested buckets.
+func (e *jsonExporter) entries(depth int, each func(fn func(k, v []byte, b *tinydb.Bucket)) error) {
+	ind := indent(depth)
+	e.write("{\n")
+
+	n := 0
+	err := each(func(k, v []byte, b *tinydb.Bucket) {
+		if n == 0 {
+			e.write(ind + "  \"entries\": [\n")
+		} else {
+			e.write(",\n")
+		}
+		n++
+
+		e.write(ind + "    {" + jsonField("key", k) + ", ")
+		if b != nil {
+			e.write("\"bucket\": ")
+			e.bucket(b, depth+2)
+		} else {
+			e.write(jsonField("value", v))
+		}
+		e.write("}")
+	})
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+
+	if n == 0 {
+		e.write(ind + "  \"entries\": []\n")
+	} else {
+		e.write("\n" + ind + "  ]\n")
+	}
+	e.write(ind + "}")
+}
+
+// write writes s, recording the first error.
+func (e *jsonExporter) write(s string) {
+	if e.err == nil {
+		_, e.err = e.w.WriteString(s)
+	}
+}
+
+// indent returns the indentation of a bucket object at depth.
+func indent(depth int) string {
+	return strings.Repeat("  ", depth)
+}
+
+// jsonField returns b as a JSON object member named name, or name64 with a
+// base64 string if b isn't text.
+func jsonField(name string, b []byte) string {
+	if !isText(b) {
+		return fmt.Sprintf("%q: %q", name+"64", base64.StdEncoding.EncodeToString(b))
+	}
+
+	// Don't escape HTML characters, which would only make exports harder to read.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(string(b))
+	return fmt.Sprintf("%q: %s", name, bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+// isText returns true if b is valid UTF-8 without control characters other
+// than tabs and line breaks.
+func isText(b []byte) bool {
+	for len(b) > 0 {
+		r, n := utf8.DecodeRune(b)
+		if r == utf8.RuneError && n == 1 {
+			return false
+		} else if unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
+
+// importCommand represents the "import" command execution.
+type importCommand struct{ *Main }
+
+func newImportCommand(m *Main) *importCommand { return &importCommand{m} }
+
+// Run executes the command.
+func (cmd *importCommand) Run(args ...string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	format := fs.String("format", "json", "")
+	inPath := fs.String("i", "", "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	} else if *format != "json" {
+		return ErrUnsupportedFormat
+	}
+
+	// Require database path. It is created if it doesn't exist.
+	path := fs.Arg(0)
+	if path == "" {
+		return ErrPathRequired
+	}
+
+	in := cmd.Stdin
+	if *inPath != "" {
+		f, err := os.Open(*inPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var root jsonBucket
+	dec := json.NewDecoder(in)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&root); err != nil {
+		return fmt.Errorf("import: %s", err)
+	} else if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("import: unexpected data after the root bucket")
+	} else if root.Sequence != 0 {
+		return fmt.Errorf("import: the root bucket has no sequence")
+	}
+
+	db, err := tinydb.Open(path, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var n int
+	if err := db.Update(func(tx *tinydb.Tx) error {
+		for i, e := range root.Entries {
+			name, err := e.key()
+			if err != nil {
+				return fmt.Errorf("import: entry %d: %s", i, err)
+			} else if e.Bucket == nil {
+				return fmt.Errorf("import: entry %d: top-level entries must be buckets", i)
+			}
+			b, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return fmt.Errorf("import: bucket %q: %s", name, err)
+			}
+			if n, err = e.Bucket.load(b, n); err != nil {
+				return fmt.Errorf("import: bucket %q: %s", name, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Stdout, "%d buckets and keys imported\n", n)
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *importCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb import [options] PATH
+
+Import reads a JSON document written by "tinydb export" and writes its
+buckets, keys, values and bucket sequences into the database at PATH, which
+is created if it doesn't exist. Existing buckets are merged into and existing
+keys are overwritten. The whole document is imported in one transaction.
+
+Additional options include:
+
+	-format FORMAT
+		Input format. Only "json" is supported.
+	-i PATH
+		Read from PATH instead of standard input.
+`, "\n")
+}
+
+// jsonBucket is a bucket object of an exported JSON document.
+type jsonBucket struct {
+	Sequence uint64      `json:"sequence"`
+	Entries  []jsonEntry `json:"entries"`
+}
+
+// jsonEntry is a key with either a value or a nested bucket.
+type jsonEntry struct {
+	Key     *string     `json:"key"`
+	Key64   []byte      `json:"key64"`
+	Value   *string     `json:"value"`
+	Value64 []byte      `json:"value64"`
+	Bucket  *jsonBucket `json:"bucket"`
+}
+
+// key returns the key of the entry.
+func (e *jsonEntry) key() ([]byte, error) {
+	if (e.Key == nil) == (e.Key64 == nil) {
+		return nil, fmt.Errorf("exactly one of key and key64 is required")
+	} else if e.Key != nil {
+		return []byte(*e.Key), nil
+	}
+	return e.Key64, nil
+}
+
+// value returns the value of an entry that isn't a bucket.
+func (e *jsonEntry) value() ([]byte, error) {
+	if (e.Value == nil) == (e.Value64 == nil) {
+		return nil, fmt.Errorf("exactly one of value, value64 and bucket is required")
+	} else if e.Value != nil {
+		return []byte(*e.Value), nil
+	}
+	return e.Value64, nil
+}
+
+// load writes the sequence and entries into b and returns n plus the number
+// of buckets and keys written.
+func (j *jsonBucket) load(b *tinydb.Bucket, n int) (int, error) {
+	n++
+	if j.Sequence != 0 {
+		if err := b.SetSequence(j.Sequence); err != nil {
+			return n, err
+		}
+	}
+	for i, e := range j.Entries {
+		k, err := e.key()
+		if err != nil {
+			return n, fmt.Errorf("entry %d: %s", i, err)
+		}
+
+		if e.Bucket != nil {
+			if e.Value != nil || e.Value64 != nil {
+				return n, fmt.Errorf("entry %d: exactly one of value, value64 and bucket is required", i)
+			}
+			child, err := b.CreateBucketIfNotExists(k)
+			if err != nil {
+				return n, fmt.Errorf("bucket %q: %s", k, err)
+			}
+			if n, err = e.Bucket.load(child, n); err != nil {
+				return n, fmt.Errorf("bucket %q: %s", k, err)
+			}
+			continue
+		}
+
+		v, err := e.value()
+		if err != nil {
+			return n, fmt.Errorf("entry %d: %s", i, err)
+		} else if err := b.Put(k, v); err != nil {
+			return n, fmt.Errorf("key %q: %s", k, err)
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,154 @@
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tinydb"
+	main "tinydb/cmd/tinydb"
+)
+
+// Ensure "export" and "import" round trip every bucket, key and value.
+func TestExportCommand_Run(t *testing.T) {
+	path := mustCreate(t)
+	defer os.RemoveAll(path)
+	dstPath := path + ".imported"
+	defer os.RemoveAll(dstPath)
+
+	m := NewMain()
+	if err := m.Run("export", path); err != nil {
+		t.Fatal(err)
+	}
+	out := m.Stdout.String()
+	if !strings.Contains(out, `{"key64": "AP8=", "value": "bar"}`) {
+		t.Fatalf("expected base64 key in:\n%s", out)
+	}
+
+	m2 := NewMain()
+	m2.Stdin.WriteString(out)
+	if err := m2.Run("import", dstPath); err != nil {
+		t.Fatal(err)
+	} else if s := m2.Stdout.String(); s != "1002 buckets and keys imported\n" {
+		t.Fatalf("unexpected output: %s", s)
+	}
+
+	var want []byte
+	mustView(t, path, func(tx *tinydb.Tx) (err error) {
+		want, err = tx.Hash()
+		return err
+	})
+	mustView(t, dstPath, func(tx *tinydb.Tx) error {
+		if got, err := tx.Hash(); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, want) {
+			t.Fatalf("hash mismatch: %x != %x", got, want)
+		}
+		return nil
+	})
+
+	// Exporting the imported database writes the same document.
+	m3 := NewMain()
+	if err := m3.Run("export", dstPath); err != nil {
+		t.Fatal(err)
+	} else if s := m3.Stdout.String(); s != out {
+		t.Fatalf("unexpected export:\n%s", s)
+	}
+}
+
+// Ensure "import" restores sequences and binary values, and "export" writes
+// them back out unchanged.
+func TestImportCommand_Run(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinydb-cmd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db")
+
+	doc := `{
+  "entries": [
+    {"key": "a<b>", "bucket": {
+      "sequence": 42,
+      "entries": [
+        {"key": "empty", "bucket": {
+          "entries": []
+        }},
+        {"key": "k", "value": "v\n"},
+        {"key64": "/w==", "value64": "AAE="}
+      ]
+    }},
+    {"key": "z", "bucket": {
+      "entries": []
+    }}
+  ]
+}
+`
+	m := NewMain()
+	m.Stdin.WriteString(doc)
+	if err := m.Run("import", path); err != nil {
+		t.Fatal(err)
+	}
+	mustView(t, path, func(tx *tinydb.Tx) error {
+		b := tx.Bucket([]byte("a<b>"))
+		if seq := b.Sequence(); seq != 42 {
+			t.Fatalf("unexpected sequence: %d", seq)
+		} else if v := b.Get([]byte{0xff}); !bytes.Equal(v, []byte{0x00, 0x01}) {
+			t.Fatalf("unexpected value: %x", v)
+		}
+		return nil
+	})
+
+	m = NewMain()
+	if err := m.Run("export", path); err != nil {
+		t.Fatal(err)
+	} else if s := m.Stdout.String(); s != doc {
+		t.Fatalf("unexpected export:\n%s", s)
+	}
+}
+
+// Ensure "import" rejects malformed documents without writing anything.
+func TestImportCommand_Errors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinydb-cmd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db")
+
+	for _, doc := range []string{
+		`{"entries": [{"key": "a", "value": "b"}]}`,
+		`{"entries": [{"value": "b", "bucket": {}}]}`,
+		`{"entries": [{"key": "a", "key64": "YQ==", "bucket": {}}]}`,
+		`{"entries": [{"key": "a", "bucket": {"entries": [{"key": "b"}]}}]}`,
+		`{"entries": [{"key": "a", "bucket": {"entries": [{"key": "b", "value": "c", "bucket": {}}]}}]}`,
+		`{"entries": [{"key": "a", "bucket": {}, "foo": 1}]}`,
+		`{"sequence": 1}`,
+		`{} {}`,
+	} {
+		m := NewMain()
+		m.Stdin.WriteString(doc)
+		if err := m.Run("import", path); err == nil {
+			t.Fatalf("expected error for %s", doc)
+		}
+	}
+	if _, err := os.Stat(path); err == nil {
+		mustView(t, path, func(tx *tinydb.Tx) error {
+			if b := tx.Bucket([]byte("a")); b != nil {
+				t.Fatal("unexpected bucket")
+			}
+			return nil
+		})
+	}
+
+	if err := NewMain().Run("export", "-format", "csv", path); err != main.ErrUnsupportedFormat {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := NewMain().Run("import", "-format", "csv", path); err != main.ErrUnsupportedFormat {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := NewMain().Run("export"); err != main.ErrPathRequired {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
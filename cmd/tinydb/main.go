@@ -0,0 +1,1578 @@
+// Command tinydb inspects tinydb database files.
+//
+// It decodes meta pages, page headers and element arrays straight from the
+// file so that spill and split problems can be examined without writing a
+// throwaway program.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
+
+	"tinydb"
+)
+
+var (
+	// ErrUsage is returned when a usage message was printed and the process
+	// should simply exit with an error.
+	ErrUsage = errors.New("usage")
+
+	// ErrUnknownCommand is returned when a CLI command is not specified.
+	ErrUnknownCommand = errors.New("unknown command")
+
+	// ErrPathRequired is returned when the path to a tinydb database is not specified.
+	ErrPathRequired = errors.New("path required")
+
+	// ErrFileNotFound is returned when a tinydb database does not exist.
+	ErrFileNotFound = errors.New("file not found")
+
+	// ErrInvalidMeta is returned when neither meta page of a file is valid.
+	ErrInvalidMeta = errors.New("invalid meta pages")
+
+	// ErrPageIDRequired is returned when a required page id is not specified.
+	ErrPageIDRequired = errors.New("page id required")
+
+	// ErrPageNotFound is returned when specifying a page above the high water mark.
+	ErrPageNotFound = errors.New("page not found")
+
+	// ErrCorrupt is returned when a consistency check finds problems.
+	ErrCorrupt = errors.New("corrupt database")
+
+	// ErrUnsupportedFormat is returned when an export or import format is not supported.
+	ErrUnsupportedFormat = errors.New("unsupported format")
+)
+
+func main() {
+	m := NewMain()
+	if err := m.Run(os.Args[1:]...); err == ErrUsage {
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(m.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+// Main represents the main program execution.
+type Main struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// NewMain returns a new instance of Main connect to the standard input/output.
+func NewMain() *Main {
+	return &Main{
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+}
+
+// Run executes the program.
+func (m *Main) Run(args ...string) error {
+	// Require a command at the beginning.
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintln(m.Stderr, m.Usage())
+		return ErrUsage
+	}
+
+	// Pages are read and written in place, so refuse to run with a stale
+	// copy of the layout.
+	if err := checkLayout(); err != nil {
+		return err
+	}
+
+	// Execute command.
+	switch args[0] {
+	case "help":
+		fmt.Fprintln(m.Stderr, m.Usage())
+		return ErrUsage
+	case "bench":
+		return newBenchCommand(m).Run(args[1:]...)
+	case "check":
+		return newCheckCommand(m).Run(args[1:]...)
+	case "compact":
+		return newCompactCommand(m).Run(args[1:]...)
+	case "convert":
+		return newConvertCommand(m).Run(args[1:]...)
+	case "dump":
+		return newDumpCommand(m).Run(args[1:]...)
+	case "export":
+		return newExportCommand(m).Run(args[1:]...)
+	case "import":
+		return newImportCommand(m).Run(args[1:]...)
+	case "info":
+		return newInfoCommand(m).Run(args[1:]...)
+	case "page":
+		return newPageCommand(m).Run(args[1:]...)
+	case "pages":
+		return newPagesCommand(m).Run(args[1:]...)
+	case "salvage":
+		return newSalvageCommand(m).Run(args[1:]...)
+	case "stats":
+		return newStatsCommand(m).Run(args[1:]...)
+	case "surgery":
+		return newSurgeryCommand(m).Run(args[1:]...)
+	default:
+		return ErrUnknownCommand
+	}
+}
+
+// Usage returns the help message.
+func (m *Main) Usage() string {
+	return strings.TrimLeft(`
+Tinydb is a tool for inspecting tinydb databases.
+
+Usage:
+
+	tinydb command [arguments]
+
+The commands are:
+
+	help        print this screen
+	bench       run synthetic read and write benchmarks
+	check       verifies integrity of both meta pages of a database
+	compact     copies a database into a new, compacted file
+	convert     converts between bbolt and tinydb database files
+	dump        print an annotated hexdump of a page
+	export      write all buckets and keys as JSON
+	import      read buckets and keys from JSON written by export
+	info        print basic info
+	page        print one or more pages in human readable format
+	pages       print list of pages with their types
+	salvage     copy every readable key from the leaf pages of a damaged file
+	stats       iterate over all pages and generate usage stats
+	surgery     perform page-level repairs on a copy of a database
+
+Use "tinydb [command] -h" for more information about a command.
+`, "\n")
+}
+
+// parseArgs parses the flags of a command and returns the database path
+// and the remaining arguments. The path must exist.
+func parseArgs(m *Main, name string, usage func() string, args []string) (string, []string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(m.Stderr)
+	help := fs.Bool("h", false, "")
+	if err := fs.Parse(args); err != nil {
+		return "", nil, err
+	} else if *help {
+		fmt.Fprintln(m.Stderr, usage())
+		return "", nil, ErrUsage
+	}
+
+	// Require database path.
+	path := fs.Arg(0)
+	if path == "" {
+		return "", nil, ErrPathRequired
+	} else if _, err := os.Stat(path); os.IsNotExist(err) {
+		return "", nil, ErrFileNotFound
+	}
+	return path, fs.Args()[1:], nil
+}
+
+// infoCommand represents the "info" command execution.
+type infoCommand struct{ *Main }
+
+func newInfoCommand(m *Main) *infoCommand { return &infoCommand{m} }
+
+// Run executes the command.
+func (cmd *infoCommand) Run(args ...string) error {
+	path, _, err := parseArgs(cmd.Main, "info", cmd.Usage, args)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pageSize, m, err := readMeta(f)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Stdout, "Page Size: %d\n", pageSize)
+	fmt.Fprintf(cmd.Stdout, "File Size: %d (%d pages)\n", fi.Size(), tinydb.PageCount(fi.Size(), pageSize))
+	printMeta(cmd.Stdout, m)
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *infoCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb info PATH
+
+Info prints the page size and file size of the database and the fields of
+its current meta page.
+`, "\n")
+}
+
+// pagesCommand represents the "pages" command execution.
+type pagesCommand struct{ *Main }
+
+func newPagesCommand(m *Main) *pagesCommand { return &pagesCommand{m} }
+
+// Run executes the command.
+func (cmd *pagesCommand) Run(args ...string) error {
+	path, _, err := parseArgs(cmd.Main, "pages", cmd.Usage, args)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pageSize, m, err := readMeta(f)
+	if err != nil {
+		return err
+	}
+
+	// Pages on the freelist keep the header they were last written with,
+	// so list them as free instead of decoding a stale type.
+	free := make(map[pgid]bool)
+	if m.freelist != pgidNoFreelist {
+		p, buf, err := readPage(f, pageSize, m, m.freelist)
+		if err != nil {
+			return err
+		}
+		for _, id := range p.freelistPageIDs(buf) {
+			free[id] = true
+		}
+	}
+
+	w := tabwriter.NewWriter(cmd.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tITEMS\tOVRFLW\t")
+	fmt.Fprintln(w, "========\t==========\t======\t======\t")
+	for id := pgid(0); id < m.pgid; id++ {
+		if free[id] {
+			fmt.Fprintf(w, "%d\tfree\t\t\t\n", id)
+			continue
+		}
+
+		p, _, err := readPage(f, pageSize, m, id)
+		if errors.Is(err, errStaleHeader) {
+			// Freed pages aren't listed when the freelist isn't synced.
+			fmt.Fprintf(w, "%d\tunknown\t\t\t\n", id)
+			continue
+		} else if err != nil {
+			return err
+		}
+		var overflow string
+		if p.overflow > 0 {
+			overflow = strconv.Itoa(int(p.overflow))
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t\n", id, p.typ(), p.count, overflow)
+		id += pgid(p.overflow)
+	}
+	return w.Flush()
+}
+
+// Usage returns the help message.
+func (cmd *pagesCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb pages PATH
+
+Pages prints a table of every page in the database up to the high water
+mark with its type, element count and number of overflow pages. Pages on
+the freelist are listed as free. Overflow pages are not listed separately.
+`, "\n")
+}
+
+// pageCommand represents the "page" command execution.
+type pageCommand struct{ *Main }
+
+func newPageCommand(m *Main) *pageCommand { return &pageCommand{m} }
+
+// Run executes the command.
+func (cmd *pageCommand) Run(args ...string) error {
+	path, args, err := parseArgs(cmd.Main, "page", cmd.Usage, args)
+	if err != nil {
+		return err
+	}
+
+	// Read page ids.
+	if len(args) == 0 {
+		return ErrPageIDRequired
+	}
+	ids := make([]pgid, len(args))
+	for i, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return err
+		}
+		ids[i] = pgid(id)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pageSize, m, err := readMeta(f)
+	if err != nil {
+		return err
+	}
+
+	for i, id := range ids {
+		// Print a separator.
+		if i > 0 {
+			fmt.Fprintln(cmd.Stdout, "===============================================")
+		}
+
+		p, buf, err := readPage(f, pageSize, m, id)
+		if err != nil {
+			return err
+		}
+
+		// Print basic page info.
+		fmt.Fprintf(cmd.Stdout, "Page ID:    %d\n", p.id)
+		fmt.Fprintf(cmd.Stdout, "Page Type:  %s\n", p.typ())
+		fmt.Fprintf(cmd.Stdout, "Total Size: %d bytes\n", len(buf))
+		fmt.Fprintf(cmd.Stdout, "Overflow:   %d\n", p.overflow)
+		fmt.Fprintf(cmd.Stdout, "Checksum:   %s\n", p.checksumStatus(buf))
+		fmt.Fprintln(cmd.Stdout)
+
+		// Print type-specific data.
+		switch p.typ() {
+		case "meta":
+			printMeta(cmd.Stdout, p.meta())
+		case "leaf":
+			cmd.printLeaf(p, buf)
+		case "branch":
+			cmd.printBranch(p, buf)
+		case "freelist":
+			cmd.printFreelist(p, buf)
+		default:
+			fmt.Fprintf(cmd.Stdout, "unknown page flags: 0x%02x\n", p.flags)
+		}
+	}
+	return nil
+}
+
+// printLeaf prints the key/value pairs of a leaf page. Bucket values are
+// decoded into their header and, for inline buckets, their element count.
+func (cmd *pageCommand) printLeaf(p *page, buf []byte) {
+	for i := uint16(0); i < p.count; i++ {
+		e := p.leafPageElement(i)
+		k, v := formatBytes(e.key(buf)), formatBytes(e.value(buf))
+		if (e.flags & bucketLeafFlag) != 0 {
+			v = formatBucket(e.value(buf))
+		}
+		fmt.Fprintf(cmd.Stdout, "%s: %s\n", k, v)
+	}
+}
+
+// printBranch prints the keys of a branch page and the child page of each.
+func (cmd *pageCommand) printBranch(p *page, buf []byte) {
+	for i := uint16(0); i < p.count; i++ {
+		e := p.branchPageElement(i)
+		fmt.Fprintf(cmd.Stdout, "%s: <pgid=%d>\n", formatBytes(e.key(buf)), e.pgid)
+	}
+}
+
+// printFreelist prints the page ids held by a freelist page.
+func (cmd *pageCommand) printFreelist(p *page, buf []byte) {
+	for _, id := range p.freelistPageIDs(buf) {
+		fmt.Fprintln(cmd.Stdout, id)
+	}
+}
+
+// Usage returns the help message.
+func (cmd *pageCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb page PATH PAGEID [PAGEID...]
+
+Page prints one or more pages in human readable format: the header of
+each page followed by its meta fields, key/value pairs, branch keys with
+their child pages, or freelist ids depending on its type. Keys and values
+that are not printable are shown in hex.
+`, "\n")
+}
+
+// benchCommand represents the "bench" command execution.
+type benchCommand struct{ *Main }
+
+func newBenchCommand(m *Main) *benchCommand { return &benchCommand{m} }
+
+// benchOptions represents the set of options that can be passed to "tinydb bench".
+type benchOptions struct {
+	Path           string
+	Work           bool
+	Count          int
+	BatchSize      int
+	KeySize        int
+	ValueSize      int
+	WriteMode      string
+	ReadMode       string
+	ReadCount      int
+	MixCount       int
+	ReadPercent    int
+	Seed           int64
+	FillPercent    float64
+	PageSize       int
+	FreelistType   string
+	NoSync         bool
+	NoFreelistSync bool
+	ProfileMode    string
+	CPUProfile     string
+	MemProfile     string
+	BlockProfile   string
+	Stats          bool
+}
+
+// Run executes the "bench" command.
+func (cmd *benchCommand) Run(args ...string) error {
+	options, err := cmd.ParseFlags(args)
+	if err != nil {
+		return err
+	}
+
+	// Remove the database when done, unless asked to keep it.
+	if options.Work {
+		fmt.Fprintf(cmd.Stderr, "work: %s\n", options.Path)
+	} else {
+		defer os.Remove(options.Path)
+	}
+
+	freelistType := tinydb.FreelistArrayType
+	if options.FreelistType == "hashmap" {
+		freelistType = tinydb.FreelistMapType
+	}
+	db, err := tinydb.Open(options.Path, &tinydb.Options{
+		PageSize:       options.PageSize,
+		FreelistType:   freelistType,
+		NoSync:         options.NoSync,
+		NoFreelistSync: options.NoFreelistSync,
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// The same seed produces the same key orders and operation mix.
+	b := &bench{db: db, options: options, rand: rand.New(rand.NewSource(options.Seed))}
+	phases := []struct {
+		name string
+		mode string
+		fn   func() (int, error)
+	}{
+		{"Write", "w", b.write},
+		{"Read", "r", b.read},
+		{"Mixed", "m", b.mix},
+	}
+	if options.MixCount == 0 {
+		phases = phases[:2]
+	}
+
+	// Profile from the start of the first phase in the profile mode to the
+	// end of the last one.
+	first, last := -1, -1
+	for i, phase := range phases {
+		if strings.Contains(options.ProfileMode, phase.mode) {
+			if first == -1 {
+				first = i
+			}
+			last = i
+		}
+	}
+
+	for i, phase := range phases {
+		if i == first {
+			if err := cmd.startProfiling(options); err != nil {
+				return err
+			}
+		}
+
+		prev := db.Stats()
+		t := time.Now()
+		n, err := phase.fn()
+		elapsed := time.Since(t)
+		stats := db.Stats()
+		if i == last || err != nil {
+			if err := cmd.stopProfiling(); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(cmd.Stdout, "# %s\t%v\t(%v/op)\t(%.0f op/sec)\n",
+			phase.name, elapsed, elapsed/time.Duration(n), float64(n)/elapsed.Seconds())
+		if options.Stats {
+			cmd.printStats(stats.Sub(&prev))
+		}
+	}
+	return nil
+}
+
+// ParseFlags parses the command line flags and validates them.
+func (cmd *benchCommand) ParseFlags(args []string) (*benchOptions, error) {
+	var options benchOptions
+
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	fs.StringVar(&options.Path, "path", "", "")
+	fs.BoolVar(&options.Work, "work", false, "")
+	fs.IntVar(&options.Count, "count", 1000, "")
+	fs.IntVar(&options.BatchSize, "batch-size", 0, "")
+	fs.IntVar(&options.KeySize, "key-size", 8, "")
+	fs.IntVar(&options.ValueSize, "value-size", 32, "")
+	fs.StringVar(&options.WriteMode, "write-mode", "seq", "")
+	fs.StringVar(&options.ReadMode, "read-mode", "seq", "")
+	fs.IntVar(&options.ReadCount, "reads", 0, "")
+	fs.IntVar(&options.MixCount, "mix", 0, "")
+	fs.IntVar(&options.ReadPercent, "read-percent", 50, "")
+	fs.Int64Var(&options.Seed, "seed", 1, "")
+	fs.Float64Var(&options.FillPercent, "fill-percent", tinydb.DefaultFillPercent, "")
+	fs.IntVar(&options.PageSize, "page-size", 0, "")
+	fs.StringVar(&options.FreelistType, "freelist", "array", "")
+	fs.BoolVar(&options.NoSync, "no-sync", false, "")
+	fs.BoolVar(&options.NoFreelistSync, "no-freelist-sync", false, "")
+	fs.StringVar(&options.ProfileMode, "profile-mode", "rw", "")
+	fs.StringVar(&options.CPUProfile, "cpuprofile", "", "")
+	fs.StringVar(&options.MemProfile, "memprofile", "", "")
+	fs.StringVar(&options.BlockProfile, "blockprofile", "", "")
+	fs.BoolVar(&options.Stats, "stats", false, "")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return nil, ErrUsage
+	}
+
+	// Validate options and fill in defaults.
+	if options.Count <= 0 {
+		return nil, fmt.Errorf("invalid count: %d", options.Count)
+	} else if options.BatchSize < 0 {
+		return nil, fmt.Errorf("invalid batch size: %d", options.BatchSize)
+	} else if options.KeySize < 4 {
+		return nil, fmt.Errorf("key size must be at least 4 bytes: %d", options.KeySize)
+	} else if options.ValueSize < 0 {
+		return nil, fmt.Errorf("invalid value size: %d", options.ValueSize)
+	} else if options.ReadPercent < 0 || options.ReadPercent > 100 {
+		return nil, fmt.Errorf("invalid read percent: %d", options.ReadPercent)
+	}
+	for _, mode := range []string{options.WriteMode, options.ReadMode} {
+		if mode != "seq" && mode != "rnd" {
+			return nil, fmt.Errorf("invalid key order: %q", mode)
+		}
+	}
+	if options.FreelistType != "array" && options.FreelistType != "hashmap" {
+		return nil, fmt.Errorf("invalid freelist type: %q", options.FreelistType)
+	}
+	if strings.Trim(options.ProfileMode, "rwm") != "" {
+		return nil, fmt.Errorf("invalid profile mode: %q", options.ProfileMode)
+	}
+	if options.BatchSize == 0 {
+		options.BatchSize = options.Count
+	}
+	if options.ReadCount == 0 {
+		options.ReadCount = options.Count
+	}
+
+	// Generate temp path if one is not passed in.
+	if options.Path == "" {
+		f, err := ioutil.TempFile("", "tinydb-bench-")
+		if err != nil {
+			return nil, fmt.Errorf("temp file: %s", err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+		options.Path = f.Name()
+	}
+	return &options, nil
+}
+
+// bench holds the state of a benchmark run across its phases.
+type bench struct {
+	db      *tinydb.Db
+	options *benchOptions
+	rand    *rand.Rand
+}
+
+var benchBucketName = []byte("bench")
+
+// key returns the key with index i, which sorts in index order.
+func (b *bench) key(i int) []byte {
+	k := make([]byte, b.options.KeySize)
+	binary.BigEndian.PutUint32(k, uint32(i))
+	return k
+}
+
+// order returns the key indexes in the given mode's order.
+func (b *bench) order(mode string) []int {
+	if mode == "rnd" {
+		return b.rand.Perm(b.options.Count)
+	}
+	idx := make([]int, b.options.Count)
+	for i := range idx {
+		idx[i] = i
+	}
+	return idx
+}
+
+// write inserts every key in the write mode's order, batch size keys per
+// transaction.
+func (b *bench) write() (int, error) {
+	idx := b.order(b.options.WriteMode)
+	value := make([]byte, b.options.ValueSize)
+	for len(idx) > 0 {
+		n := b.options.BatchSize
+		if n > len(idx) {
+			n = len(idx)
+		}
+		if err := b.db.Update(func(tx *tinydb.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists(benchBucketName)
+			if err != nil {
+				return err
+			}
+			bucket.FillPercent = b.options.FillPercent
+			for _, i := range idx[:n] {
+				if err := bucket.Put(b.key(i), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+		idx = idx[n:]
+	}
+	return b.options.Count, nil
+}
+
+// read looks up keys in the read mode's order, wrapping around the key
+// space, batch size keys per transaction.
+func (b *bench) read() (int, error) {
+	idx := b.order(b.options.ReadMode)
+	for done := 0; done < b.options.ReadCount; {
+		n := b.options.BatchSize
+		if n > b.options.ReadCount-done {
+			n = b.options.ReadCount - done
+		}
+		if err := b.db.View(func(tx *tinydb.Tx) error {
+			bucket := tx.Bucket(benchBucketName)
+			for j := done; j < done+n; j++ {
+				if k := b.key(idx[j%len(idx)]); bucket.Get(k) == nil {
+					return fmt.Errorf("key not found: %x", k)
+				}
+			}
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+		done += n
+	}
+	return b.options.ReadCount, nil
+}
+
+// mix runs operations on random existing keys, batch size operations per
+// write transaction. Each operation is a read with read percent probability
+// and an overwrite otherwise.
+func (b *bench) mix() (int, error) {
+	value := make([]byte, b.options.ValueSize)
+	for done := 0; done < b.options.MixCount; {
+		n := b.options.BatchSize
+		if n > b.options.MixCount-done {
+			n = b.options.MixCount - done
+		}
+		if err := b.db.Update(func(tx *tinydb.Tx) error {
+			bucket := tx.Bucket(benchBucketName)
+			bucket.FillPercent = b.options.FillPercent
+			for j := 0; j < n; j++ {
+				k := b.key(b.rand.Intn(b.options.Count))
+				if b.rand.Intn(100) < b.options.ReadPercent {
+					if bucket.Get(k) == nil {
+						return fmt.Errorf("key not found: %x", k)
+					}
+				} else if err := bucket.Put(k, value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+		done += n
+	}
+	return b.options.MixCount, nil
+}
+
+// printStats prints the database counters accumulated during a phase.
+func (cmd *benchCommand) printStats(s tinydb.Stats) {
+	fmt.Fprintf(cmd.Stdout, "\tPages allocated: %d (%d bytes)\n", s.TxStats.PageCount, s.TxStats.PageAlloc)
+	fmt.Fprintf(cmd.Stdout, "\tNodes split: %d, spilled: %d (%v), rebalanced: %d (%v)\n",
+		s.TxStats.Split, s.TxStats.Spill, s.TxStats.SpillTime, s.TxStats.Rebalance, s.TxStats.RebalanceTime)
+	fmt.Fprintf(cmd.Stdout, "\tWrites: %d (%v)\n", s.TxStats.Write, s.TxStats.WriteTime)
+	fmt.Fprintf(cmd.Stdout, "\tFree pages: %d, pending: %d, freelist: %d bytes\n", s.FreePageN, s.PendingPageN, s.FreelistInuse)
+}
+
+// File handlers for the various profiles.
+var cpuprofile, memprofile, blockprofile *os.File
+
+// startProfiling starts the profiles requested by options for one phase.
+func (cmd *benchCommand) startProfiling(options *benchOptions) error {
+	var err error
+
+	// Start CPU profiling.
+	if options.CPUProfile != "" {
+		cpuprofile, err = os.Create(options.CPUProfile)
+		if err != nil {
+			return fmt.Errorf("cpuprofile: %s", err)
+		}
+		if err := pprof.StartCPUProfile(cpuprofile); err != nil {
+			return fmt.Errorf("cpuprofile: %s", err)
+		}
+	}
+
+	// Start memory profiling.
+	if options.MemProfile != "" {
+		memprofile, err = os.Create(options.MemProfile)
+		if err != nil {
+			return fmt.Errorf("memprofile: %s", err)
+		}
+		runtime.MemProfileRate = 4096
+	}
+
+	// Start block profiling.
+	if options.BlockProfile != "" {
+		blockprofile, err = os.Create(options.BlockProfile)
+		if err != nil {
+			return fmt.Errorf("blockprofile: %s", err)
+		}
+		runtime.SetBlockProfileRate(1)
+	}
+	return nil
+}
+
+// stopProfiling stops the profiles and writes them out.
+func (cmd *benchCommand) stopProfiling() error {
+	if cpuprofile != nil {
+		pprof.StopCPUProfile()
+		if err := cpuprofile.Close(); err != nil {
+			return err
+		}
+		cpuprofile = nil
+	}
+
+	if memprofile != nil {
+		if err := pprof.Lookup("heap").WriteTo(memprofile, 0); err != nil {
+			return fmt.Errorf("memprofile: %s", err)
+		}
+		if err := memprofile.Close(); err != nil {
+			return err
+		}
+		memprofile = nil
+	}
+
+	if blockprofile != nil {
+		if err := pprof.Lookup("block").WriteTo(blockprofile, 0); err != nil {
+			return fmt.Errorf("blockprofile: %s", err)
+		}
+		runtime.SetBlockProfileRate(0)
+		if err := blockprofile.Close(); err != nil {
+			return err
+		}
+		blockprofile = nil
+	}
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *benchCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb bench [options]
+
+Bench writes COUNT keys into a new database in one bucket, reads them back and
+optionally runs a mix of reads and overwrites, printing the time taken and
+the throughput of each phase. Keys are big-endian indexes padded to the key
+size and all values are zero bytes. Random orders and the mix come from a
+seeded generator, so runs with the same options do the same work.
+
+Options:
+
+	-count N
+		Number of keys to write. Defaults to 1000.
+	-batch-size N
+		Operations per transaction in every phase. Defaults to COUNT.
+	-key-size N, -value-size N
+		Key and value sizes in bytes. Default to 8 and 32.
+	-write-mode seq|rnd, -read-mode seq|rnd
+		Key order for the write and read phases. Default to seq.
+	-reads N
+		Number of lookups in the read phase. Defaults to COUNT.
+	-mix N
+		Number of operations in the mixed phase, run in write
+		transactions on random keys. Defaults to 0, which skips it.
+	-read-percent P
+		Percentage of mixed operations that are reads rather than
+		overwrites. Defaults to 50.
+	-seed N
+		Seed for random key orders and the mix. Defaults to 1.
+	-fill-percent PERCENT
+		Bucket.FillPercent for writes. Defaults to 0.5.
+	-page-size N, -freelist array|hashmap
+	-no-sync, -no-freelist-sync
+		Options the database is opened with.
+	-profile-mode [w][r][m]
+		Phases to profile: write, read and mixed. Defaults to rw.
+		Profiles run from the first to the last of these phases.
+	-cpuprofile PATH, -memprofile PATH, -blockprofile PATH
+		Write CPU, heap and block profiles to PATH.
+	-stats
+		Print page, split, spill and freelist counters after each phase.
+	-path PATH
+		Database path. Defaults to a temporary file.
+	-work
+		Keep the database and print its path.
+`, "\n")
+}
+
+// checkCommand represents the "check" command execution.
+type checkCommand struct{ *Main }
+
+func newCheckCommand(m *Main) *checkCommand { return &checkCommand{m} }
+
+// Run executes the command.
+func (cmd *checkCommand) Run(args ...string) error {
+	path, _, err := parseArgs(cmd.Main, "check", cmd.Usage, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := tinydb.Open(path, &tinydb.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Check the tree of each meta page, so that a corrupt previous commit is
+	// found before Open has to fall back to it.
+	count := 0
+	for i := 0; i < 2; i++ {
+		if err := db.ViewMeta(i, func(tx *tinydb.Tx) error {
+			for err := range tx.Check() {
+				fmt.Fprintf(cmd.Stdout, "meta %d: %s\n", i, err)
+				count++
+			}
+			return nil
+		}); err != nil {
+			fmt.Fprintln(cmd.Stdout, err)
+			count++
+		}
+	}
+
+	if count > 0 {
+		fmt.Fprintf(cmd.Stdout, "%d errors found\n", count)
+		return ErrCorrupt
+	}
+	fmt.Fprintln(cmd.Stdout, "OK")
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *checkCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb check PATH
+
+Check opens a database at PATH and runs an exhaustive check against the trees
+of both meta pages. Each page is verified against its checksum and every page
+must be reachable exactly once or on the freelist. Keys must be in order and
+within the range of their parent branch element.
+
+The meta page that isn't current holds the previous commit, which Open falls
+back to if the current one is torn, so problems in either are reported.
+
+If problems are found, each is printed with the meta page it was found from
+and the command exits with a non-zero status. Otherwise "OK" is printed.
+`, "\n")
+}
+
+// compactCommand represents the "compact" command execution.
+type compactCommand struct{ *Main }
+
+func newCompactCommand(m *Main) *compactCommand { return &compactCommand{m} }
+
+// Run executes the command.
+func (cmd *compactCommand) Run(args ...string) error {
+	fs := flag.NewFlagSet("compact", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	dstPath := fs.String("o", "", "")
+	fillPercent := fs.Float64("fill-percent", 0, "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	// Require database paths.
+	srcPath := fs.Arg(0)
+	if srcPath == "" || *dstPath == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(srcPath); os.IsNotExist(err) {
+		return ErrFileNotFound
+	}
+
+	db, err := tinydb.Open(srcPath, &tinydb.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.CompactTo(*dstPath, *fillPercent); err != nil {
+		return err
+	}
+
+	src, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	dst, err := os.Stat(*dstPath)
+	if err != nil {
+		return err
+	} else if dst.Size() == 0 {
+		return fmt.Errorf("zero db size")
+	}
+	fmt.Fprintf(cmd.Stdout, "%d -> %d bytes (gain=%.2fx)\n", src.Size(), dst.Size(), float64(src.Size())/float64(dst.Size()))
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *compactCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb compact [options] -o DST SRC
+
+Compact opens a database at SRC path and walks it recursively, copying keys
+as they are found from all buckets, to a newly created database at DST path.
+Free pages are left behind, so DST is usually much smaller than SRC. Named
+snapshots are not copied.
+
+The original database is left untouched. DST must not exist.
+
+Additional options include:
+
+	-fill-percent PERCENT
+		Fill split pages to PERCENT, between 0.1 and 1.0.
+		Defaults to packing pages as full as possible.
+`, "\n")
+}
+
+// dumpCommand represents the "dump" command execution.
+type dumpCommand struct{ *Main }
+
+func newDumpCommand(m *Main) *dumpCommand { return &dumpCommand{m} }
+
+// Run executes the command.
+func (cmd *dumpCommand) Run(args ...string) error {
+	path, args, err := parseArgs(cmd.Main, "dump", cmd.Usage, args)
+	if err != nil {
+		return err
+	}
+
+	// Read page id.
+	if len(args) == 0 {
+		return ErrPageIDRequired
+	}
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pageSize, _, err := readMeta(f)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Pages past the high water mark are still dumped since a torn write
+	// may have left data there. Only the first page is read if the overflow
+	// count runs past the end of the file.
+	if int64(id) >= tinydb.PageCount(fi.Size(), pageSize) {
+		return ErrPageNotFound
+	}
+	buf := make([]byte, pageSize)
+	if _, err := f.ReadAt(buf, int64(id)*int64(pageSize)); err != nil && err != io.EOF {
+		return err
+	}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if n := int64(p.overflow); n > 0 && int64(id)+n < tinydb.PageCount(fi.Size(), pageSize) {
+		buf = make([]byte, (n+1)*int64(pageSize))
+		if _, err := f.ReadAt(buf, int64(id)*int64(pageSize)); err != nil && err != io.EOF {
+			return err
+		}
+		p = (*page)(unsafe.Pointer(&buf[0]))
+	}
+
+	fmt.Fprintf(cmd.Stdout, "Page %d: %d bytes, checksum %s\n", id, len(buf), p.checksumStatus(buf))
+	if p.id != pgid(id) {
+		fmt.Fprintf(cmd.Stdout, "WARNING: header has page id %d\n", p.id)
+	}
+	for _, r := range tinydb.PageLayout(buf) {
+		fmt.Fprintf(cmd.Stdout, "\n%08x %s", r.Offset, r.Name)
+		if r.Value != "" {
+			fmt.Fprintf(cmd.Stdout, ": %s", r.Value)
+		}
+		fmt.Fprintln(cmd.Stdout)
+		hexdump(cmd.Stdout, buf[r.Offset:r.Offset+r.Size], r.Offset)
+	}
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *dumpCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb dump PATH PAGEID
+
+Dump prints a hexdump of a raw page and its overflow pages. Each region is
+labelled with the page field or area it belongs to: the header fields, the
+meta fields or element headers, and the keys, values and freelist ids the
+elements point at. Bytes outside every region are labelled unused. Repeated
+lines within a region are collapsed into a single "*".
+
+The page is dumped even if it is past the high water mark or its header is
+invalid, which is useful when diagnosing torn writes.
+`, "\n")
+}
+
+// hexdump writes b in the format of "hexdump -C", numbering lines from
+// offset and collapsing repeated lines.
+func hexdump(w io.Writer, b []byte, offset int) {
+	var prev []byte
+	var skipped bool
+	for i := 0; i < len(b); i += 16 {
+		line := b[i:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+		if len(line) == 16 && bytes.Equal(line, prev) && i+16 < len(b) {
+			if !skipped {
+				fmt.Fprintln(w, "*")
+				skipped = true
+			}
+			continue
+		}
+		prev, skipped = line, false
+
+		var hex, ascii strings.Builder
+		for j := 0; j < 16; j++ {
+			if j == 8 {
+				hex.WriteByte(' ')
+			}
+			if j >= len(line) {
+				hex.WriteString("   ")
+				continue
+			}
+			fmt.Fprintf(&hex, "%02x ", line[j])
+			if line[j] >= 0x20 && line[j] < 0x7f {
+				ascii.WriteByte(line[j])
+			} else {
+				ascii.WriteByte('.')
+			}
+		}
+		fmt.Fprintf(w, "%08x  %s |%s|\n", offset+i, hex.String(), ascii.String())
+	}
+}
+
+// statsCommand represents the "stats" command execution.
+type statsCommand struct{ *Main }
+
+func newStatsCommand(m *Main) *statsCommand { return &statsCommand{m} }
+
+// Run executes the command.
+func (cmd *statsCommand) Run(args ...string) error {
+	path, _, err := parseArgs(cmd.Main, "stats", cmd.Usage, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := tinydb.Open(path, &tinydb.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *tinydb.Tx) error {
+		s, err := tx.ForEachPageWithStats(nil)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(cmd.Stdout, "Page count statistics\n")
+		fmt.Fprintf(cmd.Stdout, "\tNumber of logical branch pages: %d\n", s.BranchPageN)
+		fmt.Fprintf(cmd.Stdout, "\tNumber of physical branch overflow pages: %d\n", s.BranchOverflowN)
+		fmt.Fprintf(cmd.Stdout, "\tNumber of logical leaf pages: %d\n", s.LeafPageN)
+		fmt.Fprintf(cmd.Stdout, "\tNumber of physical leaf overflow pages: %d\n", s.LeafOverflowN)
+
+		fmt.Fprintf(cmd.Stdout, "Tree statistics\n")
+		fmt.Fprintf(cmd.Stdout, "\tNumber of buckets: %d\n", s.BucketN)
+		fmt.Fprintf(cmd.Stdout, "\tNumber of levels: %d\n", len(s.Depths))
+		for depth, d := range s.Depths {
+			fmt.Fprintf(cmd.Stdout, "\t\tLevel %d: %d pages, %d overflow, %d of %d bytes used (%s)\n",
+				depth, d.PageN, d.OverflowN, d.Inuse, d.Alloc, percent(d.Inuse, d.Alloc))
+		}
+
+		fmt.Fprintf(cmd.Stdout, "Page size utilization\n")
+		fmt.Fprintf(cmd.Stdout, "\tBytes allocated for physical branch pages: %d\n", s.BranchAlloc)
+		fmt.Fprintf(cmd.Stdout, "\tBytes actually used for branch data: %d (%s)\n", s.BranchInuse, percent(s.BranchInuse, s.BranchAlloc))
+		fmt.Fprintf(cmd.Stdout, "\tBytes allocated for physical leaf pages: %d\n", s.LeafAlloc)
+		fmt.Fprintf(cmd.Stdout, "\tBytes actually used for leaf data: %d (%s)\n", s.LeafInuse, percent(s.LeafInuse, s.LeafAlloc))
+
+		fmt.Fprintf(cmd.Stdout, "Bucket statistics\n")
+		fmt.Fprintf(cmd.Stdout, "\tTotal number of buckets: %d\n", s.BucketN)
+		fmt.Fprintf(cmd.Stdout, "\tTotal number on inlined buckets: %d (%s)\n", s.InlineBucketN, percent(s.InlineBucketN, s.BucketN))
+		fmt.Fprintf(cmd.Stdout, "\tBytes used for inlined buckets: %d\n", s.InlineBucketInuse)
+		return nil
+	})
+}
+
+// Usage returns the help message.
+func (cmd *statsCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb stats PATH
+
+Stats walks every page reachable from the current meta page, including the
+pages of nested buckets, and prints page counts, the number of pages at each
+level of the tree and how much of the allocated space holds data.
+`, "\n")
+}
+
+// percent formats n as a percentage of total.
+func percent(n, total int) string {
+	if total == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%d%%", n*100/total)
+}
+
+// printMeta prints the fields of a meta page.
+func printMeta(w io.Writer, m *meta) {
+	fmt.Fprintf(w, "Version:    %d\n", m.version)
+	fmt.Fprintf(w, "Page Size:  %d bytes\n", m.pageSize)
+	fmt.Fprintf(w, "Root:       <pgid=%d>\n", m.root.root)
+	if m.freelist == pgidNoFreelist {
+		fmt.Fprintf(w, "Freelist:   <not synced>\n")
+	} else {
+		fmt.Fprintf(w, "Freelist:   <pgid=%d>\n", m.freelist)
+	}
+	fmt.Fprintf(w, "HWM:        <pgid=%d>\n", m.pgid)
+	fmt.Fprintf(w, "Txn ID:     %d\n", m.txid)
+	fmt.Fprintf(w, "Checksum:   %016x\n", m.checksum)
+}
+
+// formatBytes returns b as a string if it is printable, otherwise as hex.
+func formatBytes(b []byte) string {
+	if !utf8.Valid(b) {
+		return fmt.Sprintf("%x", b)
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) {
+			return fmt.Sprintf("%x", b)
+		}
+	}
+	return string(b)
+}
+
+// formatBucket describes a bucket value stored on a leaf page.
+func formatBucket(value []byte) string {
+	if len(value) < int(unsafe.Sizeof(bucket{})) {
+		return fmt.Sprintf("<bucket: truncated header %x>", value)
+	}
+
+	// Values are packed after their keys, so copy the header to read it aligned.
+	var b bucket
+	copy((*[unsafe.Sizeof(bucket{})]byte)(unsafe.Pointer(&b))[:], value)
+	if b.root != 0 {
+		return fmt.Sprintf("<bucket: root=%d, sequence=%d>", b.root, b.sequence)
+	}
+	return fmt.Sprintf("<bucket: inline, sequence=%d, %d bytes>", b.sequence, len(value)-int(unsafe.Sizeof(bucket{})))
+}
+
+// readMeta reads the meta pages at the start of the file and returns the
+// page size and the valid meta page with the highest transaction id.
+func readMeta(f *os.File) (int, *meta, error) {
+	// Meta page 0 is at the start of the file whatever the page size.
+	buf := make([]byte, 0x1000)
+	if _, err := f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return 0, nil, err
+	}
+	var pageSize int
+	if m := (*page)(unsafe.Pointer(&buf[0])).meta(); m.validate() == nil {
+		pageSize = int(m.pageSize)
+	}
+
+	// If meta 0 is torn, look for meta 1 at each possible page size.
+	if pageSize == 0 {
+		for sz := 1024; sz <= 64*1024; sz *= 2 {
+			buf := make([]byte, sz)
+			if _, err := f.ReadAt(buf, int64(sz)); err != nil {
+				break
+			}
+			p := (*page)(unsafe.Pointer(&buf[0]))
+			if m := p.meta(); p.flags == metaPageFlag && m.validate() == nil && int(m.pageSize) == sz {
+				pageSize = sz
+				break
+			}
+		}
+	}
+	if pageSize == 0 {
+		return 0, nil, ErrInvalidMeta
+	}
+
+	// Use the valid meta page with the highest transaction id.
+	var current *meta
+	for _, m := range readMetaPages(f, pageSize) {
+		if m != nil && (current == nil || m.txid > current.txid) {
+			current = m
+		}
+	}
+	if current == nil {
+		return 0, nil, ErrInvalidMeta
+	}
+	return pageSize, current, nil
+}
+
+// readMetaPages reads both meta pages, leaving invalid ones nil.
+func readMetaPages(f *os.File, pageSize int) [2]*meta {
+	var metas [2]*meta
+	for id := range metas {
+		buf := make([]byte, pageSize)
+		if _, err := f.ReadAt(buf, int64(id*pageSize)); err != nil {
+			continue
+		}
+		if m := (*page)(unsafe.Pointer(&buf[0])).meta(); m.validate() == nil {
+			metas[id] = m
+		}
+	}
+	return metas
+}
+
+// errStaleHeader is wrapped by readPage errors for pages whose header can't
+// belong to a page at that position, such as a freed overflow page.
+var errStaleHeader = errors.New("stale page header")
+
+// readPage reads a page and its overflow pages from the file.
+func readPage(f *os.File, pageSize int, m *meta, id pgid) (*page, []byte, error) {
+	if id >= m.pgid {
+		return nil, nil, ErrPageNotFound
+	}
+
+	// Read the first page to find the overflow count.
+	buf := make([]byte, pageSize)
+	if _, err := f.ReadAt(buf, int64(id)*int64(pageSize)); err != nil {
+		return nil, nil, err
+	}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if p.id != id {
+		return nil, nil, fmt.Errorf("page %d: %w: header has id %d", id, errStaleHeader, p.id)
+	} else if p.overflow == 0 {
+		return p, buf, nil
+	} else if id+pgid(p.overflow) >= m.pgid {
+		return nil, nil, fmt.Errorf("page %d: %w: %d overflow pages run past the high water mark", id, errStaleHeader, p.overflow)
+	}
+
+	// Re-read the page with its overflow pages.
+	buf = make([]byte, (int(p.overflow)+1)*pageSize)
+	if _, err := f.ReadAt(buf, int64(id)*int64(pageSize)); err != nil {
+		return nil, nil, err
+	}
+	return (*page)(unsafe.Pointer(&buf[0])), buf, nil
+}
+
+// The types below are used to read and write pages in place. Their layout
+// is checked against tinydb.PageLayout by checkLayout before any command
+// runs, and element offsets use the sizes exported by the tinydb package.
+
+const (
+	branchPageFlag   = 0x01
+	leafPageFlag     = 0x02
+	metaPageFlag     = 0x04
+	freelistPageFlag = 0x10
+)
+
+const bucketLeafFlag = 0x01
+
+const pgidNoFreelist pgid = 0xffffffffffffffff
+
+const version = 1
+
+type pgid uint64
+
+type page struct {
+	id       pgid
+	flags    uint16
+	count    uint16
+	overflow uint32
+	checksum uint64
+}
+
+// typ returns a human readable page type string used for debugging.
+func (p *page) typ() string {
+	switch p.flags {
+	case branchPageFlag:
+		return "branch"
+	case leafPageFlag:
+		return "leaf"
+	case metaPageFlag:
+		return "meta"
+	case freelistPageFlag:
+		return "freelist"
+	}
+	return fmt.Sprintf("unknown<%02x>", p.flags)
+}
+
+// checksumStatus reports whether the page read into buf matches its checksum.
+func (p *page) checksumStatus(buf []byte) string {
+	if p.checksum == 0 {
+		return "none"
+	}
+	if sum := p.sum64(buf); sum != p.checksum {
+		return fmt.Sprintf("%016x (mismatch, computed %016x)", p.checksum, sum)
+	}
+	return fmt.Sprintf("%016x (ok)", p.checksum)
+}
+
+// sum64 returns the checksum of the page in buf, which includes its
+// overflow pages, skipping the checksum field itself.
+func (p *page) sum64(buf []byte) uint64 {
+	off := unsafe.Offsetof(p.checksum)
+	h := fnv.New64a()
+	_, _ = h.Write(buf[:off])
+	_, _ = h.Write(buf[off+unsafe.Sizeof(p.checksum):])
+	return h.Sum64()
+}
+
+func (p *page) meta() *meta {
+	return (*meta)(unsafe.Pointer(uintptr(unsafe.Pointer(p)) + uintptr(tinydb.PageHeaderSize)))
+}
+
+func (p *page) leafPageElement(index uint16) *leafPageElement {
+	off := tinydb.PageHeaderSize + int(index)*tinydb.LeafPageElementSize
+	return (*leafPageElement)(unsafe.Pointer(uintptr(unsafe.Pointer(p)) + uintptr(off)))
+}
+
+func (p *page) branchPageElement(index uint16) *branchPageElement {
+	off := tinydb.PageHeaderSize + int(index)*tinydb.BranchPageElementSize
+	return (*branchPageElement)(unsafe.Pointer(uintptr(unsafe.Pointer(p)) + uintptr(off)))
+}
+
+// freelistPageIDs returns the page ids stored on a freelist page read into
+// buf. Ids past the end of buf are dropped.
+func (p *page) freelistPageIDs(buf []byte) []pgid {
+	const size = int(unsafe.Sizeof(pgid(0)))
+	off, count := tinydb.PageHeaderSize, int(p.count)
+	if count == 0xFFFF && off+size <= len(buf) {
+		count = int(*(*pgid)(unsafe.Pointer(&buf[off])))
+		off += size
+	}
+
+	var ids []pgid
+	for i := 0; i < count && off+size <= len(buf); i++ {
+		ids = append(ids, *(*pgid)(unsafe.Pointer(&buf[off])))
+		off += size
+	}
+	return ids
+}
+
+// elementBytes returns the n bytes at pos from the element e of the page
+// read into buf, or nil if they don't fit in buf.
+func elementBytes(buf []byte, e unsafe.Pointer, pos uintptr, n uint32) []byte {
+	off := uintptr(e) - uintptr(unsafe.Pointer(&buf[0])) + pos
+	if off > uintptr(len(buf)) || uintptr(n) > uintptr(len(buf))-off {
+		return nil
+	}
+	return buf[off : off+uintptr(n)]
+}
+
+type branchPageElement struct {
+	pos   uint32
+	ksize uint32
+	pgid  pgid
+}
+
+func (n *branchPageElement) key(buf []byte) []byte {
+	return elementBytes(buf, unsafe.Pointer(n), uintptr(n.pos), n.ksize)
+}
+
+type leafPageElement struct {
+	flags uint32
+	pos   uint32
+	ksize uint32
+	vsize uint32
+}
+
+func (n *leafPageElement) key(buf []byte) []byte {
+	return elementBytes(buf, unsafe.Pointer(n), uintptr(n.pos), n.ksize)
+}
+
+func (n *leafPageElement) value(buf []byte) []byte {
+	return elementBytes(buf, unsafe.Pointer(n), uintptr(n.pos)+uintptr(n.ksize), n.vsize)
+}
+
+type bucket struct {
+	root     pgid
+	sequence uint64
+}
+
+type meta struct {
+	version  uint32
+	pageSize uint32
+	root     bucket
+	freelist pgid
+	pgid     pgid
+	txid     uint64
+	checksum uint64
+}
+
+// validate checks the version and checksum of the meta page.
+func (m *meta) validate() error {
+	if m.version != version {
+		return tinydb.ErrVersionMismatch
+	}
+	if m.checksum != 0 && m.checksum != m.sum64() {
+		return tinydb.ErrChecksum
+	}
+	return nil
+}
+
+// sum64 returns the checksum of the meta fields before the checksum.
+func (m *meta) sum64() uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write((*[unsafe.Offsetof(meta{}.checksum)]byte)(unsafe.Pointer(m))[:])
+	return h.Sum64()
+}
+
+// errLayout is returned by checkLayout when the types above no longer match
+// the on-disk layout of the tinydb package.
+var errLayout = errors.New("page layout differs from the tinydb package")
+
+// layoutRegion is a region that tinydb.PageLayout must report for a page
+// written with the types above.
+type layoutRegion struct {
+	off, size uintptr
+	name      string
+	value     string
+}
+
+// checkLayout writes a page of each type with the types above and checks
+// that tinydb.PageLayout finds every field at the same offset, with the same
+// size and value. Commands write pages in place, so they must not run if a
+// field was added, moved or resized in the tinydb package.
+func checkLayout() error {
+	const hdr = uintptr(tinydb.PageHeaderSize)
+	newPage := func(flags, count uint16) (*page, []byte, []layoutRegion) {
+		buf := make([]byte, 1024)
+		p := (*page)(unsafe.Pointer(&buf[0]))
+		*p = page{id: 3, flags: flags, count: count, overflow: 0, checksum: 0x0102030405060708}
+		return p, buf, []layoutRegion{
+			{unsafe.Offsetof(p.id), unsafe.Sizeof(p.id), "id", "3"},
+			{unsafe.Offsetof(p.flags), unsafe.Sizeof(p.flags), "flags", fmt.Sprintf("0x%02x (%s)", flags, p.typ())},
+			{unsafe.Offsetof(p.count), unsafe.Sizeof(p.count), "count", fmt.Sprint(count)},
+			{unsafe.Offsetof(p.overflow), unsafe.Sizeof(p.overflow), "overflow", "0"},
+			{unsafe.Offsetof(p.checksum), unsafe.Sizeof(p.checksum), "checksum", "0102030405060708"},
+		}
+	}
+	check := func(buf []byte, exp []layoutRegion) error {
+		regions := tinydb.PageLayout(buf)
+		for _, e := range exp {
+			var ok bool
+			for _, r := range regions {
+				if r.Name == e.name {
+					ok = r.Offset == int(e.off) && r.Size == int(e.size) && r.Value == e.value
+					break
+				}
+			}
+			if !ok {
+				return fmt.Errorf("%w: %s", errLayout, e.name)
+			}
+		}
+		return nil
+	}
+
+	// Meta page.
+	p, buf, exp := newPage(metaPageFlag, 0)
+	m := p.meta()
+	*m = meta{version: 4, pageSize: 5, root: bucket{root: 6, sequence: 7}, freelist: 8, pgid: 9, txid: 10, checksum: 11}
+	exp = append(exp,
+		layoutRegion{hdr + unsafe.Offsetof(m.version), unsafe.Sizeof(m.version), "meta.version", "4"},
+		layoutRegion{hdr + unsafe.Offsetof(m.pageSize), unsafe.Sizeof(m.pageSize), "meta.pageSize", "5"},
+		layoutRegion{hdr + unsafe.Offsetof(m.root), unsafe.Sizeof(m.root.root), "meta.root.root", "6"},
+		layoutRegion{hdr + unsafe.Offsetof(m.root) + unsafe.Offsetof(m.root.sequence), unsafe.Sizeof(m.root.sequence), "meta.root.sequence", "7"},
+		layoutRegion{hdr + unsafe.Offsetof(m.freelist), unsafe.Sizeof(m.freelist), "meta.freelist", "8"},
+		layoutRegion{hdr + unsafe.Offsetof(m.pgid), unsafe.Sizeof(m.pgid), "meta.pgid", "9"},
+		layoutRegion{hdr + unsafe.Offsetof(m.txid), unsafe.Sizeof(m.txid), "meta.txid", "10"},
+		layoutRegion{hdr + unsafe.Offsetof(m.checksum), unsafe.Sizeof(m.checksum), "meta.checksum", fmt.Sprintf("%016x", 11)},
+	)
+	if err := check(buf, exp); err != nil {
+		return err
+	}
+
+	// Branch page with one element.
+	p, buf, exp = newPage(branchPageFlag, 1)
+	be := p.branchPageElement(0)
+	*be = branchPageElement{pos: uint32(unsafe.Sizeof(*be)), ksize: 3, pgid: 12}
+	exp = append(exp, layoutRegion{hdr, unsafe.Sizeof(*be), "branch[0]", fmt.Sprintf("pos=%d ksize=3 pgid=12", be.pos)})
+	if err := check(buf, exp); err != nil {
+		return err
+	}
+
+	// Leaf page with one bucket element.
+	var b = bucket{root: 13, sequence: 14}
+	p, buf, exp = newPage(leafPageFlag, 1)
+	le := p.leafPageElement(0)
+	*le = leafPageElement{flags: bucketLeafFlag, pos: uint32(unsafe.Sizeof(*le)), ksize: 3, vsize: uint32(unsafe.Sizeof(b))}
+	voff := hdr + uintptr(le.pos) + uintptr(le.ksize)
+	copy(buf[voff:], (*[unsafe.Sizeof(bucket{})]byte)(unsafe.Pointer(&b))[:])
+	exp = append(exp,
+		layoutRegion{hdr, unsafe.Sizeof(*le), "leaf[0]", fmt.Sprintf("flags=%d pos=%d ksize=3 vsize=%d", bucketLeafFlag, le.pos, le.vsize)},
+		layoutRegion{voff, unsafe.Sizeof(b), "leaf[0].bucket", "root=13 sequence=14"},
+	)
+	if err := check(buf, exp); err != nil {
+		return err
+	}
+
+	// Freelist page with two ids.
+	_, buf, exp = newPage(freelistPageFlag, 2)
+	exp = append(exp, layoutRegion{hdr, 2 * unsafe.Sizeof(pgid(0)), "freelist.ids", "2 ids"})
+	return check(buf, exp)
+}
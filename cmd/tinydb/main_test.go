@@ -0,0 +1,400 @@
+package main_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"tinydb"
+	main "tinydb/cmd/tinydb"
+)
+
+// Main represents a test wrapper for main.Main that records output.
+type Main struct {
+	*main.Main
+	Stdin  bytes.Buffer
+	Stdout bytes.Buffer
+	Stderr bytes.Buffer
+}
+
+// NewMain returns a new instance of Main.
+func NewMain() *Main {
+	m := &Main{Main: main.NewMain()}
+	m.Main.Stdin = &m.Stdin
+	m.Main.Stdout = &m.Stdout
+	m.Main.Stderr = &m.Stderr
+	return m
+}
+
+// mustCreate creates a database with a bucket of 1000 keys, one nested
+// inline bucket and a page on the freelist, and returns its path.
+func mustCreate(t *testing.T) string {
+	f, err := ioutil.TempFile("", "tinydb-cmd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+
+	db, err := tinydb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *tinydb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		sub, err := b.CreateBucket([]byte("sub"))
+		if err != nil {
+			return err
+		}
+		return sub.Put([]byte{0x00, 0xff}, []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *tinydb.Tx) error {
+		return tx.Bucket([]byte("widgets")).Delete([]byte("0000"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Ensure the "info" command prints the page size and current meta page.
+func TestInfoCommand_Run(t *testing.T) {
+	path := mustCreate(t)
+	defer os.RemoveAll(path)
+
+	m := NewMain()
+	if err := m.Run("info", path); err != nil {
+		t.Fatal(err)
+	}
+	out := m.Stdout.String()
+	for _, s := range []string{
+		fmt.Sprintf("Page Size: %d\n", os.Getpagesize()),
+		"Version:    1\n",
+		"Txn ID:     3\n",
+	} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("missing %q in:\n%s", s, out)
+		}
+	}
+}
+
+// Ensure the "pages" command lists every page up to the high water mark.
+func TestPagesCommand_Run(t *testing.T) {
+	path := mustCreate(t)
+	defer os.RemoveAll(path)
+
+	m := NewMain()
+	if err := m.Run("pages", path); err != nil {
+		t.Fatal(err)
+	}
+	types := make(map[string]int)
+	lines := strings.Split(strings.TrimSpace(m.Stdout.String()), "\n")
+	for _, line := range lines[2:] {
+		types[strings.Fields(line)[1]]++
+	}
+	if types["meta"] != 2 || types["branch"] < 1 || types["leaf"] < 2 || types["freelist"] != 1 || types["free"] < 1 {
+		t.Fatalf("unexpected page types %v in:\n%s", types, m.Stdout.String())
+	}
+}
+
+// Ensure the "page" command decodes meta, branch and leaf pages.
+func TestPageCommand_Run(t *testing.T) {
+	path := mustCreate(t)
+	defer os.RemoveAll(path)
+
+	m := NewMain()
+	if err := m.Run("page", path, "0"); err != nil {
+		t.Fatal(err)
+	} else if out := m.Stdout.String(); !strings.Contains(out, "Page Type:  meta\n") || !strings.Contains(out, "HWM:") {
+		t.Fatalf("unexpected meta page output:\n%s", out)
+	}
+
+	// Find the pages of each type and print them all at once.
+	m = NewMain()
+	if err := m.Run("pages", path); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, line := range strings.Split(strings.TrimSpace(m.Stdout.String()), "\n")[2:] {
+		if f := strings.Fields(line); f[1] == "branch" || f[1] == "leaf" {
+			ids = append(ids, f[0])
+		}
+	}
+
+	m = NewMain()
+	if err := m.Run(append([]string{"page", path}, ids...)...); err != nil {
+		t.Fatal(err)
+	}
+	out := m.Stdout.String()
+	for _, s := range []string{
+		"Page Type:  branch\n",
+		"Page Type:  leaf\n",
+		"0999: value\n",
+		"sub: <bucket: inline, sequence=0,",
+		"(ok)\n",
+	} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("missing %q in:\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, "0000: value\n") {
+		t.Fatalf("deleted key printed:\n%s", out)
+	}
+}
+
+// Ensure the "bench" command runs each phase, writes profiles and keeps
+// the database when asked to.
+func TestBenchCommand_Run(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinydb-bench-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, cpuprofile := dir+"/db", dir+"/cpu.pprof"
+
+	m := NewMain()
+	if err := m.Run("bench", "-count", "500", "-batch-size", "100", "-write-mode", "rnd", "-read-mode", "rnd",
+		"-mix", "200", "-read-percent", "25", "-freelist", "hashmap", "-no-sync", "-stats",
+		"-profile-mode", "wm", "-cpuprofile", cpuprofile, "-path", path, "-work"); err != nil {
+		t.Fatal(err)
+	}
+	out := m.Stdout.String()
+	for _, s := range []string{"# Write\t", "# Read\t", "# Mixed\t", "\tNodes split: "} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("missing %q in:\n%s", s, out)
+		}
+	}
+	if fi, err := os.Stat(cpuprofile); err != nil || fi.Size() == 0 {
+		t.Fatalf("expected cpu profile: %v", err)
+	}
+
+	db, err := tinydb.Open(path, &tinydb.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.View(func(tx *tinydb.Tx) error {
+		if n := tx.Bucket([]byte("bench")).Stats().KeyN; n != 500 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"-write-mode", "foo"},
+		{"-key-size", "2"},
+		{"-profile-mode", "x"},
+		{"-freelist", "foo"},
+	} {
+		if err := NewMain().Run(append([]string{"bench"}, args...)...); err == nil {
+			t.Fatalf("%q: expected error", args)
+		}
+	}
+}
+
+// Ensure the "check" command passes a consistent database and reports a
+// corrupted page.
+func TestCheckCommand_Run(t *testing.T) {
+	path := mustCreate(t)
+	defer os.RemoveAll(path)
+
+	m := NewMain()
+	if err := m.Run("check", path); err != nil {
+		t.Fatal(err)
+	} else if m.Stdout.String() != "OK\n" {
+		t.Fatalf("unexpected output: %s", m.Stdout.String())
+	}
+
+	// Overwrite the end of the last leaf page, which is only reachable from
+	// the current meta page.
+	m = NewMain()
+	if err := m.Run("pages", path); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(m.Stdout.String()), "\n")
+	var id int
+	for _, line := range lines[2:] {
+		if f := strings.Fields(line); f[1] == "leaf" {
+			fmt.Sscan(f[0], &id)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageSize := os.Getpagesize()
+	if _, err := f.WriteAt([]byte{0xde, 0xad, 0xbe, 0xef}, int64(id*pageSize+pageSize-4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m = NewMain()
+	if err := m.Run("check", path); err != main.ErrCorrupt {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := m.Stdout.String()
+	for _, s := range []string{
+		fmt.Sprintf("meta 1: page checksum mismatch: page %d\n", id),
+		" errors found\n",
+	} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("missing %q in:\n%s", s, out)
+		}
+	}
+}
+
+// Ensure the "compact" command copies a database into a smaller file.
+func TestCompactCommand_Run(t *testing.T) {
+	path := mustCreate(t)
+	defer os.RemoveAll(path)
+	dstPath := path + ".compacted"
+	defer os.RemoveAll(dstPath)
+
+	m := NewMain()
+	if err := m.Run("compact", "-o", dstPath, "-fill-percent", "0.9", path); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(m.Stdout.String(), " bytes (gain=") {
+		t.Fatalf("unexpected output: %s", m.Stdout.String())
+	}
+
+	db, err := tinydb.Open(dstPath, &tinydb.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.View(func(tx *tinydb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("0999")); string(v) != "value" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := b.Get([]byte("0000")); v != nil {
+			t.Fatalf("unexpected deleted value: %q", v)
+		} else if v := b.Bucket([]byte("sub")).Get([]byte{0x00, 0xff}); string(v) != "bar" {
+			t.Fatalf("unexpected nested value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewMain().Run("compact", "-o", dstPath, path); err == nil {
+		t.Fatal("expected error for existing destination")
+	}
+}
+
+// Ensure the "dump" command labels the regions of a page.
+func TestDumpCommand_Run(t *testing.T) {
+	path := mustCreate(t)
+	defer os.RemoveAll(path)
+
+	m := NewMain()
+	if err := m.Run("dump", path, "0"); err != nil {
+		t.Fatal(err)
+	}
+	out := m.Stdout.String()
+	for _, s := range []string{
+		"Page 0: ",
+		"00000008 flags: 0x04 (meta)\n00000008  04 00 ",
+		"meta.version: 1\n",
+		"unused\n",
+		"*\n",
+	} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("missing %q in:\n%s", s, out)
+		}
+	}
+
+	// The root page of the top-level bucket holds the "widgets" key.
+	m = NewMain()
+	if err := m.Run("info", path); err != nil {
+		t.Fatal(err)
+	}
+	var root string
+	for _, line := range strings.Split(m.Stdout.String(), "\n") {
+		if strings.HasPrefix(line, "Root:") {
+			root = strings.TrimSuffix(strings.TrimPrefix(strings.Fields(line)[1], "<pgid="), ">")
+		}
+	}
+	m = NewMain()
+	if err := m.Run("dump", path, root); err != nil {
+		t.Fatal(err)
+	}
+	out = m.Stdout.String()
+	for _, s := range []string{
+		"(ok)\n",
+		" leaf[0].key\n",
+		"|widgets|\n",
+		" leaf[0].bucket: root=",
+	} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("missing %q in:\n%s", s, out)
+		}
+	}
+}
+
+// Ensure the "stats" command reports the pages of nested buckets.
+func TestStatsCommand_Run(t *testing.T) {
+	path := mustCreate(t)
+	defer os.RemoveAll(path)
+
+	m := NewMain()
+	if err := m.Run("stats", path); err != nil {
+		t.Fatal(err)
+	}
+	out := m.Stdout.String()
+	for _, s := range []string{
+		"Number of logical branch pages: 1\n",
+		"Total number of buckets: 2\n",
+		"Total number on inlined buckets: 1 (50%)\n",
+	} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("missing %q in:\n%s", s, out)
+		}
+	}
+}
+
+// Ensure that argument errors are returned.
+func TestMain_Run_Errors(t *testing.T) {
+	path := mustCreate(t)
+	defer os.RemoveAll(path)
+
+	for _, tt := range []struct {
+		args []string
+		err  error
+	}{
+		{nil, main.ErrUsage},
+		{[]string{"foo"}, main.ErrUnknownCommand},
+		{[]string{"info"}, main.ErrPathRequired},
+		{[]string{"info", path + ".missing"}, main.ErrFileNotFound},
+		{[]string{"page", path}, main.ErrPageIDRequired},
+		{[]string{"page", path, "1000000"}, main.ErrPageNotFound},
+		{[]string{"pages", "-h"}, main.ErrUsage},
+		{[]string{"check"}, main.ErrPathRequired},
+		{[]string{"compact", path}, main.ErrPathRequired},
+		{[]string{"dump", path}, main.ErrPageIDRequired},
+		{[]string{"dump", path, "1000000"}, main.ErrPageNotFound},
+	} {
+		if err := NewMain().Run(tt.args...); err != tt.err {
+			t.Fatalf("%q: unexpected error: %v", tt.args, err)
+		}
+	}
+}
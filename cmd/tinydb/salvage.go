@@ -0,0 +1,282 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unsafe"
+
+	"tinydb"
+)
+
+// salvageTxMaxSize bounds the key and value bytes written by one
+// transaction of the "salvage" command.
+const salvageTxMaxSize = 64 << 20
+
+// salvageCommand represents the "salvage" command execution.
+type salvageCommand struct{ *Main }
+
+func newSalvageCommand(m *Main) *salvageCommand { return &salvageCommand{m} }
+
+// Run executes the command.
+func (cmd *salvageCommand) Run(args ...string) (err error) {
+	fs := flag.NewFlagSet("salvage", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	help := fs.Bool("h", false, "")
+	dstPath := fs.String("o", "", "")
+	pageSize := fs.Int("page-size", 0, "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	} else if *help {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	// Require database paths.
+	srcPath := fs.Arg(0)
+	if srcPath == "" || *dstPath == "" {
+		return ErrPathRequired
+	} else if _, err := os.Stat(srcPath); os.IsNotExist(err) {
+		return ErrFileNotFound
+	} else if _, err := os.Stat(*dstPath); err == nil {
+		return fmt.Errorf("salvage: %s already exists", *dstPath)
+	}
+
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if *pageSize == 0 {
+		if *pageSize, err = guessPageSize(f, fi.Size()); err != nil {
+			return err
+		}
+	}
+
+	db, err := tinydb.Open(*dstPath, &tinydb.Options{NoSync: true})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = os.Remove(*dstPath)
+		}
+	}()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Copy the pairs of each leaf page into a bucket of its own.
+	s := &salvager{}
+	var size int
+	for id := pgid(2); int64(id+1)*int64(*pageSize) <= fi.Size(); id++ {
+		buf, err := readLeafPage(f, *pageSize, fi.Size(), id)
+		if err != nil {
+			return err
+		} else if buf == nil {
+			continue
+		}
+		p := (*page)(unsafe.Pointer(&buf[0]))
+		s.pages++
+		if p.checksum != 0 && p.checksum != p.sum64(buf) {
+			s.mismatches++
+		}
+
+		b, err := tx.CreateBucket([]byte(fmt.Sprintf("page-%010d", id)))
+		if err != nil {
+			return err
+		}
+		s.copyLeaf(b, buf)
+
+		// Commit in chunks so that large files don't build up one huge
+		// transaction.
+		if size += len(buf); size > salvageTxMaxSize {
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			if tx, err = db.Begin(true); err != nil {
+				return err
+			}
+			size = 0
+		}
+	}
+
+	// Only the last commit syncs, which also flushes the earlier ones.
+	db.NoSync = false
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.Stdout, "Page size: %d\n", *pageSize)
+	fmt.Fprintf(cmd.Stdout, "Leaf pages: %d (%d with checksum mismatches)\n", s.pages, s.mismatches)
+	fmt.Fprintf(cmd.Stdout, "Key/value pairs: %d\n", s.pairs)
+	fmt.Fprintf(cmd.Stdout, "Buckets: %d (%d inline)\n", s.buckets, s.inline)
+	fmt.Fprintf(cmd.Stdout, "Undecodable elements: %d\n", s.skipped)
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *salvageCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb salvage [options] -o DST SRC
+
+Salvage is the last resort for a database that can't be opened, such as when
+both meta pages are invalid. It ignores the tree entirely: every page of SRC
+whose header has its own page id and the leaf flag is decoded, and each key
+and value that lies within the page is copied into a new database at DST,
+which must not exist.
+
+The pairs of each leaf page go into a top-level bucket of their own named
+"page-" followed by the zero-padded page id, since the tree that related
+them is gone. Nested bucket entries become nested buckets with the same
+sequence; the pairs of an inline bucket are copied into it, while a bucket
+with its own pages is left empty and its pages show up under their own ids.
+
+Free pages still hold older versions of the pages they were copied from, so
+a key can show up under several pages with different values. Pages whose
+checksum doesn't match are decoded too and counted in the summary.
+
+Additional options include:
+
+	-page-size SIZE
+		Page size of SRC. Defaults to the size recorded by a valid meta
+		page, or else the size at which most page headers hold their
+		own page id.
+`, "\n")
+}
+
+// salvager copies decodable leaf elements into buckets and counts them.
+type salvager struct {
+	pages      int
+	mismatches int
+	pairs      int
+	buckets    int
+	inline     int
+	skipped    int
+}
+
+// copyLeaf copies the elements of the leaf page at the start of buf into b,
+// skipping any that don't fit in buf or can't be stored.
+func (s *salvager) copyLeaf(b *tinydb.Bucket, buf []byte) {
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	count := int(p.count)
+	if max := (len(buf) - tinydb.PageHeaderSize) / tinydb.LeafPageElementSize; count > max {
+		s.skipped += count - max
+		count = max
+	}
+
+	for i := 0; i < count; i++ {
+		e := p.leafPageElement(uint16(i))
+		k, v := e.key(buf), e.value(buf)
+		if len(k) == 0 || v == nil {
+			s.skipped++
+			continue
+		}
+
+		if (e.flags & bucketLeafFlag) == 0 {
+			if err := b.Put(k, v); err != nil {
+				s.skipped++
+				continue
+			}
+			s.pairs++
+			continue
+		}
+
+		// Values are packed after their keys, so copy the bucket to read its
+		// header and inline page aligned.
+		if len(v) < int(unsafe.Sizeof(bucket{})) {
+			s.skipped++
+			continue
+		}
+		value := make([]byte, len(v))
+		copy(value, v)
+		hdr := (*bucket)(unsafe.Pointer(&value[0]))
+		child, err := b.CreateBucketIfNotExists(k)
+		if err != nil {
+			s.skipped++
+			continue
+		} else if err := child.SetSequence(hdr.sequence); err != nil {
+			s.skipped++
+			continue
+		}
+		s.buckets++
+
+		inline := value[unsafe.Sizeof(bucket{}):]
+		if hdr.root == 0 && len(inline) >= tinydb.PageHeaderSize {
+			if (*page)(unsafe.Pointer(&inline[0])).flags == leafPageFlag {
+				s.inline++
+				s.copyLeaf(child, inline)
+			}
+		}
+	}
+}
+
+// guessPageSize returns the page size recorded by a valid meta page or, if
+// both are invalid, the size at which the most page headers hold their own
+// page id.
+func guessPageSize(f *os.File, size int64) (int, error) {
+	if pageSize, _, err := readMeta(f); err == nil {
+		return pageSize, nil
+	}
+
+	best, bestN := 0, 0
+	hdr := make([]byte, tinydb.PageHeaderSize)
+	for sz := 1024; sz <= 64*1024; sz *= 2 {
+		n := 0
+		for id := int64(2); (id+1)*int64(sz) <= size; id++ {
+			if _, err := f.ReadAt(hdr, id*int64(sz)); err != nil {
+				return 0, err
+			}
+			p := (*page)(unsafe.Pointer(&hdr[0]))
+			if int64(p.id) == id && p.typ() != "unknown" {
+				n++
+			}
+		}
+		if n > bestN {
+			best, bestN = sz, n
+		}
+	}
+	if best == 0 {
+		return 0, fmt.Errorf("salvage: no pages found, set the page size with -page-size")
+	}
+	return best, nil
+}
+
+// readLeafPage reads the page with the given id and its overflow pages, up to
+// the end of the file. It returns nil if the page isn't a leaf page holding
+// its own id.
+func readLeafPage(f *os.File, pageSize int, size int64, id pgid) ([]byte, error) {
+	buf := make([]byte, pageSize)
+	if _, err := f.ReadAt(buf, int64(id)*int64(pageSize)); err != nil {
+		return nil, err
+	}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if p.id != id || p.flags != leafPageFlag {
+		return nil, nil
+	} else if p.overflow == 0 {
+		return buf, nil
+	}
+
+	n := (int64(p.overflow) + 1) * int64(pageSize)
+	if rem := size - int64(id)*int64(pageSize); n > rem {
+		n = rem
+	}
+	buf = make([]byte, n)
+	if _, err := f.ReadAt(buf, int64(id)*int64(pageSize)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf, nil
+}
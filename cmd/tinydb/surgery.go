@@ -0,0 +1,372 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unsafe"
+
+	"tinydb"
+)
+
+// surgeryCommand represents the "surgery" command execution.
+type surgeryCommand struct{ *Main }
+
+func newSurgeryCommand(m *Main) *surgeryCommand { return &surgeryCommand{m} }
+
+// Run executes the command.
+func (cmd *surgeryCommand) Run(args ...string) error {
+	// Require a subcommand at the beginning.
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintln(cmd.Stderr, cmd.Usage())
+		return ErrUsage
+	}
+
+	// Execute subcommand.
+	switch args[0] {
+	case "abandon-freelist":
+		return newAbandonFreelistCommand(cmd.Main).Run(args[1:]...)
+	case "clear-page":
+		return newClearPageCommand(cmd.Main).Run(args[1:]...)
+	case "copy-page":
+		return newCopyPageCommand(cmd.Main).Run(args[1:]...)
+	case "revert-meta":
+		return newRevertMetaCommand(cmd.Main).Run(args[1:]...)
+	default:
+		return ErrUnknownCommand
+	}
+}
+
+// Usage returns the help message.
+func (cmd *surgeryCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb surgery command [arguments] -o DST SRC
+
+Surgery performs page-level repairs on a damaged database. SRC is copied to
+DST, which must not exist, and only DST is modified. Run "tinydb check DST"
+afterwards to see what is left to repair.
+
+The commands are:
+
+	abandon-freelist  drop the freelist so it is rebuilt on the next open
+	clear-page        replace a page with an empty leaf page
+	copy-page         copy a page over another one
+	revert-meta       replace the current meta page with the previous one
+
+Use "tinydb surgery [command] -h" for more information about a command.
+`, "\n")
+}
+
+// surgeryFlags returns a flag set for a surgery subcommand with the -h and
+// -o flags every subcommand takes.
+func surgeryFlags(m *Main, name string) (*flag.FlagSet, *bool, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(m.Stderr)
+	help := fs.Bool("h", false, "")
+	dstPath := fs.String("o", "", "")
+	return fs, help, dstPath
+}
+
+// parseSurgeryArgs parses the flags of a surgery subcommand, copies the
+// source database to the destination and opens the copy for writing.
+func parseSurgeryArgs(m *Main, fs *flag.FlagSet, help *bool, dstPath *string, usage func() string, args []string) (*os.File, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	} else if *help {
+		fmt.Fprintln(m.Stderr, usage())
+		return nil, ErrUsage
+	}
+
+	// Require database paths.
+	srcPath := fs.Arg(0)
+	if srcPath == "" || *dstPath == "" {
+		return nil, ErrPathRequired
+	} else if _, err := os.Stat(srcPath); os.IsNotExist(err) {
+		return nil, ErrFileNotFound
+	}
+
+	if err := copyFile(srcPath, *dstPath); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(*dstPath, os.O_RDWR, 0)
+}
+
+// closeSurgeryFile closes the destination file of a surgery subcommand and
+// removes it if the repair failed, so it isn't mistaken for a result.
+func closeSurgeryFile(f *os.File, err *error) {
+	_ = f.Close()
+	if *err != nil {
+		_ = os.Remove(f.Name())
+	}
+}
+
+// copyFile copies the file at srcPath to a new file at dstPath.
+func copyFile(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// writePage writes a page read into buf, with its overflow pages, back to
+// the file at the position of its header id. A checksum already set on the
+// page is recomputed.
+func writePage(f *os.File, pageSize int, buf []byte) error {
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if p.checksum != 0 {
+		p.checksum = p.sum64(buf)
+	}
+	if _, err := f.WriteAt(buf, int64(p.id)*int64(pageSize)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// writeMeta writes m to meta page id, recomputing its checksum. Only the
+// meta fields are written, so the page header is left as it is.
+func writeMeta(f *os.File, pageSize int, id int, m *meta) error {
+	m.checksum = m.sum64()
+	buf := (*[unsafe.Sizeof(meta{})]byte)(unsafe.Pointer(m))[:]
+	if _, err := f.WriteAt(buf, int64(id*pageSize+tinydb.PageHeaderSize)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// freelistWarning is printed after repairs that can leave the freelist out
+// of step with the tree.
+const freelistWarning = `WARNING: the freelist may no longer match the tree. Run "tinydb surgery abandon-freelist" to rebuild it on the next open.`
+
+// copyPageCommand represents the "surgery copy-page" command execution.
+type copyPageCommand struct{ *Main }
+
+func newCopyPageCommand(m *Main) *copyPageCommand { return &copyPageCommand{m} }
+
+// Run executes the command.
+func (cmd *copyPageCommand) Run(args ...string) (err error) {
+	fs, help, dstPath := surgeryFlags(cmd.Main, "copy-page")
+	from := fs.Uint64("from-page", 0, "")
+	to := fs.Uint64("to-page", 0, "")
+	f, err := parseSurgeryArgs(cmd.Main, fs, help, dstPath, cmd.Usage, args)
+	if err != nil {
+		return err
+	}
+	defer closeSurgeryFile(f, &err)
+
+	pageSize, m, err := readMeta(f)
+	if err != nil {
+		return err
+	} else if *from == 0 || *to == 0 {
+		return ErrPageIDRequired
+	} else if *from == *to || *to < 2 {
+		return fmt.Errorf("invalid target page: %d", *to)
+	}
+
+	_, buf, err := readPage(f, pageSize, m, pgid(*from))
+	if err != nil {
+		return err
+	}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if pgid(*to)+pgid(p.overflow) >= m.pgid {
+		return fmt.Errorf("page %d: %d overflow pages would run past the high water mark", *to, p.overflow)
+	}
+
+	p.id = pgid(*to)
+	if err := writePage(f, pageSize, buf); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "The page %d was copied to page %d\n", *from, *to)
+	fmt.Fprintln(cmd.Stdout, freelistWarning)
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *copyPageCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb surgery copy-page -from-page FROM -to-page TO -o DST SRC
+
+Copy-page copies page FROM, with its overflow pages, over page TO and sets
+the page id in the copied header. Use it to put back a page whose content
+is known to be good, such as an older version the previous meta page still
+refers to.
+`, "\n")
+}
+
+// clearPageCommand represents the "surgery clear-page" command execution.
+type clearPageCommand struct{ *Main }
+
+func newClearPageCommand(m *Main) *clearPageCommand { return &clearPageCommand{m} }
+
+// Run executes the command.
+func (cmd *clearPageCommand) Run(args ...string) (err error) {
+	fs, help, dstPath := surgeryFlags(cmd.Main, "clear-page")
+	id := fs.Uint64("page-id", 0, "")
+	f, err := parseSurgeryArgs(cmd.Main, fs, help, dstPath, cmd.Usage, args)
+	if err != nil {
+		return err
+	}
+	defer closeSurgeryFile(f, &err)
+
+	pageSize, m, err := readMeta(f)
+	if err != nil {
+		return err
+	} else if *id == 0 {
+		return ErrPageIDRequired
+	} else if *id < 2 || pgid(*id) >= m.pgid {
+		return ErrPageNotFound
+	} else if pgid(*id) == m.freelist {
+		return fmt.Errorf("page %d is the freelist: use abandon-freelist instead", *id)
+	}
+
+	// The header may be scribbled, so only refuse pages that look like
+	// intact branch pages: clearing one drops every page below it.
+	buf := make([]byte, pageSize)
+	if _, err := f.ReadAt(buf, int64(*id)*int64(pageSize)); err != nil {
+		return err
+	}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if p.id == pgid(*id) && p.flags == branchPageFlag {
+		return fmt.Errorf("page %d is a branch page: clear its leaf pages instead", *id)
+	}
+	overflow := p.overflow
+
+	// Write an empty leaf page in its place.
+	for i := range buf {
+		buf[i] = 0
+	}
+	p.id = pgid(*id)
+	p.flags = leafPageFlag
+	p.checksum = p.sum64(buf)
+	if err := writePage(f, pageSize, buf); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "The page %d was cleared\n", *id)
+	if overflow > 0 {
+		fmt.Fprintf(cmd.Stdout, "Its header listed %d overflow pages, which are no longer referenced\n", overflow)
+	}
+	fmt.Fprintln(cmd.Stdout, freelistWarning)
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *clearPageCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb surgery clear-page -page-id ID -o DST SRC
+
+Clear-page replaces page ID with an empty leaf page, losing the keys it held
+but keeping the rest of its bucket readable. Intact branch pages and the
+freelist page are refused. Overflow pages of the old page are left
+unreferenced.
+`, "\n")
+}
+
+// revertMetaCommand represents the "surgery revert-meta" command execution.
+type revertMetaCommand struct{ *Main }
+
+func newRevertMetaCommand(m *Main) *revertMetaCommand { return &revertMetaCommand{m} }
+
+// Run executes the command.
+func (cmd *revertMetaCommand) Run(args ...string) (err error) {
+	fs, help, dstPath := surgeryFlags(cmd.Main, "revert-meta")
+	f, err := parseSurgeryArgs(cmd.Main, fs, help, dstPath, cmd.Usage, args)
+	if err != nil {
+		return err
+	}
+	defer closeSurgeryFile(f, &err)
+
+	pageSize, _, err := readMeta(f)
+	if err != nil {
+		return err
+	}
+
+	// Overwrite the newer meta page with the older one. An invalid meta page
+	// counts as the newer one, as it is most likely a torn write.
+	metas := readMetaPages(f, pageSize)
+	src, dst := 0, 1
+	switch {
+	case metas[0] == nil && metas[1] == nil:
+		return ErrInvalidMeta
+	case metas[0] == nil:
+		src, dst = 1, 0
+	case metas[1] == nil:
+	case metas[0].txid > metas[1].txid:
+		src, dst = 1, 0
+	}
+
+	if err := writeMeta(f, pageSize, dst, metas[src]); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "The meta page %d was reverted to transaction %d\n", dst, metas[src].txid)
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *revertMetaCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb surgery revert-meta -o DST SRC
+
+Revert-meta copies the previous meta page over the current one, rolling the
+database back to the previous commit. An invalid meta page is replaced by
+the valid one.
+`, "\n")
+}
+
+// abandonFreelistCommand represents the "surgery abandon-freelist" command execution.
+type abandonFreelistCommand struct{ *Main }
+
+func newAbandonFreelistCommand(m *Main) *abandonFreelistCommand { return &abandonFreelistCommand{m} }
+
+// Run executes the command.
+func (cmd *abandonFreelistCommand) Run(args ...string) (err error) {
+	fs, help, dstPath := surgeryFlags(cmd.Main, "abandon-freelist")
+	f, err := parseSurgeryArgs(cmd.Main, fs, help, dstPath, cmd.Usage, args)
+	if err != nil {
+		return err
+	}
+	defer closeSurgeryFile(f, &err)
+
+	pageSize, _, err := readMeta(f)
+	if err != nil {
+		return err
+	}
+	for id, m := range readMetaPages(f, pageSize) {
+		if m == nil {
+			continue
+		}
+		m.freelist = pgidNoFreelist
+		if err := writeMeta(f, pageSize, id, m); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(cmd.Stdout, "The freelist was abandoned in both meta pages")
+	return nil
+}
+
+// Usage returns the help message.
+func (cmd *abandonFreelistCommand) Usage() string {
+	return strings.TrimLeft(`
+usage: tinydb surgery abandon-freelist -o DST SRC
+
+Abandon-freelist marks the freelist as not written in both meta pages. Open
+then rebuilds it from the pages reachable from the tree, and writes it out
+again unless NoFreelistSync is set. Use it after repairs that change which
+pages are in use, or when the freelist page itself is damaged.
+`, "\n")
+}
@@ -0,0 +1,227 @@
+package main_test
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"tinydb"
+	main "tinydb/cmd/tinydb"
+)
+
+// pageIDs returns the ids of the pages of type typ listed by "pages".
+func pageIDs(t *testing.T, path, typ string) []string {
+	m := NewMain()
+	if err := m.Run("pages", path); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, line := range strings.Split(strings.TrimSpace(m.Stdout.String()), "\n")[2:] {
+		if f := strings.Fields(line); f[1] == typ {
+			ids = append(ids, f[0])
+		}
+	}
+	return ids
+}
+
+// mustView runs fn in a read transaction on the database at path.
+func mustView(t *testing.T, path string, fn func(*tinydb.Tx) error) {
+	db, err := tinydb.Open(path, &tinydb.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.View(fn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure "surgery clear-page" turns a scribbled leaf page into an empty one,
+// leaving the rest of the bucket readable.
+func TestSurgery_ClearPage(t *testing.T) {
+	path := mustCreate(t)
+	defer os.RemoveAll(path)
+	dstPath := path + ".repaired"
+	defer os.RemoveAll(dstPath)
+
+	// Scribble over the header and elements of the last leaf page of the
+	// bucket, which holds its last keys and the nested bucket.
+	var id int
+	for _, leaf := range pageIDs(t, path, "leaf") {
+		m := NewMain()
+		if err := m.Run("page", path, leaf); err != nil {
+			t.Fatal(err)
+		} else if strings.Contains(m.Stdout.String(), "0999: value\n") {
+			id, _ = strconv.Atoi(leaf)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte(strings.Repeat("\xde\xad\xbe\xef", 16)), int64(id*os.Getpagesize())); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewMain().Run("check", path); err != main.ErrCorrupt {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m := NewMain()
+	if err := m.Run("surgery", "clear-page", "-page-id", strconv.Itoa(id), "-o", dstPath, path); err != nil {
+		t.Fatal(err)
+	} else if out := m.Stdout.String(); !strings.Contains(out, "The page "+strconv.Itoa(id)+" was cleared\n") {
+		t.Fatalf("unexpected output: %s", out)
+	}
+
+	m = NewMain()
+	if err := m.Run("check", dstPath); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, m.Stdout.String())
+	}
+	mustView(t, dstPath, func(tx *tinydb.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("0001")); string(v) != "value" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := b.Get([]byte("0999")); v != nil {
+			t.Fatalf("unexpected value on cleared page: %q", v)
+		}
+		return nil
+	})
+
+	// Branch pages are refused and the destination is removed.
+	branch := pageIDs(t, path, "branch")[0]
+	if err := NewMain().Run("surgery", "clear-page", "-page-id", branch, "-o", path+".branch", path); err == nil {
+		t.Fatal("expected error for branch page")
+	} else if _, err := os.Stat(path + ".branch"); !os.IsNotExist(err) {
+		t.Fatalf("expected destination to be removed: %v", err)
+	}
+}
+
+// Ensure "surgery copy-page" copies a page and rewrites its id and checksum.
+func TestSurgery_CopyPage(t *testing.T) {
+	path := mustCreate(t)
+	defer os.RemoveAll(path)
+	dstPath := path + ".repaired"
+	defer os.RemoveAll(dstPath)
+
+	from, to := pageIDs(t, path, "leaf")[0], pageIDs(t, path, "free")[0]
+	m := NewMain()
+	if err := m.Run("surgery", "copy-page", "-from-page", from, "-to-page", to, "-o", dstPath, path); err != nil {
+		t.Fatal(err)
+	} else if out := m.Stdout.String(); !strings.Contains(out, "WARNING: the freelist may no longer match the tree.") {
+		t.Fatalf("unexpected output: %s", out)
+	}
+
+	m = NewMain()
+	if err := m.Run("page", dstPath, to); err != nil {
+		t.Fatal(err)
+	}
+	out := m.Stdout.String()
+	for _, s := range []string{"Page ID:    " + to + "\n", "Page Type:  leaf\n", "(ok)\n"} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("missing %q in:\n%s", s, out)
+		}
+	}
+
+	// An existing destination is left alone.
+	if err := NewMain().Run("surgery", "copy-page", "-from-page", from, "-to-page", to, "-o", dstPath, path); err == nil {
+		t.Fatal("expected error for existing destination")
+	} else if _, err := os.Stat(dstPath); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure "surgery revert-meta" rolls the database back to the previous commit.
+func TestSurgery_RevertMeta(t *testing.T) {
+	path := mustCreate(t)
+	defer os.RemoveAll(path)
+	dstPath := path + ".repaired"
+	defer os.RemoveAll(dstPath)
+
+	m := NewMain()
+	if err := m.Run("surgery", "revert-meta", "-o", dstPath, path); err != nil {
+		t.Fatal(err)
+	} else if out := m.Stdout.String(); out != "The meta page 1 was reverted to transaction 2\n" {
+		t.Fatalf("unexpected output: %s", out)
+	}
+
+	m = NewMain()
+	if err := m.Run("info", dstPath); err != nil {
+		t.Fatal(err)
+	} else if out := m.Stdout.String(); !strings.Contains(out, "Txn ID:     2\n") {
+		t.Fatalf("unexpected info:\n%s", out)
+	}
+	if err := NewMain().Run("check", dstPath); err != nil {
+		t.Fatal(err)
+	}
+	mustView(t, dstPath, func(tx *tinydb.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("0000")); string(v) != "value" {
+			t.Fatalf("expected key deleted by the last commit, got %q", v)
+		}
+		return nil
+	})
+}
+
+// Ensure "surgery abandon-freelist" makes Open rebuild the freelist.
+func TestSurgery_AbandonFreelist(t *testing.T) {
+	path := mustCreate(t)
+	defer os.RemoveAll(path)
+	dstPath := path + ".repaired"
+	defer os.RemoveAll(dstPath)
+
+	if err := NewMain().Run("surgery", "abandon-freelist", "-o", dstPath, path); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMain()
+	if err := m.Run("info", dstPath); err != nil {
+		t.Fatal(err)
+	} else if out := m.Stdout.String(); !strings.Contains(out, "Freelist:   <not synced>\n") {
+		t.Fatalf("unexpected info:\n%s", out)
+	}
+
+	// Opening for writing rebuilds the freelist and writes it out.
+	db, err := tinydb.Open(dstPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m = NewMain()
+	if err := m.Run("check", dstPath); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, m.Stdout.String())
+	}
+	m = NewMain()
+	if err := m.Run("info", dstPath); err != nil {
+		t.Fatal(err)
+	} else if out := m.Stdout.String(); strings.Contains(out, "<not synced>") {
+		t.Fatalf("expected freelist to be written:\n%s", out)
+	}
+}
+
+// Ensure surgery subcommands report usage and argument errors.
+func TestSurgery_Errors(t *testing.T) {
+	path := mustCreate(t)
+	defer os.RemoveAll(path)
+
+	for _, tt := range []struct {
+		args []string
+		err  error
+	}{
+		{[]string{"surgery"}, main.ErrUsage},
+		{[]string{"surgery", "foo"}, main.ErrUnknownCommand},
+		{[]string{"surgery", "revert-meta", "-h"}, main.ErrUsage},
+		{[]string{"surgery", "revert-meta", path}, main.ErrPathRequired},
+		{[]string{"surgery", "revert-meta", "-o", path + ".out", path + ".missing"}, main.ErrFileNotFound},
+		{[]string{"surgery", "clear-page", "-o", path + ".out", path}, main.ErrPageIDRequired},
+		{[]string{"surgery", "clear-page", "-page-id", "1000000", "-o", path + ".out", path}, main.ErrPageNotFound},
+	} {
+		if err := NewMain().Run(tt.args...); err != tt.err {
+			t.Fatalf("%q: unexpected error: %v", tt.args, err)
+		} else if _, err := os.Stat(path + ".out"); !os.IsNotExist(err) {
+			t.Fatalf("%q: destination left behind", tt.args)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package tinydb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// compactTxMaxSize bounds the key and value bytes copied by one write
+// transaction in CompactTo, so that dirty pages of a large database don't
+// all have to be held in memory until a single commit. It is a variable so
+// tests can lower it.
+var compactTxMaxSize int64 = 64 << 20
+
+// CompactTo copies every bucket, key/value pair and bucket sequence into a
+// new database file at path, filling split pages to fillPercent. The copy
+// is written in key order with almost no free pages, so it is usually much
+// smaller than the source after heavy deletes or rewrites. A fillPercent of
+// 0 packs pages as full as the fill percent bounds in Options allow.
+//
+// The copy is taken from a single read transaction, so writers can keep
+// running, but the pages they free can't be reused until it finishes. The
+// destination uses the same page size, freelist type and fill percent
+// bounds as the source and must not already exist. Named snapshots refer to
+// pages of the source file and are not copied.
+func (db *Db) CompactTo(path string, fillPercent float64) (err error) {
+	if fillPercent == 0 {
+		fillPercent = db.maxFillPercent
+	} else if fillPercent < db.minFillPercent || fillPercent > db.maxFillPercent {
+		return ErrInvalidFillPercent
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("compact: %s already exists", path)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	dst, err := Open(path, &Options{
+		PageSize:       db.pageSize,
+		FreelistType:   db.freelistType,
+		MinFillPercent: db.minFillPercent,
+		MaxFillPercent: db.maxFillPercent,
+		NoSync:         true,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = os.Remove(path)
+		}
+	}()
+
+	return db.View(func(src *Tx) error {
+		tx, err := dst.Begin(true)
+		if err != nil {
+			return err
+		}
+		c := &compactor{dst: dst, tx: tx, fillPercent: fillPercent}
+		defer func() { _ = c.tx.Rollback() }()
+
+		if err := c.copy(&src.root, nil); err != nil {
+			return err
+		}
+
+		// Only the last commit syncs, which also flushes the earlier ones.
+		dst.NoSync = false
+		return c.tx.Commit()
+	})
+}
+
+// compactor copies buckets into a destination database for CompactTo,
+// committing whenever a transaction has copied compactTxMaxSize bytes.
+type compactor struct {
+	dst         *Db
+	tx          *Tx
+	size        int64
+	fillPercent float64
+}
+
+// copy copies the contents of src into the destination bucket at path,
+// which must already exist. A nil path is the root bucket.
+func (c *compactor) copy(src *Bucket, path [][]byte) error {
+	cur := src.Cursor()
+	for k, v := cur.First(); k != nil; k, v = cur.Next() {
+		if path == nil && bytes.Equal(k, snapshotBucket) {
+			continue
+		}
+		if err := c.reserve(len(k) + len(v)); err != nil {
+			return err
+		}
+		dst := c.bucket(path)
+
+		if v == nil {
+			if child := src.Bucket(k); child != nil {
+				b, err := dst.CreateBucket(k)
+				if err != nil {
+					return err
+				}
+				if err := b.SetSequence(child.Sequence()); err != nil {
+					return err
+				}
+				if err := c.copy(child, append(path[:len(path):len(path)], k)); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := dst.Put(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reserve accounts for n bytes about to be copied, first committing and
+// starting a new transaction if they would go over compactTxMaxSize.
+func (c *compactor) reserve(n int) error {
+	if c.size > 0 && c.size+int64(n) > compactTxMaxSize {
+		if err := c.tx.Commit(); err != nil {
+			return err
+		}
+		tx, err := c.dst.Begin(true)
+		if err != nil {
+			return err
+		}
+		c.tx, c.size = tx, 0
+	}
+	c.size += int64(n)
+	return nil
+}
+
+// bucket returns the destination bucket at path in the current transaction.
+func (c *compactor) bucket(path [][]byte) *Bucket {
+	b := &c.tx.root
+	for _, name := range path {
+		b = b.Bucket(name)
+	}
+	b.FillPercent = c.fillPercent
+	return b
+}
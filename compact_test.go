@@ -0,0 +1,167 @@
+package tinydb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// Ensure that compacting a sparse database copies every bucket, key and
+// sequence into a smaller file, across several write transactions.
+func TestDb_CompactTo(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 5000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%05d", i)), bytes.Repeat([]byte{'v'}, 100)); err != nil {
+				return err
+			}
+		}
+		if err := b.SetSequence(42); err != nil {
+			return err
+		}
+		sub, err := b.CreateBucket([]byte("sub"))
+		if err != nil {
+			return err
+		}
+		if _, err := sub.NextSequence(); err != nil {
+			return err
+		}
+		if err := sub.Put([]byte("foo"), []byte("bar")); err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte("empty"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 5000; i++ {
+			if i%10 != 0 {
+				if err := b.Delete([]byte(fmt.Sprintf("%05d", i))); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateSnapshot([]byte("snap")); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(n int64) { compactTxMaxSize = n }(compactTxMaxSize)
+	compactTxMaxSize = 4096
+
+	dstPath := tempfile()
+	defer os.RemoveAll(dstPath)
+	if err := db.CompactTo(dstPath, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CompactTo(dstPath, 0); err == nil {
+		t.Fatal("expected error for existing destination")
+	}
+
+	dst, err := Open(dstPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := db.View(func(src *Tx) error {
+		return dst.View(func(tx *Tx) error {
+			if tx.ID() < 3 {
+				t.Fatalf("expected several commits, got txid %d", tx.ID())
+			}
+			if tx.snapshots() != nil {
+				t.Fatal("snapshot bucket copied")
+			}
+			if tx.Bucket([]byte("empty")) == nil {
+				t.Fatal("empty bucket not copied")
+			}
+			b := tx.Bucket([]byte("widgets"))
+			if b.Sequence() != 42 || b.Bucket([]byte("sub")).Sequence() != 1 {
+				t.Fatalf("unexpected sequences: %d, %d", b.Sequence(), b.Bucket([]byte("sub")).Sequence())
+			}
+
+			// Compare everything but the snapshot bucket.
+			for _, name := range []string{"widgets", "empty"} {
+				exp, got := hashOf(src.Bucket([]byte(name))), hashOf(tx.Bucket([]byte(name)))
+				if !bytes.Equal(exp, got) {
+					t.Fatalf("%s: contents differ", name)
+				}
+			}
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	srcInfo, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstInfo, err := os.Stat(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dstInfo.Size()*2 > srcInfo.Size() {
+		t.Fatalf("expected compacted file to be less than half the size: %d -> %d", srcInfo.Size(), dstInfo.Size())
+	}
+}
+
+// Ensure that an invalid fill percent is rejected.
+func TestDb_CompactTo_FillPercent(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	dstPath := tempfile()
+	defer os.RemoveAll(dstPath)
+	for _, fillPercent := range []float64{-1, 0.05, 1.5} {
+		if err := db.CompactTo(dstPath, fillPercent); err != ErrInvalidFillPercent {
+			t.Fatalf("%v: unexpected error: %v", fillPercent, err)
+		}
+	}
+	if _, err := os.Stat(dstPath); !os.IsNotExist(err) {
+		t.Fatalf("unexpected destination file: %v", err)
+	}
+}
+
+// Ensure that the fill percent is checked against the database's own bounds.
+func TestDb_CompactTo_FillPercentBounds(t *testing.T) {
+	path := tempfile()
+	defer os.RemoveAll(path)
+	db, err := Open(path, &Options{MinFillPercent: 0.05, MaxFillPercent: 0.8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	dstPath := tempfile()
+	defer os.RemoveAll(dstPath)
+	for _, fillPercent := range []float64{0.01, 0.9} {
+		if err := db.CompactTo(dstPath, fillPercent); err != ErrInvalidFillPercent {
+			t.Fatalf("%v: unexpected error: %v", fillPercent, err)
+		}
+	}
+	if err := db.CompactTo(dstPath, 0.07); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// hashOf returns the hash of the contents of b.
+func hashOf(b *Bucket) []byte {
+	h := sha256.New()
+	hashBucket(h, b)
+	return h.Sum(nil)
+}
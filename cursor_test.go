@@ -0,0 +1,195 @@
+package tinydb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// putKeys creates the "widgets" bucket and writes count keys of the form %04d.
+func putKeys(t *testing.T, db *Db, count int) {
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < count; i++ {
+			k := []byte(fmt.Sprintf("%04d", i))
+			if err := b.Put(k, k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a cursor returns nil keys on an empty bucket.
+func TestCursor_Empty(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	putKeys(t, db, 0)
+
+	if err := db.View(func(tx *Tx) error {
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		if k, v := c.First(); k != nil || v != nil {
+			t.Fatalf("unexpected first: %q=%q", k, v)
+		}
+		if k, v := c.Last(); k != nil || v != nil {
+			t.Fatalf("unexpected last: %q=%q", k, v)
+		}
+		if k, _ := c.Seek([]byte("foo")); k != nil {
+			t.Fatalf("unexpected seek: %q", k)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a cursor iterates forward and backward over every key in order.
+func TestCursor_Iterate(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	putKeys(t, db, 1000)
+
+	if err := db.View(func(tx *Tx) error {
+		c := tx.Bucket([]byte("widgets")).Cursor()
+
+		var i int
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			exp := []byte(fmt.Sprintf("%04d", i))
+			if !bytes.Equal(k, exp) || !bytes.Equal(v, exp) {
+				t.Fatalf("unexpected pair at %d: %q=%q", i, k, v)
+			}
+			i++
+		}
+		if i != 1000 {
+			t.Fatalf("exp=1000; got=%d", i)
+		}
+
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			i--
+			if exp := []byte(fmt.Sprintf("%04d", i)); !bytes.Equal(k, exp) {
+				t.Fatalf("unexpected key at %d: %q", i, k)
+			}
+		}
+		if i != 0 {
+			t.Fatalf("exp=0; got=%d", i)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a cursor can seek to exact keys and to the following key.
+func TestCursor_Seek(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	putKeys(t, db, 1000)
+
+	if err := db.View(func(tx *Tx) error {
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		if k, _ := c.Seek([]byte("0500")); string(k) != "0500" {
+			t.Fatalf("unexpected key: %q", k)
+		}
+		if k, _ := c.Seek([]byte("0500a")); string(k) != "0501" {
+			t.Fatalf("unexpected key: %q", k)
+		}
+		if k, _ := c.Seek([]byte("")); string(k) != "0000" {
+			t.Fatalf("unexpected key: %q", k)
+		}
+		if k, _ := c.Seek([]byte("1000")); k != nil {
+			t.Fatalf("unexpected key: %q", k)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a cursor sees uncommitted writes and reports buckets with nil values.
+func TestCursor_Writable(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		if _, err := tx.CreateBucket([]byte("b")); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.root.Put([]byte("a"), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.root.Put([]byte("c"), []byte("3")); err != nil {
+			t.Fatal(err)
+		}
+
+		c := tx.root.Cursor()
+		var got []string
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			got = append(got, fmt.Sprintf("%s=%v", k, v))
+		}
+		if exp := "[a=[49] b=[] c=[51]]"; fmt.Sprint(got) != exp {
+			t.Fatalf("exp=%s; got=%v", exp, got)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a cursor can delete keys while iterating.
+func TestCursor_Delete(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	putKeys(t, db, 1000)
+
+	if err := db.Update(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if _, err := b.CreateBucket([]byte("sub")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *Tx) error {
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		bound := []byte("0500")
+		for k, _ := c.First(); bytes.Compare(k, bound) < 0; k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c.Seek([]byte("sub"))
+		if err := c.Delete(); err != ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		var n int
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		k, _ := c.First()
+		if !bytes.Equal(k, []byte("0500")) {
+			t.Fatalf("unexpected first key: %q", k)
+		}
+		for ; k != nil; k, _ = c.Next() {
+			n++
+		}
+		if n != 501 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
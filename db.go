@@ -1,35 +1,131 @@
 package tinydb
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"runtime"
 	"sync"
+	"time"
 	"unsafe"
+
+	"tinydb/internal/failpoint"
 )
 
-// maxMapSize represents the largest mmap size supported by Bolt.
-const maxMapSize = 0xFFFFFFFFFFFF // 256TB
 // The largest step that can be taken when remapping the mmap.
 const maxMmapStep = 1 << 30 // 1GB
 
+// Default values if not set in a Db instance.
+const (
+	DefaultMaxBatchSize  int = 1000
+	DefaultMaxBatchDelay     = 10 * time.Millisecond
+)
+
+// Db represents a collection of buckets persisted to a file on disk.
+// All data access is performed through transactions which can be obtained through the Db.
 type Db struct {
+	// When enabled, the database will perform a Check() after every commit.
+	// A panic is issued if the database is in an inconsistent state. This
+	// flag has a large performance impact so it should only be used for
+	// debugging purposes.
+	StrictMode bool
+
+	// Setting the NoSync flag will cause the database to skip fsync()
+	// calls after each commit. This can be useful when bulk loading data
+	// into a database and you can restart the bulk load in the event of
+	// a system failure or database corruption. Do not set this flag for
+	// normal use.
+	//
+	// THIS IS UNSAFE. PLEASE USE WITH CAUTION.
+	NoSync bool
+
+	// When true, skips syncing freelist to disk. This improves the database
+	// write performance under normal operation, but requires a full database
+	// re-sync during recovery.
+	NoFreelistSync bool
+
+	// When true, skips the fsync() call when growing the database file.
+	// The file is still truncated to its new size.
+	NoGrowSync bool
+
+	// AllocSize is the step the file grows by when commits need more pages,
+	// amortizing the truncate and fsync over many commits. The file grows
+	// to the next multiple of AllocSize, but never past the largest mapping
+	// unless it is split into segments. Zero grows the file to exactly the
+	// pages in use.
+	AllocSize int
+
+	// Mlock locks the pages of the database file in memory, so they are
+	// never swapped out and reads never fault. The memory can't be
+	// reclaimed while the database is open, and locking can fail against
+	// RLIMIT_MEMLOCK. It is set by Open and can't be changed later.
+	// (UNIX only)
+	Mlock bool
+
+	// MaxBatchSize is the maximum size of a batch. Default value is
+	// copied from DefaultMaxBatchSize in Open.
+	//
+	// If <=0, disables batching.
+	//
+	// Do not change concurrently with calls to Batch.
+	MaxBatchSize int
+
+	// MaxBatchDelay is the maximum delay before a batch starts.
+	// Default value is copied from DefaultMaxBatchDelay in Open.
+	//
+	// If <=0, effectively disables batching.
+	//
+	// Do not change concurrently with calls to Batch.
+	MaxBatchDelay time.Duration
+
 	path     string
-	file     *os.File
+	opened   bool
+	readOnly bool
+	file     dbFile
 	dataref  []byte // mmap'ed readonly, write throws SEGV
 	data     *[maxMapSize]byte
 	datasz   int
+	cache    *pageCache   // pages read with pread instead of mmap, if set
+	segments *segmentFile // the file split into segments, if set
+	filesz   int          // current on disk file size
 	pageSize int
 	freelist *freelist
+
+	freelistType FreelistType
+	checksumMode ChecksumMode
+	mmapAdvice   MmapAdvice
+	punchHoles   int // minimum run of free pages to punch a hole over, or zero
+	commitLog    io.Writer
+	maxReadTxs   int
+
+	logger              Logger
+	hooks               Hooks
+	slowCommitThreshold time.Duration
+
+	minFillPercent float64 // floor applied to Bucket.FillPercent
+	maxFillPercent float64 // ceiling applied to Bucket.FillPercent
+
 	pagePool sync.Pool
 	rwtx     *Tx
+	txs      []*Tx                 // open read-only transactions
+	subs     map[string][]chan int // bucket change subscribers
+	stats    Stats
 
-	meta0 *meta
-	meta1 *meta
+	meta0   *meta
+	meta1   *meta
+	written txid // last meta page written, under metalock
+	durable txid // last meta page known to be on disk, under metalock
 
+	batchMu  sync.Mutex
+	batch    *batch
 	rwlock   sync.Mutex   // Allows only one writer at a time.
 	metalock sync.Mutex   // Protects meta page access.
 	mmaplock sync.RWMutex // Protects mmap access during remapping.
 	statlock sync.RWMutex // Protects stats access.
+	synclock sync.Mutex   // Serializes fsyncs so waiting commits share them.
+	subslock sync.Mutex   // Protects bucket subscriptions.
 }
 
 const tinyDBVersion = 1
@@ -38,45 +134,525 @@ const fileMode = 0666
 // default page size for db is set to the OS page size.
 var defaultPageSize = os.Getpagesize()
 
-func Open(path string) (*Db, error) {
+// The range of page sizes a database can be created with. Page sizes must
+// also be a power of two.
+const (
+	minPageSize = 1024
+	maxPageSize = 64 * 1024
+)
+
+// Open creates and opens a database at the given path.
+// If the file does not exist then it will be created automatically.
+// Opening MemoryPath creates a database held in memory instead.
+// Passing in nil options will cause tinydb to open the database with the
+// default options.
+// The file is locked exclusively until the database is closed, so opening
+// it again, from this or another process, blocks until then. Read-only
+// databases take a shared lock instead.
+func Open(path string, options *Options) (*Db, error) {
+	if options == nil {
+		options = DefaultOptions
+	}
 	db := &Db{
-		pageSize: defaultPageSize,
+		NoSync:              options.NoSync,
+		NoGrowSync:          options.NoGrowSync,
+		AllocSize:           options.AllocSize,
+		Mlock:               options.Mlock,
+		NoFreelistSync:      options.NoFreelistSync,
+		MaxBatchSize:        DefaultMaxBatchSize,
+		MaxBatchDelay:       DefaultMaxBatchDelay,
+		opened:              true,
+		minFillPercent:      options.MinFillPercent,
+		maxFillPercent:      options.MaxFillPercent,
+		freelistType:        options.FreelistType,
+		checksumMode:        options.ChecksumMode,
+		mmapAdvice:          options.MmapAdvice,
+		punchHoles:          options.PunchHoleMinPages,
+		commitLog:           options.CommitLog,
+		maxReadTxs:          options.MaxReadTxs,
+		logger:              options.Logger,
+		hooks:               options.Hooks,
+		slowCommitThreshold: options.SlowCommitThreshold,
+	}
+	if db.logger == nil {
+		db.logger = discardLogger{}
 	}
+	if db.minFillPercent == 0 {
+		db.minFillPercent = minFillPercent
+	}
+	if db.maxFillPercent == 0 {
+		db.maxFillPercent = maxFillPercent
+	}
+	if db.minFillPercent < 0 || db.minFillPercent > db.maxFillPercent || db.maxFillPercent > 1 {
+		return nil, ErrInvalidFillPercent
+	}
+	if db.freelistType == "" {
+		db.freelistType = FreelistArrayType
+	} else if db.freelistType != FreelistArrayType && db.freelistType != FreelistMapType {
+		return nil, fmt.Errorf("unknown freelist type: %q", db.freelistType)
+	}
+
 	flag := os.O_RDWR | os.O_CREATE
+	if options.ReadOnly {
+		flag = os.O_RDONLY
+		db.readOnly = true
+	}
 
 	// open data file
-	var err error
-	if db.file, err = os.OpenFile(path, flag, fileMode); err != nil {
+	if path == MemoryPath {
+		db.file = &memFile{}
+	} else if f, err := openSegmentFile(path, flag, options.SegmentSize); err != nil {
+		_ = db.close()
 		return nil, err
+	} else if f != nil {
+		db.file, db.segments = f, f
+	} else if f, err := os.OpenFile(path, flag, fileMode); err != nil {
+		_ = db.close()
+		return nil, err
+	} else {
+		db.file = f
 	}
 	db.path = db.file.Name()
 
+	// Lock file so that other processes using tinydb in read-write mode cannot
+	// use the database at the same time. This would cause corruption since
+	// the two processes would write meta pages and free pages separately.
+	// The database file is locked exclusively (only one process can grab the lock)
+	// if !options.ReadOnly.
+	// The database file is locked using the shared lock (more than one process may
+	// hold a lock at the same time) otherwise (options.ReadOnly is set).
+	// In-memory databases can't be shared, so they aren't locked.
+	if !db.inMemory() {
+		if err := flock(db, fileMode, !db.readOnly, options.Timeout); err != nil {
+			_ = db.close()
+			return nil, err
+		}
+	}
+
+	// Default values for test hooks
+	db.pageSize = options.PageSize
+	if db.pageSize == 0 {
+		db.pageSize = defaultPageSize
+	} else if db.pageSize < minPageSize || db.pageSize > maxPageSize || db.pageSize&(db.pageSize-1) != 0 {
+		_ = db.close()
+		return nil, ErrInvalidPageSize
+	}
+
 	// initialize the database if it doesn't exist
 	if fileInfo, err := db.file.Stat(); err != nil {
+		_ = db.close()
 		return nil, err
 	} else if fileInfo.Size() == 0 {
 		// initialize meta pages
 		if err := db.init(); err != nil {
-			_ = db.file.Close()
+			_ = db.close()
 			return nil, err
 		}
 	} else {
-		// read meta page to validate
-		var buf [4069]byte
-		bw, err := db.file.ReadAt(buf[:], 0)
-		if err == nil && bw == len(buf) {
-			m := db.pageInBuffer(buf[:], 0).meta()
-			if err = m.validate(); err != nil {
-				return nil, err
-			}
-		} else {
+		// Read the first meta page to determine the page size. If meta0
+		// fails validation it may just be a torn write, so look for meta1
+		// at each possible page size instead; mmap fails if both are invalid.
+		buf := make([]byte, 0x1000) // heap allocated so the page is 8-byte aligned
+		bw, err := db.file.ReadAt(buf, 0)
+		if bw < int(pageHeaderSize+unsafe.Sizeof(meta{})) {
+			_ = db.close()
 			return nil, ErrInvalid
+		} else if err != nil && err != io.EOF {
+			_ = db.close()
+			return nil, err
+		}
+		if m := db.pageInBuffer(buf, 0).meta(); m.validate() == nil {
+			db.pageSize = int(m.pageSize)
+		} else if pageSize, ok := db.secondMetaPageSize(); ok {
+			db.pageSize = pageSize
+		}
+	}
+
+	// Pages can't span segments, so segments hold a whole number of them.
+	if db.segments != nil && db.segments.size%db.pageSize != 0 {
+		_ = db.close()
+		return nil, ErrInvalidSegmentSize
+	}
+
+	// Preallocate the file so the first commits don't each have to grow it.
+	if !db.readOnly && options.InitialSize > 0 {
+		if err := db.preallocate(options.InitialSize); err != nil {
+			_ = db.close()
+			return nil, err
+		}
+	}
+
+	// Initialize page pool.
+	db.pagePool = sync.Pool{
+		New: func() interface{} {
+			return make([]byte, db.pageSize)
+		},
+	}
+
+	// Read pages through a cache instead of mapping the file if asked to, or
+	// if the platform can't map files. In-memory databases are always mapped.
+	if (options.NoMmap || runtime.GOOS == "js") && !db.inMemory() {
+		db.cache = newPageCache(db.file, db.pageSize, options.PageCacheSize)
+	}
+
+	// Memory map the data file.
+	if err := db.mmap(options.InitialMmapSize); err != nil {
+		_ = db.close()
+		return nil, err
+	}
+
+	if err := db.loadFreelist(); err != nil {
+		_ = db.close()
+		return nil, err
+	}
+
+	// Whatever meta page was read back is on disk.
+	db.written = db.meta().txid
+	db.durable = db.written
+
+	// Flush the freelist when transitioning from NoFreelistSync so the file
+	// opens quickly next time, and with versions that always expect one.
+	if !db.readOnly && !db.NoFreelistSync && !db.hasSyncedFreelist() {
+		tx, err := db.Begin(true)
+		if tx != nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			_ = db.close()
+			return nil, err
 		}
 	}
 
 	return db, nil
 }
 
+// loadFreelist reads the freelist, or rebuilds it if it wasn't written, and
+// pins the pages of named snapshots. With ChecksumOnOpen every reachable page
+// is verified first.
+func (db *Db) loadFreelist() (err error) {
+	tx := &Tx{}
+	tx.init(db)
+
+	// Damaged pages panic while the tree is walked.
+	defer func() {
+		if r := recover(); r != nil {
+			err = pageError(r)
+		}
+	}()
+	if db.checksumMode == ChecksumOnOpen {
+		tx.walkPages(tx.meta.root.root, 0, func(*page, int) {})
+	}
+
+	db.freelist = newFreelist(db.freelistType)
+	if db.segments != nil {
+		db.freelist.segmentPages = pgid(db.segments.size / db.pageSize)
+	}
+	if db.hasSyncedFreelist() {
+		p := db.page(db.meta().freelist)
+		if err := p.checkType(freelistPageFlag); err != nil {
+			return err
+		}
+		if db.checksumMode != ChecksumOff {
+			if err := tx.verify(p); err != nil {
+				return err
+			}
+		}
+		db.freelist.read(p)
+	} else {
+		db.freelist.readIDs(db.freepages())
+	}
+
+	// Keep the pages of named snapshots allocated.
+	db.freelist.pinned = tx.snapshotPages(nil)
+	return nil
+}
+
+// hasSyncedFreelist returns true if the current meta points at a freelist page.
+func (db *Db) hasSyncedFreelist() bool {
+	return db.meta().freelist != pgidNoFreelist
+}
+
+// freepages returns every page below the high water mark that is not
+// reachable from the current meta, which is the freelist of a database
+// written with NoFreelistSync.
+func (db *Db) freepages() []pgid {
+	tx := &Tx{}
+	tx.init(db)
+
+	reachable := tx.snapshotPages(nil)
+	tx.markReachable(tx.root.root, reachable)
+
+	var ids []pgid
+	for id := pgid(2); id < tx.meta.pgid; id++ {
+		if !reachable[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// markReachable marks every page of the bucket tree rooted at root and its
+// nested buckets, including overflow pages.
+func (tx *Tx) markReachable(root pgid, reachable map[pgid]bool) {
+	tx.walkPages(root, 0, func(p *page, _ int) {
+		// Inline buckets live inside their parent's page.
+		if p.id == 0 {
+			return
+		}
+		for i := pgid(0); i <= pgid(p.overflow); i++ {
+			reachable[p.id+i] = true
+		}
+	})
+}
+
+// Options represents the options that can be set when opening a database.
+type Options struct {
+	// Timeout is the amount of time to wait to obtain a file lock.
+	// When set to zero it will wait indefinitely.
+	Timeout time.Duration
+
+	// Sets the Db.NoGrowSync flag before memory mapping the file.
+	NoGrowSync bool
+
+	// Do not sync freelist to disk. This improves the database write performance
+	// under normal operation, but requires a full database re-sync during recovery.
+	NoFreelistSync bool
+
+	// FreelistType sets the backend freelist type. There are two options.
+	// Array which is simple but endures dramatic performance degradation if
+	// the database is large and fragmentation in freelist is common.
+	// The alternative one is using hashmap, it is faster in almost all
+	// circumstances but it doesn't guarantee that it offers the smallest
+	// page id available. In normal case it is safe.
+	// The default type is array.
+	FreelistType FreelistType
+
+	// Open database in read-only mode. Uses flock(..., LOCK_SH |LOCK_NB) to
+	// grab a shared lock (UNIX).
+	ReadOnly bool
+
+	// InitialMmapSize is the initial mmap size of the database
+	// in bytes. Read transactions won't block write transaction
+	// if the InitialMmapSize is large enough to hold database mmap
+	// size. (See Db.Begin for more information)
+	//
+	// If <=0, the initial map size is 0.
+	// If initialMmapSize is smaller than the previous database size,
+	// it takes no effect.
+	InitialMmapSize int
+
+	// PageSize overrides the default OS page size when creating a new
+	// database and must be a power of two between 1KB and 64KB. Existing
+	// databases always use the page size stored in their meta pages, so a
+	// file created on a machine with 16KB pages opens on one with 4KB pages.
+	PageSize int
+
+	// NoSync sets the initial value of Db.NoSync. Normally this can just be
+	// set directly on the Db itself when returned from Open(), but this option
+	// is useful in APIs which expose Options but not the underlying Db.
+	NoSync bool
+
+	// ChecksumMode selects when page checksums are verified. Checksums are
+	// always written, so verification can be enabled at any time. The
+	// default, ChecksumOff, skips verification.
+	ChecksumMode ChecksumMode
+
+	// MaxReadTxs caps the number of read-only transactions that can be open
+	// at once. Beginning another one returns an error wrapping
+	// ErrTooManyReadTxs, which surfaces transactions leaked by a missing
+	// Rollback before they exhaust memory or block remapping. Zero means
+	// no limit.
+	MaxReadTxs int
+
+	// CommitLog receives one line per committed write transaction listing
+	// the page ids it freed and allocated and the buckets whose root page
+	// changed. It is meant for diagnosing unexpected file growth and write
+	// amplification and costs an extra walk of the open buckets per commit.
+	CommitLog io.Writer
+
+	// Logger receives diagnostic messages such as remaps and validation
+	// failures. By default messages are discarded.
+	Logger Logger
+
+	// Hooks are called when notable events happen, alongside the messages
+	// sent to Logger.
+	Hooks Hooks
+
+	// SlowCommitThreshold is the commit duration at or above which a commit
+	// is reported to Logger and Hooks.SlowCommit. Zero disables reporting.
+	SlowCommitThreshold time.Duration
+
+	// MinFillPercent and MaxFillPercent bound Bucket.FillPercent for every
+	// bucket in the database. Lower ceilings leave room on split pages for
+	// random inserts, reducing rewrites at the cost of file size, while
+	// higher floors pack pages tighter. Zero uses the defaults of 0.1 and
+	// 1.0, so a floor of exactly zero can't be set; a small positive floor
+	// such as 0.01 splits pages almost as early. Open fails unless
+	// MinFillPercent <= MaxFillPercent <= 1 and neither is negative.
+	MinFillPercent float64
+	MaxFillPercent float64
+
+	// NoMmap reads pages from the file with pread into a cache instead of
+	// memory mapping it, for platforms and filesystems where mmap is
+	// unavailable or unreliable. Values returned by Get stay valid for the
+	// life of the transaction as usual. It is always set on js/wasm and
+	// ignored for databases opened at MemoryPath.
+	NoMmap bool
+
+	// PageCacheSize is the number of pages kept in the cache when NoMmap is
+	// set. Evicted pages stay in memory while open transactions reference
+	// them. Zero uses DefaultPageCacheSize.
+	PageCacheSize int
+
+	// SegmentSize splits a new database into segment files of this many
+	// bytes, named path, path.1, path.2 and so on, that are mapped
+	// separately. Growing the database then maps one new segment instead of
+	// remapping the whole file, so it doesn't wait for readers, and the
+	// database can grow past the largest single mapping. It must be a
+	// multiple of the page size, and values can't span segments, so it also
+	// bounds the largest value. Databases already split into segments
+	// always open with their own segment size; a database that isn't can
+	// only be split while it fits in the first segment. Zero disables
+	// segments.
+	SegmentSize int
+
+	// MmapAdvice tells the kernel how the mapping will be accessed. The
+	// default, MmapAdviceRandom, disables readahead, which suits lookups
+	// on databases larger than memory. It has no effect on Windows or with
+	// NoMmap.
+	MmapAdvice MmapAdvice
+
+	// InitialSize preallocates the file to at least this many bytes, rounded
+	// up to the page size, when it is opened for writing. Files that are
+	// already larger are left alone.
+	InitialSize int
+
+	// AllocSize sets Db.AllocSize.
+	AllocSize int
+
+	// Mlock sets Db.Mlock. It has no effect with NoMmap or for databases
+	// opened at MemoryPath. (UNIX only)
+	Mlock bool
+
+	// PunchHoleMinPages punches holes (FALLOC_FL_PUNCH_HOLE) over runs of
+	// at least this many free pages once no reader can use them, so the
+	// filesystem releases their blocks while the file keeps its size. This
+	// reclaims disk space after large deletes without compacting, at the
+	// cost of the blocks being allocated again when the pages are reused.
+	// If the filesystem doesn't support it, punching stops after the first
+	// failure, which is logged. Zero disables it. (Linux only)
+	PunchHoleMinPages int
+}
+
+// MmapAdvice is the access pattern passed to madvise for the mapping.
+type MmapAdvice int
+
+const (
+	// MmapAdviceRandom expects pages to be read in random order
+	// (MADV_RANDOM), so only the faulting page is read.
+	MmapAdviceRandom MmapAdvice = iota
+
+	// MmapAdviceNormal leaves readahead to the kernel (MADV_NORMAL).
+	MmapAdviceNormal
+
+	// MmapAdviceSequential expects pages to be read in order
+	// (MADV_SEQUENTIAL), as by full scans and backups.
+	MmapAdviceSequential
+
+	// MmapAdviceWillNeed reads the mapping ahead as soon as it is made
+	// (MADV_WILLNEED).
+	MmapAdviceWillNeed
+)
+
+// ChecksumMode selects when page checksums are verified.
+type ChecksumMode int
+
+const (
+	// ChecksumOff writes page checksums but never verifies them.
+	ChecksumOff ChecksumMode = iota
+
+	// ChecksumOnRead verifies each page the first time a transaction reads
+	// it. A mismatch fails the transaction with a *PageChecksumError.
+	ChecksumOnRead
+
+	// ChecksumOnOpen verifies every page reachable from the current meta
+	// page when the database is opened, and then verifies on read.
+	ChecksumOnOpen
+)
+
+// DefaultOptions represent the options used if nil options are passed into Open().
+// No timeout is used which will cause tinydb to wait indefinitely for a lock.
+var DefaultOptions = &Options{
+	Timeout:      0,
+	NoGrowSync:   false,
+	FreelistType: FreelistArrayType,
+}
+
+// Close releases all database resources.
+// It will block waiting for any open transactions to finish
+// before closing the database and returning.
+func (db *Db) Close() error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	// Make commits that didn't wait for their fsync durable.
+	if !db.NoSync {
+		if err := db.syncWritten(); err != nil {
+			return err
+		}
+	}
+
+	db.metalock.Lock()
+	defer db.metalock.Unlock()
+
+	db.mmaplock.Lock()
+	defer db.mmaplock.Unlock()
+
+	return db.close()
+}
+
+func (db *Db) close() error {
+	if !db.opened {
+		return nil
+	}
+	db.opened = false
+	db.freelist = nil
+
+	// Close bucket subscriptions so receivers stop waiting.
+	db.subslock.Lock()
+	for _, subs := range db.subs {
+		for _, ch := range subs {
+			close(ch)
+		}
+	}
+	db.subs = nil
+	db.subslock.Unlock()
+
+	// Close the mmap.
+	if err := db.munmap(); err != nil {
+		return err
+	}
+
+	// Close file handles.
+	if db.file != nil {
+		// Unlock the file.
+		if !db.inMemory() {
+			if err := funlock(db); err != nil {
+				log.Printf("tinydb.Close(): funlock error: %s", err)
+			}
+		}
+
+		// Close the file descriptor.
+		if err := db.file.Close(); err != nil {
+			return fmt.Errorf("db file close: %s", err)
+		}
+		db.file = nil
+	}
+
+	db.path = ""
+	return nil
+}
+
 // init creates a new database file and initialize its meta pages.
 func (db *Db) init() error {
 	buf := make([]byte, db.pageSize*4)
@@ -86,34 +662,802 @@ func (db *Db) init() error {
 		// buf[:] to get slice struct array address
 		page := db.pageInBuffer(buf[:], i)
 		page.id = pgid(i)
+		page.flags = metaPageFlag
 
 		// init meta page
 		m := page.meta()
-		m.pgid = pgid(i)
-		m.pageSize = uint32(db.pageSize)
 		m.version = tinyDBVersion
+		m.pageSize = uint32(db.pageSize)
+		m.freelist = 2
+		m.root = bucket{root: 3}
+		m.pgid = 4
+		m.txid = txid(i)
 		m.checksum = m.sum64()
 	}
 
 	// create a freelist page
 	p := db.pageInBuffer(buf[:], 2)
 	p.id = pgid(2)
+	p.flags = freelistPageFlag
+	p.count = 0
 
-	// create a empty leaf page for preparation
+	// create a empty leaf page for the root bucket
 	p = db.pageInBuffer(buf[:], 3)
-	p.id = pgid(2)
+	p.id = pgid(3)
+	p.flags = leafPageFlag
+	p.count = 0
+
+	for i := 2; i < 4; i++ {
+		p = db.pageInBuffer(buf[:], i)
+		p.checksum = p.sum64(db.pageSize)
+	}
 
-	if _, err := db.file.Write(buf); err != nil {
+	if _, err := db.file.WriteAt(buf, 0); err != nil {
 		return err
 	}
 
 	if err := db.file.Sync(); err != nil {
 		return err
 	}
+	db.filesz = len(buf)
 
 	return nil
 }
 
+// Begin starts a new transaction.
+// Multiple read-only transactions can be used concurrently but only one
+// write transaction can be used at a time. Starting multiple write transactions
+// will cause the calls to block and be serialized until the current write
+// transaction finishes.
+//
+// Transactions should not be dependent on one another. Opening a read
+// transaction and a write transaction in the same goroutine can cause the
+// writer to deadlock because the database periodically needs to re-mmap itself
+// as it grows and it cannot do that while a read transaction is open.
+//
+// IMPORTANT: You must close read-only transactions after you are finished or
+// else the database will not reclaim old pages.
+func (db *Db) Begin(writable bool) (*Tx, error) {
+	if writable {
+		return db.beginRWTx()
+	}
+	return db.beginTx()
+}
+
+func (db *Db) beginTx() (*Tx, error) {
+	// Lock the meta pages while we initialize the transaction. We obtain
+	// the meta lock before the mmap lock because that's the order that the
+	// write transaction will obtain them.
+	db.metalock.Lock()
+
+	// Obtain a read-only lock on the mmap. When the mmap is remapped it will
+	// obtain a write lock so all transactions must be closed before it can be
+	// remapped.
+	db.mmaplock.RLock()
+
+	// Exit if the database is not open yet.
+	if !db.opened {
+		db.mmaplock.RUnlock()
+		db.metalock.Unlock()
+		return nil, ErrDatabaseNotOpen
+	}
+
+	// Refuse new readers once the cap is reached. Readers that are never
+	// rolled back pin the mmap and the pages freed since they started.
+	if db.maxReadTxs > 0 && len(db.txs) >= db.maxReadTxs {
+		db.mmaplock.RUnlock()
+		db.metalock.Unlock()
+		return nil, fmt.Errorf("%w: %d of %d open, check for read transactions that are never rolled back",
+			ErrTooManyReadTxs, len(db.txs), db.maxReadTxs)
+	}
+
+	// Create a transaction associated with the database.
+	t := &Tx{}
+	t.init(db)
+
+	// Keep track of transaction until it closes.
+	db.txs = append(db.txs, t)
+	n := len(db.txs)
+
+	// Unlock the meta pages.
+	db.metalock.Unlock()
+
+	// Update the transaction stats.
+	db.statlock.Lock()
+	db.stats.TxN++
+	db.stats.OpenTxN = n
+	db.statlock.Unlock()
+
+	return t, nil
+}
+
+func (db *Db) beginRWTx() (*Tx, error) {
+	// If the database was opened with Options.ReadOnly, return an error.
+	if db.readOnly {
+		return nil, ErrDatabaseReadOnly
+	}
+
+	// Obtain writer lock. This is released by the transaction when it closes.
+	// This enforces only one writer transaction at a time.
+	db.rwlock.Lock()
+
+	// Once we have the writer lock then we can lock the meta pages so that
+	// we can set up the transaction.
+	db.metalock.Lock()
+
+	// Exit if the database is not open yet.
+	if !db.opened {
+		db.metalock.Unlock()
+		db.rwlock.Unlock()
+		return nil, ErrDatabaseNotOpen
+	}
+
+	// Create a transaction associated with the database.
+	t := &Tx{writable: true}
+	t.init(db)
+	db.rwtx = t
+
+	// Free any pages associated with closed read-only transactions. Pages
+	// freed by a commit may still be referenced by readers that began
+	// before it, so only release pages freed before the oldest open reader.
+	var minid txid = 0xFFFFFFFFFFFFFFFF
+	for _, t := range db.txs {
+		if t.meta.txid < minid {
+			minid = t.meta.txid
+		}
+	}
+
+	// Until a commit is on disk, a crash recovers to the meta page before
+	// it, which still references the pages the commit freed.
+	if !db.NoSync && db.durable < minid {
+		minid = db.durable + 1
+	}
+	var runs []freeRun
+	if minid > 0 {
+		released := db.freelist.release(minid - 1)
+		if db.punchHoles > 0 && len(released) > 0 {
+			runs = db.freelist.runs(released, db.punchHoles)
+		}
+	}
+	db.metalock.Unlock()
+
+	// Punch holes over the released pages before the transaction can
+	// allocate them, without keeping readers waiting on the meta lock.
+	db.punchFreeRuns(runs)
+
+	return t, nil
+}
+
+// punchFreeRuns punches holes in the file over runs of free pages so the
+// filesystem can release their blocks. Punching is turned off after the
+// first failure, since it usually means the filesystem doesn't support it.
+func (db *Db) punchFreeRuns(runs []freeRun) {
+	for _, r := range runs {
+		off, size := int64(r.start)*int64(db.pageSize), int64(r.n)*int64(db.pageSize)
+		var err error
+		switch f := db.file.(type) {
+		case *os.File:
+			err = punchHole(f, off, size)
+		case *segmentFile:
+			err = f.punchHole(off, size)
+		}
+		if err != nil {
+			db.punchFailed(err)
+			db.punchHoles = 0
+			return
+		}
+	}
+}
+
+// removeTx removes a transaction from the database.
+func (db *Db) removeTx(tx *Tx) {
+	// Release the read lock on the mmap.
+	db.mmaplock.RUnlock()
+
+	// Use the meta lock to restrict access to the DB object.
+	db.metalock.Lock()
+	for i, t := range db.txs {
+		if t == tx {
+			last := len(db.txs) - 1
+			db.txs[i] = db.txs[last]
+			db.txs[last] = nil
+			db.txs = db.txs[:last]
+			break
+		}
+	}
+	n := len(db.txs)
+	db.metalock.Unlock()
+
+	// Merge statistics.
+	db.statlock.Lock()
+	db.stats.OpenTxN = n
+	db.stats.TxStats.add(&tx.stats)
+	db.statlock.Unlock()
+}
+
+// Update executes a function within the context of a read-write managed transaction.
+// If no error is returned from the function then the transaction is committed.
+// If an error is returned then the entire transaction is rolled back.
+// Any error that is returned from the function or returned from the commit is
+// returned from the Update() method.
+//
+// Attempting to manually commit or rollback within the function will cause a panic.
+func (db *Db) Update(fn func(*Tx) error) (err error) {
+	t, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the transaction rolls back in the event of a panic.
+	defer func() {
+		if t.db != nil {
+			t.rollback()
+		}
+		if r := recover(); r != nil {
+			err = pageError(r)
+		}
+	}()
+
+	// Mark as a managed tx so that the inner function cannot manually commit.
+	t.managed = true
+
+	// If an error is returned from the function then rollback and return error.
+	err = fn(t)
+	t.managed = false
+	if err != nil {
+		_ = t.Rollback()
+		return err
+	}
+
+	return t.Commit()
+}
+
+// View executes a function within the context of a managed read-only transaction.
+// Any error that is returned from the function is returned from the View() method.
+//
+// Attempting to manually rollback within the function will cause a panic.
+func (db *Db) View(fn func(*Tx) error) (err error) {
+	t, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the transaction rolls back in the event of a panic.
+	defer func() {
+		if t.db != nil {
+			t.rollback()
+		}
+		if r := recover(); r != nil {
+			err = pageError(r)
+		}
+	}()
+
+	// Mark as a managed tx so that the inner function cannot manually rollback.
+	t.managed = true
+
+	// If an error is returned from the function then pass it through.
+	err = fn(t)
+	t.managed = false
+	if err != nil {
+		_ = t.Rollback()
+		return err
+	}
+
+	return t.Rollback()
+}
+
+// Batch calls fn as part of a batch. It behaves similar to Update,
+// except:
+//
+// 1. concurrent Batch calls can be combined into a single tinydb
+// transaction.
+//
+// 2. the function passed to Batch may be called multiple times,
+// regardless of whether it returns error or not.
+//
+// This means that Batch function side effects must be idempotent and
+// take permanent effect only after a successful return is seen in
+// caller.
+//
+// The maximum batch size and delay can be adjusted with Db.MaxBatchSize
+// and Db.MaxBatchDelay, respectively.
+//
+// Batch is only useful when there are multiple goroutines calling it.
+func (db *Db) Batch(fn func(*Tx) error) error {
+	errCh := make(chan error, 1)
+
+	db.batchMu.Lock()
+	if (db.batch == nil) || (db.batch != nil && len(db.batch.calls) >= db.MaxBatchSize) {
+		// There is no existing batch, or the existing batch is full; start a new one.
+		db.batch = &batch{
+			db: db,
+		}
+		db.batch.timer = time.AfterFunc(db.MaxBatchDelay, db.batch.trigger)
+	}
+	db.batch.calls = append(db.batch.calls, call{fn: fn, err: errCh})
+	if len(db.batch.calls) >= db.MaxBatchSize {
+		// wake up batch, it's ready to run
+		go db.batch.trigger()
+	}
+	db.batchMu.Unlock()
+
+	err := <-errCh
+	if err == trySolo {
+		err = db.Update(fn)
+	}
+	return err
+}
+
+type call struct {
+	fn  func(*Tx) error
+	err chan<- error
+}
+
+type batch struct {
+	db    *Db
+	timer *time.Timer
+	start sync.Once
+	calls []call
+}
+
+// trigger runs the batch if it hasn't already been run.
+func (b *batch) trigger() {
+	b.start.Do(b.run)
+}
+
+// run performs the transactions in the batch and communicates results
+// back to Batch.
+func (b *batch) run() {
+	b.db.batchMu.Lock()
+	b.timer.Stop()
+	// Make sure no new work is added to this batch, but don't break
+	// other batches.
+	if b.db.batch == b {
+		b.db.batch = nil
+	}
+	b.db.batchMu.Unlock()
+
+retry:
+	for len(b.calls) > 0 {
+		var failIdx = -1
+		err := b.db.Update(func(tx *Tx) error {
+			for i, c := range b.calls {
+				if err := safelyCall(c.fn, tx); err != nil {
+					failIdx = i
+					return err
+				}
+			}
+			return nil
+		})
+
+		if failIdx >= 0 {
+			// take the failing transaction out of the batch. it's
+			// safe to shorten b.calls here because db.batch no longer
+			// points to us, and we hold the mutex anyway.
+			c := b.calls[failIdx]
+			b.calls[failIdx], b.calls = b.calls[len(b.calls)-1], b.calls[:len(b.calls)-1]
+			// tell the submitter re-run it solo, continue with the rest of the batch
+			c.err <- trySolo
+			continue retry
+		}
+
+		// pass success, or tinydb internal errors, to all callers
+		for _, c := range b.calls {
+			c.err <- err
+		}
+		break retry
+	}
+}
+
+// trySolo is a special sentinel error value used for signaling that a
+// transaction function should be re-run. It should never be seen by
+// callers.
+var trySolo = errors.New("batch function returned an error and should be re-run solo")
+
+type panicked struct {
+	reason interface{}
+}
+
+func (p panicked) Error() string {
+	if err, ok := p.reason.(error); ok {
+		return err.Error()
+	}
+	return fmt.Sprintf("panic: %v", p.reason)
+}
+
+func safelyCall(fn func(*Tx) error, tx *Tx) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = panicked{p}
+		}
+	}()
+	return fn(tx)
+}
+
+// pageError returns the recovered value r as an error if it was caused by an
+// unknown page type. Any other panic is propagated.
+func pageError(r interface{}) error {
+	switch err := r.(type) {
+	case *UnknownPageTypeError:
+		return err
+	case *PageChecksumError:
+		return err
+	}
+	panic(r)
+}
+
+// Stats retrieves ongoing performance stats for the database.
+// This is only updated when a transaction closes.
+func (db *Db) Stats() Stats {
+	db.statlock.RLock()
+	defer db.statlock.RUnlock()
+	return db.stats
+}
+
+// FreelistStats returns the current state of the freelist, showing how
+// fragmented the file is. It waits for any open read/write transaction to
+// close first.
+func (db *Db) FreelistStats() FreelistStats {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.freelist == nil {
+		return FreelistStats{}
+	}
+
+	s := FreelistStats{
+		FreePageN:    db.freelist.free_count(),
+		PendingPageN: db.freelist.pending_count(),
+		Pending:      make(map[int]int, len(db.freelist.pending)),
+		LargestRun:   db.freelist.largestRun(),
+		Size:         int(db.freelist.size()),
+	}
+	for id, ids := range db.freelist.pending {
+		s.Pending[int(id)] = len(ids)
+	}
+	return s
+}
+
+// Warmup reads every page in use into memory, so that the first reads
+// after a cold start don't each wait on a page fault. The kernel is asked to
+// read the mapping ahead with MADV_WILLNEED and every page is then touched to
+// fault it in. Databases opened with NoMmap read the file through instead,
+// which fills the operating system's cache rather than the page cache.
+//
+// Warmup can run alongside transactions, but holds off remapping until it
+// returns, like a read-only transaction.
+func (db *Db) Warmup() error {
+	db.metalock.Lock()
+	db.mmaplock.RLock()
+	defer db.mmaplock.RUnlock()
+	if !db.opened {
+		db.metalock.Unlock()
+		return ErrDatabaseNotOpen
+	}
+	size := int64(db.meta().pgid) * int64(db.pageSize)
+	db.metalock.Unlock()
+
+	if db.inMemory() {
+		return nil
+	} else if db.cache != nil {
+		_, err := io.Copy(io.Discard, io.NewSectionReader(db.file, 0, size))
+		return err
+	}
+
+	return db.eachMapping(size, func(b []byte) error {
+		if err := adviseMmap(b, MmapAdviceWillNeed); err != nil {
+			return err
+		}
+		touchPages(b)
+		return nil
+	})
+}
+
+// eachMapping calls fn with each mapping of the file, cut to the first sz
+// bytes of the file overall.
+func (db *Db) eachMapping(sz int64, fn func(b []byte) error) error {
+	maps := [][]byte{db.dataref}
+	if db.segments != nil {
+		maps = db.segments.maps.Load().([][]byte)
+	}
+	for _, b := range maps {
+		if sz <= 0 {
+			break
+		} else if int64(len(b)) > sz {
+			b = b[:sz]
+		}
+		sz -= int64(len(b))
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mlock locks the first sz bytes of the mapping in memory if Mlock is set.
+// Locks are released when the mapping is unmapped.
+func (db *Db) mlock(sz int) error {
+	if !db.Mlock || db.cache != nil || db.inMemory() {
+		return nil
+	}
+	return db.eachMapping(int64(sz), mlock)
+}
+
+// touchPages reads a byte of every OS page in b to fault it in.
+func touchPages(b []byte) {
+	var sum byte
+	for i := 0; i < len(b); i += os.Getpagesize() {
+		sum += b[i]
+	}
+	runtime.KeepAlive(sum) // keep the reads from being optimized away
+}
+
+// Stats represents statistics about the database.
+type Stats struct {
+	// Freelist stats
+	FreePageN     int // total number of free pages on the freelist
+	PendingPageN  int // total number of pending pages on the freelist
+	FreeAlloc     int // total bytes allocated in free pages
+	FreelistInuse int // total bytes used by the freelist
+
+	// Transaction stats
+	TxN     int // total number of started read transactions
+	OpenTxN int // number of currently open read transactions
+
+	TxStats TxStats // global, ongoing stats.
+}
+
+// Sub calculates and returns the difference between two sets of database stats.
+// This is useful when obtaining stats at two different points and time and
+// you need the performance counters that occurred within that time span.
+func (s *Stats) Sub(other *Stats) Stats {
+	if other == nil {
+		return *s
+	}
+	var diff Stats
+	diff.FreePageN = s.FreePageN
+	diff.PendingPageN = s.PendingPageN
+	diff.FreeAlloc = s.FreeAlloc
+	diff.FreelistInuse = s.FreelistInuse
+	diff.TxN = s.TxN - other.TxN
+	diff.OpenTxN = s.OpenTxN
+	diff.TxStats = s.TxStats.Sub(&other.TxStats)
+	return diff
+}
+
+// FreelistStats describes the freelist at one point in time.
+type FreelistStats struct {
+	FreePageN    int         // number of pages free to allocate
+	PendingPageN int         // number of freed pages still in use by open read transactions
+	Pending      map[int]int // pending pages by the id of the transaction that freed them
+	LargestRun   int         // longest run of contiguous free pages
+	Size         int         // bytes the freelist takes when written to the file
+}
+
+// SubscribeBucket returns a channel that receives the id of every committed
+// transaction that changed the named top-level bucket. Changes include writes
+// to any of its keys or nested buckets, and creating or deleting the bucket.
+//
+// Notifications are coalesced: the channel holds at most one pending id and
+// commits never block on a slow receiver, so a receiver may see a single
+// notification for several commits. Use UnsubscribeBucket to stop receiving.
+func (db *Db) SubscribeBucket(name []byte) <-chan int {
+	ch := make(chan int, 1)
+
+	db.subslock.Lock()
+	defer db.subslock.Unlock()
+	if db.subs == nil {
+		db.subs = make(map[string][]chan int)
+	}
+	db.subs[string(name)] = append(db.subs[string(name)], ch)
+	return ch
+}
+
+// UnsubscribeBucket removes a subscription created by SubscribeBucket and
+// closes its channel.
+func (db *Db) UnsubscribeBucket(ch <-chan int) {
+	db.subslock.Lock()
+	defer db.subslock.Unlock()
+	for name, subs := range db.subs {
+		for i, sub := range subs {
+			if sub != ch {
+				continue
+			}
+			close(sub)
+			subs = append(subs[:i], subs[i+1:]...)
+			if len(subs) == 0 {
+				delete(db.subs, name)
+			} else {
+				db.subs[name] = subs
+			}
+			return
+		}
+	}
+}
+
+// notify sends id to the subscribers of every changed bucket.
+func (db *Db) notify(id int, changed map[string]struct{}) {
+	db.subslock.Lock()
+	defer db.subslock.Unlock()
+	for name := range changed {
+		for _, ch := range db.subs[name] {
+			select {
+			case ch <- id:
+			default:
+			}
+		}
+	}
+}
+
+// meta retrieves the current meta page reference.
+func (db *Db) meta() *meta {
+	// We have to return the meta with the highest txid which doesn't fail
+	// validation. Otherwise, we can cause errors when in fact the database is
+	// in a consistent state. metaA is the one with the higher txid.
+	metaA := db.meta0
+	metaB := db.meta1
+	if db.meta1.txid > db.meta0.txid {
+		metaA = db.meta1
+		metaB = db.meta0
+	}
+
+	// Use higher meta page if valid. Otherwise fallback to previous, if valid.
+	if err := metaA.validate(); err == nil {
+		return metaA
+	} else if err := metaB.validate(); err == nil {
+		return metaB
+	}
+
+	// This should never be reached, because both meta1 and meta0 were validated
+	// on mmap() and we do fsync() on every write.
+	panic("tinydb.Db.meta(): invalid meta pages")
+}
+
+// Sync flushes the database file to disk. It isn't needed under normal
+// operation, but makes commits durable that were made with NoSync set or
+// with DurabilityAsync.
+func (db *Db) Sync() error {
+	return db.sync()
+}
+
+// sync flushes the file to disk. Every meta page written before the call
+// is on disk once it returns.
+func (db *Db) sync() error {
+	db.synclock.Lock()
+	defer db.synclock.Unlock()
+	return db.syncLocked()
+}
+
+// syncTx returns once the meta page of the given transaction is on disk,
+// syncing the file unless a sync since it was written already covered it.
+// Commits waiting at the same time queue on the sync lock, so the first to
+// sync covers the others.
+func (db *Db) syncTx(id txid) error {
+	db.synclock.Lock()
+	defer db.synclock.Unlock()
+
+	db.metalock.Lock()
+	durable := db.durable
+	db.metalock.Unlock()
+	if durable >= id {
+		return nil
+	}
+	return db.syncLocked()
+}
+
+// syncLocked flushes the file to disk. The caller must hold the sync lock.
+func (db *Db) syncLocked() error {
+	db.metalock.Lock()
+	id := db.written
+	db.metalock.Unlock()
+
+	if fp := failpoint.Lookup(db); fp != nil {
+		if err := fp.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := db.file.Sync(); err != nil {
+		return err
+	}
+
+	db.metalock.Lock()
+	if id > db.durable {
+		db.durable = id
+	}
+	db.metalock.Unlock()
+	return nil
+}
+
+// syncWritten syncs the file if any meta page written isn't on disk yet.
+func (db *Db) syncWritten() error {
+	db.metalock.Lock()
+	id := db.written
+	db.metalock.Unlock()
+	return db.syncTx(id)
+}
+
+// grow grows the size of the database to the given sz.
+func (db *Db) grow(sz int) error {
+	// Ignore if the new size is less than available file size.
+	if sz <= db.filesz {
+		return nil
+	}
+
+	// Grow in steps of AllocSize, so that commits don't truncate and sync
+	// the file every time it needs a few more pages.
+	if db.AllocSize > 0 {
+		step := int64(db.AllocSize)
+		n := (int64(sz) + step - 1) / step * step
+		if db.segments == nil && n > maxMapSize {
+			n = maxMapSize
+		}
+		// An in-memory file past its mapping would be reallocated, leaving
+		// the mapping pointing at the old buffer.
+		if db.inMemory() && n > int64(db.datasz) && sz <= db.datasz {
+			n = int64(db.datasz)
+		}
+		sz = int(n)
+	}
+
+	// Truncate and fsync to ensure file size metadata is flushed.
+	// https://github.com/boltdb/bolt/issues/284
+	// On Windows the file was already grown to the size of the mapping,
+	// and a mapped file can't be truncated.
+	if runtime.GOOS != "windows" || db.inMemory() || db.cache != nil {
+		if err := db.file.Truncate(int64(sz)); err != nil {
+			return fmt.Errorf("file resize error: %s", err)
+		}
+	}
+	if !db.NoGrowSync {
+		if err := db.sync(); err != nil {
+			return fmt.Errorf("file sync error: %s", err)
+		}
+	}
+
+	// Lock the pages the file grew by.
+	if err := db.mlock(sz); err != nil {
+		return err
+	}
+
+	db.filesz = sz
+	return nil
+}
+
+// preallocate grows the file to at least sz bytes, rounded up to the page
+// size, before it is mapped.
+func (db *Db) preallocate(sz int) error {
+	sz = (sz + db.pageSize - 1) / db.pageSize * db.pageSize
+	if info, err := db.file.Stat(); err != nil {
+		return err
+	} else if info.Size() >= int64(sz) {
+		return nil
+	}
+	if err := db.file.Truncate(int64(sz)); err != nil {
+		return fmt.Errorf("file resize error: %s", err)
+	}
+	if !db.NoGrowSync {
+		if err := db.sync(); err != nil {
+			return fmt.Errorf("file sync error: %s", err)
+		}
+	}
+	return nil
+}
+
+// secondMetaPageSize looks for a valid meta1 page at every supported page
+// size and returns the page size recorded in the first one found.
+func (db *Db) secondMetaPageSize() (int, bool) {
+	buf := make([]byte, pageHeaderSize+unsafe.Sizeof(meta{}))
+	for pageSize := minPageSize; pageSize <= maxPageSize; pageSize *= 2 {
+		if _, err := db.file.ReadAt(buf, int64(pageSize)); err != nil {
+			return 0, false
+		}
+		p := (*page)(unsafe.Pointer(&buf[0]))
+		if m := p.meta(); p.flags == metaPageFlag && m.validate() == nil && int(m.pageSize) == pageSize {
+			return pageSize, true
+		}
+	}
+	return 0, false
+}
+
 // pageInBuffer retrieves a page reference from a given byte array based on the current page size.
 func (db *Db) pageInBuffer(b []byte, id int) *page {
 	return (*page)(unsafe.Pointer(&b[id*db.pageSize]))
@@ -121,12 +1465,23 @@ func (db *Db) pageInBuffer(b []byte, id int) *page {
 
 // page retrieves a page reference from the mmap based on the current page size.
 func (db *Db) page(id pgid) *page {
+	if db.cache != nil {
+		return db.cache.page(id)
+	} else if db.segments != nil {
+		return db.segments.page(id, db.pageSize)
+	}
 	pos := id * pgid(db.pageSize)
 	return (*page)(unsafe.Pointer(&db.data[pos]))
 }
 
 // allocate returns a contiguous block of memory starting at a given page.
 func (db *Db) allocate(count int) (*page, error) {
+	if fp := failpoint.Lookup(db); fp != nil {
+		if err := fp.Allocate(); err != nil {
+			return nil, err
+		}
+	}
+
 	// Allocate a temporary buffer for the page.
 	var buf []byte
 	if count == 1 {
@@ -142,8 +1497,25 @@ func (db *Db) allocate(count int) (*page, error) {
 		return p, nil
 	}
 
-	// Resize mmap() if we're at the end.
+	// A page can't span two segments, so skip to the start of the next one
+	// if it would, freeing the pages in between.
 	p.id = db.rwtx.meta.pgid
+	if db.segments != nil {
+		n := pgid(db.segments.size / db.pageSize)
+		if pgid(count) > n {
+			return nil, fmt.Errorf("allocate %d pages: larger than a segment", count)
+		} else if start := (p.id + pgid(count) - 1) / n * n; start > p.id {
+			db.freelist.free(db.rwtx.meta.txid, &page{id: p.id, overflow: uint32(start - p.id - 1)})
+			db.rwtx.meta.pgid, p.id = start, start
+		}
+	}
+
+	// Resize mmap() if we're at the end. The size is checked before it is
+	// converted, since an int only has 32 bits on some platforms. Segments
+	// are mapped separately, so only each one has to fit in a mapping.
+	if db.segments == nil && (p.id+pgid(count)+1)*pgid(db.pageSize) > maxMapSize {
+		return nil, fmt.Errorf("mmap allocate error: %w", ErrMmapTooLarge)
+	}
 	var minsz = int((p.id+pgid(count))+1) * db.pageSize
 	if minsz >= db.datasz {
 		if err := db.mmap(minsz); err != nil {
@@ -160,18 +1532,29 @@ func (db *Db) allocate(count int) (*page, error) {
 // mmap opens the underlying memory-mapped file and initializes the meta references.
 // minsz is the minimum size that the new mmap can be.
 func (db *Db) mmap(minsz int) error {
+	if db.segments != nil && db.cache == nil {
+		return db.mmapSegments(minsz)
+	}
+
 	db.mmaplock.Lock()
 	defer db.mmaplock.Unlock()
 
+	if fp := failpoint.Lookup(db); fp != nil {
+		time.Sleep(fp.RemapDelay())
+	}
+
 	info, err := db.file.Stat()
 	if err != nil {
 		return fmt.Errorf("mmap stat error: %s", err)
+	} else if info.Size() > maxMapSize {
+		return ErrMmapTooLarge
 	} else if int(info.Size()) < db.pageSize*2 {
 		return fmt.Errorf("file size too small")
 	}
 
 	// Ensure the size is at least the minimum size.
-	var size = int(info.Size())
+	db.filesz = int(info.Size())
+	var size = db.filesz
 	if size < minsz {
 		size = minsz
 	}
@@ -186,15 +1569,36 @@ func (db *Db) mmap(minsz int) error {
 	}
 
 	// Unmap existing data before continuing.
+	oldsz := db.datasz
 	if err := db.munmap(); err != nil {
 		return err
 	}
 
 	// Memory-map the data file as a byte slice.
-	if err := mmap(db, size); err != nil {
+	if db.cache != nil {
+		if err := mmapCache(db); err != nil {
+			return err
+		}
+	} else if db.inMemory() {
+		mmapMemory(db, size)
+	} else if err := mmap(db, size); err != nil {
+		return err
+	}
+
+	if oldsz > 0 && oldsz != db.datasz {
+		db.remapped(oldsz, db.datasz)
+	}
+
+	// Unmapping released the locks, so lock the new mapping again.
+	if err := db.mlock(db.filesz); err != nil {
 		return err
 	}
+	return db.loadMeta()
+}
 
+// loadMeta saves references to the meta pages once the file is mapped and
+// validates them.
+func (db *Db) loadMeta() error {
 	// Save references to the meta pages.
 	db.meta0 = db.page(0).meta()
 	db.meta1 = db.page(1).meta()
@@ -204,6 +1608,12 @@ func (db *Db) mmap(minsz int) error {
 	// properly -- but we can recover using meta1. And vice-versa.
 	err0 := db.meta0.validate()
 	err1 := db.meta1.validate()
+	if err0 != nil {
+		db.validationFailed(fmt.Errorf("meta page 0: %w", err0))
+	}
+	if err1 != nil {
+		db.validationFailed(fmt.Errorf("meta page 1: %w", err1))
+	}
 	if err0 != nil && err1 != nil {
 		return err0
 	}
@@ -213,6 +1623,18 @@ func (db *Db) mmap(minsz int) error {
 
 // munmap unmaps the data file from memory.
 func (db *Db) munmap() error {
+	if db.cache != nil {
+		db.datasz = 0
+		return nil
+	} else if db.segments != nil {
+		if err := munmapSegments(db); err != nil {
+			return fmt.Errorf("unmap error: " + err.Error())
+		}
+		return nil
+	} else if db.inMemory() {
+		munmapMemory(db)
+		return nil
+	}
 	if err := munmap(db); err != nil {
 		return fmt.Errorf("unmap error: " + err.Error())
 	}
@@ -232,7 +1654,7 @@ func (db *Db) mmapSize(size int) (int, error) {
 
 	// Verify the requested size is not above the maximum allowed.
 	if size > maxMapSize {
-		return 0, fmt.Errorf("mmap too large")
+		return 0, ErrMmapTooLarge
 	}
 
 	// If larger than 1GB then grow by 1GB at a time.
@@ -1,10 +1,17 @@
 package tinydb
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 	"unsafe"
 )
 
@@ -27,7 +34,7 @@ func TestOpen_InitDBFile(t *testing.T) {
 	path := tempfile()
 	defer os.RemoveAll(path)
 
-	db, err := Open(path)
+	db, err := Open(path, nil)
 	if err != nil {
 		t.Fatal(err)
 	} else if db == nil {
@@ -40,6 +47,10 @@ func TestOpen_InitDBFile(t *testing.T) {
 	}
 	dbFileSize := fileInfo.Size()
 	expectedDBFileSize := int64(os.Getpagesize() * 4)
+	if runtime.GOOS == "windows" {
+		// The file is grown to the initial mmap size.
+		expectedDBFileSize = 32 * 1024
+	}
 	if expectedDBFileSize != dbFileSize {
 		t.Fatalf("incorrect init db file size %d, expected size: %d", dbFileSize, expectedDBFileSize)
 	}
@@ -51,6 +62,86 @@ func TestOpen_InitDBFile(t *testing.T) {
 	}
 }
 
+// Ensure that InitialSize preallocates the file and that commits then use
+// the space without growing it.
+func TestOpen_InitialSize(t *testing.T) {
+	path := tempfile()
+	defer os.RemoveAll(path)
+	db, err := Open(path, &Options{InitialSize: 1<<20 - 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), make([]byte, 100000))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 1<<20 {
+		t.Fatalf("unexpected file size: %d", info.Size())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A smaller initial size doesn't shrink the file.
+	db, err = Open(path, &Options{InitialSize: 64 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 1<<20 {
+		t.Fatalf("unexpected file size: %d", info.Size())
+	}
+}
+
+// Ensure that AllocSize grows the file in steps.
+func TestDb_AllocSize(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the file grows with the mapping on windows")
+	}
+	path := tempfile()
+	defer os.RemoveAll(path)
+	db, err := Open(path, &Options{AllocSize: 256 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 50000))
+		}); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		} else if info.Size()%(256*1024) != 0 {
+			t.Fatalf("unexpected file size: %d", info.Size())
+		}
+	}
+	if err := db.View(func(tx *Tx) error {
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestOpen_ErrInvalid(t *testing.T) {
 	path := tempfile()
 	defer os.RemoveAll(path)
@@ -66,7 +157,7 @@ func TestOpen_ErrInvalid(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err := Open(path); err != ErrInvalid {
+	if _, err := Open(path, nil); err != ErrInvalid {
 		t.Fatalf("unexpected error: %s", err)
 	}
 }
@@ -75,11 +166,18 @@ func TestOpen_ExistFile(t *testing.T) {
 	path := tempfile()
 	defer os.RemoveAll(path)
 
-	_, _ = Open(path)
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
 
-	_, err := Open(path)
+	db, err = Open(path, nil)
 	if err != nil {
 		t.Fatalf("Open exist tinydb file error")
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
 	}
 }
 
@@ -87,7 +185,11 @@ func TestOpen_ErrVersionMismatch(t *testing.T) {
 	path := tempfile()
 	defer os.RemoveAll(path)
 
-	_, _ = Open(path)
+	if db, err := Open(path, nil); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
 
 	// Read data file.
 	buf, err := ioutil.ReadFile(path)
@@ -109,7 +211,7 @@ func TestOpen_ErrVersionMismatch(t *testing.T) {
 	}
 
 	// Reopen data file.
-	if _, err := Open(path); err != ErrVersionMismatch {
+	if _, err := Open(path, nil); err != ErrVersionMismatch {
 		t.Fatalf("unexpected error: %s", err)
 	}
 }
@@ -118,7 +220,11 @@ func TestOpen_ErrChecksum(t *testing.T) {
 	path := tempfile()
 	defer os.RemoveAll(path)
 
-	_, _ = Open(path)
+	if db, err := Open(path, nil); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
 
 	// Read data file.
 	buf, err := ioutil.ReadFile(path)
@@ -140,7 +246,1635 @@ func TestOpen_ErrChecksum(t *testing.T) {
 	}
 
 	// Reopen data file.
-	if _, err := Open(path); err != ErrChecksum {
+	if _, err := Open(path, nil); err != ErrChecksum {
 		t.Fatalf("unexpected error: %s", err)
 	}
 }
+
+// Ensure that Open falls back to the previous meta page when the latest one
+// fails validation, as after a torn meta write.
+func TestOpen_MetaFallback(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	put := func(v string) int {
+		var id int
+		if err := db.Update(func(tx *Tx) error {
+			id = tx.ID()
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("foo"), []byte(v))
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	put("1")
+	id := put("2")
+
+	// Corrupt the meta page written by the last commit.
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageSize := os.Getpagesize()
+	m := (*meta)(unsafe.Pointer(&buf[(id%2)*pageSize+int(pageHeaderSize)]))
+	if int(m.txid) != id {
+		t.Fatalf("unexpected meta txid: %d", m.txid)
+	}
+	m.pgid++
+	if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if tx.ID() != id-1 {
+			t.Fatalf("unexpected txid: %d", tx.ID())
+		}
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); string(v) != "1" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next commit overwrites the corrupted meta page.
+	if got := put("3"); got != id {
+		t.Fatalf("unexpected txid: %d", got)
+	}
+	if err := db.meta().validate(); err != nil || int(db.meta().txid) != id {
+		t.Fatalf("unexpected meta: txid=%d, err=%v", db.meta().txid, err)
+	}
+}
+
+// testLogger records the messages it receives by level.
+type testLogger struct {
+	mu   sync.Mutex
+	msgs map[string][]string
+}
+
+func (l *testLogger) logf(level, format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.msgs == nil {
+		l.msgs = make(map[string][]string)
+	}
+	l.msgs[level] = append(l.msgs[level], fmt.Sprintf(format, v...))
+}
+
+func (l *testLogger) Debugf(format string, v ...interface{})   { l.logf("debug", format, v...) }
+func (l *testLogger) Infof(format string, v ...interface{})    { l.logf("info", format, v...) }
+func (l *testLogger) Warningf(format string, v ...interface{}) { l.logf("warning", format, v...) }
+func (l *testLogger) Errorf(format string, v ...interface{})   { l.logf("error", format, v...) }
+
+// Ensure that remaps, slow commits and meta validation failures are reported
+// to the logger and hooks.
+func TestOpen_LoggerHooks(t *testing.T) {
+	path := tempfile()
+	defer os.RemoveAll(path)
+
+	var logger testLogger
+	var remaps [][2]int
+	var slow []int
+	var failures []error
+	options := &Options{
+		Logger: &logger,
+		Hooks: Hooks{
+			SlowCommit:        func(txid int, _ time.Duration) { slow = append(slow, txid) },
+			Remap:             func(oldSize, newSize int) { remaps = append(remaps, [2]int{oldSize, newSize}) },
+			ValidationFailure: func(err error) { failures = append(failures, err) },
+		},
+		SlowCommitThreshold: time.Nanosecond,
+	}
+	db, err := Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Logger() != &logger {
+		t.Fatal("unexpected logger")
+	}
+
+	var id int
+	if err := db.Update(func(tx *Tx) error {
+		id = tx.ID()
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), make([]byte, 64*1024))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(slow) != 1 || slow[0] != id || len(logger.msgs["warning"]) != 1 {
+		t.Fatalf("unexpected slow commits: %v %q", slow, logger.msgs["warning"])
+	}
+	if len(remaps) != 1 || remaps[0][0] != 32*1024 || remaps[0][1] <= remaps[0][0] || len(logger.msgs["info"]) != 1 {
+		t.Fatalf("unexpected remaps: %v %q", remaps, logger.msgs["info"])
+	}
+	if len(failures) != 0 {
+		t.Fatalf("unexpected validation failures: %v", failures)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the meta page written by the last commit.
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := (*meta)(unsafe.Pointer(&buf[(id%2)*db.pageSize+int(pageHeaderSize)]))
+	m.pgid++
+	if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if len(failures) == 0 || !errors.Is(failures[0], ErrChecksum) || len(logger.msgs["error"]) != len(failures) {
+		t.Fatalf("unexpected validation failures: %v %q", failures, logger.msgs["error"])
+	}
+}
+
+// Ensure that a corrupted page type is reported as an error by managed
+// transactions instead of being misread.
+func TestDb_View_ErrUnknownPageType(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	var root pgid
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		root = tx.Bucket([]byte("widgets")).Root()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite the flags of the bucket's root page.
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := int64(root)*int64(db.pageSize) + int64(unsafe.Offsetof(page{}.flags))
+	if _, err := f.WriteAt([]byte{0x80, 0x00}, offset); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.View(func(tx *Tx) error {
+		tx.Bucket([]byte("widgets")).Get([]byte("0001"))
+		t.Fatal("expected unknown page type")
+		return nil
+	})
+	var perr *UnknownPageTypeError
+	if !errors.Is(err, ErrUnknownPageType) || !errors.As(err, &perr) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if perr.Pgid != uint64(root) || perr.Flags != 0x80 {
+		t.Fatalf("unexpected page error: %+v", perr)
+	}
+
+	// Writers are rolled back and report the same error.
+	if err := db.Update(func(tx *Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("0001"), []byte("x"))
+	}); !errors.Is(err, ErrUnknownPageType) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that Open rejects a freelist page with an unexpected type.
+func TestOpen_ErrUnknownPageType(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := int64(db.meta().freelist)*int64(db.pageSize) + int64(unsafe.Offsetof(page{}.flags))
+	if _, err := f.WriteAt([]byte{leafPageFlag, 0x00}, offset); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, nil); !errors.Is(err, ErrUnknownPageType) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that a database can be updated within a managed transaction.
+func TestDb_Update(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		if !tx.Writable() {
+			t.Fatal("expected writable tx")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if m := db.meta(); m.txid != 2 {
+		t.Fatalf("exp txid=2; got=%d", m.txid)
+	}
+}
+
+// Ensure that an error returned from Update rolls back the transaction.
+func TestDb_Update_ErrorRollback(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	errFoo := errors.New("foo")
+	if err := db.Update(func(tx *Tx) error {
+		n := tx.root.node(tx.root.root, nil)
+		n.put([]byte("foo"), []byte("foo"), []byte("bar"), 0, 0)
+		return errFoo
+	}); err != errFoo {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if m := db.meta(); m.txid != 1 {
+		t.Fatalf("exp txid=1; got=%d", m.txid)
+	}
+}
+
+// Ensure that a panic inside Update rolls back and releases the writer lock.
+func TestDb_Update_PanicRollback(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("expected panic")
+			}
+		}()
+		_ = db.Update(func(tx *Tx) error {
+			panic("boom")
+		})
+	}()
+
+	// The writer lock must have been released.
+	if err := db.Update(func(tx *Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that committing a managed transaction panics.
+func TestDb_Update_ManualCommit(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	var panicked bool
+	if err := db.Update(func(tx *Tx) error {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					panicked = true
+				}
+			}()
+			_ = tx.Commit()
+		}()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if !panicked {
+		t.Fatal("expected panic")
+	}
+}
+
+// Ensure that a database can be read within a managed read-only transaction.
+func TestDb_View(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.View(func(tx *Tx) error {
+		if tx.Writable() {
+			t.Fatal("expected read-only tx")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	errFoo := errors.New("foo")
+	if err := db.View(func(tx *Tx) error { return errFoo }); err != errFoo {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that rolling back a managed read-only transaction panics.
+func TestDb_View_ManualRollback(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	var panicked bool
+	if err := db.View(func(tx *Tx) error {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					panicked = true
+				}
+			}()
+			_ = tx.Rollback()
+		}()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if !panicked {
+		t.Fatal("expected panic")
+	}
+}
+
+// Ensure that bucket subscribers are notified of commits that change their bucket.
+func TestDb_SubscribeBucket(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	widgets := db.SubscribeBucket([]byte("widgets"))
+	woojits := db.SubscribeBucket([]byte("woojits"))
+
+	var id int
+	if err := db.Update(func(tx *Tx) error {
+		id = tx.ID()
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-widgets:
+		if got != id {
+			t.Fatalf("unexpected txid: %d; exp %d", got, id)
+		}
+	default:
+		t.Fatal("expected notification")
+	}
+
+	// Writes to a nested bucket notify the top-level bucket.
+	if err := db.Update(func(tx *Tx) error {
+		id = tx.ID()
+		child, err := tx.Bucket([]byte("widgets")).CreateBucket([]byte("foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return child.Put([]byte("bar"), []byte("baz"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-widgets; got != id {
+		t.Fatalf("unexpected txid: %d; exp %d", got, id)
+	}
+
+	// Rolled back and read-only transactions do not notify.
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.Bucket([]byte("widgets")).Put([]byte("foo2"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		return errors.New("rollback")
+	}); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := db.View(func(tx *Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-widgets:
+		t.Fatal("unexpected notification")
+	case <-woojits:
+		t.Fatal("unexpected notification")
+	default:
+	}
+
+	db.UnsubscribeBucket(widgets)
+	if _, ok := <-widgets; ok {
+		t.Fatal("expected closed channel")
+	}
+}
+
+// Ensure that a slow subscriber does not block commits.
+func TestDb_SubscribeBucket_Coalesce(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	ch := db.SubscribeBucket([]byte("widgets"))
+	for i := 0; i < 3; i++ {
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b.Put([]byte("foo"), []byte(fmt.Sprint(i)))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-ch
+	select {
+	case <-ch:
+		t.Fatal("expected coalesced notifications")
+	default:
+	}
+}
+
+// Ensure that a closed database rejects new transactions.
+func TestDb_Close(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	ch := db.SubscribeBucket([]byte("widgets"))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-ch; ok {
+		t.Fatal("expected closed subscription")
+	}
+	if _, err := db.Begin(false); err != ErrDatabaseNotOpen {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := db.Begin(true); err != ErrDatabaseNotOpen {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Closing twice is a no-op.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that Close waits for the open writer to finish.
+func TestDb_Close_PendingTx(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- db.Close() }()
+
+	select {
+	case <-done:
+		t.Fatal("database closed too early")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// The committed data is visible after reopening.
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.View(func(tx *Tx) error {
+		if tx.Bucket([]byte("widgets")) == nil {
+			t.Fatal("expected bucket")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a database file can only be opened by one Db at a time.
+func TestOpen_Locked(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	opened := make(chan *Db)
+	go func() {
+		db, err := Open(path, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- db
+	}()
+
+	select {
+	case <-opened:
+		t.Fatal("expected Open to block while the file is locked")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db := <-opened; db != nil {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Ensure that MemoryPath opens independent databases that don't touch disk
+// and remap as they grow.
+func TestOpen_Memory(t *testing.T) {
+	db, err := Open(MemoryPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := Open(MemoryPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	// Write enough to remap several times.
+	value := make([]byte, 1024)
+	for i := 0; i < 10; i++ {
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 100; j++ {
+				if err := b.Put([]byte(fmt.Sprintf("%04d", i*100+j)), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.datasz <= 1<<20 {
+		t.Fatalf("expected remap, got mmap size %d", db.datasz)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != 1000 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.View(func(tx *Tx) error {
+		if tx.Bucket([]byte("widgets")) != nil {
+			t.Fatal("unexpected bucket in other database")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(MemoryPath); !os.IsNotExist(err) {
+		t.Fatalf("unexpected file: %v", err)
+	}
+
+	// Reopening starts over with an empty database.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(MemoryPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.View(func(tx *Tx) error {
+		if tx.Bucket([]byte("widgets")) != nil {
+			t.Fatal("unexpected bucket after reopen")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that AllocSize doesn't grow an in-memory database past its mapping,
+// which would move the buffer out from under it.
+func TestOpen_Memory_AllocSize(t *testing.T) {
+	db, err := Open(MemoryPath, &Options{AllocSize: 16 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 50000))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.View(func(tx *Tx) error {
+		if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != 10 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a database opened with NoMmap reads and writes through a page
+// cache much smaller than the database, and that readers keep seeing the
+// pages of their own snapshot.
+func TestOpen_NoMmap(t *testing.T) {
+	path := tempfile()
+	defer os.RemoveAll(path)
+	options := &Options{NoMmap: true, PageCacheSize: 8}
+	db, err := Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	} else if db.cache == nil || db.data != nil {
+		t.Fatal("expected page cache instead of mmap")
+	}
+
+	large := bytes.Repeat([]byte("x"), 10000)
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), []byte("old")); err != nil {
+				return err
+			}
+		}
+		return b.Put([]byte("large"), large)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite every key while a reader holds the old snapshot.
+	rtx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), []byte("new")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	b := rtx.Bucket([]byte("widgets"))
+	for i := 0; i < 1000; i++ {
+		if v := b.Get([]byte(fmt.Sprintf("%04d", i))); string(v) != "old" {
+			t.Fatalf("unexpected value for %04d: %q", i, v)
+		}
+	}
+	if err := rtx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen and verify the data made it to the file.
+	db, err = Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("0999")); string(v) != "new" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := b.Get([]byte("large")); !bytes.Equal(v, large) {
+			t.Fatalf("unexpected large value: %d bytes", len(v))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that Warmup reads in databases however they are opened.
+func TestDb_Warmup(t *testing.T) {
+	for name, options := range map[string]*Options{
+		"random":     {},
+		"sequential": {MmapAdvice: MmapAdviceSequential},
+		"willneed":   {MmapAdvice: MmapAdviceWillNeed},
+		"nommap":     {NoMmap: true},
+		"segments":   {PageSize: 4096, SegmentSize: 64 * 1024},
+		"memory":     nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := MemoryPath
+			if options != nil {
+				path = tempfile()
+				defer removeSegments(path)
+			}
+			db, err := Open(path, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Update(func(tx *Tx) error {
+				b, err := tx.CreateBucket([]byte("widgets"))
+				if err != nil {
+					return err
+				}
+				for i := 0; i < 100; i++ {
+					if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 1000)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.Warmup(); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.View(func(tx *Tx) error {
+				if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != 100 {
+					t.Fatalf("unexpected key count: %d", n)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			} else if err := db.Warmup(); err != ErrDatabaseNotOpen {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// Ensure that Mlock locks the whole file in memory as it grows and is
+// remapped.
+func TestOpen_Mlock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("mlock not supported on windows")
+	}
+	path := tempfile()
+	defer os.RemoveAll(path)
+	db, err := Open(path, &Options{Mlock: true})
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOMEM) || errors.Is(err, syscall.EAGAIN) {
+		t.Skipf("mlock not permitted: %v", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 1000)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The locked size is only reported by Linux.
+	buf, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Skip("locked memory not reported")
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		var kb int
+		if _, err := fmt.Sscanf(line, "VmLck: %d kB", &kb); err == nil {
+			if kb*1024 < db.filesz {
+				t.Fatalf("expected %d bytes locked, got %d kB", db.filesz, kb)
+			}
+			return
+		}
+	}
+	t.Skip("locked memory not reported")
+}
+
+// Ensure that a file larger than the platform can map fails to open instead
+// of overflowing, as on 32-bit systems.
+func TestOpen_MmapTooLarge(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Grow the file sparsely past 2GB.
+	const size = 3 << 30
+	if err := os.Truncate(path, size); err != nil {
+		t.Skipf("sparse file: %v", err)
+	}
+
+	db, err := Open(path, nil)
+	if size > maxMapSize {
+		if err != ErrMmapTooLarge {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that Open validates and applies the fill percent bounds.
+func TestOpen_FillPercentBounds(t *testing.T) {
+	for _, opts := range []*Options{
+		{MinFillPercent: -0.1},
+		{MaxFillPercent: 1.5},
+		{MinFillPercent: 0.8, MaxFillPercent: 0.5},
+	} {
+		path := tempfile()
+		if _, err := Open(path, opts); err != ErrInvalidFillPercent {
+			t.Fatalf("%+v: unexpected error: %v", opts, err)
+		}
+		os.RemoveAll(path)
+	}
+
+	// Fill sequential keys with FillPercent=1.0 and return the page count.
+	pages := func(opts *Options) pgid {
+		path := tempfile()
+		defer os.RemoveAll(path)
+		db, err := Open(path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.FillPercent = 1.0
+			for i := 0; i < 2000; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%05d", i)), make([]byte, 50)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return db.meta().pgid
+	}
+	full, capped := pages(nil), pages(&Options{MaxFillPercent: 0.5})
+	if capped <= full*3/2 {
+		t.Fatalf("expected capped fill percent to use more pages: %d vs %d", capped, full)
+	}
+}
+
+// Ensure that Open times out when the file stays locked.
+func TestOpen_Timeout(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	start := time.Now()
+	if _, err := Open(path, &Options{Timeout: 100 * time.Millisecond}); err != ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	} else if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("returned too early: %s", d)
+	}
+}
+
+// Ensure that read-only databases share the file lock and reject writers.
+func TestOpen_ReadOnly(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db0, err := Open(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db0.Close()
+	db1, err := Open(path, &Options{ReadOnly: true, Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db1.Close()
+
+	if err := db1.View(func(tx *Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db0.Begin(true); err != ErrDatabaseReadOnly {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := Open(path, &Options{Timeout: 100 * time.Millisecond}); err != ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that a custom page size is used for new files and read back from
+// existing ones.
+func TestOpen_PageSize(t *testing.T) {
+	path := tempfile()
+	defer os.RemoveAll(path)
+	pageSize := defaultPageSize * 2
+
+	db, err := Open(path, &Options{PageSize: pageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.pageSize != pageSize {
+		t.Fatalf("exp=%d; got=%d", pageSize, db.pageSize)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if tx.Bucket([]byte("widgets")) == nil {
+			t.Fatal("expected bucket")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that invalid page sizes are rejected and that a database whose
+// first meta page is damaged still opens with its own page size.
+func TestOpen_PageSize_MetaFallback(t *testing.T) {
+	for _, pageSize := range []int{512, 3000, 128 * 1024} {
+		path := tempfile()
+		if _, err := Open(path, &Options{PageSize: pageSize}); err != ErrInvalidPageSize {
+			t.Fatalf("%d: unexpected error: %v", pageSize, err)
+		}
+		os.RemoveAll(path)
+	}
+
+	path := tempfile()
+	defer os.RemoveAll(path)
+	pageSize := 16 * 1024
+	if pageSize == defaultPageSize {
+		pageSize = 8 * 1024
+	}
+	db, err := Open(path, &Options{PageSize: pageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Zero out meta0 so only meta1 identifies the page size.
+	f, err := os.OpenFile(path, os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(make([]byte, 128), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.pageSize != pageSize {
+		t.Fatalf("exp=%d; got=%d", pageSize, db.pageSize)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that the hashmap freelist reuses freed pages across commits and
+// reopens.
+func TestOpen_FreelistMapType(t *testing.T) {
+	path := tempfile()
+	defer os.RemoveAll(path)
+	opts := &Options{FreelistType: FreelistMapType, NoSync: true}
+
+	put := func(db *Db, n int) {
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < n; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%05d", i)), make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(db, 1000)
+	put(db, 1000)
+	hwm := db.meta().pgid
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	put(db, 1000)
+	if n := db.meta().pgid; n > hwm*3/2 {
+		t.Fatalf("expected freed pages to be reused: %d > %d", n, hwm)
+	}
+
+	if _, err := Open(tempfile(), &Options{FreelistType: "btree"}); err == nil {
+		t.Fatal("expected error for unknown freelist type")
+	}
+}
+
+// Ensure that read transactions beyond the configured cap are refused until
+// one of the open ones is rolled back.
+func TestDb_Begin_MaxReadTxs(t *testing.T) {
+	path := tempfile()
+	defer os.RemoveAll(path)
+	db, err := Open(path, &Options{MaxReadTxs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tx0, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx1, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Begin(false); !errors.Is(err, ErrTooManyReadTxs) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Writers are not limited.
+	if err := db.Update(func(tx *Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx0.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	tx2, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range []*Tx{tx1, tx2} {
+		if err := tx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Ensure that a database written without a freelist rebuilds it on Open and
+// writes it out again once reopened without the option.
+func TestOpen_NoFreelistSync(t *testing.T) {
+	path := tempfile()
+	defer os.RemoveAll(path)
+	opts := &Options{NoFreelistSync: true, NoSync: true}
+
+	db, err := Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(n int) {
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < n; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%05d", i)), make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(1000)
+	put(1000)
+	if db.meta().freelist != pgidNoFreelist {
+		t.Fatalf("unexpected freelist page: %d", db.meta().freelist)
+	}
+
+	// A rolled back writer rebuilds the freelist by scanning.
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		return errors.New("rollback")
+	}); err == nil {
+		t.Fatal("expected error")
+	}
+	hwm, free := db.meta().pgid, db.freelist.free_count()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := db.freelist.free_count(); n < free || n == 0 {
+		t.Fatalf("expected rebuilt freelist with at least %d pages; got %d", free, n)
+	}
+	put(1000)
+	if n := db.meta().pgid; n != hwm {
+		t.Fatalf("expected freed pages to be reused: %d != %d", n, hwm)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if !db.hasSyncedFreelist() {
+		t.Fatal("expected freelist to be written")
+	}
+	if err := db.View(func(tx *Tx) error {
+		var n int
+		if err := tx.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1000 {
+			t.Fatalf("exp=1000; got=%d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that database stats merge transaction stats when transactions close
+// and that Sub returns the counters accumulated in between.
+func TestDb_Stats(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	prev := db.Stats()
+
+	if err := db.Update(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := db.Stats().OpenTxN; n != 1 {
+		t.Fatalf("unexpected OpenTxN: %d", n)
+	}
+	b := tx.Bucket([]byte("widgets"))
+	before := tx.Stats()
+	b.Cursor().First()
+	if after := tx.Stats(); after.Sub(&before).CursorCount != 1 {
+		t.Fatalf("unexpected CursorCount: %d", after.Sub(&before).CursorCount)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := db.Stats()
+	diff := stats.Sub(&prev)
+	if stats.OpenTxN != 0 || diff.TxN != 1 {
+		t.Fatalf("unexpected tx counts: open=%d started=%d", stats.OpenTxN, diff.TxN)
+	} else if diff.TxStats.PageCount == 0 || diff.TxStats.Spill == 0 || diff.TxStats.Write == 0 {
+		t.Fatalf("unexpected tx stats: %+v", diff.TxStats)
+	} else if diff.TxStats.CursorCount < 1 {
+		t.Fatalf("unexpected CursorCount: %d", diff.TxStats.CursorCount)
+	} else if stats.FreelistInuse == 0 {
+		t.Fatal("expected freelist usage")
+	} else if stats.FreeAlloc != (stats.FreePageN+stats.PendingPageN)*db.pageSize {
+		t.Fatalf("unexpected FreeAlloc: %d", stats.FreeAlloc)
+	}
+}
+
+// Ensure that freelist stats report pending pages by transaction and the
+// largest run of free pages.
+func TestDb_FreelistStats(t *testing.T) {
+	for _, typ := range []FreelistType{FreelistArrayType, FreelistMapType} {
+		t.Run(string(typ), func(t *testing.T) {
+			path := tempfile()
+			defer os.Remove(path)
+			db, err := Open(path, &Options{FreelistType: typ})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			if err := db.Update(func(tx *Tx) error {
+				b, err := tx.CreateBucket([]byte("widgets"))
+				if err != nil {
+					return err
+				}
+				return b.Put([]byte("foo"), make([]byte, 20*db.pageSize))
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// An open reader keeps the deleted value pending.
+			tx, err := db.Begin(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var id int
+			if err := db.Update(func(tx *Tx) error {
+				id = tx.ID()
+				return tx.Bucket([]byte("widgets")).Delete([]byte("foo"))
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if s := db.FreelistStats(); s.Pending[id] < 21 || s.PendingPageN < s.Pending[id] {
+				t.Fatalf("unexpected pending pages: %+v", s)
+			} else if s.LargestRun >= 21 {
+				t.Fatalf("unexpected largest run: %d", s.LargestRun)
+			}
+			if err := tx.Rollback(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The next transaction releases it.
+			if err := db.Update(func(tx *Tx) error { return nil }); err != nil {
+				t.Fatal(err)
+			}
+			s := db.FreelistStats()
+			if _, ok := s.Pending[id]; ok {
+				t.Fatalf("unexpected pending pages: %+v", s)
+			} else if s.LargestRun < 21 || s.FreePageN < s.LargestRun {
+				t.Fatalf("unexpected largest run: %+v", s)
+			} else if stats := db.Stats(); s.FreePageN != stats.FreePageN || s.PendingPageN != stats.PendingPageN {
+				t.Fatalf("unexpected page counts: %+v, %+v", s, stats)
+			} else if s.Size != stats.FreelistInuse {
+				t.Fatalf("unexpected size: %d, %d", s.Size, stats.FreelistInuse)
+			}
+		})
+	}
+}
+
+// Ensure that strict mode panics at the commit that leaves the database
+// inconsistent, without writing its meta page.
+func TestDb_StrictMode(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.Remove(path)
+	defer db.Close()
+	db.StrictMode = true
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leak a page, which is neither reachable nor free.
+	func() {
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "unreachable unfreed") {
+				t.Fatalf("unexpected panic: %v", r)
+			}
+		}()
+		_ = db.Update(func(tx *Tx) error {
+			if _, err := tx.allocate(1); err != nil {
+				return err
+			}
+			return tx.Bucket([]byte("widgets")).Put([]byte("baz"), []byte("bat"))
+		})
+	}()
+
+	if err := db.View(func(tx *Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("baz")); v != nil {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("baz"), []byte("bat"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that concurrent Batch calls are all applied.
+func TestDb_Batch(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	if err := db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Iterate over multiple updates in separate goroutines.
+	n := 2
+	ch := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			ch <- db.Batch(func(tx *Tx) error {
+				return tx.Bucket([]byte("widgets")).Put([]byte(fmt.Sprintf("%d", i)), []byte{})
+			})
+		}(i)
+	}
+
+	// Check all responses to make sure there's no error.
+	for i := 0; i < n; i++ {
+		if err := <-ch; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Ensure data is correct.
+	if err := db.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < n; i++ {
+			if v := b.Get([]byte(fmt.Sprintf("%d", i))); v == nil {
+				t.Errorf("key not found: %d", i)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a panic in a batched function reaches its caller and that a
+// failing function doesn't fail the rest of the batch.
+func TestDb_Batch_Panic(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	var sentinel int
+	var bork = &sentinel
+	var problem interface{}
+	var err error
+
+	// Execute a function inside a batch that panics.
+	func() {
+		defer func() {
+			if p := recover(); p != nil {
+				problem = p
+			}
+		}()
+		err = db.Batch(func(tx *Tx) error {
+			panic(bork)
+		})
+	}()
+
+	// Verify there is no error.
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Verify the panic was captured.
+	if problem != bork {
+		t.Fatalf("wrong error: %v != %v", problem, bork)
+	}
+
+	// Fill a batch where one function fails; the others still commit.
+	db.MaxBatchSize = 3
+	db.MaxBatchDelay = time.Hour
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			errs <- db.Batch(func(tx *Tx) error {
+				if i == 1 {
+					return errors.New("fail")
+				}
+				_, err := tx.CreateBucketIfNotExists([]byte(fmt.Sprintf("b%d", i)))
+				return err
+			})
+		}(i)
+	}
+	var failed int
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("exp=1 failed call; got=%d", failed)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if tx.Bucket([]byte("b0")) == nil || tx.Bucket([]byte("b2")) == nil {
+			t.Fatal("expected buckets")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a damaged page is reported on read, or on open in paranoid
+// mode, and ignored when verification is off.
+func TestOpen_PageChecksum(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), []byte("bar")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var root pgid
+	if err := db.View(func(tx *Tx) error {
+		root = tx.Bucket([]byte("widgets")).root
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Untouched pages pass verification.
+	db, err := Open(path, &Options{ChecksumMode: ChecksumOnOpen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip the last byte of the bucket's root page.
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	off := int64(root+1)*int64(defaultPageSize) - 1
+	if _, err := f.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xFF
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(path, &Options{ChecksumMode: ChecksumOnOpen}); !errors.Is(err, ErrPageChecksum) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	read := func(mode ChecksumMode) error {
+		db, err := Open(path, &Options{ChecksumMode: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		return db.View(func(tx *Tx) error {
+			tx.Bucket([]byte("widgets")).Get([]byte("0042"))
+			return nil
+		})
+	}
+	var cerr *PageChecksumError
+	if err := read(ChecksumOnRead); !errors.As(err, &cerr) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if cerr.Pgid != uint64(root) {
+		t.Fatalf("exp=%d; got=%d", root, cerr.Pgid)
+	}
+	if err := read(ChecksumOff); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,56 @@
+// Package drill injects failures into an open tinydb database so that
+// applications embedding tinydb can exercise their own recovery logic.
+//
+// A Drill only affects the database it was created for. Failures are armed
+// explicitly and, except for the remap delay, fire exactly once:
+//
+//	d := drill.New(db)
+//	defer d.Close()
+//
+//	d.FailNextSync(errors.New("disk on fire"))
+//	err := db.Update(...) // returns the injected error and rolls back
+package drill
+
+import (
+	"time"
+
+	"tinydb"
+	"tinydb/internal/failpoint"
+)
+
+// Drill arms failures on a single open database.
+type Drill struct {
+	db *tinydb.Db
+	fp *failpoint.Points
+}
+
+// New returns a drill for db. Calling New twice for the same database
+// returns drills that share the same armed failures.
+func New(db *tinydb.Db) *Drill {
+	return &Drill{db: db, fp: failpoint.Register(db)}
+}
+
+// FailNextSync makes the next fsync of the database file return err instead
+// of syncing. A commit that hits it is rolled back and returns err.
+func (d *Drill) FailNextSync(err error) {
+	d.fp.FailSync(err)
+}
+
+// FailNextAllocation makes the next page allocation return err. Pages are
+// allocated while a writable transaction commits, so the commit is rolled
+// back and returns err.
+func (d *Drill) FailNextAllocation(err error) {
+	d.fp.FailAllocate(err)
+}
+
+// DelayRemap makes every remap of the database sleep for delay while holding
+// the mmap lock, which blocks new read transactions for that long. A zero
+// delay disables it.
+func (d *Drill) DelayRemap(delay time.Duration) {
+	d.fp.SetRemapDelay(delay)
+}
+
+// Close disarms all failures for the database.
+func (d *Drill) Close() {
+	failpoint.Unregister(d.db)
+}
@@ -0,0 +1,126 @@
+package drill_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"tinydb"
+	"tinydb/drill"
+)
+
+// mustOpen opens a database in a temporary file.
+func mustOpen(t *testing.T) (*tinydb.Db, string) {
+	f, err := ioutil.TempFile("", "tinydb-drill-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+
+	db, err := tinydb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, path
+}
+
+// put writes a key into the widgets bucket.
+func put(db *tinydb.Db, key, value string) error {
+	return db.Update(func(tx *tinydb.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), []byte(value))
+	})
+}
+
+// get reads a key from the widgets bucket.
+func get(t *testing.T, db *tinydb.Db, key string) (value string) {
+	if err := db.View(func(tx *tinydb.Tx) error {
+		if b := tx.Bucket([]byte("widgets")); b != nil {
+			value = string(b.Get([]byte(key)))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// Ensure that an injected fsync failure fails one commit and rolls it back.
+func TestDrill_FailNextSync(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	d := drill.New(db)
+	defer d.Close()
+
+	errSync := errors.New("sync failed")
+	d.FailNextSync(errSync)
+	if err := put(db, "foo", "bar"); err == nil || !strings.Contains(err.Error(), errSync.Error()) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v := get(t, db, "foo"); v != "" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+
+	// The failure only fires once.
+	if err := put(db, "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if v := get(t, db, "foo"); v != "bar" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+}
+
+// Ensure that an injected allocation failure fails one commit and rolls it back.
+func TestDrill_FailNextAllocation(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	d := drill.New(db)
+	defer d.Close()
+
+	errAlloc := errors.New("allocation failed")
+	d.FailNextAllocation(errAlloc)
+	if err := put(db, "foo", "bar"); err != errAlloc {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := put(db, "foo", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	if v := get(t, db, "foo"); v != "baz" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+}
+
+// Ensure that a remap is delayed and that closing the drill disarms it.
+func TestDrill_DelayRemap(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	d := drill.New(db)
+	d.DelayRemap(50 * time.Millisecond)
+
+	// A large commit grows the mmap.
+	start := time.Now()
+	if err := put(db, "foo", string(make([]byte, 1<<20))); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected delayed remap; commit took %s", elapsed)
+	}
+
+	// Failures armed before Close no longer fire.
+	d.FailNextSync(errors.New("sync failed"))
+	d.Close()
+	if err := put(db, "bar", "baz"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,163 @@
+// Package encoding provides order-preserving binary encoders for building keys.
+//
+// tinydb compares keys with bytes.Compare, so keys built from integers, floats
+// or timestamps must be encoded such that their byte order matches their
+// logical order. Every Append* function appends the encoded value to dst and
+// returns the extended slice, which makes it cheap to build composite keys.
+package encoding
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+var (
+	// ErrShortBuffer is returned when decoding a value from a buffer that is
+	// smaller than the encoded size.
+	ErrShortBuffer = errors.New("encoding: short buffer")
+
+	// ErrMalformedTuple is returned when decoding a tuple that is not properly
+	// escaped or terminated.
+	ErrMalformedTuple = errors.New("encoding: malformed tuple")
+)
+
+// Tuple escaping bytes. Each tuple element is terminated by 0x00 0x01 and any
+// 0x00 inside an element is escaped as 0x00 0xFF, so a shorter element always
+// sorts before a longer element sharing the same prefix.
+const (
+	tupleEscape     = 0x00
+	tupleTerminator = 0x01
+	tupleEscapedNul = 0xFF
+)
+
+// AppendUint64 appends the big-endian encoding of v to dst.
+func AppendUint64(dst []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(dst, buf[:]...)
+}
+
+// Uint64 decodes a value encoded by AppendUint64 and returns the remaining bytes.
+func Uint64(b []byte) (uint64, []byte, error) {
+	if len(b) < 8 {
+		return 0, b, ErrShortBuffer
+	}
+	return binary.BigEndian.Uint64(b), b[8:], nil
+}
+
+// AppendInt64 appends an encoding of v to dst in which negative numbers sort
+// before positive numbers. The sign bit is flipped so two's complement values
+// compare correctly as unsigned big-endian bytes.
+func AppendInt64(dst []byte, v int64) []byte {
+	return AppendUint64(dst, uint64(v)^(1<<63))
+}
+
+// Int64 decodes a value encoded by AppendInt64 and returns the remaining bytes.
+func Int64(b []byte) (int64, []byte, error) {
+	u, rest, err := Uint64(b)
+	if err != nil {
+		return 0, b, err
+	}
+	return int64(u ^ (1 << 63)), rest, nil
+}
+
+// AppendFloat64 appends an order-preserving encoding of v to dst.
+// Positive floats get their sign bit flipped while negative floats have all
+// bits inverted, so -Inf < negative < -0 < +0 < positive < +Inf. NaNs sort
+// by their sign bit like other floats: a NaN with the sign bit clear, such as
+// math.NaN(), sorts after +Inf and one with the sign bit set sorts before
+// -Inf.
+func AppendFloat64(dst []byte, v float64) []byte {
+	u := math.Float64bits(v)
+	if u&(1<<63) != 0 {
+		u = ^u
+	} else {
+		u |= 1 << 63
+	}
+	return AppendUint64(dst, u)
+}
+
+// Float64 decodes a value encoded by AppendFloat64 and returns the remaining bytes.
+func Float64(b []byte) (float64, []byte, error) {
+	u, rest, err := Uint64(b)
+	if err != nil {
+		return 0, b, err
+	}
+	if u&(1<<63) != 0 {
+		u &^= 1 << 63
+	} else {
+		u = ^u
+	}
+	return math.Float64frombits(u), rest, nil
+}
+
+// AppendTime appends t as nanoseconds since the Unix epoch using AppendInt64.
+// The location and monotonic clock reading are not preserved.
+func AppendTime(dst []byte, t time.Time) []byte {
+	return AppendInt64(dst, t.UnixNano())
+}
+
+// Time decodes a value encoded by AppendTime and returns the remaining bytes.
+// The returned time is in UTC.
+func Time(b []byte) (time.Time, []byte, error) {
+	ns, rest, err := Int64(b)
+	if err != nil {
+		return time.Time{}, b, err
+	}
+	return time.Unix(0, ns).UTC(), rest, nil
+}
+
+// AppendTuple appends the escaped encoding of each element to dst.
+// Tuples compare element by element, so ("a", "z") sorts before ("ab", "a").
+// Elements may themselves be produced by the other Append* functions.
+func AppendTuple(dst []byte, elems ...[]byte) []byte {
+	for _, e := range elems {
+		for _, c := range e {
+			if c == tupleEscape {
+				dst = append(dst, tupleEscape, tupleEscapedNul)
+				continue
+			}
+			dst = append(dst, c)
+		}
+		dst = append(dst, tupleEscape, tupleTerminator)
+	}
+	return dst
+}
+
+// Tuple decodes all elements of a tuple encoded by AppendTuple.
+func Tuple(b []byte) ([][]byte, error) {
+	var elems [][]byte
+	var elem []byte
+	for i := 0; i < len(b); i++ {
+		if b[i] != tupleEscape {
+			elem = append(elem, b[i])
+			continue
+		}
+
+		// An escape byte must always be followed by a marker.
+		if i+1 >= len(b) {
+			return nil, ErrMalformedTuple
+		}
+		i++
+		switch b[i] {
+		case tupleEscapedNul:
+			elem = append(elem, tupleEscape)
+		case tupleTerminator:
+			if elem == nil {
+				elem = []byte{}
+			}
+			elems = append(elems, elem)
+			elem = nil
+		default:
+			return nil, ErrMalformedTuple
+		}
+	}
+
+	// Trailing bytes without a terminator are not a valid element.
+	if elem != nil {
+		return nil, ErrMalformedTuple
+	}
+	return elems, nil
+}
@@ -0,0 +1,136 @@
+package encoding
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+// Ensure that encoded signed integers sort in numeric order.
+func TestAppendInt64_Order(t *testing.T) {
+	values := []int64{math.MinInt64, -1 << 40, -256, -1, 0, 1, 255, 1 << 40, math.MaxInt64}
+	for i := 1; i < len(values); i++ {
+		a, b := AppendInt64(nil, values[i-1]), AppendInt64(nil, values[i])
+		if bytes.Compare(a, b) != -1 {
+			t.Fatalf("expected %d < %d; got %x >= %x", values[i-1], values[i], a, b)
+		}
+	}
+
+	for _, v := range values {
+		got, rest, err := Int64(AppendInt64(nil, v))
+		if err != nil {
+			t.Fatal(err)
+		} else if got != v || len(rest) != 0 {
+			t.Fatalf("round trip %d: got %d, rest %x", v, got, rest)
+		}
+	}
+}
+
+// Ensure that encoded floats sort in numeric order.
+func TestAppendFloat64_Order(t *testing.T) {
+	values := []float64{math.Inf(-1), -1e300, -1.5, -math.SmallestNonzeroFloat64, 0, math.SmallestNonzeroFloat64, 1.5, 1e300, math.Inf(1)}
+	for i := 1; i < len(values); i++ {
+		a, b := AppendFloat64(nil, values[i-1]), AppendFloat64(nil, values[i])
+		if bytes.Compare(a, b) != -1 {
+			t.Fatalf("expected %v < %v; got %x >= %x", values[i-1], values[i], a, b)
+		}
+	}
+
+	for _, v := range values {
+		got, _, err := Float64(AppendFloat64(nil, v))
+		if err != nil {
+			t.Fatal(err)
+		} else if got != v {
+			t.Fatalf("round trip %v: got %v", v, got)
+		}
+	}
+
+	// NaNs sort by their sign bit.
+	nan := math.NaN()
+	negNaN := math.Copysign(nan, -1)
+	if bytes.Compare(AppendFloat64(nil, nan), AppendFloat64(nil, math.Inf(1))) != 1 {
+		t.Fatal("expected NaN to sort after +Inf")
+	} else if bytes.Compare(AppendFloat64(nil, negNaN), AppendFloat64(nil, math.Inf(-1))) != -1 {
+		t.Fatal("expected negative NaN to sort before -Inf")
+	}
+}
+
+// Ensure that timestamps round trip and sort chronologically.
+func TestAppendTime(t *testing.T) {
+	t0 := time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := time.Date(2021, 6, 1, 12, 30, 0, 42, time.UTC)
+	a, b := AppendTime(nil, t0), AppendTime(nil, t1)
+	if bytes.Compare(a, b) != -1 {
+		t.Fatalf("expected %v < %v", t0, t1)
+	}
+
+	got, _, err := Time(b)
+	if err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(t1) {
+		t.Fatalf("round trip: got %v, expected %v", got, t1)
+	}
+}
+
+// Ensure that decoding a short buffer returns an error.
+func TestUint64_ErrShortBuffer(t *testing.T) {
+	if _, _, err := Uint64([]byte{1, 2, 3}); err != ErrShortBuffer {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that tuples sort element by element, including elements containing 0x00.
+func TestAppendTuple_Order(t *testing.T) {
+	tuples := [][][]byte{
+		{[]byte(""), []byte("z")},
+		{[]byte("a"), []byte("z")},
+		{[]byte("a\x00"), []byte("a")},
+		{[]byte("a\x00\x00"), []byte("a")},
+		{[]byte("a\x01"), []byte("a")},
+		{[]byte("ab"), []byte("a")},
+		{[]byte("ab"), []byte("b")},
+	}
+	for i := 1; i < len(tuples); i++ {
+		a, b := AppendTuple(nil, tuples[i-1]...), AppendTuple(nil, tuples[i]...)
+		if bytes.Compare(a, b) != -1 {
+			t.Fatalf("expected %q < %q; got %x >= %x", tuples[i-1], tuples[i], a, b)
+		}
+	}
+
+	for _, tuple := range tuples {
+		elems, err := Tuple(AppendTuple(nil, tuple...))
+		if err != nil {
+			t.Fatal(err)
+		} else if len(elems) != len(tuple) {
+			t.Fatalf("expected %d elements; got %d", len(tuple), len(elems))
+		}
+		for i := range elems {
+			if !bytes.Equal(elems[i], tuple[i]) {
+				t.Fatalf("element %d: expected %q; got %q", i, tuple[i], elems[i])
+			}
+		}
+	}
+}
+
+// Ensure that composite keys built from typed elements keep numeric order.
+func TestAppendTuple_Composite(t *testing.T) {
+	key := func(user string, ts int64) []byte {
+		return AppendTuple(nil, []byte(user), AppendInt64(nil, ts))
+	}
+	if bytes.Compare(key("bob", -5), key("bob", 3)) != -1 {
+		t.Fatal("expected negative timestamp to sort first")
+	}
+	if bytes.Compare(key("bob", math.MaxInt64), key("bobby", math.MinInt64)) != -1 {
+		t.Fatal("expected shorter user to sort first")
+	}
+}
+
+// Ensure that malformed tuples are rejected.
+func TestTuple_ErrMalformedTuple(t *testing.T) {
+	for _, b := range [][]byte{{'a'}, {'a', 0x00}, {'a', 0x00, 0x02}} {
+		if _, err := Tuple(b); err != ErrMalformedTuple {
+			t.Fatalf("%x: unexpected error: %v", b, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package tinydb
+
+import "bytes"
+
+// engine is the ordered key/value storage behind a Bucket. Bucket and Tx
+// validate arguments, track changes and manage nested buckets, and leave
+// storing elements to the engine. The B+tree is the only engine; the
+// interface lets experimental trees be developed and benchmarked in the
+// tree against the same Bucket API and tests. Nested bucket headers and
+// Cursor still work on the B+tree directly.
+type engine interface {
+	// get returns the value and flags of the element for key, and false
+	// if there is none.
+	get(key []byte) (value []byte, flags uint32, ok bool)
+
+	// put inserts or replaces the value for key. Returns
+	// ErrIncompatibleValue if key holds a nested bucket.
+	put(key, value []byte) error
+
+	// del removes the element for key and returns false if there was none.
+	// Returns ErrIncompatibleValue if key holds a nested bucket.
+	del(key []byte) (bool, error)
+
+	// cursor returns a cursor over the elements in key order.
+	cursor() engineCursor
+
+	// rebalance and spill write out the engine's changes on commit.
+	rebalance()
+	spill() error
+}
+
+// engineCursor iterates over the elements of an engine in key order. Each
+// method returns a nil key once it moves past either end.
+type engineCursor interface {
+	first() (key, value []byte, flags uint32)
+	last() (key, value []byte, flags uint32)
+	next() (key, value []byte, flags uint32)
+	prev() (key, value []byte, flags uint32)
+	seek(key []byte) (k, value []byte, flags uint32)
+}
+
+// btree is the B+tree engine stored in the bucket's pages and nodes.
+type btree struct {
+	b *Bucket
+}
+
+func (t btree) get(key []byte) ([]byte, uint32, bool) {
+	k, v, flags := t.b.Cursor().seek(key)
+	if !bytes.Equal(key, k) {
+		return nil, 0, false
+	}
+	return v, flags, true
+}
+
+func (t btree) put(key, value []byte) error {
+	// Move cursor to correct position.
+	c := t.b.Cursor()
+	k, _, flags := c.seek(key)
+
+	// Return an error if there is an existing key with a bucket value.
+	if bytes.Equal(key, k) && (flags&bucketLeafFlag) != 0 {
+		return ErrIncompatibleValue
+	}
+
+	// Insert into node.
+	key = cloneBytes(key)
+	c.node().put(key, key, value, 0, 0)
+	return nil
+}
+
+func (t btree) del(key []byte) (bool, error) {
+	// Move cursor to correct position.
+	c := t.b.Cursor()
+	k, _, flags := c.seek(key)
+
+	// Return false if the key doesn't exist.
+	if !bytes.Equal(key, k) {
+		return false, nil
+	}
+
+	// Return an error if there is already existing bucket value.
+	if (flags & bucketLeafFlag) != 0 {
+		return false, ErrIncompatibleValue
+	}
+
+	// Delete the node if we have a matching key.
+	c.node().del(key)
+	return true, nil
+}
+
+func (t btree) cursor() engineCursor { return btreeCursor{t.b.Cursor()} }
+func (t btree) rebalance()           { t.b.rebalance() }
+func (t btree) spill() error         { return t.b.spill() }
+
+// btreeCursor adapts a Cursor to return the flags of each element.
+type btreeCursor struct {
+	c *Cursor
+}
+
+func (c btreeCursor) first() ([]byte, []byte, uint32)          { return c.at(c.c.First()) }
+func (c btreeCursor) last() ([]byte, []byte, uint32)           { return c.at(c.c.Last()) }
+func (c btreeCursor) next() ([]byte, []byte, uint32)           { return c.at(c.c.Next()) }
+func (c btreeCursor) prev() ([]byte, []byte, uint32)           { return c.at(c.c.Prev()) }
+func (c btreeCursor) seek(key []byte) ([]byte, []byte, uint32) { return c.at(c.c.Seek(key)) }
+
+// at returns the raw element under the cursor after a move that returned k.
+func (c btreeCursor) at(k, _ []byte) ([]byte, []byte, uint32) {
+	if k == nil {
+		return nil, nil, 0
+	}
+	return c.c.keyValue()
+}
@@ -0,0 +1,167 @@
+package tinydb
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+// engines lists the storage engines run through the engine tests. New
+// engines register here to be checked against the B+tree's behavior.
+var engines = map[string]func(b *Bucket) engine{
+	"btree": func(b *Bucket) engine { return btree{b} },
+}
+
+// Ensure that every engine stores, deletes and iterates keys in order and
+// that its changes survive a commit.
+func TestEngine(t *testing.T) {
+	for name, open := range engines {
+		t.Run(name, func(t *testing.T) {
+			db, path := mustOpen(t)
+			defer os.RemoveAll(path)
+			defer db.Close()
+
+			// Insert keys in random order and delete every third one.
+			var keys []string
+			for _, i := range rand.Perm(2000) {
+				keys = append(keys, fmt.Sprintf("%05d", i))
+			}
+			if err := db.Update(func(tx *Tx) error {
+				if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+					return err
+				}
+				e := open(tx.Bucket([]byte("widgets")))
+				for _, k := range keys {
+					if err := e.put([]byte(k), []byte("v"+k)); err != nil {
+						return err
+					}
+				}
+				for i, k := range keys {
+					if i%3 != 0 {
+						continue
+					}
+					if ok, err := e.del([]byte(k)); err != nil || !ok {
+						t.Fatalf("del %s: %v, %v", k, ok, err)
+					}
+				}
+				if ok, err := e.del([]byte("missing")); err != nil || ok {
+					t.Fatalf("del missing: %v, %v", ok, err)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			var exp []string
+			for i, k := range keys {
+				if i%3 != 0 {
+					exp = append(exp, k)
+				}
+			}
+			sort.Strings(exp)
+
+			if err := db.View(func(tx *Tx) error {
+				e := open(tx.Bucket([]byte("widgets")))
+				for _, k := range exp {
+					if v, _, ok := e.get([]byte(k)); !ok || string(v) != "v"+k {
+						t.Fatalf("get %s: %q, %v", k, v, ok)
+					}
+				}
+
+				// Walk forwards and backwards.
+				var fwd, rev []string
+				c := e.cursor()
+				for k, _, _ := c.first(); k != nil; k, _, _ = c.next() {
+					fwd = append(fwd, string(k))
+				}
+				for k, _, _ := c.last(); k != nil; k, _, _ = c.prev() {
+					rev = append([]string{string(k)}, rev...)
+				}
+				if fmt.Sprint(fwd) != fmt.Sprint(exp) || fmt.Sprint(rev) != fmt.Sprint(exp) {
+					t.Fatalf("unexpected order: %d forward, %d reverse, %d expected", len(fwd), len(rev), len(exp))
+				}
+
+				// Seek lands on the next key for missing ones.
+				if k, _, _ := c.seek([]byte("00000")); !bytes.Equal(k, []byte(exp[0])) {
+					t.Fatalf("unexpected seek: %q", k)
+				} else if k, _, _ := c.seek([]byte("99999")); k != nil {
+					t.Fatalf("unexpected seek past end: %q", k)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// Ensure that engines refuse to overwrite or delete a nested bucket.
+func TestEngine_IncompatibleValue(t *testing.T) {
+	for name, open := range engines {
+		t.Run(name, func(t *testing.T) {
+			db, path := mustOpen(t)
+			defer os.RemoveAll(path)
+			defer db.Close()
+
+			if err := db.Update(func(tx *Tx) error {
+				b, err := tx.CreateBucket([]byte("widgets"))
+				if err != nil {
+					return err
+				}
+				if _, err := b.CreateBucket([]byte("foo")); err != nil {
+					return err
+				}
+				e := open(b)
+				if err := e.put([]byte("foo"), []byte("bar")); err != ErrIncompatibleValue {
+					t.Fatalf("unexpected put error: %v", err)
+				}
+				if _, err := e.del([]byte("foo")); err != ErrIncompatibleValue {
+					t.Fatalf("unexpected del error: %v", err)
+				}
+				if _, flags, ok := e.get([]byte("foo")); !ok || (flags&bucketLeafFlag) == 0 {
+					t.Fatalf("expected bucket element: %v, %x", ok, flags)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// BenchmarkEngine_Put measures committing batches of random puts per engine.
+func BenchmarkEngine_Put(b *testing.B) {
+	for name, open := range engines {
+		b.Run(name, func(b *testing.B) {
+			path := tempfile()
+			defer os.RemoveAll(path)
+			db, err := Open(path, &Options{NoSync: true})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i += 1000 {
+				if err := db.Update(func(tx *Tx) error {
+					bkt, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+					if err != nil {
+						return err
+					}
+					e := open(bkt)
+					for j := i; j < i+1000 && j < b.N; j++ {
+						if err := e.put([]byte(fmt.Sprintf("%016x", rand.Int63())), make([]byte, 64)); err != nil {
+							return err
+						}
+					}
+					return nil
+				}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package tinydb
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 // These errors can be returned when opening or calling methods on a DB.
 var (
@@ -23,11 +26,50 @@ var (
 	// ErrChecksum is returned when either meta page checksum does not match.
 	ErrChecksum = errors.New("checksum error")
 
+	// ErrMmapTooLarge is returned when a database grows, or is opened,
+	// larger than the largest mapping supported on this platform, such as
+	// 2GB on 32-bit ARM and x86.
+	ErrMmapTooLarge = errors.New("mmap too large")
+
+	// ErrUnknownPageType is returned when a page has flags that don't match
+	// the page type expected at that position in the file, which typically
+	// means the file is corrupted or was written by a newer version. The
+	// error is returned as an *UnknownPageTypeError identifying the page.
+	ErrUnknownPageType = errors.New("unknown page type")
+
+	// ErrPageChecksum is returned when checksum verification is enabled and
+	// a page doesn't match the checksum in its header. The error is returned
+	// as a *PageChecksumError identifying the page.
+	ErrPageChecksum = errors.New("page checksum mismatch")
+
+	// ErrInvalidFillPercent is returned by Open when the fill percent bounds
+	// in Options are out of range or inverted.
+	ErrInvalidFillPercent = errors.New("invalid fill percent bounds")
+
+	// ErrInvalidPageSize is returned by Open when Options.PageSize is not a
+	// power of two between 1KB and 64KB.
+	ErrInvalidPageSize = errors.New("invalid page size")
+
+	// ErrInvalidSegmentSize is returned by Open when Options.SegmentSize is
+	// not a multiple of the page size, or doesn't match the size of the
+	// segments the database is already split into.
+	ErrInvalidSegmentSize = errors.New("invalid segment size")
+
 	// ErrTimeout is returned when a database cannot obtain an exclusive lock
 	// on the data file after the timeout passed to Open().
 	ErrTimeout = errors.New("timeout")
 )
 
+// These errors can occur when creating, dropping or viewing a named snapshot.
+var (
+	// ErrSnapshotNotFound is returned when a named snapshot does not exist.
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+
+	// ErrSnapshotExists is returned when creating a snapshot with a name
+	// that is already in use.
+	ErrSnapshotExists = errors.New("snapshot already exists")
+)
+
 // These errors can occur when beginning or committing a Tx.
 var (
 	// ErrTxNotWritable is returned when performing a write operation on a
@@ -38,6 +80,10 @@ var (
 	// that has already been committed or rolled back.
 	ErrTxClosed = errors.New("tx closed")
 
+	// ErrTooManyReadTxs is returned when beginning a read-only transaction
+	// while Options.MaxReadTxs transactions are already open.
+	ErrTooManyReadTxs = errors.New("too many open read transactions")
+
 	// ErrDatabaseReadOnly is returned when a mutating transaction is started on a
 	// read-only database.
 	ErrDatabaseReadOnly = errors.New("database is in read-only mode")
@@ -55,6 +101,10 @@ var (
 	// ErrBucketNameRequired is returned when creating a bucket with a blank name.
 	ErrBucketNameRequired = errors.New("bucket name required")
 
+	// ErrBucketReserved is returned when creating or deleting the top-level
+	// bucket reserved for named snapshots.
+	ErrBucketReserved = errors.New("bucket name reserved")
+
 	// ErrKeyRequired is returned when inserting a zero-length key.
 	ErrKeyRequired = errors.New("key required")
 
@@ -69,3 +119,41 @@ var (
 	// non-bucket key on an existing bucket key.
 	ErrIncompatibleValue = errors.New("incompatible value")
 )
+
+// UnknownPageTypeError identifies a page whose flags don't match any expected
+// page type. It matches ErrUnknownPageType with errors.Is.
+//
+// Cursors and buckets cannot return errors, so they panic with this error
+// when they reach such a page. Db.View and Db.Update recover it and return
+// it as the transaction error.
+type UnknownPageTypeError struct {
+	Pgid  uint64
+	Flags uint16
+}
+
+// Error implements the error interface.
+func (e *UnknownPageTypeError) Error() string {
+	return fmt.Sprintf("%s: page %d has flags 0x%02x", ErrUnknownPageType, e.Pgid, e.Flags)
+}
+
+// Is reports whether target is ErrUnknownPageType.
+func (e *UnknownPageTypeError) Is(target error) bool {
+	return target == ErrUnknownPageType
+}
+
+// PageChecksumError is returned when a page's contents don't match the
+// checksum stored in its header, which typically means the page was
+// damaged on disk after it was written.
+type PageChecksumError struct {
+	Pgid uint64
+}
+
+// Error implements the error interface.
+func (e *PageChecksumError) Error() string {
+	return fmt.Sprintf("%s: page %d", ErrPageChecksum, e.Pgid)
+}
+
+// Is reports whether target is ErrPageChecksum.
+func (e *PageChecksumError) Is(target error) bool {
+	return target == ErrPageChecksum
+}
@@ -0,0 +1,211 @@
+package tinydb_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"tinydb"
+)
+
+// tempDbPath returns a path for a new database file inside a temporary
+// directory. The returned func removes the directory.
+func tempDbPath() (string, func()) {
+	dir, err := ioutil.TempDir("", "tinydb-example-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return filepath.Join(dir, "example.db"), func() { _ = os.RemoveAll(dir) }
+}
+
+func ExampleDb_Begin() {
+	path, cleanup := tempDbPath()
+	defer cleanup()
+
+	db, err := tinydb.Open(path, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// Start a writable transaction and commit it.
+	tx, err := db.Begin(true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("writable=%v id=%d\n", tx.Writable(), tx.ID())
+	if err := tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Read-only transactions see the last committed transaction id.
+	tx, err = db.Begin(false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("writable=%v id=%d\n", tx.Writable(), tx.ID())
+	if err := tx.Rollback(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// writable=true id=2
+	// writable=false id=2
+}
+
+func ExampleTx_Rollback() {
+	path, cleanup := tempDbPath()
+	defer cleanup()
+
+	db, err := tinydb.Open(path, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// Rolling back a writable transaction discards its changes.
+	tx, err := db.Begin(true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		log.Fatal(err)
+	}
+
+	// A closed transaction can not be committed.
+	fmt.Println(tx.Commit())
+
+	// Output:
+	// tx closed
+}
+
+func ExampleTx_OnCommit() {
+	path, cleanup := tempDbPath()
+	defer cleanup()
+
+	db, err := tinydb.Open(path, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tx.OnCommit(func() { fmt.Println("committed") })
+	if err := tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// committed
+}
+
+func ExampleDb_Update() {
+	path, cleanup := tempDbPath()
+	defer cleanup()
+
+	db, err := tinydb.Open(path, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// The transaction is committed when the function returns nil and
+	// rolled back when it returns an error.
+	if err := db.Update(func(tx *tinydb.Tx) error {
+		fmt.Printf("update id=%d\n", tx.ID())
+		return nil
+	}); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := db.View(func(tx *tinydb.Tx) error {
+		fmt.Printf("view id=%d\n", tx.ID())
+		return nil
+	}); err != nil {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// update id=2
+	// view id=2
+}
+
+func ExampleTx_CreateBucket() {
+	path, cleanup := tempDbPath()
+	defer cleanup()
+
+	db, err := tinydb.Open(path, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// Create a bucket and store a key in it.
+	if err := db.Update(func(tx *tinydb.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		log.Fatal(err)
+	}
+
+	// Read the value back in a read-only transaction.
+	if err := db.View(func(tx *tinydb.Tx) error {
+		fmt.Printf("foo=%s\n", tx.Bucket([]byte("widgets")).Get([]byte("foo")))
+		return nil
+	}); err != nil {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// foo=bar
+}
+
+func ExampleCursor() {
+	path, cleanup := tempDbPath()
+	defer cleanup()
+
+	db, err := tinydb.Open(path, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Update(func(tx *tinydb.Tx) error {
+		b, err := tx.CreateBucket([]byte("animals"))
+		if err != nil {
+			return err
+		}
+		for _, k := range []string{"dog", "cat", "liger"} {
+			if err := b.Put([]byte(k), []byte("fun")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Fatal(err)
+	}
+
+	// Keys are always iterated in byte-sorted order.
+	if err := db.View(func(tx *tinydb.Tx) error {
+		c := tx.Bucket([]byte("animals")).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			fmt.Printf("A %s is %s.\n", k, v)
+		}
+		return nil
+	}); err != nil {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// A cat is fun.
+	// A dog is fun.
+	// A liger is fun.
+}
@@ -6,20 +6,65 @@ import (
 	"unsafe"
 )
 
+// FreelistType is the type of the freelist backend.
+type FreelistType string
+
+const (
+	// FreelistArrayType indicates backend freelist type is array.
+	FreelistArrayType = FreelistType("array")
+	// FreelistMapType indicates backend freelist type is hashmap.
+	FreelistMapType = FreelistType("hashmap")
+)
+
+// pidSet holds the set of starting pgids which have the same span size.
+type pidSet map[pgid]struct{}
+
 // freelist represents a list of all pages that are available for allocation.
 // It also tracks pages that have been freed but are still in use by open transactions.
 type freelist struct {
-	ids     []pgid          // all free and available free page ids.
-	pending map[txid][]pgid // mapping of soon-to-be free page ids by tx.
-	cache   map[pgid]bool   // fast lookup of all free and pending page ids.
+	freelistType   FreelistType       // freelist type
+	ids            []pgid             // all free and available free page ids.
+	spans          *spanIndex         // runs of ids for arrayAllocate, built on first use after ids are read
+	pending        map[txid][]pgid    // mapping of soon-to-be free page ids by tx.
+	cache          map[pgid]bool      // fast lookup of all free and pending page ids.
+	pinned         map[pgid]bool      // pages retained by named snapshots, never freed.
+	freemaps       map[uint64]pidSet  // key is the size of continuous pages(span), value is a set which contains the starting pgids of same size
+	forwardMap     map[pgid]uint64    // key is start pgid, value is its span size
+	backwardMap    map[pgid]uint64    // key is end pgid, value is its span size
+	allocate       func(n int) pgid   // the freelist allocate func
+	free_count     func() int         // the function which gives you free page number
+	mergeSpans     func(ids pgids)    // the mergeSpan func
+	getFreePageIDs func() []pgid      // get free pgids func
+	readIDs        func(pgids []pgid) // readIDs func reads list of pages and init the freelist
+	segmentPages   pgid               // pages per segment file, which spans never cross; zero if unsegmented
 }
 
 // newFreelist returns an empty, initialized freelist.
-func newFreelist() *freelist {
-	return &freelist{
-		pending: make(map[txid][]pgid),
-		cache:   make(map[pgid]bool),
+func newFreelist(freelistType FreelistType) *freelist {
+	f := &freelist{
+		freelistType: freelistType,
+		pending:      make(map[txid][]pgid),
+		cache:        make(map[pgid]bool),
+		freemaps:     make(map[uint64]pidSet),
+		forwardMap:   make(map[pgid]uint64),
+		backwardMap:  make(map[pgid]uint64),
+	}
+
+	if freelistType == FreelistMapType {
+		f.allocate = f.hashmapAllocate
+		f.free_count = f.hashmapFreeCount
+		f.mergeSpans = f.hashmapMergeSpans
+		f.getFreePageIDs = f.hashmapGetFreePageIDs
+		f.readIDs = f.hashmapReadIDs
+	} else {
+		f.allocate = f.arrayAllocate
+		f.free_count = f.arrayFreeCount
+		f.mergeSpans = f.arrayMergeSpans
+		f.getFreePageIDs = f.arrayGetFreePageIDs
+		f.readIDs = f.arrayReadIDs
 	}
+
+	return f
 }
 
 // size returns the size of the page after serialization.
@@ -38,8 +83,8 @@ func (f *freelist) count() int {
 	return f.free_count() + f.pending_count()
 }
 
-// free_count returns count of free pages
-func (f *freelist) free_count() int {
+// arrayFreeCount returns count of free pages(array version)
+func (f *freelist) arrayFreeCount() int {
 	return len(f.ids)
 }
 
@@ -60,51 +105,226 @@ func (f *freelist) copyall(dst []pgid) {
 		m = append(m, list...)
 	}
 	sort.Sort(m)
-	mergepgids(dst, f.ids, m)
+	mergepgids(dst, f.getFreePageIDs(), m)
 }
 
-// allocate returns the starting page id of a contiguous list of pages of a given size.
+// arrayAllocate returns the starting page id of a contiguous list of pages of a given size.
 // If a contiguous block cannot be found then 0 is returned.
-func (f *freelist) allocate(n int) pgid {
-	if len(f.ids) == 0 {
+func (f *freelist) arrayAllocate(n int) pgid {
+	if len(f.ids) == 0 || n <= 0 {
+		return 0
+	}
+
+	// Find the lowest run that is long enough through the span index,
+	// building it first if the ids were just read.
+	if f.spans == nil {
+		f.spans = newSpanIndex(f.ids, f.contiguous)
+	}
+	r := f.spans.first(n)
+	if r < 0 {
 		return 0
 	}
+	initial := f.spans.runs[r].start
+	if initial <= 1 {
+		panic(fmt.Sprintf("invalid page allocation: %d", initial))
+	}
+	f.spans.take(r, n)
+
+	// If we're allocating off the beginning then take the fast path
+	// and just adjust the existing slice. This will use extra memory
+	// temporarily but the append() in free() will realloc the slice
+	// as is necessary.
+	i := sort.Search(len(f.ids), func(i int) bool { return f.ids[i] >= initial })
+	if i == 0 {
+		f.ids = f.ids[n:]
+	} else {
+		copy(f.ids[i:], f.ids[i+n:])
+		f.ids = f.ids[:len(f.ids)-n]
+	}
+
+	// Remove from the free cache.
+	for i := pgid(0); i < pgid(n); i++ {
+		delete(f.cache, initial+i)
+	}
+
+	return initial
+}
+
+// spanIndex finds the lowest run of free pages long enough for an
+// allocation without scanning every free id. The runs are ordered by start
+// page and their lengths kept in a max tree. Allocating shortens a run in
+// place, and freed ids are merged into the runs around them.
+type spanIndex struct {
+	runs       []freeRun
+	tree       []int // tree[1] is the root; the leaves from len(tree)/2 are the run lengths
+	contiguous func(prev, id pgid) bool
+}
+
+// newSpanIndex indexes the runs of the sorted ids.
+func newSpanIndex(ids []pgid, contiguous func(prev, id pgid) bool) *spanIndex {
+	idx := &spanIndex{contiguous: contiguous}
+	for i := 0; i < len(ids); {
+		j := i + 1
+		for j < len(ids) && contiguous(ids[j-1], ids[j]) {
+			j++
+		}
+		idx.runs = append(idx.runs, freeRun{start: ids[i], n: j - i})
+		i = j
+	}
+	idx.build()
+	return idx
+}
 
-	var initial, previd pgid
-	for i, id := range f.ids {
-		if id <= 1 {
-			panic(fmt.Sprintf("invalid page allocation: %d", id))
+// add merges the sorted ids, none of which may be in a run already, into
+// the runs. Freed pages usually extend or join the runs around them, which
+// is done in place; otherwise the runs are rebuilt.
+func (idx *spanIndex) add(ids []pgid) {
+	// Allocations take the start of a run, so going backwards lets pages
+	// given back extend the run they were taken from.
+	for i := len(ids) - 1; i >= 0; i-- {
+		if !idx.addInPlace(ids[i]) {
+			idx.rebuild(ids[:i+1])
+			return
 		}
+	}
+}
 
-		// Reset initial page if this is not contiguous.
-		if previd == 0 || id-previd != 1 {
-			initial = id
+// addInPlace adds id to the runs without moving any and reports whether it
+// could. Runs emptied by allocations are left in place with no pages, and
+// id can take the place of one if no run next to it joins it.
+func (idx *spanIndex) addInPlace(id pgid) bool {
+	runs := idx.runs
+	q := sort.Search(len(runs), func(i int) bool { return runs[i].start > id })
+
+	// empty reports whether there is no run at i, or only an emptied one.
+	// endJoins and startJoins report whether the run at i ends right before
+	// id or starts right after it. Emptied runs can hide the runs next to
+	// id, so id only goes in place when its neighbours on both sides are
+	// known.
+	empty := func(i int) bool { return i < 0 || i >= len(runs) || runs[i].n == 0 }
+	nonempty := func(i int) bool { return i < 0 || i >= len(runs) || runs[i].n > 0 }
+	endJoins := func(i int) bool { return !empty(i) && idx.contiguous(runs[i].start+pgid(runs[i].n-1), id) }
+	startJoins := func(i int) bool { return !empty(i) && idx.contiguous(id, runs[i].start) }
+	joinPrev, joinNext := endJoins(q-1), startJoins(q)
+
+	switch {
+	case joinPrev && joinNext:
+		runs[q-1].n += 1 + runs[q].n
+		runs[q].start, runs[q].n = runs[q].start+pgid(runs[q].n), 0
+		idx.update(q - 1)
+		idx.update(q)
+	case joinPrev && nonempty(q):
+		runs[q-1].n++
+		idx.update(q - 1)
+	case joinNext && nonempty(q-1):
+		runs[q].start--
+		runs[q].n++
+		idx.update(q)
+	case !joinNext && nonempty(q) && q > 0 && runs[q-1].n == 0 && nonempty(q-2) && !endJoins(q-2):
+		runs[q-1] = freeRun{start: id, n: 1}
+		idx.update(q - 1)
+	case !joinPrev && nonempty(q-1) && q < len(runs) && runs[q].n == 0 && nonempty(q+1) && !startJoins(q+1):
+		runs[q] = freeRun{start: id, n: 1}
+		idx.update(q)
+	default:
+		return false
+	}
+	return true
+}
+
+// rebuild merges the sorted ids into the runs, dropping emptied runs.
+func (idx *spanIndex) rebuild(ids []pgid) {
+	runs := make([]freeRun, 0, len(idx.runs)+len(ids))
+	push := func(r freeRun) {
+		if r.n == 0 {
+			return
+		}
+		if last := len(runs) - 1; last >= 0 && idx.contiguous(runs[last].start+pgid(runs[last].n-1), r.start) {
+			runs[last].n += r.n
+		} else {
+			runs = append(runs, r)
 		}
+	}
+
+	i := 0
+	for _, id := range ids {
+		for ; i < len(idx.runs) && idx.runs[i].start < id; i++ {
+			push(idx.runs[i])
+		}
+		push(freeRun{start: id, n: 1})
+	}
+	for ; i < len(idx.runs); i++ {
+		push(idx.runs[i])
+	}
+	idx.runs = runs
+	idx.build()
+}
+
+// build rebuilds the tree over the run lengths.
+func (idx *spanIndex) build() {
+	leaves := 1
+	for leaves < len(idx.runs) {
+		leaves *= 2
+	}
+	if cap(idx.tree) >= 2*leaves {
+		idx.tree = idx.tree[:2*leaves]
+	} else {
+		idx.tree = make([]int, 2*leaves)
+	}
+	for i := range idx.tree[leaves:] {
+		idx.tree[leaves+i] = 0
+		if i < len(idx.runs) {
+			idx.tree[leaves+i] = idx.runs[i].n
+		}
+	}
+	for i := leaves - 1; i > 0; i-- {
+		idx.tree[i] = maxInt(idx.tree[2*i], idx.tree[2*i+1])
+	}
+}
 
-		// If we found a contiguous block then remove it and return it.
-		if (id-initial)+1 == pgid(n) {
-			// If we're allocating off the beginning then take the fast path
-			// and just adjust the existing slice. This will use extra memory
-			// temporarily but the append() in free() will realloc the slice
-			// as is necessary.
-			if (i + 1) == n {
-				f.ids = f.ids[i+1:]
-			} else {
-				copy(f.ids[i-n+1:], f.ids[i+1:])
-				f.ids = f.ids[:len(f.ids)-n]
-			}
-
-			// Remove from the free cache.
-			for i := pgid(0); i < pgid(n); i++ {
-				delete(f.cache, initial+i)
-			}
-
-			return initial
+// first returns the position of the lowest run of at least n pages, or -1
+// if there is none.
+func (idx *spanIndex) first(n int) int {
+	if idx.tree[1] < n {
+		return -1
+	}
+	leaves := len(idx.tree) / 2
+	i := 1
+	for i < leaves {
+		if i *= 2; idx.tree[i] < n {
+			i++
 		}
+	}
+	return i - leaves
+}
 
-		previd = id
+// take removes the first n pages of the run at position i.
+func (idx *spanIndex) take(i, n int) {
+	idx.runs[i].start += pgid(n)
+	idx.runs[i].n -= n
+	idx.update(i)
+}
+
+// update brings the tree up to date with the length of the run at i.
+func (idx *spanIndex) update(i int) {
+	j := len(idx.tree)/2 + i
+	idx.tree[j] = idx.runs[i].n
+	for j /= 2; j > 0; j /= 2 {
+		idx.tree[j] = maxInt(idx.tree[2*j], idx.tree[2*j+1])
 	}
-	return 0
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// contiguous returns true if id directly follows prev in the same segment,
+// so both can be allocated as one span.
+func (f *freelist) contiguous(prev, id pgid) bool {
+	return id == prev+1 && (f.segmentPages == 0 || id%f.segmentPages != 0)
 }
 
 // free releases a page and its overflow for a given transaction id.
@@ -114,6 +334,11 @@ func (f *freelist) free(txid txid, p *page) {
 		panic(fmt.Sprintf("cannot free page 0 or 1: %d", p.id))
 	}
 
+	// Pages of a named snapshot stay allocated until it is dropped.
+	if f.pinned[p.id] {
+		return
+	}
+
 	// Free page and all its overflow pages.
 	var ids = f.pending[txid]
 	for id := p.id; id <= p.id+pgid(p.overflow); id++ {
@@ -129,8 +354,9 @@ func (f *freelist) free(txid txid, p *page) {
 	f.pending[txid] = ids
 }
 
-// release moves all page ids for a transaction id (or older) to the freelist.
-func (f *freelist) release(txid txid) {
+// release moves all page ids for a transaction id (or older) to the freelist
+// and returns them.
+func (f *freelist) release(txid txid) pgids {
 	m := make(pgids, 0)
 	for tid, ids := range f.pending {
 		if tid <= txid {
@@ -140,8 +366,66 @@ func (f *freelist) release(txid txid) {
 			delete(f.pending, tid)
 		}
 	}
-	sort.Sort(m)
-	f.ids = pgids(f.ids).merge(m)
+	f.mergeSpans(m)
+	return m
+}
+
+// freeRun is a run of contiguous free pages.
+type freeRun struct {
+	start pgid
+	n     int
+}
+
+// runs returns the longest runs of free pages that contain any of the given
+// ids and are at least min pages long. Runs don't cross segments and pending
+// pages aren't part of runs.
+func (f *freelist) runs(ids pgids, min int) []freeRun {
+	ids = append(pgids(nil), ids...)
+	sort.Sort(ids)
+	free := f.getFreePageIDs()
+
+	var runs []freeRun
+	for i, j := 0, 0; i < len(free); {
+		// Find the end of the run starting at free[i].
+		k := i + 1
+		for k < len(free) && f.contiguous(free[k-1], free[k]) {
+			k++
+		}
+
+		// Keep it if it is long enough and holds one of the ids.
+		for j < len(ids) && ids[j] < free[i] {
+			j++
+		}
+		if k-i >= min && j < len(ids) && ids[j] <= free[k-1] {
+			runs = append(runs, freeRun{start: free[i], n: k - i})
+		}
+		i = k
+	}
+	return runs
+}
+
+// largestRun returns the length of the longest run of contiguous free pages.
+// Pending pages aren't part of runs.
+func (f *freelist) largestRun() int {
+	var n int
+	if f.freelistType == FreelistMapType {
+		for _, size := range f.forwardMap {
+			n = maxInt(n, int(size))
+		}
+		return n
+	} else if f.spans != nil {
+		return f.spans.tree[1]
+	}
+
+	for i := 0; i < len(f.ids); {
+		j := i + 1
+		for j < len(f.ids) && f.contiguous(f.ids[j-1], f.ids[j]) {
+			j++
+		}
+		n = maxInt(n, j-i)
+		i = j
+	}
+	return n
 }
 
 // rollback removes the pages from a given pending tx.
@@ -164,28 +448,53 @@ func (f *freelist) freed(pgid pgid) bool {
 func (f *freelist) read(p *page) {
 	// If the page.count is at the max uint16 value (64k) then it's considered
 	// an overflow and the size of the freelist is stored as the first element.
+	data := unsafeAdd(unsafe.Pointer(p), pageHeaderSize)
 	idx, count := 0, int(p.count)
 	if count == 0xFFFF {
 		idx = 1
-		count = int(((*[maxAllocSize]pgid)(unsafe.Pointer(&p.ptr)))[0])
+		count = int(*(*pgid)(data))
 	}
 
 	// Copy the list of page ids from the freelist.
 	if count == 0 {
-		f.ids = nil
+		f.readIDs(nil)
 	} else {
-		ids := ((*[maxAllocSize]pgid)(unsafe.Pointer(&p.ptr)))[idx:count]
-		f.ids = make([]pgid, len(ids))
-		copy(f.ids, ids)
+		var ids []pgid
+		unsafeSlice(unsafe.Pointer(&ids), data, idx+count)
+		idsCopy := make([]pgid, count)
+		copy(idsCopy, ids[idx:])
 
 		// Make sure they're sorted.
-		sort.Sort(pgids(f.ids))
+		sort.Sort(pgids(idsCopy))
+
+		f.readIDs(idsCopy)
 	}
+}
 
-	// Rebuild the page cache.
+// arrayReadIDs initializes the freelist from a given list of ids(array version).
+func (f *freelist) arrayReadIDs(ids []pgid) {
+	f.ids = ids
+	f.spans = nil
 	f.reindex()
 }
 
+// arrayGetFreePageIDs returns the sorted free page ids(array version).
+func (f *freelist) arrayGetFreePageIDs() []pgid {
+	return f.ids
+}
+
+// arrayMergeSpans merges the sorted ids into the free list(array version).
+func (f *freelist) arrayMergeSpans(ids pgids) {
+	if len(ids) == 0 {
+		return
+	}
+	sort.Sort(ids)
+	f.ids = pgids(f.ids).merge(ids)
+	if f.spans != nil {
+		f.spans.add(ids)
+	}
+}
+
 // write writes the page ids onto a freelist page. All free and pending ids are
 // saved to disk since in the event of a program crash, all pending ids will
 // become free.
@@ -203,13 +512,13 @@ func (f *freelist) write(p *page) error {
 	} else if lenids < 0xFFFF {
 		p.count = uint16(lenids)
 		var ids []pgid
-		data := unsafeAdd(unsafe.Pointer(p), unsafe.Sizeof(*p))
+		data := unsafeAdd(unsafe.Pointer(p), pageHeaderSize)
 		unsafeSlice(unsafe.Pointer(&ids), data, lenids)
 		f.copyall(ids)
 	} else {
 		p.count = 0xFFFF
 		var ids []pgid
-		data := unsafeAdd(unsafe.Pointer(p), unsafe.Sizeof(*p))
+		data := unsafeAdd(unsafe.Pointer(p), pageHeaderSize)
 		unsafeSlice(unsafe.Pointer(&ids), data, lenids+1)
 		ids[0] = pgid(lenids)
 		f.copyall(ids[1:])
@@ -221,7 +530,11 @@ func (f *freelist) write(p *page) error {
 // reload reads the freelist from a page and filters out pending items.
 func (f *freelist) reload(p *page) {
 	f.read(p)
+	f.noSyncReload(f.getFreePageIDs())
+}
 
+// noSyncReload reads the freelist from pgids and filters out pending items.
+func (f *freelist) noSyncReload(pgids []pgid) {
 	// Build a cache of only pending pages.
 	pcache := make(map[pgid]bool)
 	for _, pendingIDs := range f.pending {
@@ -233,22 +546,22 @@ func (f *freelist) reload(p *page) {
 	// Check each page in the freelist and build a new available freelist
 	// with any pages not in the pending lists.
 	var a []pgid
-	for _, id := range f.ids {
+	for _, id := range pgids {
 		if !pcache[id] {
 			a = append(a, id)
 		}
 	}
-	f.ids = a
 
 	// Once the available list is rebuilt then rebuild the free cache so that
 	// it includes the available and pending free pages.
-	f.reindex()
+	f.readIDs(a)
 }
 
 // reindex rebuilds the free cache based on available and pending free lists.
 func (f *freelist) reindex() {
-	f.cache = make(map[pgid]bool, len(f.ids))
-	for _, id := range f.ids {
+	ids := f.getFreePageIDs()
+	f.cache = make(map[pgid]bool, len(ids))
+	for _, id := range ids {
 		f.cache[id] = true
 	}
 	for _, pendingIDs := range f.pending {
@@ -0,0 +1,426 @@
+package tinydb
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+// Ensure that a page is added to a transaction's freelist.
+func TestFreelist_free(t *testing.T) {
+	f := newFreelist(FreelistArrayType)
+	f.free(100, &page{id: 12})
+	if !reflect.DeepEqual([]pgid{12}, f.pending[100]) {
+		t.Fatalf("exp=%v; got=%v", []pgid{12}, f.pending[100])
+	}
+}
+
+// Ensure that a page and its overflow is added to a transaction's freelist.
+func TestFreelist_free_overflow(t *testing.T) {
+	f := newFreelist(FreelistArrayType)
+	f.free(100, &page{id: 12, overflow: 3})
+	if exp := []pgid{12, 13, 14, 15}; !reflect.DeepEqual(exp, f.pending[100]) {
+		t.Fatalf("exp=%v; got=%v", exp, f.pending[100])
+	}
+}
+
+// Ensure that a transaction's free pages can be released.
+func TestFreelist_release(t *testing.T) {
+	f := newFreelist(FreelistArrayType)
+	f.free(100, &page{id: 12, overflow: 1})
+	f.free(100, &page{id: 9})
+	f.free(102, &page{id: 39})
+	f.release(100)
+	f.release(101)
+	if exp := []pgid{9, 12, 13}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+
+	f.release(102)
+	if exp := []pgid{9, 12, 13, 39}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that the runs of free pages around released pages are found,
+// leaving out pending pages and short runs.
+func TestFreelist_runs(t *testing.T) {
+	for _, typ := range []FreelistType{FreelistArrayType, FreelistMapType} {
+		f := newFreelist(typ)
+		f.free(100, &page{id: 3, overflow: 4})
+		f.free(100, &page{id: 20, overflow: 9})
+		f.free(101, &page{id: 8, overflow: 1})
+		f.free(102, &page{id: 10, overflow: 1})
+		f.free(102, &page{id: 40, overflow: 1})
+		f.release(101)
+		released := f.release(102)
+		exp := []freeRun{{start: 3, n: 9}}
+		if runs := f.runs(released, 3); !reflect.DeepEqual(exp, runs) {
+			t.Fatalf("%s: exp=%v; got=%v", typ, exp, runs)
+		}
+
+		// Runs are split at segment boundaries.
+		f.segmentPages = 8
+		exp = []freeRun{{start: 8, n: 4}}
+		if runs := f.runs(released, 3); !reflect.DeepEqual(exp, runs) {
+			t.Fatalf("%s: segmented: exp=%v; got=%v", typ, exp, runs)
+		}
+	}
+}
+
+// Ensure that the largest run of free pages doesn't cross segments.
+func TestFreelist_largestRun(t *testing.T) {
+	for _, typ := range []FreelistType{FreelistArrayType, FreelistMapType} {
+		f := newFreelist(typ)
+		f.segmentPages = 8
+		f.readIDs([]pgid{3, 4, 5, 6, 7, 8, 9, 10, 11, 20})
+		if n := f.largestRun(); n != 5 {
+			t.Fatalf("%s: exp=5; got=%v", typ, n)
+		}
+
+		// The hashmap freelist may allocate from either run.
+		exp := 4
+		if id := f.allocate(2); id == 8 {
+			exp = 5
+		} else if id != 3 {
+			t.Fatalf("%s: unexpected allocation: %v", typ, id)
+		}
+		if n := f.largestRun(); n != exp {
+			t.Fatalf("%s: exp=%d; got=%v", typ, exp, n)
+		}
+	}
+}
+
+// Ensure that a freelist can find contiguous blocks of pages.
+func TestFreelist_allocate(t *testing.T) {
+	f := newFreelist(FreelistArrayType)
+	f.ids = []pgid{3, 4, 5, 6, 7, 9, 12, 13, 18}
+	f.reindex()
+	if id := int(f.allocate(3)); id != 3 {
+		t.Fatalf("exp=3; got=%v", id)
+	}
+	if id := int(f.allocate(1)); id != 6 {
+		t.Fatalf("exp=6; got=%v", id)
+	}
+	if id := int(f.allocate(3)); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
+	}
+	if id := int(f.allocate(2)); id != 12 {
+		t.Fatalf("exp=12; got=%v", id)
+	}
+	if exp := []pgid{7, 9, 18}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+	if f.freed(12) || !f.freed(18) {
+		t.Fatal("unexpected free cache")
+	}
+}
+
+// Ensure that allocating through the span index matches a scan for the
+// lowest run of free pages, as pages are allocated and released.
+func TestFreelist_allocate_spans(t *testing.T) {
+	f := newFreelist(FreelistArrayType)
+	f.segmentPages = 64
+	var ids []pgid
+	for id := pgid(2); id < 2000; id++ {
+		if rand.Intn(3) != 0 {
+			ids = append(ids, id)
+		}
+	}
+	f.readIDs(ids)
+
+	var allocated []*page
+	for i := 0; i < 5000; i++ {
+		n := 1 + rand.Intn(8)
+		exp := lowestRun(f.ids, n, f.contiguous)
+		if id := f.allocate(n); id != exp {
+			t.Fatalf("allocate(%d): exp=%v; got=%v", n, exp, id)
+		} else if id != 0 {
+			allocated = append(allocated, &page{id: id, overflow: uint32(n - 1)})
+		}
+
+		// Apart from emptied runs, the index holds the runs of the ids.
+		var runs []freeRun
+		for _, r := range f.spans.runs {
+			if r.n > 0 {
+				runs = append(runs, r)
+			}
+		}
+		if exp := newSpanIndex(f.ids, f.contiguous).runs; !reflect.DeepEqual(exp, runs) {
+			t.Fatalf("unexpected runs after %d steps: exp=%v; got=%v", i, exp, runs)
+		}
+
+		// Give back a few earlier allocations at a time.
+		if rand.Intn(2) == 0 {
+			for j := rand.Intn(4); j > 0 && len(allocated) > 0; j-- {
+				k := rand.Intn(len(allocated))
+				f.free(txid(i), allocated[k])
+				allocated = append(allocated[:k], allocated[k+1:]...)
+			}
+			f.release(txid(i))
+		}
+	}
+}
+
+// Ensure that a page added next to an emptied run still joins the run
+// behind it.
+func TestFreelist_allocate_spans_emptied(t *testing.T) {
+	contiguous := func(prev, id pgid) bool { return id == prev+1 }
+	for _, tt := range []struct {
+		runs []freeRun
+		id   pgid
+		exp  []freeRun
+	}{
+		{[]freeRun{{16, 2}, {18, 0}, {75, 1}}, 18, []freeRun{{16, 3}, {75, 1}}},
+		{[]freeRun{{10, 1}, {19, 0}, {19, 2}}, 18, []freeRun{{10, 1}, {18, 3}}},
+	} {
+		idx := &spanIndex{runs: append([]freeRun(nil), tt.runs...), contiguous: contiguous}
+		idx.build()
+		idx.add([]pgid{tt.id})
+
+		var runs []freeRun
+		for _, r := range idx.runs {
+			if r.n > 0 {
+				runs = append(runs, r)
+			}
+		}
+		if !reflect.DeepEqual(tt.exp, runs) {
+			t.Fatalf("add %d to %v: exp=%v; got=%v", tt.id, tt.runs, tt.exp, runs)
+		} else if idx.tree[1] != 3 {
+			t.Fatalf("add %d to %v: unexpected longest run: %d", tt.id, tt.runs, idx.tree[1])
+		}
+	}
+}
+
+// lowestRun returns the start of the lowest run of n contiguous ids, or 0.
+func lowestRun(ids []pgid, n int, contiguous func(prev, id pgid) bool) pgid {
+	for i := range ids {
+		if i == 0 || !contiguous(ids[i-1], ids[i]) {
+			j := i + 1
+			for j < len(ids) && j-i < n && contiguous(ids[j-1], ids[j]) {
+				j++
+			}
+			if j-i == n {
+				return ids[i]
+			}
+		}
+	}
+	return 0
+}
+
+// Ensure that a freelist can deserialize from a freelist page.
+func TestFreelist_read(t *testing.T) {
+	// Create a page.
+	var buf [4096]byte
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	p.flags = freelistPageFlag
+	p.count = 2
+
+	// Insert 2 page ids.
+	ids := (*[2]pgid)(unsafeAdd(unsafe.Pointer(p), pageHeaderSize))
+	ids[0] = 23
+	ids[1] = 50
+
+	// Deserialize page into a freelist.
+	f := newFreelist(FreelistArrayType)
+	f.read(p)
+
+	// Ensure that there are two page ids in the freelist.
+	if exp := []pgid{23, 50}; !reflect.DeepEqual(exp, f.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f.ids)
+	}
+}
+
+// Ensure that a freelist can serialize into a freelist page.
+func TestFreelist_write(t *testing.T) {
+	// Create a freelist and write it to a page.
+	var buf [4096]byte
+	f := newFreelist(FreelistArrayType)
+	f.readIDs([]pgid{12, 39})
+	f.pending[100] = []pgid{28, 11}
+	f.pending[101] = []pgid{3}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if err := f.write(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the page back out.
+	f2 := newFreelist(FreelistArrayType)
+	f2.read(p)
+
+	// Ensure that the freelist is correct.
+	// All free and pending pages should be present in sorted order.
+	if exp := []pgid{3, 11, 12, 28, 39}; !reflect.DeepEqual(exp, f2.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f2.ids)
+	}
+}
+
+// Ensure that freelists around the 0xFFFF page.count boundary round trip,
+// storing the count in the first element once page.count overflows.
+func TestFreelist_write_CountBoundary(t *testing.T) {
+	for _, n := range []int{0xFFFE, 0xFFFF, 0x10000, 0x20000} {
+		f := newFreelist(FreelistArrayType)
+		for i := 0; i < n; i++ {
+			f.ids = append(f.ids, pgid(i+2))
+		}
+
+		// The serialized size must reserve an extra element for the count.
+		expSize := pageHeaderSize + uintptr(n)*unsafe.Sizeof(pgid(0))
+		if n >= 0xFFFF {
+			expSize += unsafe.Sizeof(pgid(0))
+		}
+		if sz := f.size(); sz != expSize {
+			t.Fatalf("n=%d: exp size=%d; got=%d", n, expSize, sz)
+		}
+
+		buf := make([]byte, f.size())
+		p := (*page)(unsafe.Pointer(&buf[0]))
+		if err := f.write(p); err != nil {
+			t.Fatal(err)
+		}
+		if n < 0xFFFF && int(p.count) != n {
+			t.Fatalf("n=%d: exp count=%d; got=%d", n, n, p.count)
+		} else if n >= 0xFFFF && p.count != 0xFFFF {
+			t.Fatalf("n=%d: exp overflow count; got=%d", n, p.count)
+		}
+
+		f2 := newFreelist(FreelistArrayType)
+		f2.read(p)
+		if len(f2.ids) != n {
+			t.Fatalf("n=%d: exp %d ids; got %d", n, n, len(f2.ids))
+		} else if f2.ids[0] != 2 || f2.ids[n-1] != pgid(n+1) {
+			t.Fatalf("n=%d: unexpected ids [%d ... %d]", n, f2.ids[0], f2.ids[n-1])
+		}
+	}
+}
+
+// Ensure that the hashmap freelist allocates contiguous spans and merges
+// released pages with their neighbours.
+func TestFreelist_hashmapAllocate(t *testing.T) {
+	f := newFreelist(FreelistMapType)
+	f.readIDs([]pgid{3, 4, 5, 6, 7, 9, 12, 13, 18})
+	if id := int(f.allocate(3)); id != 3 {
+		t.Fatalf("exp=3; got=%v", id)
+	}
+	if n := f.free_count(); n != 6 {
+		t.Fatalf("exp=6; got=%v", n)
+	}
+	if id := int(f.allocate(3)); id != 0 {
+		t.Fatalf("exp=0; got=%v", id)
+	}
+
+	// Both remaining two page spans match exactly, in no particular order.
+	a, b := f.allocate(2), f.allocate(2)
+	if a > b {
+		a, b = b, a
+	}
+	if a != 6 || b != 12 {
+		t.Fatalf("exp=[6 12]; got=[%v %v]", a, b)
+	}
+	if f.freed(12) || !f.freed(18) {
+		t.Fatal("unexpected free cache")
+	}
+
+	// Releasing page 10 and 11 joins them with 9 into one span.
+	f.free(100, &page{id: 10, overflow: 1})
+	f.release(100)
+	if id := int(f.allocate(3)); id != 9 {
+		t.Fatalf("exp=9; got=%v", id)
+	}
+}
+
+// Ensure that the hashmap freelist serializes to the same sorted page as
+// the array freelist.
+func TestFreelist_hashmapWrite(t *testing.T) {
+	var buf [4096]byte
+	f := newFreelist(FreelistMapType)
+	f.readIDs([]pgid{12, 39})
+	f.pending[100] = []pgid{28, 11}
+	f.pending[101] = []pgid{3}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if err := f.write(p); err != nil {
+		t.Fatal(err)
+	}
+
+	f2 := newFreelist(FreelistArrayType)
+	f2.read(p)
+	if exp := []pgid{3, 11, 12, 28, 39}; !reflect.DeepEqual(exp, f2.ids) {
+		t.Fatalf("exp=%v; got=%v", exp, f2.ids)
+	}
+}
+
+// BenchmarkFreelist_allocate measures allocating and freeing back spans of
+// one and sixteen pages on a fragmented freelist. Only the run at the end of
+// the freelist is long enough for sixteen pages.
+func BenchmarkFreelist_allocate(b *testing.B) {
+	for _, typ := range []FreelistType{FreelistArrayType, FreelistMapType} {
+		for _, n := range []int{1, 16} {
+			b.Run(fmt.Sprintf("%s/%d", typ, n), func(b *testing.B) {
+				f := newFreelist(typ)
+				f.readIDs(fragmentedIDs(100000))
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					id := f.allocate(n)
+					if id == 0 {
+						b.Fatal("allocation failed")
+					}
+					f.free(txid(i), &page{id: id, overflow: uint32(n - 1)})
+					f.release(txid(i))
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkFreelist_write measures serializing a fragmented freelist.
+func BenchmarkFreelist_write(b *testing.B) {
+	for _, typ := range []FreelistType{FreelistArrayType, FreelistMapType} {
+		b.Run(string(typ), func(b *testing.B) {
+			f := newFreelist(typ)
+			f.readIDs(fragmentedIDs(100000))
+			buf := make([]byte, f.size())
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := f.write((*page)(unsafe.Pointer(&buf[0]))); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkFreelist_read measures loading a fragmented freelist.
+func BenchmarkFreelist_read(b *testing.B) {
+	f := newFreelist(FreelistArrayType)
+	f.readIDs(fragmentedIDs(100000))
+	buf := make([]byte, f.size())
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if err := f.write(p); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, typ := range []FreelistType{FreelistArrayType, FreelistMapType} {
+		b.Run(string(typ), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				newFreelist(typ).read(p)
+			}
+		})
+	}
+}
+
+// fragmentedIDs returns n free pages with a gap after each, followed by a
+// run of 64 pages.
+func fragmentedIDs(n int) []pgid {
+	ids := make([]pgid, 0, n+64)
+	for i := 0; i < n; i++ {
+		ids = append(ids, pgid(2+2*i))
+	}
+	for i := 0; i < 64; i++ {
+		ids = append(ids, pgid(2+2*n+i))
+	}
+	return ids
+}
@@ -0,0 +1,104 @@
+// Package failpoint holds failures injected into open databases. The points
+// are set by the public drill package and consumed by tinydb at the few
+// places where a failure can be simulated.
+package failpoint
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	mu     sync.Mutex
+	active int32 // number of registered databases, read without mu
+	points = make(map[interface{}]*Points)
+)
+
+// Points represents the failures armed for a single database.
+type Points struct {
+	mu         sync.Mutex
+	syncErr    error
+	allocErr   error
+	remapDelay time.Duration
+}
+
+// Register returns the points for key, creating them if needed.
+func Register(key interface{}) *Points {
+	mu.Lock()
+	defer mu.Unlock()
+	if p, ok := points[key]; ok {
+		return p
+	}
+	p := &Points{}
+	points[key] = p
+	atomic.AddInt32(&active, 1)
+	return p
+}
+
+// Unregister removes the points for key.
+func Unregister(key interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := points[key]; ok {
+		delete(points, key)
+		atomic.AddInt32(&active, -1)
+	}
+}
+
+// Lookup returns the points for key or nil if none are registered.
+// It is cheap when no database has any points registered.
+func Lookup(key interface{}) *Points {
+	if atomic.LoadInt32(&active) == 0 {
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return points[key]
+}
+
+// FailSync arms err to be returned by the next fsync.
+func (p *Points) FailSync(err error) {
+	p.mu.Lock()
+	p.syncErr = err
+	p.mu.Unlock()
+}
+
+// Sync returns and disarms the pending fsync failure, if any.
+func (p *Points) Sync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.syncErr
+	p.syncErr = nil
+	return err
+}
+
+// FailAllocate arms err to be returned by the next page allocation.
+func (p *Points) FailAllocate(err error) {
+	p.mu.Lock()
+	p.allocErr = err
+	p.mu.Unlock()
+}
+
+// Allocate returns and disarms the pending allocation failure, if any.
+func (p *Points) Allocate() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.allocErr
+	p.allocErr = nil
+	return err
+}
+
+// SetRemapDelay sets how long every remap sleeps before unmapping.
+func (p *Points) SetRemapDelay(d time.Duration) {
+	p.mu.Lock()
+	p.remapDelay = d
+	p.mu.Unlock()
+}
+
+// RemapDelay returns the current remap delay.
+func (p *Points) RemapDelay() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remapDelay
+}
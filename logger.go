@@ -0,0 +1,75 @@
+package tinydb
+
+import (
+	"time"
+)
+
+// Logger receives diagnostic messages from a Db. The methods may be called
+// from any goroutine, including with database locks held, so they must not
+// block or call back into the database.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warningf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// discardLogger is the default Logger. It drops every message.
+type discardLogger struct{}
+
+func (discardLogger) Debugf(format string, v ...interface{})   {}
+func (discardLogger) Infof(format string, v ...interface{})    {}
+func (discardLogger) Warningf(format string, v ...interface{}) {}
+func (discardLogger) Errorf(format string, v ...interface{})   {}
+
+// Hooks are called synchronously when notable events happen inside a Db.
+// Like Logger, they may run with database locks held and must not use the
+// database. A nil hook is skipped.
+type Hooks struct {
+	// SlowCommit is called after a write transaction commits when the
+	// commit took at least Options.SlowCommitThreshold.
+	SlowCommit func(txid int, elapsed time.Duration)
+
+	// Remap is called after the data file is remapped to a new size, such
+	// as when a commit grows the database past the current mapping.
+	Remap func(oldSize, newSize int)
+
+	// ValidationFailure is called when a meta page or a page checksum fails
+	// validation. A single invalid meta page is recovered from by using the
+	// other one, so this can fire on databases that still open cleanly.
+	ValidationFailure func(err error)
+}
+
+// Logger returns the logger the database reports to.
+func (db *Db) Logger() Logger {
+	return db.logger
+}
+
+// slowCommit reports a commit that took at least the slow commit threshold.
+func (db *Db) slowCommit(txid int, elapsed time.Duration) {
+	db.logger.Warningf("tinydb: slow commit txid=%d elapsed=%s", txid, elapsed)
+	if db.hooks.SlowCommit != nil {
+		db.hooks.SlowCommit(txid, elapsed)
+	}
+}
+
+// remapped reports that the mmap changed size.
+func (db *Db) remapped(oldSize, newSize int) {
+	db.logger.Infof("tinydb: remapped %s from %d to %d bytes", db.path, oldSize, newSize)
+	if db.hooks.Remap != nil {
+		db.hooks.Remap(oldSize, newSize)
+	}
+}
+
+// punchFailed reports that punching holes over free pages failed.
+func (db *Db) punchFailed(err error) {
+	db.logger.Warningf("tinydb: punching holes in %s failed, disabling: %v", db.path, err)
+}
+
+// validationFailed reports a meta page or page checksum that failed validation.
+func (db *Db) validationFailed(err error) {
+	db.logger.Errorf("tinydb: validation failed for %s: %v", db.path, err)
+	if db.hooks.ValidationFailure != nil {
+		db.hooks.ValidationFailure(err)
+	}
+}
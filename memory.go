@@ -0,0 +1,163 @@
+package tinydb
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// MemoryPath is the path that opens a database held in memory instead of a
+// file. Every Open of MemoryPath creates a new, empty database that is
+// discarded on Close. It isn't locked, so it can be opened any number of
+// times, and it is never synced.
+const MemoryPath = ":memory:"
+
+// dbFile is the storage behind a Db: the database file, or a memFile for
+// databases opened at MemoryPath.
+type dbFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Fd() uintptr
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// memFile is a file held in a byte slice. Its length is the file size and
+// its capacity is the size mapped by mmap, so writes are seen through the
+// mapping just like writes to a file mapped with MAP_SHARED. The Db never
+// writes past its mapping, so the slice is only reallocated by mmap, while
+// no transaction holds a reference into it.
+type memFile struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+// inMemory returns true if the database was opened at MemoryPath.
+func (db *Db) inMemory() bool {
+	_, ok := db.file.(*memFile)
+	return ok
+}
+
+// ReadAt reads len(b) bytes at off, returning io.EOF if the file ends first.
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off < 0 {
+		return 0, errors.New("memfile: negative offset")
+	} else if off >= int64(len(f.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.buf[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes b at off, extending the file if needed.
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off < 0 {
+		return 0, errors.New("memfile: negative offset")
+	}
+	if end := int(off) + len(b); end > len(f.buf) {
+		f.resize(end)
+	}
+	return copy(f.buf[off:], b), nil
+}
+
+// Truncate changes the size of the file.
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size < 0 {
+		return errors.New("memfile: negative size")
+	}
+	f.resize(int(size))
+	return nil
+}
+
+// resize sets the file size to n, zeroing any bytes it gains.
+func (f *memFile) resize(n int) {
+	if n > cap(f.buf) {
+		buf := make([]byte, n)
+		copy(buf, f.buf)
+		f.buf = buf
+		return
+	}
+	old := len(f.buf)
+	f.buf = f.buf[:n]
+	for i := old; i < n; i++ {
+		f.buf[i] = 0
+	}
+}
+
+// mmap returns the first sz bytes of the file's memory, growing its capacity
+// to sz first. Bytes past the end of the file read as zero.
+func (f *memFile) mmap(sz int) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if sz > cap(f.buf) {
+		buf := make([]byte, len(f.buf), sz)
+		copy(buf, f.buf)
+		f.buf = buf
+	}
+	return f.buf[:sz]
+}
+
+// Fd returns ^uintptr(0), as for a closed *os.File, since memFile has no
+// file descriptor.
+func (f *memFile) Fd() uintptr { return ^uintptr(0) }
+
+// Name returns MemoryPath.
+func (f *memFile) Name() string { return MemoryPath }
+
+// Stat returns the size of the file.
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return memFileInfo(len(f.buf)), nil
+}
+
+// Sync does nothing since there is nothing to flush the memory to.
+func (f *memFile) Sync() error { return nil }
+
+// Close releases the memory of the file.
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buf = nil
+	return nil
+}
+
+// memFileInfo describes a memFile of the given size.
+type memFileInfo int
+
+func (fi memFileInfo) Name() string       { return MemoryPath }
+func (fi memFileInfo) Size() int64        { return int64(fi) }
+func (fi memFileInfo) Mode() os.FileMode  { return fileMode }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// mmapMemory points the data at the memory of the in-memory file.
+func mmapMemory(db *Db, sz int) {
+	b := db.file.(*memFile).mmap(sz)
+	db.dataref = b
+	db.data = (*[maxMapSize]byte)(unsafe.Pointer(&b[0]))
+	db.datasz = sz
+}
+
+// munmapMemory drops the references to the memory of the in-memory file.
+func munmapMemory(db *Db) {
+	db.dataref = nil
+	db.data = nil
+	db.datasz = 0
+}
@@ -47,23 +47,27 @@ type inode struct {
 
 type inodes []inode
 
+// put inserts a key/value pair into the node, replacing the inode at oldKey.
+// Inodes are always kept in ascending bytes.Compare order of their keys, so a
+// key that is a prefix of another key sorts before it. Zero-length keys are
+// not allowed because they can not be distinguished from a missing key.
 func (n *node) put(oldKey, key, value []byte, pgid pgid, flags uint32) {
-	// find first larger index, precondition: increasing order
+	if len(oldKey) <= 0 {
+		panic("put: zero-length old key")
+	} else if len(key) <= 0 {
+		panic("put: zero-length new key")
+	}
+
+	// Find insertion index: the first inode whose key is >= oldKey.
 	idx := sort.Search(len(n.inodes), func(i int) bool {
-		// n.inodes[i].key >= oldKey
-		return bytes.Compare(n.inodes[i].key, oldKey) >= 0
+		return bytes.Compare(n.inodes[i].key, oldKey) != -1
 	})
 
-	if idx < len(n.inodes) && bytes.Equal(n.inodes[idx].key, key) {
-		// key is present
-	} else {
-		// key is not present in increasing order data ([2,3,4])
-		// and if key > maxKey, idx=len(nodes)+1
-		// and if key < minKey, idx=0
+	// Add capacity and shift nodes if we don't have an exact match and need to insert.
+	exact := idx < len(n.inodes) && bytes.Equal(n.inodes[idx].key, oldKey)
+	if !exact {
 		n.inodes = append(n.inodes, inode{})
-		if idx == 0 {
-			copy(n.inodes[idx+1:], n.inodes[idx:])
-		}
+		copy(n.inodes[idx+1:], n.inodes[idx:])
 	}
 
 	inode := &n.inodes[idx]
@@ -73,7 +77,10 @@ func (n *node) put(oldKey, key, value []byte, pgid pgid, flags uint32) {
 	inode.flags = flags
 }
 
+// read initializes the node from a page.
 func (n *node) read(p *page) {
+	p.mustBeBTree()
+	n.pgid = p.id
 	n.isLeaf = (p.flags & leafPageFlag) != 0
 	n.inodes = make(inodes, p.count)
 
@@ -90,8 +97,16 @@ func (n *node) read(p *page) {
 			inode.key = elem.key()
 		}
 	}
+
+	// Save first key so we can find the node in the parent when we spill.
+	if len(n.inodes) > 0 {
+		n.key = n.inodes[0].key
+	} else {
+		n.key = nil
+	}
 }
 
+// write writes the items onto one or more pages.
 func (n *node) write(p *page) {
 	if n.isLeaf {
 		p.flags |= leafPageFlag
@@ -244,16 +259,19 @@ const (
 func (n *node) splitTwo(pageSize uintptr) (*node, *node) {
 	// Ignore the split if the page doesn't have at least enough nodes for
 	// two pages or if the nodes can fit in a single page.
-	if len(n.inodes) <= (minKeysPerPage*2) || n.sizeLessThan(pageSize) {
+	if len(n.inodes) <= (n.bucket.minKeysPerPage()*2) || n.sizeLessThan(pageSize) {
 		return n, nil
 	}
 
 	// Determine the threshold before starting a new node.
+	var db = n.bucket.tx.db
 	var fillPercent = n.bucket.FillPercent
-	if fillPercent < minFillPercent {
-		fillPercent = minFillPercent
-	} else if fillPercent > maxFillPercent {
-		fillPercent = maxFillPercent
+	if n.bucket.packed {
+		fillPercent = db.maxFillPercent
+	} else if fillPercent < db.minFillPercent {
+		fillPercent = db.minFillPercent
+	} else if fillPercent > db.maxFillPercent {
+		fillPercent = db.maxFillPercent
 	}
 	threshold := int(float64(pageSize) * fillPercent)
 
@@ -300,16 +318,17 @@ func (n *node) sizeLessThan(v uintptr) bool {
 // This is only be called from split().
 func (n *node) splitIndex(threshold int) (index, sz uintptr) {
 	sz = pageHeaderSize
+	minKeys := n.bucket.minKeysPerPage()
 
 	// Loop until we only have the minimum number of keys required for the second page.
-	for i := 0; i < len(n.inodes)-minKeysPerPage; i++ {
+	for i := 0; i < len(n.inodes)-minKeys; i++ {
 		index = uintptr(i)
 		inode := n.inodes[i]
 		elsize := n.pageElementSize() + uintptr(len(inode.key)) + uintptr(len(inode.value))
 
 		// If we have at least the minimum number of keys and adding another
 		// node would put us over the threshold then exit and return.
-		if index >= minKeysPerPage && sz+elsize > uintptr(threshold) {
+		if index >= uintptr(minKeys) && sz+elsize > uintptr(threshold) {
 			break
 		}
 
@@ -1,6 +1,8 @@
 package tinydb
 
 import (
+	"bytes"
+	"math/rand"
 	"testing"
 	"unsafe"
 )
@@ -35,20 +37,85 @@ func TestNode_Put(t *testing.T) {
 	}
 }
 
+// Ensure that keys are kept in byte-wise order regardless of insertion order,
+// including keys that are prefixes of other keys.
+func TestNode_Put_Order(t *testing.T) {
+	keys := []string{"\x00", "\x00\x00", "a", "a\x00", "aa", "ab", "b", "ba", "\xff", "\xff\xff"}
+	for _, seed := range []int64{0, 1, 2, 3} {
+		n := node{inodes: make(inodes, 0)}
+		for _, i := range rand.New(rand.NewSource(seed)).Perm(len(keys)) {
+			n.put([]byte(keys[i]), []byte(keys[i]), []byte(keys[i]), 0, 0)
+		}
+
+		if len(n.inodes) != len(keys) {
+			t.Fatalf("seed %d: expect %d inodes; got %d", seed, len(keys), len(n.inodes))
+		}
+		for i, k := range keys {
+			if got := string(n.inodes[i].key); got != k {
+				t.Fatalf("seed %d: expect %q at %d; got %q", seed, k, i, got)
+			}
+		}
+	}
+}
+
+// Ensure that putting with an old key renames the inode in place.
+func TestNode_Put_Rename(t *testing.T) {
+	n := node{inodes: make(inodes, 0)}
+	n.put([]byte("a"), []byte("a"), nil, 1, 0)
+	n.put([]byte("c"), []byte("c"), nil, 3, 0)
+	n.put([]byte("c"), []byte("b"), nil, 2, 0)
+
+	if len(n.inodes) != 2 {
+		t.Fatalf("expect inodes is 2; got %d", len(n.inodes))
+	} else if k := string(n.inodes[1].key); k != "b" || n.inodes[1].pgid != 2 {
+		t.Fatalf("expect b:2 at 1; got %s:%d", k, n.inodes[1].pgid)
+	}
+}
+
+// Ensure that a zero-length key is rejected.
+func TestNode_Put_ZeroLengthKey(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	n := node{inodes: make(inodes, 0)}
+	n.put([]byte{}, []byte{}, []byte("v"), 0, 0)
+}
+
+// Ensure that deleting keys keeps the remaining keys in order.
+func TestNode_Del_Order(t *testing.T) {
+	n := node{inodes: make(inodes, 0)}
+	for _, k := range []string{"c", "a", "ab", "b"} {
+		n.put([]byte(k), []byte(k), nil, 0, 0)
+	}
+	n.del([]byte("ab"))
+	n.del([]byte("missing"))
+
+	var got []string
+	for _, inode := range n.inodes {
+		got = append(got, string(inode.key))
+	}
+	if len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Fatalf("unexpected keys: %q", got)
+	} else if !n.unbalanced {
+		t.Fatal("expected node to be unbalanced")
+	}
+}
+
 func TestNode_ReadLeafPage(t *testing.T) {
 	var buf [4096]byte
 	page := (*page)(unsafe.Pointer(&buf[0]))
 	page.flags = leafPageFlag
 	page.count = 2
 
-	pageHeaderStart := uintptr(unsafe.Pointer(page))
-	pageElementsStart := pageHeaderStart + pageHeaderSize
+	pageElementsStart := unsafeAdd(unsafe.Pointer(page), pageHeaderSize)
 
 	// construct page elements:
 	// pageElements space layout:
 	// [pageElem1, pageElem2, kv1, vk2]
 	// so pos is sequential added val
-	pageElements := (*[2]leafPageElement)(unsafe.Pointer(pageElementsStart))
+	pageElements := (*[2]leafPageElement)(pageElementsStart)
 	pageElements[0] = leafPageElement{
 		flags: leafPageFlag,
 		pos:   uint32(leafPageElementSize * 2), // kv1 behind [pageElem1, pageElem2]
@@ -64,7 +131,7 @@ func TestNode_ReadLeafPage(t *testing.T) {
 
 	// write data to above page elements
 	s := "key1" + "val1" + "key2" + "val2"
-	data := unsafeByteSlice(unsafe.Pointer(pageElementsStart), leafPageElementSize*2, 0, len(s))
+	data := unsafeByteSlice(pageElementsStart, leafPageElementSize*2, 0, len(s))
 	copy(data, s)
 
 	// deserialize page
@@ -187,3 +254,75 @@ func TestNode_split_SinglePage(t *testing.T) {
 		t.Fatalf("expected nil parent")
 	}
 }
+
+// Ensure that splitting keeps keys ordered across the resulting nodes.
+func TestNode_split_Order(t *testing.T) {
+	n := &node{inodes: make(inodes, 0), bucket: &Bucket{tx: &Tx{db: &Db{}, meta: &meta{pgid: 1}}}}
+	for _, i := range rand.New(rand.NewSource(42)).Perm(100) {
+		k := []byte{byte('a' + i%26), byte(i)}
+		n.put(k, k, []byte("0123456701234567"), 0, 0)
+	}
+
+	nodes := n.split(256)
+	if len(nodes) < 2 {
+		t.Fatalf("expected split; got %d nodes", len(nodes))
+	}
+
+	var prev []byte
+	for _, node := range nodes {
+		for _, inode := range node.inodes {
+			if prev != nil && bytes.Compare(prev, inode.key) != -1 {
+				t.Fatalf("out of order: %x >= %x", prev, inode.key)
+			}
+			prev = inode.key
+		}
+	}
+}
+
+// Ensure that a bucket can lower the minimum keys per page so that a node of
+// a few large values still splits.
+func TestNode_split_MinKeysPerPageOverride(t *testing.T) {
+	newNode := func(minKeys int) *node {
+		b := &Bucket{tx: &Tx{db: &Db{}, meta: &meta{pgid: 1}}, MinKeysPerPage: minKeys}
+		n := &node{inodes: make(inodes, 0), bucket: b}
+		for _, k := range []string{"00000001", "00000002", "00000003", "00000004"} {
+			n.put([]byte(k), []byte(k), make([]byte, 64), 0, 0)
+		}
+		return n
+	}
+
+	// Four keys can't be split with the default of two keys per page.
+	if nodes := newNode(0).split(100); len(nodes) != 1 {
+		t.Fatalf("exp=1; got=%d", len(nodes))
+	}
+
+	// With one key per page the node splits until only two keys remain.
+	nodes := newNode(1).split(100)
+	if len(nodes) != 3 {
+		t.Fatalf("exp=3; got=%d", len(nodes))
+	}
+	for i, exp := range []int{1, 1, 2} {
+		if len(nodes[i].inodes) != exp {
+			t.Fatalf("node %d: exp=%d; got=%d", i, exp, len(nodes[i].inodes))
+		}
+	}
+}
+
+// Ensure that a node whose elements are each larger than a page still splits
+// into nodes that keep the minimum number of keys.
+func TestNode_split_Oversize(t *testing.T) {
+	n := &node{inodes: make(inodes, 0), bucket: &Bucket{tx: &Tx{db: &Db{}, meta: &meta{pgid: 1}}}}
+	for _, k := range []string{"00000001", "00000002", "00000003", "00000004", "00000005"} {
+		n.put([]byte(k), []byte(k), make([]byte, 10000), 0, 0)
+	}
+
+	nodes := n.split(4096)
+	if len(nodes) != 2 {
+		t.Fatalf("exp=2; got=%d", len(nodes))
+	}
+	for i, exp := range []int{2, 3} {
+		if len(nodes[i].inodes) != exp {
+			t.Fatalf("node %d: exp=%d; got=%d", i, exp, len(nodes[i].inodes))
+		}
+	}
+}
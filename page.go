@@ -14,10 +14,237 @@ const (
 	freelistPageFlag = 0x10
 )
 
+const (
+	bucketLeafFlag = 0x01
+)
+
+// pgidNoFreelist is stored as the meta freelist page when the freelist
+// isn't written to disk.
+const pgidNoFreelist pgid = 0xffffffffffffffff
+
 const pageHeaderSize = unsafe.Sizeof(page{})
 const branchPageElementSize = unsafe.Sizeof(branchPageElement{})
 const leafPageElementSize = unsafe.Sizeof(leafPageElement{})
 
+// Pages are mapped at page-aligned offsets and read in place, so every
+// struct laid out inside a page must keep its 8-byte fields 8-byte aligned.
+// These fail to compile if a layout change breaks that on any architecture.
+var (
+	_ = [1]struct{}{}[pageHeaderSize%8]
+	_ = [1]struct{}{}[branchPageElementSize%8]
+	_ = [1]struct{}{}[leafPageElementSize%8]
+	_ = [1]struct{}{}[unsafe.Sizeof(meta{})%8]
+	_ = [1]struct{}{}[unsafe.Offsetof(meta{}.root)%8]
+	_ = [1]struct{}{}[unsafe.Sizeof(bucket{})%8]
+)
+
+// Page layout sizes exported for tools that decode database files directly.
+// They always match the in-memory structs used by this package.
+const (
+	// PageHeaderSize is the size of the header at the start of every page.
+	PageHeaderSize = int(pageHeaderSize)
+
+	// BranchPageElementSize is the size of one element header on a branch page.
+	BranchPageElementSize = int(branchPageElementSize)
+
+	// LeafPageElementSize is the size of one element header on a leaf page.
+	LeafPageElementSize = int(leafPageElementSize)
+)
+
+// PageCount returns the number of pages occupied by a file of fileSize bytes
+// for the given page size. A trailing partial page is counted as a page.
+func PageCount(fileSize int64, pageSize int) int64 {
+	if pageSize <= 0 {
+		return 0
+	}
+	return (fileSize + int64(pageSize) - 1) / int64(pageSize)
+}
+
+// PageRegion is a labelled byte range of a raw page returned by PageLayout.
+type PageRegion struct {
+	Offset int    // offset from the start of the page
+	Size   int    // length in bytes, 0 for a region that is out of bounds
+	Name   string // field or area, such as "flags" or "leaf[3].key"
+	Value  string // decoded value, empty for raw keys and values
+}
+
+// PageLayout splits a raw page, as read from a database file together with
+// any overflow pages, into the regions laid out by the structs in this file:
+// the header fields, then the meta fields, element headers, or freelist ids
+// depending on the page type, and the keys and values the elements point
+// at. Bytes not covered by any region are returned as "unused". Regions are
+// sorted by offset.
+//
+// Counts and offsets read from the page are checked against buf, so torn or
+// corrupted pages are reported with "out of bounds" regions instead of
+// panicking.
+func PageLayout(buf []byte) []PageRegion {
+	l := &pageLayout{buf: buf}
+	var p page
+	if !l.load(unsafe.Pointer(&p), 0, pageHeaderSize, "header") {
+		return l.finish()
+	}
+	l.add(unsafe.Offsetof(p.id), unsafe.Sizeof(p.id), "id", fmt.Sprint(p.id))
+	l.add(unsafe.Offsetof(p.flags), unsafe.Sizeof(p.flags), "flags", fmt.Sprintf("0x%02x (%s)", p.flags, p.typ()))
+	l.add(unsafe.Offsetof(p.count), unsafe.Sizeof(p.count), "count", fmt.Sprint(p.count))
+	l.add(unsafe.Offsetof(p.overflow), unsafe.Sizeof(p.overflow), "overflow", fmt.Sprint(p.overflow))
+	l.add(unsafe.Offsetof(p.checksum), unsafe.Sizeof(p.checksum), "checksum", fmt.Sprintf("%016x", p.checksum))
+
+	switch p.flags {
+	case metaPageFlag:
+		l.meta()
+	case branchPageFlag:
+		l.branch(int(p.count))
+	case leafPageFlag:
+		l.leaf(int(p.count))
+	case freelistPageFlag:
+		l.freelist(int(p.count))
+	}
+	return l.finish()
+}
+
+// typ returns the name of the page type for debugging.
+func (p *page) typ() string {
+	switch p.flags {
+	case branchPageFlag:
+		return "branch"
+	case leafPageFlag:
+		return "leaf"
+	case metaPageFlag:
+		return "meta"
+	case freelistPageFlag:
+		return "freelist"
+	}
+	return "unknown"
+}
+
+// pageLayout collects the regions of a raw page for PageLayout. Structs are
+// copied out of buf rather than cast in place since buf may be unaligned.
+type pageLayout struct {
+	buf     []byte
+	regions []PageRegion
+}
+
+// add records a region, or an "out of bounds" region if it doesn't fit in
+// the page. It returns whether the region fits.
+func (l *pageLayout) add(off, size uintptr, name, value string) bool {
+	if off > uintptr(len(l.buf)) || size > uintptr(len(l.buf))-off {
+		if off > uintptr(len(l.buf)) {
+			off = uintptr(len(l.buf))
+		}
+		l.regions = append(l.regions, PageRegion{Offset: int(off), Name: name, Value: fmt.Sprintf("out of bounds: %d bytes", size)})
+		return false
+	}
+	l.regions = append(l.regions, PageRegion{Offset: int(off), Size: int(size), Name: name, Value: value})
+	return true
+}
+
+// load copies size bytes at off into dst, recording an "out of bounds"
+// region named name if they don't fit in the page.
+func (l *pageLayout) load(dst unsafe.Pointer, off, size uintptr, name string) bool {
+	if off > uintptr(len(l.buf)) || size > uintptr(len(l.buf))-off {
+		return l.add(off, size, name, "")
+	}
+	copy(unsafeByteSlice(dst, 0, 0, int(size)), l.buf[off:off+size])
+	return true
+}
+
+func (l *pageLayout) meta() {
+	var m meta
+	if !l.load(unsafe.Pointer(&m), pageHeaderSize, unsafe.Sizeof(m), "meta") {
+		return
+	}
+	l.add(pageHeaderSize+unsafe.Offsetof(m.version), unsafe.Sizeof(m.version), "meta.version", fmt.Sprint(m.version))
+	l.add(pageHeaderSize+unsafe.Offsetof(m.pageSize), unsafe.Sizeof(m.pageSize), "meta.pageSize", fmt.Sprint(m.pageSize))
+	l.add(pageHeaderSize+unsafe.Offsetof(m.root), unsafe.Sizeof(m.root.root), "meta.root.root", fmt.Sprint(m.root.root))
+	l.add(pageHeaderSize+unsafe.Offsetof(m.root)+unsafe.Offsetof(m.root.sequence), unsafe.Sizeof(m.root.sequence), "meta.root.sequence", fmt.Sprint(m.root.sequence))
+	l.add(pageHeaderSize+unsafe.Offsetof(m.freelist), unsafe.Sizeof(m.freelist), "meta.freelist", fmt.Sprint(m.freelist))
+	l.add(pageHeaderSize+unsafe.Offsetof(m.pgid), unsafe.Sizeof(m.pgid), "meta.pgid", fmt.Sprint(m.pgid))
+	l.add(pageHeaderSize+unsafe.Offsetof(m.txid), unsafe.Sizeof(m.txid), "meta.txid", fmt.Sprint(m.txid))
+	l.add(pageHeaderSize+unsafe.Offsetof(m.checksum), unsafe.Sizeof(m.checksum), "meta.checksum", fmt.Sprintf("%016x", m.checksum))
+}
+
+func (l *pageLayout) branch(count int) {
+	for i := 0; i < count; i++ {
+		var e branchPageElement
+		off := pageHeaderSize + uintptr(i)*branchPageElementSize
+		name := fmt.Sprintf("branch[%d]", i)
+		if !l.load(unsafe.Pointer(&e), off, branchPageElementSize, name) {
+			return
+		}
+		l.add(off, branchPageElementSize, name, fmt.Sprintf("pos=%d ksize=%d pgid=%d", e.pos, e.ksize, e.pgid))
+		l.add(off+uintptr(e.pos), uintptr(e.ksize), name+".key", "")
+	}
+}
+
+func (l *pageLayout) leaf(count int) {
+	for i := 0; i < count; i++ {
+		var e leafPageElement
+		off := pageHeaderSize + uintptr(i)*leafPageElementSize
+		name := fmt.Sprintf("leaf[%d]", i)
+		if !l.load(unsafe.Pointer(&e), off, leafPageElementSize, name) {
+			return
+		}
+		l.add(off, leafPageElementSize, name, fmt.Sprintf("flags=%d pos=%d ksize=%d vsize=%d", e.flags, e.pos, e.ksize, e.vsize))
+		l.add(off+uintptr(e.pos), uintptr(e.ksize), name+".key", "")
+
+		voff := off + uintptr(e.pos) + uintptr(e.ksize)
+		if (e.flags & bucketLeafFlag) == 0 {
+			l.add(voff, uintptr(e.vsize), name+".value", "")
+			continue
+		}
+		var b bucket
+		if uintptr(e.vsize) < unsafe.Sizeof(b) {
+			l.add(voff, uintptr(e.vsize), name+".value", "truncated bucket header")
+			continue
+		} else if !l.load(unsafe.Pointer(&b), voff, unsafe.Sizeof(b), name+".bucket") {
+			continue
+		}
+		l.add(voff, unsafe.Sizeof(b), name+".bucket", fmt.Sprintf("root=%d sequence=%d", b.root, b.sequence))
+		if b.root == 0 && uintptr(e.vsize) > unsafe.Sizeof(b) {
+			l.add(voff+unsafe.Sizeof(b), uintptr(e.vsize)-unsafe.Sizeof(b), name+".inline", "inline bucket page")
+		}
+	}
+}
+
+func (l *pageLayout) freelist(count int) {
+	const size = unsafe.Sizeof(pgid(0))
+	off := pageHeaderSize
+	if count == 0xFFFF {
+		var n pgid
+		if !l.load(unsafe.Pointer(&n), off, size, "freelist.count") {
+			return
+		}
+		l.add(off, size, "freelist.count", fmt.Sprint(n))
+		off += size
+		count = int(n)
+	}
+	if count > 0 {
+		l.add(off, uintptr(count)*size, "freelist.ids", fmt.Sprintf("%d ids", count))
+	}
+}
+
+// finish sorts the regions and fills the gaps between them.
+func (l *pageLayout) finish() []PageRegion {
+	sort.SliceStable(l.regions, func(i, j int) bool { return l.regions[i].Offset < l.regions[j].Offset })
+
+	var regions []PageRegion
+	var end int
+	for _, r := range l.regions {
+		if r.Offset > end {
+			regions = append(regions, PageRegion{Offset: end, Size: r.Offset - end, Name: "unused"})
+		}
+		regions = append(regions, r)
+		if r.Offset+r.Size > end {
+			end = r.Offset + r.Size
+		}
+	}
+	if end < len(l.buf) {
+		regions = append(regions, PageRegion{Offset: end, Size: len(l.buf) - end, Name: "unused"})
+	}
+	return regions
+}
+
 type pgid uint64
 
 type page struct {
@@ -25,7 +252,62 @@ type page struct {
 	flags    uint16 // different pages type
 	count    uint16 // pageElement counts
 	overflow uint32
-	ptr      uintptr
+	checksum uint64 // FNV-1a of the page with this field skipped, 0 if unset
+}
+
+// checkType returns an *UnknownPageTypeError unless the page flags are
+// exactly one of the given page types.
+func (p *page) checkType(types ...uint16) error {
+	for _, typ := range types {
+		if p.flags == typ {
+			return nil
+		}
+	}
+	return &UnknownPageTypeError{Pgid: uint64(p.id), Flags: p.flags}
+}
+
+// mustBeBTree panics with an *UnknownPageTypeError unless the page is a
+// branch or leaf page.
+func (p *page) mustBeBTree() {
+	if err := p.checkType(branchPageFlag, leafPageFlag); err != nil {
+		panic(err)
+	}
+}
+
+// sum64 returns the checksum of a page spanning size bytes, skipping the
+// checksum field itself.
+func (p *page) sum64(size int) uint64 {
+	off := unsafe.Offsetof(p.checksum)
+	var h = fnv.New64a()
+	_, _ = h.Write(unsafeByteSlice(unsafe.Pointer(p), 0, 0, int(off)))
+
+	// Hash the rest in chunks since a page run can exceed maxAllocSize.
+	for pos := off + unsafe.Sizeof(p.checksum); pos < uintptr(size); {
+		sz := uintptr(size) - pos
+		if sz > maxAllocSize-1 {
+			sz = maxAllocSize - 1
+		}
+		_, _ = h.Write(unsafeByteSlice(unsafe.Pointer(p), pos, 0, int(sz)))
+		pos += sz
+	}
+	return h.Sum64()
+}
+
+// inuse returns the bytes used by the header, elements, keys and values of
+// a branch or leaf page.
+func (p *page) inuse() uintptr {
+	n := pageHeaderSize
+	if (p.flags & branchPageFlag) != 0 {
+		for i := uint16(0); i < p.count; i++ {
+			n += branchPageElementSize + uintptr(p.branchPageElement(i).ksize)
+		}
+		return n
+	}
+	for i := uint16(0); i < p.count; i++ {
+		elem := p.leafPageElement(i)
+		n += leafPageElementSize + uintptr(elem.ksize) + uintptr(elem.vsize)
+	}
+	return n
 }
 
 func (p *page) meta() *meta {
@@ -51,41 +333,49 @@ type branchPageElement struct {
 }
 
 func (n *branchPageElement) key() []byte {
-	return unsafeByteSlice(unsafe.Pointer(n), 0, int(n.pos), int(n.pos)+int(n.ksize))
+	return unsafeByteSlice(unsafe.Pointer(n), uintptr(n.pos), 0, int(n.ksize))
 }
 
 // leafPageElement represents a node on a leaf page
 // reference see: https://cdn.jsdelivr.net/gh/lichuang/lichuang.github.io/media/imgs/20200625-boltdb-1/leaf-page-layout.png
 type leafPageElement struct {
-	flags uint32 // leaf-page or sub-bucket
+	flags uint32 // 0 for a key/value pair, bucketLeafFlag for a sub-bucket
 	pos   uint32 // offset from pageElement to key
 	ksize uint32
 	vsize uint32
 }
 
 func (n *leafPageElement) key() []byte {
-	return unsafeByteSlice(unsafe.Pointer(n), 0, int(n.pos), int(n.pos)+int(n.ksize))
+	return unsafeByteSlice(unsafe.Pointer(n), uintptr(n.pos), 0, int(n.ksize))
 }
 
 func (n *leafPageElement) value() []byte {
-	i := int(n.ksize + n.pos)
-	j := i + int(n.vsize)
-	return unsafeByteSlice(unsafe.Pointer(n), 0, i, j)
+	// Slice from the start of the value rather than the element so values
+	// far into a large overflow run stay within maxAllocSize.
+	return unsafeByteSlice(unsafe.Pointer(n), uintptr(n.pos)+uintptr(n.ksize), 0, int(n.vsize))
 }
 
+type pages []*page
+
+func (s pages) Len() int           { return len(s) }
+func (s pages) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s pages) Less(i, j int) bool { return s[i].id < s[j].id }
+
 type meta struct {
 	version  uint32
 	pageSize uint32
-	pgid     pgid
-	txid     txid
+	root     bucket // root bucket header, its root page holds the top-level keys
+	freelist pgid   // page id of the freelist page
+	pgid     pgid   // high water mark, the first page id past the end of the data
+	txid     txid   // id of the transaction that wrote this meta
 	checksum uint64
 }
 
 func (m *meta) sum64() uint64 {
 	h := fnv.New64a()
 	// data struct memory alignment
-	// unsafe.Offsetof(meta{}.checksum) = version + pageSize + pgid = uint32+uint32+uint64 = 16byte
-	// (*[16]byte)(unsafe.Pointer(m)) -> force to take needed fields before checksum
+	// unsafe.Offsetof(meta{}.checksum) = all fields before checksum
+	// (*[N]byte)(unsafe.Pointer(m)) -> force to take needed fields before checksum
 	dataBeforeChecksum := (*[unsafe.Offsetof(meta{}.checksum)]byte)(unsafe.Pointer(m))
 	_, _ = h.Write(dataBeforeChecksum[:])
 	return h.Sum64()
@@ -100,6 +390,29 @@ func (m *meta) validate() error {
 	return nil
 }
 
+// copy copies one meta object to another.
+func (m *meta) copy(dest *meta) {
+	*dest = *m
+}
+
+// write writes the meta onto a page.
+func (m *meta) write(p *page) {
+	if m.root.root >= m.pgid {
+		panic(fmt.Sprintf("root bucket pgid (%d) above high water mark (%d)", m.root.root, m.pgid))
+	} else if m.freelist >= m.pgid && m.freelist != pgidNoFreelist {
+		panic(fmt.Sprintf("freelist pgid (%d) above high water mark (%d)", m.freelist, m.pgid))
+	}
+
+	// Page id is either going to be 0 or 1 which we can determine by the transaction ID.
+	p.id = pgid(m.txid % 2)
+	p.flags |= metaPageFlag
+
+	// Calculate the checksum.
+	m.checksum = m.sum64()
+
+	m.copy(p.meta())
+}
+
 type pgids []pgid
 
 func (s pgids) Len() int           { return len(s) }
@@ -1 +1,96 @@
 package tinydb
+
+import (
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+// Ensure that the exported layout sizes match the page structs.
+func TestPage_ExportedSizes(t *testing.T) {
+	if PageHeaderSize != int(unsafe.Sizeof(page{})) {
+		t.Fatalf("unexpected PageHeaderSize: %d", PageHeaderSize)
+	}
+	if BranchPageElementSize != int(unsafe.Sizeof(branchPageElement{})) {
+		t.Fatalf("unexpected BranchPageElementSize: %d", BranchPageElementSize)
+	}
+	if LeafPageElementSize != int(unsafe.Sizeof(leafPageElement{})) {
+		t.Fatalf("unexpected LeafPageElementSize: %d", LeafPageElementSize)
+	}
+}
+
+// Ensure that page counts round partial pages up.
+func TestPageCount(t *testing.T) {
+	for _, tt := range []struct {
+		fileSize int64
+		pageSize int
+		exp      int64
+	}{
+		{0, 4096, 0},
+		{1, 4096, 1},
+		{4096, 4096, 1},
+		{4097, 4096, 2},
+		{4 * 16384, 16384, 4},
+		{4096, 0, 0},
+	} {
+		if got := PageCount(tt.fileSize, tt.pageSize); got != tt.exp {
+			t.Fatalf("PageCount(%d, %d): exp=%d; got=%d", tt.fileSize, tt.pageSize, tt.exp, got)
+		}
+	}
+}
+
+// Ensure that the layout of a leaf page labels each element, key and value
+// in offset order and reports corrupted offsets instead of panicking.
+func TestPageLayout(t *testing.T) {
+	n := &node{isLeaf: true, inodes: inodes{
+		{key: []byte("foo"), value: []byte("bar")},
+		{key: []byte("sub"), value: make([]byte, bucketHeaderSize), flags: bucketLeafFlag},
+	}}
+	buf := make([]byte, 1024)
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	p.id = 5
+	n.write(p)
+
+	var names []string
+	var end int
+	for _, r := range PageLayout(buf) {
+		if r.Offset != end {
+			t.Fatalf("region %s: exp offset=%d; got=%d", r.Name, end, r.Offset)
+		}
+		end += r.Size
+		names = append(names, r.Name)
+		switch r.Name {
+		case "id":
+			if r.Value != "5" {
+				t.Fatalf("unexpected id: %s", r.Value)
+			}
+		case "leaf[0].key":
+			if k := string(buf[r.Offset : r.Offset+r.Size]); k != "foo" {
+				t.Fatalf("unexpected key: %s", k)
+			}
+		case "leaf[1].bucket":
+			if r.Value != "root=0 sequence=0" {
+				t.Fatalf("unexpected bucket: %s", r.Value)
+			}
+		}
+	}
+	if end != len(buf) {
+		t.Fatalf("exp end=%d; got=%d", len(buf), end)
+	}
+	exp := "id flags count overflow checksum leaf[0] leaf[1] leaf[0].key leaf[0].value leaf[1].key leaf[1].bucket unused"
+	if got := strings.Join(names, " "); got != exp {
+		t.Fatalf("unexpected regions:\nexp=%s\ngot=%s", exp, got)
+	}
+
+	// Point the first key past the end of the page.
+	p.leafPageElement(0).pos = 4096
+	var found bool
+	for _, r := range PageLayout(buf) {
+		if r.Name == "leaf[0].key" {
+			found = r.Size == 0 && strings.HasPrefix(r.Value, "out of bounds")
+		}
+	}
+	if !found {
+		t.Fatal("expected out of bounds key")
+	}
+}
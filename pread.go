@@ -0,0 +1,156 @@
+package tinydb
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+	"unsafe"
+)
+
+// DefaultPageCacheSize is the number of pages cached when Options.NoMmap is
+// set and Options.PageCacheSize isn't.
+const DefaultPageCacheSize = 1024
+
+// pageCache serves pages read from the file with pread when the database
+// isn't memory mapped. The meta pages are held in fixed buffers that commits
+// update in place, as they would be in a mapping, so the meta references
+// stay valid. Other pages are evicted least recently used first; evicting a
+// page a transaction still references doesn't free it, it only means the
+// next reader reads it again.
+type pageCache struct {
+	file     dbFile
+	pageSize int
+	size     int
+	metas    [2][]byte
+
+	mu    sync.Mutex
+	lru   *list.List // of *page, most recently used first
+	pages map[pgid]*list.Element
+}
+
+func newPageCache(file dbFile, pageSize, size int) *pageCache {
+	if size <= 0 {
+		size = DefaultPageCacheSize
+	}
+	return &pageCache{
+		file:     file,
+		pageSize: pageSize,
+		size:     size,
+		metas:    [2][]byte{make([]byte, pageSize), make([]byte, pageSize)},
+		lru:      list.New(),
+		pages:    make(map[pgid]*list.Element),
+	}
+}
+
+// page returns the page with the given id, reading it and its overflow
+// pages from the file if they aren't cached. Read errors panic, like faults
+// on a mapping do.
+func (c *pageCache) page(id pgid) *page {
+	if id < 2 {
+		return (*page)(unsafe.Pointer(&c.metas[id][0]))
+	}
+
+	c.mu.Lock()
+	if e, ok := c.pages[id]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*page)
+	}
+	c.mu.Unlock()
+
+	// Read without holding the lock so readers don't wait on each other's
+	// I/O. Two readers missing on the same page both read it.
+	p, err := c.read(id)
+	if err != nil {
+		panic(fmt.Sprintf("page %d: read error: %s", id, err))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.pages[id]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*page)
+	}
+	c.pages[id] = c.lru.PushFront(p)
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.pages, e.Value.(*page).id)
+	}
+	return p
+}
+
+// read reads a page and its overflow pages from the file.
+func (c *pageCache) read(id pgid) (*page, error) {
+	buf := make([]byte, c.pageSize)
+	if err := c.readAt(buf, id); err != nil {
+		return nil, err
+	}
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	if p.overflow == 0 {
+		return p, nil
+	}
+
+	// Check the overflow pages are in the file before allocating for them,
+	// since the count may be corrupt.
+	info, err := c.file.Stat()
+	if err != nil {
+		return nil, err
+	} else if end := (int64(id) + int64(p.overflow) + 1) * int64(c.pageSize); end > info.Size() {
+		return nil, fmt.Errorf("%d overflow pages past the end of the file", p.overflow)
+	}
+	buf = make([]byte, (int(p.overflow)+1)*c.pageSize)
+	if err := c.readAt(buf, id); err != nil {
+		return nil, err
+	}
+	return (*page)(unsafe.Pointer(&buf[0])), nil
+}
+
+// readAt fills buf from the page with the given id.
+func (c *pageCache) readAt(buf []byte, id pgid) error {
+	n, err := c.file.ReadAt(buf, int64(id)*int64(c.pageSize))
+	if err == io.EOF && n == len(buf) {
+		err = nil
+	}
+	return err
+}
+
+// loadMetas reads both meta pages from the file.
+func (c *pageCache) loadMetas() error {
+	for id := range c.metas {
+		if err := c.readAt(c.metas[id], pgid(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMeta copies a meta page just written to the file into its buffer.
+// The caller must hold the meta lock.
+func (c *pageCache) writeMeta(buf []byte) {
+	p := (*page)(unsafe.Pointer(&buf[0]))
+	copy(c.metas[p.id], buf)
+}
+
+// invalidate drops the cached page with the given id, which was just
+// rewritten in the file.
+func (c *pageCache) invalidate(id pgid) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.pages[id]; ok {
+		c.lru.Remove(e)
+		delete(c.pages, id)
+	}
+}
+
+// mmapCache loads the meta pages in place of mapping the file. There is no
+// mapping to outgrow, so the mapped size is set to the largest allowed and
+// the database is never remapped.
+func mmapCache(db *Db) error {
+	if err := db.cache.loadMetas(); err != nil {
+		return err
+	}
+	db.datasz = maxMapSize
+	return nil
+}
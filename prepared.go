@@ -0,0 +1,153 @@
+package tinydb
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// Prepared caches the cursor descent path to a key prefix inside a bucket.
+// Lookups and scans of keys under the prefix from later read-only transactions
+// start at the deepest branch page that covers the whole prefix instead of at
+// the bucket root. The path is tied to the transaction id it was built in and
+// is rebuilt transparently once the database has changed.
+//
+// Writable transactions, snapshot transactions and inline buckets always use
+// a regular descent.
+// A Prepared must only be used with transactions from a single database and
+// is safe for concurrent use.
+type Prepared struct {
+	path   [][]byte
+	prefix []byte
+
+	mu   sync.Mutex
+	txid txid          // transaction id the path was built in
+	refs []preparedRef // branch pages above the covering page, nil until built
+	pgid pgid          // page covering every key with the prefix
+}
+
+// preparedRef represents a branch page and the child index on the path.
+type preparedRef struct {
+	pgid  pgid
+	index int
+}
+
+// Prepare returns a prepared lookup for keys starting with prefix in the
+// bucket found by following the bucket names in path from the root.
+func Prepare(prefix []byte, path ...[]byte) *Prepared {
+	p := &Prepared{prefix: cloneBytes(prefix)}
+	for _, name := range path {
+		p.path = append(p.path, cloneBytes(name))
+	}
+	return p
+}
+
+// Get retrieves the value for a key in the prepared bucket.
+// Returns a nil value if the bucket or key does not exist, or if the key is a
+// nested bucket. Keys outside the prefix are looked up normally.
+// The returned value is only valid for the life of the transaction.
+func (p *Prepared) Get(tx *Tx, key []byte) []byte {
+	if tx.db == nil {
+		return nil
+	}
+	c, k, v, flags := p.seek(tx, key)
+	if c == nil || (flags&bucketLeafFlag) != 0 || !bytes.Equal(key, k) {
+		return nil
+	}
+	return v
+}
+
+// Scan executes a function for each key/value pair under the prefix, in key
+// order, like Bucket.Scan. Returns ErrBucketNotFound if the prepared bucket
+// does not exist.
+func (p *Prepared) Scan(tx *Tx, fn func(k, v []byte) error) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	c, k, v, flags := p.seek(tx, p.prefix)
+	if c == nil {
+		return ErrBucketNotFound
+	}
+
+	// If we ended up after the last element of a page then move to the next one.
+	if ref := &c.stack[len(c.stack)-1]; ref.index >= ref.count() {
+		k, v, flags = c.next()
+	}
+	for ; k != nil && bytes.HasPrefix(k, p.prefix); k, v, flags = c.next() {
+		if (flags & bucketLeafFlag) != 0 {
+			v = nil
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seek moves a cursor on the prepared bucket to key like Cursor.seek, but
+// starts from the cached covering page when key is under the prefix.
+// Returns a nil cursor if the bucket does not exist.
+func (p *Prepared) seek(tx *Tx, key []byte) (c *Cursor, k []byte, v []byte, flags uint32) {
+	b := &tx.root
+	for i, name := range p.path {
+		if i == 0 && bytes.Equal(name, snapshotBucket) {
+			return nil, nil, nil, 0
+		} else if b = b.Bucket(name); b == nil {
+			return nil, nil, nil, 0
+		}
+	}
+	c = b.Cursor()
+	if tx.writable || tx.snapshot || b.root == 0 || !bytes.HasPrefix(key, p.prefix) {
+		k, v, flags = c.seek(key)
+		return c, k, v, flags
+	}
+
+	p.mu.Lock()
+	if p.refs == nil || p.txid != tx.meta.txid {
+		p.build(b)
+	}
+	refs, pgid := p.refs, p.pgid
+	p.mu.Unlock()
+
+	// Seed the stack with the cached branch pages and continue the
+	// descent from the covering page.
+	c.stack = c.stack[:0]
+	for _, ref := range refs {
+		c.stack = append(c.stack, elemRef{page: tx.page(ref.pgid), index: ref.index})
+	}
+	c.search(key, pgid)
+	k, v, flags = c.keyValue()
+	return c, k, v, flags
+}
+
+// build walks down from the bucket root for as long as a single child covers
+// every key with the prefix, and caches the branch pages it passed.
+func (p *Prepared) build(b *Bucket) {
+	p.txid, p.refs, p.pgid = b.tx.meta.txid, []preparedRef{}, b.root
+	for {
+		page := b.tx.page(p.pgid)
+		if (page.flags & branchPageFlag) == 0 {
+			return
+		}
+
+		// Find the child holding the prefix, as Cursor.searchPage does.
+		var exact bool
+		index := sort.Search(int(page.count), func(i int) bool {
+			ret := bytes.Compare(page.branchPageElement(uint16(i)).key(), p.prefix)
+			if ret == 0 {
+				exact = true
+			}
+			return ret != -1
+		})
+		if !exact && index > 0 {
+			index--
+		}
+
+		// Stop if the next child may also hold keys with the prefix.
+		if index+1 < int(page.count) && bytes.HasPrefix(page.branchPageElement(uint16(index+1)).key(), p.prefix) {
+			return
+		}
+		p.refs = append(p.refs, preparedRef{pgid: page.id, index: index})
+		p.pgid = page.branchPageElement(uint16(index)).pgid
+	}
+}
@@ -0,0 +1,133 @@
+package tinydb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// putUsers writes count users with sessions under "users/<id>/..." keys.
+func putUsers(t *testing.T, db *Db, count int, value string) {
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < count; i++ {
+			for j := 0; j < 10; j++ {
+				if err := b.Put([]byte(fmt.Sprintf("users/%04d/%d", i, j)), []byte(value)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a prepared lookup returns the same results as a regular one
+// and reuses its cached path within a snapshot.
+func TestPrepared_Get(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	putUsers(t, db, 1000, "a")
+
+	p := Prepare([]byte("users/0500/"), []byte("widgets"))
+	if err := db.View(func(tx *Tx) error {
+		if v := p.Get(tx, []byte("users/0500/3")); string(v) != "a" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if v := p.Get(tx, []byte("users/0500/x")); v != nil {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		// Keys outside the prefix fall back to a regular lookup.
+		if v := p.Get(tx, []byte("users/0001/1")); string(v) != "a" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.refs) == 0 {
+		t.Fatal("expected cached branch pages")
+	}
+	built := p.txid
+
+	// A change to the database invalidates the cached path.
+	putUsers(t, db, 1000, "b")
+	if err := db.View(func(tx *Tx) error {
+		if v := p.Get(tx, []byte("users/0500/3")); string(v) != "b" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if p.txid == built {
+		t.Fatal("expected cached path to be rebuilt")
+	}
+
+	// Writable transactions see their own uncommitted writes.
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.Bucket([]byte("widgets")).Put([]byte("users/0500/3"), []byte("c")); err != nil {
+			t.Fatal(err)
+		}
+		if v := p.Get(tx, []byte("users/0500/3")); string(v) != "c" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a prepared scan visits exactly the keys under the prefix.
+func TestPrepared_Scan(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	putUsers(t, db, 1000, "a")
+
+	for _, prefix := range []string{"users/0500/", "users/05", "users/", "users/9", "users/0999/9"} {
+		p := Prepare([]byte(prefix), []byte("widgets"))
+		if err := db.View(func(tx *Tx) error {
+			var exp, got [][]byte
+			if err := tx.Bucket([]byte("widgets")).Scan([]byte(prefix), func(k, v []byte) error {
+				exp = append(exp, k)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				got = got[:0]
+				if err := p.Scan(tx, func(k, v []byte) error {
+					got = append(got, k)
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != len(exp) {
+					t.Fatalf("%q: unexpected key count: %d != %d", prefix, len(got), len(exp))
+				}
+				for j := range exp {
+					if !bytes.Equal(got[j], exp[j]) {
+						t.Fatalf("%q: unexpected key %q; exp %q", prefix, got[j], exp[j])
+					}
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		if err := Prepare(nil, []byte("missing")).Scan(tx, func(k, v []byte) error { return nil }); err != ErrBucketNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
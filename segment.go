@@ -0,0 +1,390 @@
+package tinydb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// segmentFile is a database file split into segment files of a fixed size,
+// each mapped on its own. The first segment is at the database path and the
+// others follow it as path.1, path.2 and so on. Every segment but the last
+// is full.
+//
+// Segments are only ever added, and a segment's mapping covers the whole
+// segment even before the file has grown into it, so growing the database
+// maps at most one new segment and never moves the pages readers hold.
+type segmentFile struct {
+	path     string
+	flag     int
+	size     int  // size of each segment in bytes
+	readOnly bool // segments are mapped only as far as they exist
+
+	mu    sync.Mutex
+	files []*os.File
+	dirty map[int]bool // segments written since the last sync
+
+	maps atomic.Value // [][]byte, one mapping per segment
+}
+
+// segmentPath returns the path of the i-th segment of the database at path.
+func segmentPath(path string, i int) string {
+	if i == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// openSegmentFile opens the segments of the database at path. It returns
+// nil if size is zero and the database isn't already split into segments.
+// Otherwise the segment size of an existing database must match size,
+// unless size is zero.
+func openSegmentFile(path string, flag int, size int) (*segmentFile, error) {
+	segmented := false
+	if _, err := os.Stat(segmentPath(path, 1)); err == nil {
+		segmented = true
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if size == 0 && !segmented {
+		return nil, nil
+	} else if size < 0 || size > maxMapSize {
+		return nil, ErrInvalidSegmentSize
+	}
+
+	f := &segmentFile{
+		path:     path,
+		flag:     flag,
+		size:     size,
+		readOnly: flag&(os.O_WRONLY|os.O_RDWR) == 0,
+		dirty:    make(map[int]bool),
+	}
+	f.maps.Store([][]byte(nil))
+	for i := 0; ; i++ {
+		// Only the first segment is created here.
+		segflag := flag
+		if i > 0 {
+			segflag &^= os.O_CREATE
+		}
+		file, err := os.OpenFile(segmentPath(path, i), segflag, fileMode)
+		if os.IsNotExist(err) && i > 0 {
+			break
+		} else if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		f.files = append(f.files, file)
+	}
+
+	// Every segment but the last is full, so the first one gives the size.
+	if segmented {
+		info, err := f.files[0].Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		} else if size != 0 && int64(size) != info.Size() {
+			_ = f.Close()
+			return nil, ErrInvalidSegmentSize
+		}
+		f.size = int(info.Size())
+	}
+	for i, file := range f.files {
+		info, err := file.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		} else if info.Size() > int64(f.size) || (i < len(f.files)-1 && info.Size() != int64(f.size)) {
+			_ = f.Close()
+			return nil, fmt.Errorf("segment %d: %w", i, ErrInvalidSegmentSize)
+		}
+	}
+	return f, nil
+}
+
+// segment returns the file of the i-th segment, creating it and any
+// segments before it if they don't exist yet. The last segment is filled
+// before another is added, so the segment size can be read back from the
+// first one.
+func (f *segmentFile) segment(i int) (*os.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.files) <= i {
+		if f.readOnly {
+			return nil, io.EOF
+		}
+		last := len(f.files) - 1
+		if info, err := f.files[last].Stat(); err != nil {
+			return nil, err
+		} else if info.Size() != int64(f.size) {
+			if err := f.files[last].Truncate(int64(f.size)); err != nil {
+				return nil, err
+			}
+			f.dirty[last] = true
+		}
+		file, err := os.OpenFile(segmentPath(f.path, len(f.files)), f.flag|os.O_CREATE, fileMode)
+		if err != nil {
+			return nil, err
+		}
+		f.files = append(f.files, file)
+	}
+	return f.files[i], nil
+}
+
+// ReadAt reads len(b) bytes at off, returning io.EOF if the last segment
+// ends first.
+func (f *segmentFile) ReadAt(b []byte, off int64) (int, error) {
+	n := 0
+	for n < len(b) {
+		i, pos := int((off+int64(n))/int64(f.size)), (off+int64(n))%int64(f.size)
+		f.mu.Lock()
+		if i >= len(f.files) {
+			f.mu.Unlock()
+			return n, io.EOF
+		}
+		file := f.files[i]
+		f.mu.Unlock()
+
+		end := len(b)
+		if rem := int64(f.size) - pos; int64(end-n) > rem {
+			end = n + int(rem)
+		}
+		m, err := file.ReadAt(b[n:end], pos)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// WriteAt writes b at off, creating segments as needed.
+func (f *segmentFile) WriteAt(b []byte, off int64) (int, error) {
+	n := 0
+	for n < len(b) {
+		i, pos := int((off+int64(n))/int64(f.size)), (off+int64(n))%int64(f.size)
+		file, err := f.segment(i)
+		if err != nil {
+			return n, err
+		}
+
+		end := len(b)
+		if rem := int64(f.size) - pos; int64(end-n) > rem {
+			end = n + int(rem)
+		}
+		m, err := file.WriteAt(b[n:end], pos)
+		n += m
+		f.markDirty(i)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// punchHole punches a hole over size bytes at off in every segment the
+// range covers.
+func (f *segmentFile) punchHole(off, size int64) error {
+	for size > 0 {
+		i, pos := int(off/int64(f.size)), off%int64(f.size)
+		file, err := f.segment(i)
+		if err != nil {
+			return err
+		}
+		n := size
+		if rem := int64(f.size) - pos; n > rem {
+			n = rem
+		}
+		if err := punchHole(file, pos, n); err != nil {
+			return err
+		}
+		off, size = off+n, size-n
+	}
+	return nil
+}
+
+// Truncate grows or shrinks the database to size, filling every segment
+// before the last and removing the segments past it.
+func (f *segmentFile) Truncate(size int64) error {
+	if size < 0 {
+		return errors.New("segment: negative size")
+	}
+	last := 0
+	if size > 0 {
+		last = int((size - 1) / int64(f.size))
+	}
+	for i := 0; i <= last; i++ {
+		file, err := f.segment(i)
+		if err != nil {
+			return err
+		}
+		sz := int64(f.size)
+		if i == last {
+			sz = size - int64(last)*int64(f.size)
+		}
+		if info, err := file.Stat(); err != nil {
+			return err
+		} else if info.Size() == sz {
+			continue
+		}
+		if err := file.Truncate(sz); err != nil {
+			return err
+		}
+		f.markDirty(i)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.files) > last+1 {
+		i := len(f.files) - 1
+		if err := f.files[i].Close(); err != nil {
+			return err
+		} else if err := os.Remove(segmentPath(f.path, i)); err != nil {
+			return err
+		}
+		f.files = f.files[:i]
+		delete(f.dirty, i)
+	}
+	return nil
+}
+
+// markDirty records that the i-th segment needs to be synced.
+func (f *segmentFile) markDirty(i int) {
+	f.mu.Lock()
+	f.dirty[i] = true
+	f.mu.Unlock()
+}
+
+// Sync syncs the segments written since the last sync.
+func (f *segmentFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.dirty {
+		if err := f.files[i].Sync(); err != nil {
+			return err
+		}
+		delete(f.dirty, i)
+	}
+	return nil
+}
+
+// Fd returns the file descriptor of the first segment, which holds the
+// file lock.
+func (f *segmentFile) Fd() uintptr { return f.files[0].Fd() }
+
+// Name returns the path of the first segment.
+func (f *segmentFile) Name() string { return f.path }
+
+// Stat returns the total size of the segments.
+func (f *segmentFile) Stat() (os.FileInfo, error) {
+	f.mu.Lock()
+	last := f.files[len(f.files)-1]
+	n := len(f.files)
+	f.mu.Unlock()
+
+	info, err := last.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return segmentFileInfo{info, int64(n-1)*int64(f.size) + info.Size()}, nil
+}
+
+// Close closes every segment.
+func (f *segmentFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var err error
+	for _, file := range f.files {
+		if e := file.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	f.files = nil
+	return err
+}
+
+// segmentFileInfo describes the segments of a database as a whole.
+type segmentFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi segmentFileInfo) Size() int64 { return fi.size }
+
+// page returns the page with the given id from the segment mappings.
+func (f *segmentFile) page(id pgid, pageSize int) *page {
+	maps := f.maps.Load().([][]byte)
+	pos := int64(id) * int64(pageSize)
+	return (*page)(unsafe.Pointer(&maps[pos/int64(f.size)][pos%int64(f.size)]))
+}
+
+// mmapSegments maps the segments needed to hold minsz bytes, and all of
+// the file, that aren't mapped yet. Mapped segments stay where they are, so
+// unlike mmap it doesn't wait for readers to finish.
+func (db *Db) mmapSegments(minsz int) error {
+	f := db.segments
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("mmap stat error: %s", err)
+	} else if int(info.Size()) < db.pageSize*2 {
+		return fmt.Errorf("file size too small")
+	}
+
+	// Segments past the end of a read-only database can't be created.
+	db.filesz = int(info.Size())
+	size := db.filesz
+	if size < minsz && !f.readOnly {
+		size = minsz
+	}
+	n := (size + f.size - 1) / f.size
+
+	maps := f.maps.Load().([][]byte)
+	if n <= len(maps) {
+		return nil
+	}
+	grown := make([][]byte, n)
+	copy(grown, maps)
+	for i := len(maps); i < n; i++ {
+		file, err := f.segment(i)
+		if err != nil {
+			return err
+		}
+		if grown[i], err = mmapFile(file, f.size, f.readOnly, db.mmapAdvice); err != nil {
+			for _, b := range grown[len(maps):i] {
+				_ = munmapFile(b)
+			}
+			return err
+		}
+	}
+	f.maps.Store(grown)
+
+	oldsz := db.datasz
+	db.datasz = n * f.size
+	if oldsz > 0 {
+		db.remapped(oldsz, db.datasz)
+		return nil
+	}
+	if err := db.mlock(db.filesz); err != nil {
+		return err
+	}
+	return db.loadMeta()
+}
+
+// munmapSegments unmaps every segment.
+func munmapSegments(db *Db) error {
+	f := db.segments
+	maps := f.maps.Load().([][]byte)
+	f.maps.Store([][]byte(nil))
+	db.datasz = 0
+
+	var err error
+	for _, b := range maps {
+		if e := munmapFile(b); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,216 @@
+package tinydb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// Ensure that a database split into segments grows across segment files,
+// never lays a page across two of them, and reopens with the segment size
+// found on disk.
+func TestOpen_SegmentSize(t *testing.T) {
+	for _, typ := range []FreelistType{FreelistArrayType, FreelistMapType} {
+		t.Run(string(typ), func(t *testing.T) {
+			path := tempfile()
+			defer removeSegments(path)
+			db, err := Open(path, &Options{PageSize: 4096, SegmentSize: 64 * 1024, FreelistType: typ})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Values of five pages don't divide the sixteen pages of a
+			// segment, so allocations regularly skip to the next one.
+			value := bytes.Repeat([]byte("x"), 5*4096-100)
+			for i := 0; i < 10; i++ {
+				if err := db.Update(func(tx *Tx) error {
+					b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+					if err != nil {
+						return err
+					}
+					for j := 0; j < 10; j++ {
+						if err := b.Put([]byte(fmt.Sprintf("%04d", i*10+j)), value); err != nil {
+							return err
+						}
+					}
+					// Overwrite earlier values so freed spans are reused.
+					return b.Delete([]byte(fmt.Sprintf("%04d", i*5)))
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := os.Stat(segmentPath(path, 10)); err != nil {
+				t.Fatalf("expected segments: %v", err)
+			}
+			if err := db.View(func(tx *Tx) error {
+				for err := range tx.Check() {
+					t.Fatal(err)
+				}
+				for id := pgid(2); id < tx.meta.pgid; id++ {
+					if f := tx.db.freelist; !f.freed(id) {
+						p := tx.page(id)
+						if (p.id+pgid(p.overflow))/16 != p.id/16 {
+							t.Fatalf("page %d spans segments", p.id)
+						}
+						id += pgid(p.overflow)
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The segment size is read back from the files.
+			db, err = Open(path, &Options{FreelistType: typ})
+			if err != nil {
+				t.Fatal(err)
+			} else if db.segments == nil || db.segments.size != 64*1024 {
+				t.Fatal("expected segments")
+			}
+			if err := db.View(func(tx *Tx) error {
+				b := tx.Bucket([]byte("widgets"))
+				if n := b.Stats().KeyN; n != 90 {
+					t.Fatalf("unexpected key count: %d", n)
+				} else if v := b.Get([]byte("0099")); !bytes.Equal(v, value) {
+					t.Fatalf("unexpected value: %d bytes", len(v))
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Values can't be larger than a segment.
+			if err := db.Update(func(tx *Tx) error {
+				return tx.Bucket([]byte("widgets")).Put([]byte("large"), make([]byte, 64*1024))
+			}); err == nil {
+				t.Fatal("expected error")
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := Open(path, &Options{SegmentSize: 32 * 1024}); !errors.Is(err, ErrInvalidSegmentSize) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// Ensure that growing into a new segment doesn't wait for open readers, as
+// remapping a single file does.
+func TestOpen_SegmentSize_GrowWithReader(t *testing.T) {
+	path := tempfile()
+	defer removeSegments(path)
+	db, err := Open(path, &Options{PageSize: 4096, SegmentSize: 64 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("foo"), make([]byte, 1<<20-1<<16))
+		})
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected value larger than a segment to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("commit blocked by reader")
+	}
+
+	go func() {
+		done <- db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 100; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 8192)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("commit blocked by reader")
+	}
+	if tx.Bucket([]byte("widgets")) != nil {
+		t.Fatal("unexpected bucket in old snapshot")
+	}
+}
+
+// Ensure that an existing database can only be split into segments while
+// it fits in the first one.
+func TestOpen_SegmentSize_Existing(t *testing.T) {
+	db, path := mustOpen(t)
+	defer removeSegments(path)
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), make([]byte, 100000))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pageSize := db.pageSize
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(path, &Options{SegmentSize: 8 * pageSize}); !errors.Is(err, ErrInvalidSegmentSize) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := Open(path, &Options{SegmentSize: 1024*pageSize + 1}); !errors.Is(err, ErrInvalidSegmentSize) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	db, err := Open(path, &Options{SegmentSize: 1024 * pageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); len(v) != 100000 {
+			t.Fatalf("unexpected value: %d bytes", len(v))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// removeSegments removes a database and all of its segment files.
+func removeSegments(path string) {
+	for i := 0; ; i++ {
+		if err := os.Remove(segmentPath(path, i)); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package tinydb
+
+import (
+	"unsafe"
+)
+
+// snapshotBucket is the reserved top-level bucket holding named snapshots.
+// Each key is a snapshot name and each value is a snapshotRecord.
+var snapshotBucket = []byte("\x00snapshots")
+
+// snapshotRecord is the stored form of a named snapshot: the root bucket
+// header it was taken at.
+type snapshotRecord struct {
+	root bucket
+}
+
+const snapshotRecordSize = int(unsafe.Sizeof(snapshotRecord{}))
+
+// CreateSnapshot records the last committed state of the database under
+// name. Every page reachable from it is kept out of the freelist until the
+// snapshot is dropped, so it can be read later with ViewSnapshot without
+// copying the file. Later writes copy pages as usual, so the file grows by
+// the pages a snapshot keeps alive.
+//
+// Snapshots are stored in a reserved top-level bucket named "\x00snapshots"
+// and their pages are scanned on Open.
+func (db *Db) CreateSnapshot(name []byte) error {
+	if len(name) == 0 {
+		return ErrKeyRequired
+	}
+	return db.pinning(func(tx *Tx) error {
+		rec := snapshotRecord{root: tx.meta.root}
+
+		// Pin the tree before the record is written, since writing it copies
+		// pages of the current tree.
+		pinned := tx.snapshotPages(nil)
+		tx.markReachable(rec.root.root, pinned)
+		tx.db.freelist.pinned = pinned
+
+		b, err := tx.root.CreateBucketIfNotExists(snapshotBucket)
+		if err != nil {
+			return err
+		} else if b.Get(name) != nil {
+			return ErrSnapshotExists
+		}
+		value := make([]byte, snapshotRecordSize)
+		*(*snapshotRecord)(unsafe.Pointer(&value[0])) = rec
+		return b.Put(name, value)
+	})
+}
+
+// DropSnapshot removes a named snapshot and frees the pages that only it
+// was keeping alive. Read transactions already open on the snapshot keep
+// those pages until they close.
+func (db *Db) DropSnapshot(name []byte) error {
+	return db.pinning(func(tx *Tx) error {
+		b := tx.snapshots()
+		if b == nil || b.Get(name) == nil {
+			return ErrSnapshotNotFound
+		}
+
+		// Free the pages that are no longer pinned and aren't part of the
+		// committed tree. The ones that are get freed by later writes.
+		pinned := tx.snapshotPages(name)
+		committed := make(map[pgid]bool)
+		tx.markReachable(tx.meta.root.root, committed)
+
+		f := tx.db.freelist
+		old := f.pinned
+		f.pinned = pinned
+		for id := range old {
+			if !pinned[id] && !committed[id] {
+				f.free(tx.meta.txid, &page{id: id})
+			}
+		}
+
+		return b.Delete(name)
+	})
+}
+
+// ViewSnapshot executes a function within the context of a managed read-only
+// transaction on the named snapshot. Any error that is returned from the
+// function is returned from the ViewSnapshot() method.
+func (db *Db) ViewSnapshot(name []byte, fn func(*Tx) error) error {
+	return db.View(func(tx *Tx) error {
+		b := tx.snapshots()
+		if b == nil {
+			return ErrSnapshotNotFound
+		}
+		rec, ok := readSnapshotRecord(b.Get(name))
+		if !ok {
+			return ErrSnapshotNotFound
+		}
+
+		// Swap the root bucket for the snapshot's. The transaction keeps its
+		// own id for reader tracking. The current freelist doesn't describe
+		// the snapshot's tree, so the snapshot is read without one.
+		tx.meta.root = rec.root
+		tx.meta.freelist = pgidNoFreelist
+		tx.root = newBucket(tx)
+		tx.root.bucket = &bucket{}
+		*tx.root.bucket = rec.root
+		tx.snapshot = true
+		return fn(tx)
+	})
+}
+
+// pinning runs fn in a write transaction that may change the pinned pages,
+// restoring them if the transaction doesn't commit.
+func (db *Db) pinning(fn func(*Tx) error) error {
+	var pinned map[pgid]bool
+	err := db.Update(func(tx *Tx) error {
+		pinned = tx.db.freelist.pinned
+		return fn(tx)
+	})
+	if err != nil && db.freelist != nil {
+		db.freelist.pinned = pinned
+	}
+	return err
+}
+
+// snapshots returns the reserved bucket holding named snapshots, or nil if
+// no snapshot was ever created.
+func (tx *Tx) snapshots() *Bucket {
+	return tx.root.Bucket(snapshotBucket)
+}
+
+// readSnapshotRecord decodes a snapshot record, reporting false if v isn't
+// one.
+func readSnapshotRecord(v []byte) (snapshotRecord, bool) {
+	if len(v) != snapshotRecordSize {
+		return snapshotRecord{}, false
+	}
+	return *(*snapshotRecord)(unsafe.Pointer(&cloneBytes(v)[0])), true
+}
+
+// snapshotPages returns every page reachable from the named snapshots,
+// except the one called skip. Entries that aren't snapshot records pin
+// nothing.
+func (tx *Tx) snapshotPages(skip []byte) map[pgid]bool {
+	pinned := make(map[pgid]bool)
+	b := tx.snapshots()
+	if b == nil {
+		return pinned
+	}
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if skip != nil && string(k) == string(skip) {
+			continue
+		}
+		if rec, ok := readSnapshotRecord(v); ok {
+			tx.markReachable(rec.root.root, pinned)
+		}
+	}
+	return pinned
+}
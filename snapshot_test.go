@@ -0,0 +1,264 @@
+package tinydb
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Ensure that a named snapshot keeps its data readable across writes that
+// reuse free pages and across a reopen, until it is dropped.
+func TestDb_Snapshot(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	put := func(value string) {
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 500; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%04d", i)), []byte(value)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(view func([]byte, func(*Tx) error) error, name string) (string, error) {
+		var v string
+		err := view([]byte(name), func(tx *Tx) error {
+			v = string(tx.Bucket([]byte("widgets")).Get([]byte("0042")))
+			return nil
+		})
+		return v, err
+	}
+
+	put("before")
+	if err := db.CreateSnapshot([]byte("upgrade")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateSnapshot([]byte("upgrade")); err != ErrSnapshotExists {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		put(fmt.Sprintf("after%d", i))
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	put("reopened")
+
+	if v, err := get(db.ViewSnapshot, "upgrade"); err != nil {
+		t.Fatal(err)
+	} else if v != "before" {
+		t.Fatalf("unexpected snapshot value: %q", v)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("0042")); string(v) != "reopened" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.DropSnapshot([]byte("upgrade")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(db.ViewSnapshot, "upgrade"); err != ErrSnapshotNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.DropSnapshot([]byte("upgrade")); err != ErrSnapshotNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Once the snapshot is gone its pages are reused.
+	put("dropped")
+	hwm := db.meta().pgid
+	for i := 0; i < 5; i++ {
+		put(fmt.Sprintf("dropped%d", i))
+	}
+	if n := db.meta().pgid; n != hwm {
+		t.Fatalf("expected freed pages to be reused: %d != %d", n, hwm)
+	}
+}
+
+// Ensure that the freelist holds exactly the pages that neither the current
+// tree nor a snapshot can reach, after snapshots are created and dropped.
+func TestDb_Snapshot_Freelist(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	update := func(fn func(tx *Tx) error) {
+		if err := db.Update(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put := func(n int, value string) {
+		update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			child, err := b.CreateBucketIfNotExists([]byte("sub"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < n; i++ {
+				k := []byte(fmt.Sprintf("%04d", i))
+				if err := b.Put(k, []byte(value)); err != nil {
+					return err
+				}
+				if err := child.Put(k, make([]byte, 5000)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	check := func() {
+		// Unreachable pages are free, pending or hold the freelist itself.
+		free := db.freelist.getFreePageIDs()
+		for _, ids := range db.freelist.pending {
+			free = append(free, ids...)
+		}
+		p := db.page(db.meta().freelist)
+		for i := pgid(0); i <= pgid(p.overflow); i++ {
+			free = append(free, p.id+i)
+		}
+		sort.Sort(pgids(free))
+		if ids := db.freepages(); !reflect.DeepEqual(ids, free) {
+			t.Fatalf("freelist mismatch:\nunreachable=%v\nfree=%v", ids, free)
+		}
+	}
+
+	put(200, "a")
+	if err := db.CreateSnapshot([]byte("s1")); err != nil {
+		t.Fatal(err)
+	}
+	put(100, "b")
+	if err := db.CreateSnapshot([]byte("s2")); err != nil {
+		t.Fatal(err)
+	}
+	put(300, "c")
+	if err := db.DropSnapshot([]byte("s1")); err != nil {
+		t.Fatal(err)
+	}
+	put(50, "d")
+	check()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+
+	if err := db.ViewSnapshot([]byte("s2"), func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("0000")); string(v) != "b" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := b.Get([]byte("0150")); string(v) != "a" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := b.Bucket([]byte("sub")).Get([]byte("0199")); len(v) != 5000 {
+			t.Fatalf("unexpected value size: %d", len(v))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.DropSnapshot([]byte("s2")); err != nil {
+		t.Fatal(err)
+	}
+	put(10, "e")
+	check()
+}
+
+// Ensure that the bucket holding snapshots can't be reached through the
+// public bucket API, and that entries in it that aren't snapshot records
+// are ignored rather than read as one.
+func TestDb_Snapshot_Reserved(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), make([]byte, 10000))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateSnapshot([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *Tx) error {
+		if tx.Bucket(snapshotBucket) != nil {
+			t.Fatal("expected reserved bucket to be hidden")
+		} else if _, err := tx.CreateBucket(snapshotBucket); err != ErrBucketReserved {
+			t.Fatalf("unexpected error: %v", err)
+		} else if _, err := tx.CreateBucketIfNotExists(snapshotBucket); err != ErrBucketReserved {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := tx.DeleteBucket(snapshotBucket); err != ErrBucketReserved {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Write entries that aren't records, as a damaged file might hold.
+		b := tx.snapshots()
+		if err := b.Put([]byte("empty"), []byte{}); err != nil {
+			return err
+		} else if err := b.Put([]byte("short"), []byte("x")); err != nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte("widgets"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, name := range []string{"empty", "short"} {
+		if err := db.ViewSnapshot([]byte(name), func(*Tx) error { return nil }); err != ErrSnapshotNotFound {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+	}
+	if err := db.ViewSnapshot([]byte("a"), func(tx *Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); len(v) != 10000 {
+			t.Fatalf("unexpected value: %d bytes", len(v))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,10 +1,39 @@
 package tinydb
 
-import "time"
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unsafe"
+)
 
 // txid represents the internal transaction identifier.
 type txid uint64
 
+// Durability sets when Commit returns relative to the transaction reaching
+// disk. Either way commits reach disk in order: a crash loses some of the
+// latest commits, never an earlier one or part of one.
+type Durability int
+
+const (
+	// DurabilitySync returns from Commit once the transaction is on disk.
+	// Commits waiting at the same time share an fsync, and the next
+	// transaction's fsync of its pages also covers them.
+	DurabilitySync Durability = iota
+
+	// DurabilityAsync returns from Commit as soon as the transaction is
+	// written, leaving it to be made durable by the next fsync: that of a
+	// later commit, Db.Sync or Close. Readers see the transaction
+	// immediately.
+	DurabilityAsync
+)
+
 // Tx represents a read-only or read/write transaction on the database.
 // Read-only transactions can be used for retrieving values for keys and creating cursors.
 // Read/write transactions can create and remove buckets and create and remove keys.
@@ -22,6 +51,10 @@ type Tx struct {
 	pages          map[pgid]*page
 	stats          TxStats
 	commitHandlers []func()
+	changed        map[string]struct{} // top-level buckets changed by the tx
+	allocated      []pgid              // pages allocated by the tx, only with a commit log
+	snapshot       bool                // reading a named snapshot or older meta instead of the current tree
+	verified       map[pgid]bool       // pages whose checksum was verified by the tx
 
 	// WriteFlag specifies the flag for write-related methods like WriteTo().
 	// Tx opens the database file with the specified flag to copy the data.
@@ -30,6 +63,491 @@ type Tx struct {
 	// workloads. For databases that are much larger than available RAM,
 	// set the flag to syscall.O_DIRECT to avoid trashing the page cache.
 	WriteFlag int
+
+	// Durability sets when Commit returns relative to the transaction
+	// reaching disk. It is ignored when Db.NoSync is set.
+	Durability Durability
+}
+
+// init initializes the transaction.
+func (tx *Tx) init(db *Db) {
+	tx.db = db
+	tx.pages = nil
+
+	// Copy the meta page since it can be changed by the writer.
+	tx.meta = &meta{}
+	db.meta().copy(tx.meta)
+
+	// Copy over the root bucket.
+	tx.root = newBucket(tx)
+	tx.root.bucket = &bucket{}
+	*tx.root.bucket = tx.meta.root
+
+	// Increment the transaction id and add a page cache for writable transactions.
+	if tx.writable {
+		tx.pages = make(map[pgid]*page)
+		tx.meta.txid += txid(1)
+	}
+}
+
+// ID returns the transaction id.
+func (tx *Tx) ID() int {
+	return int(tx.meta.txid)
+}
+
+// DB returns a reference to the database that created the transaction.
+func (tx *Tx) DB() *Db {
+	return tx.db
+}
+
+// Writable returns whether the transaction can perform write operations.
+func (tx *Tx) Writable() bool {
+	return tx.writable
+}
+
+// Stats retrieves a copy of the current transaction statistics.
+func (tx *Tx) Stats() TxStats {
+	return tx.stats
+}
+
+// OnCommit adds a handler function to be executed after the transaction successfully commits.
+func (tx *Tx) OnCommit(fn func()) {
+	tx.commitHandlers = append(tx.commitHandlers, fn)
+}
+
+// Bucket retrieves a bucket by name.
+// Returns nil if the bucket does not exist, or if the name is reserved.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (tx *Tx) Bucket(name []byte) *Bucket {
+	if bytes.Equal(name, snapshotBucket) {
+		return nil
+	}
+	return tx.root.Bucket(name)
+}
+
+// CreateBucket creates a new bucket.
+// Returns an error if the bucket already exists, if the bucket name is blank, reserved, or too long.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (tx *Tx) CreateBucket(name []byte) (*Bucket, error) {
+	if bytes.Equal(name, snapshotBucket) {
+		return nil, ErrBucketReserved
+	}
+	return tx.root.CreateBucket(name)
+}
+
+// CreateBucketIfNotExists creates a new bucket if it doesn't already exist.
+// Returns an error if the bucket name is blank, reserved, or too long.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (tx *Tx) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
+	if bytes.Equal(name, snapshotBucket) {
+		return nil, ErrBucketReserved
+	}
+	return tx.root.CreateBucketIfNotExists(name)
+}
+
+// DeleteBucket deletes a bucket.
+// Returns an error if the bucket cannot be found, if the key represents a non-bucket value,
+// or if the name is reserved.
+func (tx *Tx) DeleteBucket(name []byte) error {
+	if bytes.Equal(name, snapshotBucket) {
+		return ErrBucketReserved
+	}
+	return tx.root.DeleteBucket(name)
+}
+
+// ForEach executes a function for each bucket in the root.
+// If the provided function returns an error then the iteration is stopped and
+// the error is returned to the caller. The reserved bucket holding named
+// snapshots is skipped.
+func (tx *Tx) ForEach(fn func(name []byte, b *Bucket) error) error {
+	return tx.root.ForEach(func(k, v []byte) error {
+		if bytes.Equal(k, snapshotBucket) {
+			return nil
+		}
+		return fn(k, tx.root.Bucket(k))
+	})
+}
+
+// Hash returns a SHA-256 digest of every bucket, key and value visible to the
+// transaction. Buckets and keys are visited in key order and every entry is
+// length-prefixed, so two databases hash equal exactly when they hold the
+// same logical contents, regardless of page layout. Sequences and the reserved
+// bucket holding named snapshots are not hashed.
+func (tx *Tx) Hash() ([]byte, error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	}
+	h := sha256.New()
+	hashBucket(h, &tx.root)
+	return h.Sum(nil), nil
+}
+
+// hashBucket writes the contents of b to h. Each entry is a tag byte, followed
+// by the length-prefixed key and, for values, the length-prefixed value.
+// Nested buckets are written recursively and terminated by an end tag.
+func hashBucket(h hash.Hash, b *Bucket) {
+	var buf [binary.MaxVarintLen64]byte
+	writeBytes := func(v []byte) {
+		n := binary.PutUvarint(buf[:], uint64(len(v)))
+		h.Write(buf[:n])
+		h.Write(v)
+	}
+
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if b == &b.tx.root && bytes.Equal(k, snapshotBucket) {
+			continue
+		}
+		if v == nil {
+			if child := b.Bucket(k); child != nil {
+				h.Write([]byte{hashBucketTag})
+				writeBytes(k)
+				hashBucket(h, child)
+				h.Write([]byte{hashEndTag})
+				continue
+			}
+		}
+		h.Write([]byte{hashValueTag})
+		writeBytes(k)
+		writeBytes(v)
+	}
+}
+
+// Tags written by hashBucket before each entry.
+const (
+	hashValueTag  = 0x01
+	hashBucketTag = 0x02
+	hashEndTag    = 0x03
+)
+
+// Commit writes all changes to disk and updates the meta page.
+// Returns an error if a disk write error occurs, or if Commit is
+// called on a read-only transaction.
+func (tx *Tx) Commit() error {
+	if tx.managed {
+		panic("managed tx commit not allowed")
+	}
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+
+	// Rebalance nodes which have had deletions.
+	var commitStart = time.Now()
+	var startTime = commitStart
+	tx.root.engine().rebalance()
+	if tx.stats.Rebalance > 0 {
+		tx.stats.RebalanceTime += time.Since(startTime)
+	}
+
+	// Remember the bucket roots so the commit log can report what moved.
+	var roots map[string]pgid
+	if tx.db.commitLog != nil {
+		roots = tx.root.openRoots(nil, make(map[string]pgid))
+	}
+
+	// spill data onto dirty pages.
+	startTime = time.Now()
+	if err := tx.root.engine().spill(); err != nil {
+		tx.rollback()
+		return err
+	}
+	tx.stats.SpillTime += time.Since(startTime)
+
+	// Free the old root bucket.
+	tx.meta.root.root = tx.root.root
+
+	// Free the old freelist because commit writes out a fresh freelist.
+	if tx.meta.freelist != pgidNoFreelist {
+		tx.db.freelist.free(tx.meta.txid, tx.db.page(tx.meta.freelist))
+	}
+
+	if !tx.db.NoFreelistSync {
+		if err := tx.commitFreelist(); err != nil {
+			return err
+		}
+	} else {
+		tx.meta.freelist = pgidNoFreelist
+	}
+
+	// Grow the database if the high water mark has moved past the end of
+	// the file, including while spilling, so that the pages are never
+	// appended by the writes alone.
+	if err := tx.db.grow(int(tx.meta.pgid+1) * tx.db.pageSize); err != nil {
+		tx.rollback()
+		return err
+	}
+
+	// Write dirty pages to disk.
+	startTime = time.Now()
+	if err := tx.write(); err != nil {
+		tx.rollback()
+		return err
+	}
+
+	// If strict mode is enabled then perform a consistency check before
+	// the meta page makes the commit visible.
+	if tx.db.StrictMode {
+		var errs []string
+		for err := range tx.Check() {
+			errs = append(errs, err.Error())
+		}
+		if len(errs) > 0 {
+			panic("check fail: " + strings.Join(errs, "\n"))
+		}
+	}
+
+	// Write meta to disk.
+	if err := tx.writeMeta(); err != nil {
+		tx.rollback()
+		return err
+	}
+	tx.stats.WriteTime += time.Since(startTime)
+
+	if tx.db.commitLog != nil {
+		tx.logCommit(roots)
+	}
+
+	// Finalize the transaction.
+	db, id := tx.db, tx.ID()
+	sync := !db.NoSync && tx.Durability == DurabilitySync
+	tx.close()
+
+	// Wait for the meta page to reach disk without holding the writer
+	// lock, so that the next transaction can get going meanwhile.
+	if sync {
+		if err := db.syncTx(txid(id)); err != nil {
+			return err
+		}
+	}
+
+	if elapsed := time.Since(commitStart); db.slowCommitThreshold > 0 && elapsed >= db.slowCommitThreshold {
+		db.slowCommit(id, elapsed)
+	}
+
+	// Notify bucket subscribers and execute commit handlers now that the
+	// locks have been removed.
+	if len(tx.changed) > 0 {
+		db.notify(id, tx.changed)
+	}
+	for _, fn := range tx.commitHandlers {
+		fn()
+	}
+
+	return nil
+}
+
+// commitFreelist writes the freelist to freshly allocated pages and points
+// the meta at them. The transaction is rolled back on error.
+func (tx *Tx) commitFreelist() error {
+	// Allocate new pages for the new free list. This will overestimate
+	// the size of the freelist but not underestimate the size (which would be bad).
+	// Skipping to the next segment frees pages, so allocate again if that
+	// outgrew the estimate.
+	p, err := tx.allocate((int(tx.db.freelist.size()) / tx.db.pageSize) + 1)
+	for err == nil && int(tx.db.freelist.size()) > (int(p.overflow)+1)*tx.db.pageSize {
+		tx.db.freelist.free(tx.meta.txid, p)
+		p, err = tx.allocate((int(tx.db.freelist.size()) / tx.db.pageSize) + 1)
+	}
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	if err := tx.db.freelist.write(p); err != nil {
+		tx.rollback()
+		return err
+	}
+	tx.meta.freelist = p.id
+	return nil
+}
+
+// logCommit writes the pages freed and allocated by the transaction and the
+// buckets whose root moved since before the spill to the commit log.
+func (tx *Tx) logCommit(before map[string]pgid) {
+	after := tx.root.openRoots(nil, make(map[string]pgid))
+	names := make([]string, 0, len(after))
+	for name := range after {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var moved []string
+	for _, name := range names {
+		if old, ok := before[name]; ok && old != after[name] {
+			moved = append(moved, fmt.Sprintf("%s:%d->%d", name, old, after[name]))
+		}
+	}
+	freed := tx.db.freelist.pending[tx.meta.txid]
+	if _, err := fmt.Fprintf(tx.db.commitLog, "tinydb: commit txid=%d freed=%v allocated=%v roots=%v\n",
+		tx.meta.txid, freed, tx.allocated, moved); err != nil {
+		log.Printf("tinydb: commit log error: %s", err)
+	}
+}
+
+// Rollback closes the transaction and ignores all previous updates. Read-only
+// transactions must be rolled back and not committed.
+func (tx *Tx) Rollback() error {
+	if tx.managed {
+		panic("managed tx rollback not allowed")
+	}
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	tx.rollback()
+	return nil
+}
+
+func (tx *Tx) rollback() {
+	if tx.db == nil {
+		return
+	}
+	if tx.writable {
+		tx.db.freelist.rollback(tx.meta.txid)
+		if !tx.db.hasSyncedFreelist() {
+			// Reconstruct the free page list by scanning the database.
+			tx.db.freelist.noSyncReload(tx.db.freepages())
+		} else {
+			tx.db.freelist.reload(tx.db.page(tx.db.meta().freelist))
+		}
+	}
+	tx.close()
+}
+
+func (tx *Tx) close() {
+	if tx.db == nil {
+		return
+	}
+	if tx.writable {
+		// Grab freelist stats.
+		var freelistFreeN = tx.db.freelist.free_count()
+		var freelistPendingN = tx.db.freelist.pending_count()
+		var freelistAlloc = tx.db.freelist.size()
+
+		// Remove transaction ref & writer lock.
+		tx.db.rwtx = nil
+		tx.db.rwlock.Unlock()
+
+		// Merge statistics.
+		tx.db.statlock.Lock()
+		tx.db.stats.FreePageN = freelistFreeN
+		tx.db.stats.PendingPageN = freelistPendingN
+		tx.db.stats.FreeAlloc = (freelistFreeN + freelistPendingN) * tx.db.pageSize
+		tx.db.stats.FreelistInuse = int(freelistAlloc)
+		tx.db.stats.TxStats.add(&tx.stats)
+		tx.db.statlock.Unlock()
+	} else {
+		tx.db.removeTx(tx)
+	}
+
+	// Clear all references.
+	tx.db = nil
+	tx.meta = nil
+	tx.root = Bucket{tx: tx}
+	tx.pages = nil
+}
+
+// write writes any dirty pages to disk.
+func (tx *Tx) write() error {
+	// Sort pages by id.
+	pages := make(pages, 0, len(tx.pages))
+	for _, p := range tx.pages {
+		pages = append(pages, p)
+	}
+	// Clear out page cache early.
+	tx.pages = make(map[pgid]*page)
+	sort.Sort(pages)
+
+	// Write pages to disk in order. Runs of adjacent pages are batched
+	// into one vectored write, so the disk sees long sequential writes
+	// rather than a write per page.
+	var batch writeBatch
+	for _, p := range pages {
+		rem := (uint64(p.overflow) + 1) * uint64(tx.db.pageSize)
+		offset := int64(p.id) * int64(tx.db.pageSize)
+		p.checksum = p.sum64(int(rem))
+
+		// Write out page in "max allocation" sized chunks.
+		var written uintptr
+		for rem > 0 {
+			sz := rem
+			if sz > maxAllocSize-1 {
+				sz = maxAllocSize - 1
+			}
+			buf := unsafeByteSlice(unsafe.Pointer(p), written, 0, int(sz))
+			if err := batch.add(tx.db.file, buf, offset); err != nil {
+				return err
+			}
+			rem -= sz
+			offset += int64(sz)
+			written += uintptr(sz)
+		}
+
+		// Update statistics.
+		tx.stats.Write++
+	}
+	if err := batch.flush(tx.db.file); err != nil {
+		return err
+	}
+
+	// Drop stale copies of the rewritten pages. No open transaction can
+	// reference them, since they were free.
+	if tx.db.cache != nil {
+		for _, p := range pages {
+			tx.db.cache.invalidate(p.id)
+		}
+	}
+
+	// Ensure the pages are durable before the meta page points at them.
+	if !tx.db.NoSync {
+		if err := tx.db.sync(); err != nil {
+			return err
+		}
+	}
+
+	// Put small pages back to page pool.
+	for _, p := range pages {
+		// Ignore page sizes over 1 page.
+		// These are allocated using make() instead of the page pool.
+		if int(p.overflow) != 0 {
+			continue
+		}
+
+		buf := unsafeByteSlice(unsafe.Pointer(p), 0, 0, tx.db.pageSize)
+		for i := range buf {
+			buf[i] = 0
+		}
+		tx.db.pagePool.Put(buf)
+	}
+
+	return nil
+}
+
+// writeMeta writes the meta to the disk.
+func (tx *Tx) writeMeta() error {
+	// Create a temporary buffer for the meta page.
+	buf := make([]byte, tx.db.pageSize)
+	p := tx.db.pageInBuffer(buf, 0)
+	tx.meta.write(p)
+
+	// Write the meta page to file. It is synced by Commit, or left for a
+	// later sync, once the writer lock is released.
+	if _, err := tx.db.file.WriteAt(buf, int64(p.id)*int64(tx.db.pageSize)); err != nil {
+		return err
+	}
+
+	// Without a mapping the new meta page has to be copied in by hand.
+	tx.db.metalock.Lock()
+	if tx.db.cache != nil {
+		tx.db.cache.writeMeta(buf)
+	}
+	tx.db.written = tx.meta.txid
+	tx.db.metalock.Unlock()
+
+	// Update statistics.
+	tx.stats.Write++
+
+	return nil
 }
 
 // page returns a reference to the page with a given id.
@@ -42,8 +560,38 @@ func (tx *Tx) page(id pgid) *page {
 		}
 	}
 
-	// Otherwise return directly from the mmap.
-	return tx.db.page(id)
+	// Otherwise return directly from the mmap, verifying the page the first
+	// time this transaction reads it.
+	p := tx.db.page(id)
+	if tx.db.checksumMode != ChecksumOff && !tx.verified[id] {
+		if err := tx.verify(p); err != nil {
+			panic(err)
+		}
+		if tx.verified == nil {
+			tx.verified = make(map[pgid]bool)
+		}
+		tx.verified[id] = true
+	}
+	return p
+}
+
+// verify checks a page read from the mmap against its checksum. Pages
+// written before checksums were added have none and always pass.
+func (tx *Tx) verify(p *page) error {
+	if p.checksum == 0 {
+		return nil
+	}
+	if p.id+pgid(p.overflow) >= tx.meta.pgid || p.checksum != p.sum64((int(p.overflow)+1)*tx.db.pageSize) {
+		err := &PageChecksumError{Pgid: uint64(p.id)}
+		tx.db.validationFailed(err)
+		return err
+	}
+	return nil
+}
+
+// String returns a string representation of the transaction.
+func (tx *Tx) String() string {
+	return fmt.Sprintf("tx<%d>", tx.ID())
 }
 
 // allocate returns a contiguous block of memory starting at a given page.
@@ -55,6 +603,11 @@ func (tx *Tx) allocate(count int) (*page, error) {
 
 	// Save to our page cache.
 	tx.pages[p.id] = p
+	if tx.db.commitLog != nil {
+		for i := 0; i < count; i++ {
+			tx.allocated = append(tx.allocated, p.id+pgid(i))
+		}
+	}
 
 	// Update statistics.
 	tx.stats.PageCount++
@@ -63,6 +616,148 @@ func (tx *Tx) allocate(count int) (*page, error) {
 	return p, nil
 }
 
+// PageInfo describes a page visited by Tx.ForEachPageWithStats.
+type PageInfo struct {
+	ID            int    // page id, 0 for the page embedded in an inline bucket
+	Type          string // "branch" or "leaf"
+	Count         int    // number of elements
+	OverflowCount int    // number of overflow pages following the page
+	Depth         int    // depth from the root bucket's root page, continued through nested buckets
+	Inuse         int    // bytes used by the header, elements, keys and values
+}
+
+// PageStats accumulates the pages visited by Tx.ForEachPageWithStats.
+type PageStats struct {
+	BranchPageN     int // number of branch pages
+	BranchOverflowN int // number of overflow pages following branch pages
+	LeafPageN       int // number of leaf pages
+	LeafOverflowN   int // number of overflow pages following leaf pages
+
+	BucketN           int // total number of buckets, excluding the root bucket
+	InlineBucketN     int // total number of inline buckets
+	InlineBucketInuse int // bytes used by inline buckets
+
+	BranchInuse int // bytes actually used for branch data
+	BranchAlloc int // bytes allocated for branch pages, including overflow
+	LeafInuse   int // bytes actually used for leaf data
+	LeafAlloc   int // bytes allocated for leaf pages, including overflow
+
+	// Depths holds page counts and byte usage for each depth, indexed by
+	// PageInfo.Depth. Inline bucket pages are not included.
+	Depths []DepthStats
+}
+
+// DepthStats accumulates the pages found at one depth of the tree.
+type DepthStats struct {
+	PageN     int // number of branch and leaf pages
+	OverflowN int // number of overflow pages
+	Inuse     int // bytes actually used
+	Alloc     int // bytes allocated, including overflow
+}
+
+// ForEachPageWithStats calls fn, if not nil, for every page reachable from
+// the root bucket, descending into nested buckets, and returns the totals.
+// Pages are visited depth first in key order. Writable transactions see the
+// pages as of the start of the transaction. Iteration stops at the first
+// error returned by fn.
+func (tx *Tx) ForEachPageWithStats(fn func(info PageInfo) error) (PageStats, error) {
+	var s PageStats
+	if tx.db == nil {
+		return s, ErrTxClosed
+	}
+
+	var err error
+	tx.walkPages(tx.meta.root.root, 0, func(p *page, depth int) {
+		if err != nil {
+			return
+		}
+		info := PageInfo{
+			ID:            int(p.id),
+			Count:         int(p.count),
+			OverflowCount: int(p.overflow),
+			Depth:         depth,
+			Inuse:         int(p.inuse()),
+		}
+		alloc := (info.OverflowCount + 1) * tx.db.pageSize
+		if (p.flags & branchPageFlag) != 0 {
+			info.Type = "branch"
+		} else {
+			info.Type = "leaf"
+		}
+
+		if info.Type == "leaf" {
+			for i := 0; i < info.Count; i++ {
+				if (p.leafPageElement(uint16(i)).flags & bucketLeafFlag) != 0 {
+					s.BucketN++
+				}
+			}
+		}
+		switch {
+		case p.id == 0:
+			s.InlineBucketN++
+			s.InlineBucketInuse += info.Inuse
+		case info.Type == "branch":
+			s.BranchPageN++
+			s.BranchOverflowN += info.OverflowCount
+			s.BranchInuse += info.Inuse
+			s.BranchAlloc += alloc
+		default:
+			s.LeafPageN++
+			s.LeafOverflowN += info.OverflowCount
+			s.LeafInuse += info.Inuse
+			s.LeafAlloc += alloc
+		}
+		if p.id != 0 {
+			for len(s.Depths) <= depth {
+				s.Depths = append(s.Depths, DepthStats{})
+			}
+			d := &s.Depths[depth]
+			d.PageN++
+			d.OverflowN += info.OverflowCount
+			d.Inuse += info.Inuse
+			d.Alloc += alloc
+		}
+
+		if fn != nil {
+			err = fn(info)
+		}
+	})
+	return s, err
+}
+
+// walkPages calls fn for every page of the bucket tree rooted at root, and
+// for the trees of its nested buckets, depth first in key order. The page
+// of an inline bucket is passed as a copy with an id of 0. Depth continues
+// to count through nested buckets.
+func (tx *Tx) walkPages(root pgid, depth int, fn func(p *page, depth int)) {
+	p := tx.page(root)
+	p.mustBeBTree()
+	fn(p, depth)
+
+	if (p.flags & branchPageFlag) != 0 {
+		for i := 0; i < int(p.count); i++ {
+			tx.walkPages(p.branchPageElement(uint16(i)).pgid, depth+1, fn)
+		}
+		return
+	}
+	for i := 0; i < int(p.count); i++ {
+		elem := p.leafPageElement(uint16(i))
+		if (elem.flags & bucketLeafFlag) == 0 {
+			continue
+		}
+
+		// Copy the bucket value so its header and inline page are aligned.
+		value := cloneBytes(elem.value())
+		if child := (*bucket)(unsafe.Pointer(&value[0])); child.root != 0 {
+			tx.walkPages(child.root, depth+1, fn)
+			continue
+		}
+		inline := (*page)(unsafe.Pointer(&value[bucketHeaderSize]))
+		inline.id = 0
+		fn(inline, depth+1)
+	}
+}
+
 // TxStats represents statistics about the actions performed by the transaction.
 type TxStats struct {
 	// Page statistics.
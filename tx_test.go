@@ -0,0 +1,919 @@
+package tinydb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// mustOpen opens a database at a temporary path and fails the test on error.
+func mustOpen(t *testing.T) (*Db, string) {
+	path := tempfile()
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, path
+}
+
+// Ensure that committing a closed transaction returns an error.
+func TestTx_Commit_ErrTxClosed(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != ErrTxClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that rolling back a closed transaction returns an error.
+func TestTx_Rollback_ErrTxClosed(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != ErrTxClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that committing a read-only transaction returns an error.
+func TestTx_Commit_ErrTxNotWritable(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != ErrTxNotWritable {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that each commit writes the meta page chosen by its txid and that
+// the newest meta is used after reopening.
+func TestTx_Commit_AlternatesMeta(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	for i, exp := range []*meta{db.meta0, db.meta1, db.meta0} {
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		} else if tx.ID() != i+2 {
+			t.Fatalf("exp txid=%d; got=%d", i+2, tx.ID())
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if exp.txid != txid(i+2) {
+			t.Fatalf("exp meta txid=%d; got=%d", i+2, exp.txid)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := db.meta(); m.txid != 4 {
+		t.Fatalf("exp txid=4; got=%d", m.txid)
+	} else if err := m.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that commit spills the root node to pages that can be read back.
+func TestTx_Commit_Spill(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := tx.root.node(tx.root.root, nil)
+	for i := 0; i < 1000; i++ {
+		k := []byte(fmt.Sprintf("%08d", i))
+		n.put(k, k, []byte("0123456701234567"), 0, 0)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen and walk the tree from the root page.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err = db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var keys []string
+	var walk func(id pgid)
+	walk = func(id pgid) {
+		n := &node{}
+		n.read(tx.page(id))
+		for _, inode := range n.inodes {
+			if n.isLeaf {
+				keys = append(keys, string(inode.key))
+			} else {
+				walk(inode.pgid)
+			}
+		}
+	}
+	walk(tx.root.root)
+
+	if len(keys) != 1000 {
+		t.Fatalf("exp=1000; got=%d", len(keys))
+	}
+	for i, k := range keys {
+		if exp := fmt.Sprintf("%08d", i); k != exp {
+			t.Fatalf("exp=%s; got=%s", exp, k)
+		}
+	}
+}
+
+// Ensure that a rolled back transaction does not change the database.
+func TestTx_Rollback(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := tx.root.node(tx.root.root, nil)
+	n.put([]byte("foo"), []byte("foo"), []byte("bar"), 0, 0)
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if m := db.meta(); m.txid != 1 {
+		t.Fatalf("exp txid=1; got=%d", m.txid)
+	} else if p := db.page(m.root.root); p.count != 0 {
+		t.Fatalf("exp empty root; got count=%d", p.count)
+	}
+}
+
+// Ensure that commit handlers run after a successful commit.
+func TestTx_OnCommit(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	var x int
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.OnCommit(func() { x += 1 })
+	tx.OnCommit(func() { x += 2 })
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	} else if x != 3 {
+		t.Fatalf("unexpected x: %d", x)
+	}
+}
+
+// Ensure that Tx.ForEach visits top-level buckets in order and skips the
+// reserved snapshot bucket.
+func TestTx_ForEach(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		for _, name := range []string{"widgets", "foo", "bar"} {
+			if _, err := tx.CreateBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateSnapshot([]byte("snap")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		var names []string
+		if err := tx.ForEach(func(name []byte, b *Bucket) error {
+			if b == nil {
+				t.Fatalf("nil bucket for %q", name)
+			}
+			names = append(names, string(name))
+			return nil
+		}); err != nil {
+			return err
+		}
+		if strings.Join(names, ",") != "bar,foo,widgets" {
+			t.Fatalf("unexpected buckets: %v", names)
+		}
+
+		// Errors stop the iteration.
+		var n int
+		errStop := errors.New("stop")
+		if err := tx.ForEach(func(name []byte, b *Bucket) error {
+			n++
+			return errStop
+		}); err != errStop || n != 1 {
+			t.Fatalf("unexpected error %v after %d buckets", err, n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that Tx.Hash depends only on the logical contents of the database.
+func TestTx_Hash(t *testing.T) {
+	hashOf := func(fn func(tx *Tx) error) []byte {
+		db, path := mustOpen(t)
+		defer os.RemoveAll(path)
+		if err := db.Update(fn); err != nil {
+			t.Fatal(err)
+		}
+		var sum []byte
+		if err := db.View(func(tx *Tx) error {
+			var err error
+			sum, err = tx.Hash()
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return sum
+	}
+	fill := func(order []int, extra bool) func(tx *Tx) error {
+		return func(tx *Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			child, err := b.CreateBucket([]byte("child"))
+			if err != nil {
+				return err
+			}
+			for _, i := range order {
+				k := []byte(fmt.Sprintf("%04d", i))
+				if err := b.Put(k, make([]byte, 100)); err != nil {
+					return err
+				}
+				if err := child.Put(k, k); err != nil {
+					return err
+				}
+			}
+			if extra {
+				for i := 0; i < 500; i++ {
+					if err := b.Put([]byte(fmt.Sprintf("x%04d", i)), []byte("x")); err != nil {
+						return err
+					}
+				}
+				for i := 0; i < 500; i++ {
+					if err := b.Delete([]byte(fmt.Sprintf("x%04d", i))); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+	}
+
+	asc, desc := make([]int, 1000), make([]int, 1000)
+	for i := range asc {
+		asc[i], desc[i] = i, 999-i
+	}
+	exp := hashOf(fill(asc, false))
+	if got := hashOf(fill(desc, true)); !bytes.Equal(exp, got) {
+		t.Fatalf("expected equal hashes: %x != %x", exp, got)
+	}
+	if got := hashOf(fill(asc[1:], false)); bytes.Equal(exp, got) {
+		t.Fatal("expected different hashes")
+	}
+
+	// Creating a named snapshot doesn't change the contents.
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	if err := db.Update(fill(asc, false)); err != nil {
+		t.Fatal(err)
+	} else if err := db.CreateSnapshot([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if got, err := tx.Hash(); err != nil {
+			return err
+		} else if !bytes.Equal(exp, got) {
+			t.Fatalf("expected snapshots to be ignored: %x != %x", exp, got)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Key/value boundaries and nested buckets must be unambiguous.
+	kv := func(k, v string) func(tx *Tx) error {
+		return func(tx *Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(k), []byte(v))
+		}
+	}
+	if bytes.Equal(hashOf(kv("ab", "c")), hashOf(kv("a", "bc"))) {
+		t.Fatal("expected different hashes")
+	}
+	if bytes.Equal(hashOf(kv("a", "")), hashOf(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		_, err = b.CreateBucket([]byte("a"))
+		return err
+	})) {
+		t.Fatal("expected different hashes")
+	}
+}
+
+// Ensure that freed pages are persisted by commit and reused after a reopen.
+func TestTx_Commit_FreelistPersisted(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 500)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		return tx.DeleteBucket([]byte("widgets"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	count, hwm := db.freelist.count(), db.meta().pgid
+	if count < 100 {
+		t.Fatalf("expected freed pages; got %d", count)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen and verify the freelist was read back from disk.
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := db.freelist.count(); n != count {
+		t.Fatalf("freelist count mismatch: %d != %d", n, count)
+	}
+	for _, id := range db.freelist.ids {
+		if id <= 1 || id >= hwm {
+			t.Fatalf("invalid free page id: %d", id)
+		}
+	}
+
+	// Writing the same amount of data must not grow the file.
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 500)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if db.meta().pgid > hwm {
+		t.Fatalf("expected freed pages to be reused: high water mark %d -> %d", hwm, db.meta().pgid)
+	}
+}
+
+// Ensure that pages freed while a read transaction is open are not reused
+// until that reader closes.
+func TestTx_Commit_PendingWithOpenReader(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	// Grow the mmap up front so later writers don't need to remap while
+	// the reader holds the mmap lock.
+	if err := db.Update(func(tx *Tx) error {
+		widgets, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		filler, err := tx.CreateBucket([]byte("filler"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			k := []byte(fmt.Sprintf("%04d", i))
+			if err := widgets.Put(k, bytes.Repeat(k, 25)); err != nil {
+				t.Fatal(err)
+			}
+			if err := filler.Put(k, make([]byte, 1000)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		return tx.DeleteBucket([]byte("filler"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete the bucket the reader can see, then overwrite as many free
+	// pages as possible.
+	if err := db.Update(func(tx *Tx) error {
+		return tx.DeleteBucket([]byte("widgets"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pending := db.freelist.pending_count()
+	for i := 0; i < 2; i++ {
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("other"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j := 0; j < 1000; j++ {
+				if err := b.Put([]byte(fmt.Sprintf("%d-%04d", i, j)), bytes.Repeat([]byte{0xFF}, 100)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.freelist.pending_count() < pending {
+		t.Fatalf("pending pages released while a reader is open: %d < %d", db.freelist.pending_count(), pending)
+	}
+
+	// The reader still sees its snapshot.
+	var n int
+	if err := reader.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+		if !bytes.Equal(v, bytes.Repeat(k, 25)) {
+			t.Fatalf("unexpected value for %q: %x", k, v)
+		}
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1000 {
+		t.Fatalf("unexpected key count: %d", n)
+	}
+	if err := reader.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the reader closes the next writer releases the pages.
+	if err := db.Update(func(tx *Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.freelist.pending_count(); n >= pending {
+		t.Fatalf("expected pending pages to be released; got %d", n)
+	}
+}
+
+// Ensure that a read transaction sees the snapshot from when it began.
+func TestTx_ReadSnapshot(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	// Grow the mmap up front since a remap waits for open readers.
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("filler"), make([]byte, 1<<20)); err != nil {
+			t.Fatal(err)
+		}
+		return b.Put([]byte("foo"), []byte("1"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		return tx.Bucket([]byte("widgets")).Delete([]byte("filler"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	r1, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if err := b.Put([]byte("foo"), []byte("2")); err != nil {
+			t.Fatal(err)
+		}
+		return b.Put([]byte("bar"), []byte("2"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	r2, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r1.ID() >= r2.ID() {
+		t.Fatalf("expected increasing snapshot ids: %d, %d", r1.ID(), r2.ID())
+	}
+	if v := r1.Bucket([]byte("widgets")).Get([]byte("foo")); string(v) != "1" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+	if v := r1.Bucket([]byte("widgets")).Get([]byte("bar")); v != nil {
+		t.Fatalf("unexpected value: %q", v)
+	}
+	if v := r2.Bucket([]byte("widgets")).Get([]byte("foo")); string(v) != "2" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+	if len(db.txs) != 2 {
+		t.Fatalf("unexpected open readers: %d", len(db.txs))
+	}
+	if err := r1.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r2.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.txs) != 0 {
+		t.Fatalf("unexpected open readers: %d", len(db.txs))
+	}
+}
+
+// Ensure that many readers can run alongside a writer and each sees a
+// consistent snapshot.
+func TestTx_ConcurrentReaders(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+
+	// Every commit writes the same counter value under all keys.
+	write := func(n int) {
+		if err := db.Update(func(tx *Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 100; i++ {
+				if err := b.Put([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprint(n))); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Error(err)
+		}
+	}
+	write(0)
+
+	done := make(chan struct{})
+	errs := make(chan error, 8)
+	for r := 0; r < 8; r++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+				if err := db.View(func(tx *Tx) error {
+					var exp []byte
+					return tx.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+						if exp == nil {
+							exp = v
+						} else if !bytes.Equal(v, exp) {
+							return fmt.Errorf("inconsistent snapshot: %q != %q", v, exp)
+						}
+						return nil
+					})
+				}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for n := 1; n <= 50; n++ {
+		write(n)
+	}
+	close(done)
+	for r := 0; r < 8; r++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Ensure that commits are logged with their freed and allocated pages and
+// the buckets whose root moved.
+func TestTx_Commit_CommitLog(t *testing.T) {
+	var buf bytes.Buffer
+	path := tempfile()
+	defer os.RemoveAll(path)
+	db, err := Open(path, &Options{CommitLog: &buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Grow the bucket past a single inline page so it gets its own root.
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%03d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		_, err = tx.CreateBucket([]byte("idle"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf.Reset()
+	var id int
+	if err := db.Update(func(tx *Tx) error {
+		id = tx.ID()
+		if tx.Bucket([]byte("idle")) == nil {
+			t.Fatal("expected bucket")
+		}
+		return tx.Bucket([]byte("widgets")).Put([]byte("000"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	line := buf.String()
+	if !strings.HasPrefix(line, fmt.Sprintf("tinydb: commit txid=%d freed=[", id)) {
+		t.Fatalf("unexpected log line: %q", line)
+	} else if !strings.Contains(line, "roots=[widgets:") {
+		t.Fatalf("expected widgets root to move: %q", line)
+	} else if strings.Contains(line, "idle") {
+		t.Fatalf("unexpected idle bucket: %q", line)
+	} else if strings.Contains(line, "freed=[]") || strings.Contains(line, "allocated=[]") {
+		t.Fatalf("expected freed and allocated pages: %q", line)
+	} else if strings.Count(line, "\n") != 1 {
+		t.Fatalf("expected a single line: %q", line)
+	}
+}
+
+// Ensure that the page walk visits every reachable page once and that its
+// totals add up.
+func TestTx_ForEachPageWithStats(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.RemoveAll(path)
+	defer db.Close()
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 50)); err != nil {
+				return err
+			}
+		}
+		small, err := b.CreateBucket([]byte("small"))
+		if err != nil {
+			return err
+		}
+		if err := small.Put([]byte("foo"), []byte("bar")); err != nil {
+			return err
+		}
+		large, err := b.CreateBucket([]byte("large"))
+		if err != nil {
+			return err
+		}
+		return large.Put([]byte("big"), make([]byte, 3*db.pageSize))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		seen := map[pgid]bool{0: true, 1: true}
+		for _, id := range db.freepages() {
+			seen[id] = true
+		}
+		var visited int
+		s, err := tx.ForEachPageWithStats(func(info PageInfo) error {
+			visited++
+			if info.ID == 0 {
+				return nil
+			}
+			for i := 0; i <= info.OverflowCount; i++ {
+				if id := pgid(info.ID + i); seen[id] {
+					t.Fatalf("page %d visited twice or also free", id)
+				} else {
+					seen[id] = true
+				}
+			}
+			if info.Inuse > (info.OverflowCount+1)*db.pageSize {
+				t.Fatalf("page %d uses more than it allocates: %+v", info.ID, info)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seen) != int(tx.meta.pgid) {
+			t.Fatalf("expected every page below %d to be reachable or free; got %d", tx.meta.pgid, len(seen))
+		}
+
+		if s.BucketN != 3 || s.InlineBucketN != 1 {
+			t.Fatalf("unexpected bucket counts: %d, %d", s.BucketN, s.InlineBucketN)
+		} else if visited != s.BranchPageN+s.LeafPageN+s.InlineBucketN {
+			t.Fatalf("unexpected visit count: %d", visited)
+		} else if s.LeafOverflowN < 3 {
+			t.Fatalf("expected overflow pages: %d", s.LeafOverflowN)
+		} else if s.LeafInuse > s.LeafAlloc || s.BranchInuse > s.BranchAlloc {
+			t.Fatalf("inuse above alloc: %+v", s)
+		}
+
+		var pageN, alloc int
+		for _, d := range s.Depths {
+			pageN += d.PageN
+			alloc += d.Alloc
+		}
+		if s.Depths[0].PageN != 1 {
+			t.Fatalf("expected a single root page: %+v", s.Depths[0])
+		} else if pageN != s.BranchPageN+s.LeafPageN || alloc != s.BranchAlloc+s.LeafAlloc {
+			t.Fatalf("depth totals don't add up: %+v", s)
+		}
+
+		// Errors from fn stop the walk.
+		visited = 0
+		stop := errors.New("stop")
+		if _, err := tx.ForEachPageWithStats(func(PageInfo) error {
+			visited++
+			return stop
+		}); err != stop || visited != 1 {
+			t.Fatalf("unexpected result: %v, %d", err, visited)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that an asynchronous commit is visible at once, becomes durable
+// with the next sync, and that the pages it frees aren't reused before then.
+func TestTx_Commit_DurabilityAsync(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.Remove(path)
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), make([]byte, 10*db.pageSize))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var id int
+	if err := db.Update(func(tx *Tx) error {
+		tx.Durability = DurabilityAsync
+		id = tx.ID()
+		return tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if db.written != txid(id) || db.durable >= txid(id) {
+		t.Fatalf("unexpected durable txid: %d, written %d", db.durable, db.written)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); !bytes.Equal(v, []byte("bar")) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The overwritten value is held back until the commit is synced.
+	if err := db.Update(func(tx *Tx) error {
+		tx.Durability = DurabilityAsync
+		if len(db.freelist.pending[txid(id)]) == 0 {
+			t.Fatal("expected pages freed by the async commit to be pending")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	} else if db.durable != db.written {
+		t.Fatalf("unexpected durable txid: %d, written %d", db.durable, db.written)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		if len(db.freelist.pending[txid(id)]) != 0 {
+			t.Fatal("expected pages freed by the async commit to be released")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that concurrent synchronous commits all reach disk when sharing
+// fsyncs.
+func TestTx_Commit_DurabilitySync_Concurrent(t *testing.T) {
+	db, path := mustOpen(t)
+	defer os.Remove(path)
+	defer db.Close()
+
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			errs <- db.Update(func(tx *Tx) error {
+				b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+				if err != nil {
+					return err
+				}
+				return b.Put([]byte(fmt.Sprintf("%02d", i)), []byte("bar"))
+			})
+		}(i)
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.durable != db.written {
+		t.Fatalf("unexpected durable txid: %d, written %d", db.durable, db.written)
+	}
+	if err := db.View(func(tx *Tx) error {
+		if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != cap(errs) {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
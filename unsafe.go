@@ -5,11 +5,9 @@ import (
 	"unsafe"
 )
 
-// only for amb64
-// maxAllocSize is the size used when creating array pointers.
-// 0x7FFFFFFF -> 31bit
-// 7 -> 0111
-const maxAllocSize = 0x7FFFFFFF
+// maxAllocSize is the size used when creating array pointers. It is defined
+// per architecture next to maxMapSize: 0x7FFFFFFF (31bit) on 64-bit
+// platforms and smaller where the address space can't hold such an array.
 
 // why -> https://groups.google.com/g/golang-nuts/c/noiQZUxqnHg
 // why -> https://github.com/golang/go/issues/2188
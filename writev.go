@@ -0,0 +1,64 @@
+package tinydb
+
+import (
+	"os"
+	"runtime"
+)
+
+// Limits on a single batched write. Linux accepts at most 1024 buffers
+// (IOV_MAX) in one pwritev call, and batches copied into one buffer
+// shouldn't allocate too much at once.
+const (
+	maxWriteBatchBufs = 1024
+	maxWriteBatchSize = 16 << 20
+)
+
+// writeBatch collects buffers that are adjacent in the file, such as the
+// dirty pages of a commit in page order, so that they are written with a
+// single vectored write instead of one write each.
+type writeBatch struct {
+	bufs [][]byte
+	off  int64 // file offset of the first buffer
+	size int64 // total length of the buffers
+}
+
+// add appends buf, which belongs at off in the file, writing the batch out
+// first if buf doesn't directly follow it or the batch is full.
+func (b *writeBatch) add(f dbFile, buf []byte, off int64) error {
+	if len(b.bufs) > 0 && (off != b.off+b.size || len(b.bufs) == maxWriteBatchBufs || b.size+int64(len(buf)) > maxWriteBatchSize) {
+		if err := b.flush(f); err != nil {
+			return err
+		}
+	}
+	if len(b.bufs) == 0 {
+		b.off = off
+	}
+	b.bufs = append(b.bufs, buf)
+	b.size += int64(len(buf))
+	return nil
+}
+
+// flush writes out the batch and empties it.
+func (b *writeBatch) flush(f dbFile) error {
+	bufs, off := b.bufs, b.off
+	b.bufs, b.off, b.size = b.bufs[:0], 0, 0
+
+	switch file, ok := f.(*os.File); {
+	case len(bufs) == 0:
+		return nil
+	case len(bufs) == 1:
+		_, err := f.WriteAt(bufs[0], off)
+		return err
+	case ok && runtime.GOOS == "linux":
+		return pwritev(file, bufs, off)
+	default:
+		// Without vectored writes, one large write still beats many small
+		// ones, so copy the buffers together.
+		var buf []byte
+		for _, b := range bufs {
+			buf = append(buf, b...)
+		}
+		_, err := f.WriteAt(buf, off)
+		return err
+	}
+}
@@ -0,0 +1,46 @@
+package tinydb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Ensure that a batch writes every buffer where it belongs, splitting on
+// gaps and when it fills up.
+func TestWriteBatch(t *testing.T) {
+	f, err := os.Create(tempfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// More buffers than fit in one batch, with a gap part way through.
+	var batch writeBatch
+	want := make([]byte, 3000*16)
+	for i := 0; i < 3000; i++ {
+		if i >= 1500 && i < 1510 {
+			continue
+		}
+		buf := bytes.Repeat([]byte{byte(i)}, 16)
+		copy(want[i*16:], buf)
+		if err := batch.add(f, buf, int64(i*16)); err != nil {
+			t.Fatal(err)
+		} else if len(batch.bufs) > maxWriteBatchBufs {
+			t.Fatalf("batch too long: %d", len(batch.bufs))
+		}
+	}
+	if err := batch.flush(f); err != nil {
+		t.Fatal(err)
+	} else if len(batch.bufs) != 0 {
+		t.Fatal("expected empty batch")
+	}
+
+	if got, err := ioutil.ReadFile(f.Name()); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, want) {
+		t.Fatal("unexpected file contents")
+	}
+}